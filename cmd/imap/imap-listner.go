@@ -2,12 +2,13 @@ package imap
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 
 	"log"
-	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/ProtonMail/gluon"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/enjoys-in/airsend-imap/cmd/wireframe"
 	factory "github.com/enjoys-in/airsend-imap/internal/core/imap"
+	"github.com/enjoys-in/airsend-imap/internal/core/oauth"
 
 	"github.com/pkg/profile"
 	"github.com/sirupsen/logrus"
@@ -32,6 +34,9 @@ const (
 	rollingCounterNewConnectionThreshold = 300
 	rollingCounterNumberOfBuckets        = 6
 	rollingCounterBucketRotationInterval = time.Second * 10
+
+	// mailboxDelimiter separates the levels of mailbox names.
+	mailboxDelimiter = "/"
 )
 
 // var logIMAP = logrus.WithField("pkg", "server/imap") //nolint:gochecknoglobals
@@ -39,16 +44,23 @@ const (
 //	type IMAPEventPublisher interface {
 //		PublishIMAPEvent(ctx context.Context, event imapEvents.Event)
 //	}
-func RunImap(app *wireframe.AppWireframe) {
-	log.Println("🧩 Starting IMAP server...")
 
-	ctx := context.Background()
+// RunImap serves IMAP on every configured endpoint until ctx is cancelled, then shuts the
+// server down within the configured deadline. It returns any startup or shutdown error.
+func RunImap(ctx context.Context, app *wireframe.AppWireframe) (err error) {
+	log.Println("🧩 Starting IMAP server...")
 
 	flag.Parse()
 	tlsConfig, err := app.Config.LoadTLS()
 	if err != nil {
 		log.Printf("❌ Failed to load TLS certs: %v", err)
+	}
 
+	// Resolve the endpoints before anything else so a missing certificate fails startup
+	// instead of silently serving without TLS.
+	endpoints, err := endpointsFromConfig(app.Config.IMAP, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("invalid IMAP listener configuration: %w", err)
 	}
 
 	// Initialize Gluon with your store
@@ -83,70 +95,158 @@ func RunImap(app *wireframe.AppWireframe) {
 	// 	reporter := &reporter.NullReporter{}
 	uidValidityGenerator := imap.NewEpochUIDValidityGenerator(time.Now())
 
-	server, err := gluon.New(
+	options := []gluon.Option{
 		gluon.WithLogger(
 			logrus.StandardLogger().WriterLevel(logrus.TraceLevel),
 			logrus.StandardLogger().WriterLevel(logrus.TraceLevel),
 		),
-		gluon.WithDelimiter(string("/")),
+		gluon.WithDelimiter(mailboxDelimiter),
 
 		gluon.WithDataDir(dataDir),
-		gluon.WithTLS(tlsConfig),
 		gluon.WithDatabaseDir(dbPath),
 		gluon.WithUIDValidityGenerator(uidValidityGenerator),
 		gluon.WithConnectionRollingCounter(rollingCounterNewConnectionThreshold, rollingCounterNumberOfBuckets, rollingCounterBucketRotationInterval),
 		gluon.WithPanicHandler(panicHandler),
-	)
+	}
+	// STARTTLS is only advertised on the plaintext endpoint when a certificate is loaded; Gluon
+	// advertises it on every connection, and the login proxy drops it once TLS is active.
+	// Tenants with their own server names get their own certificate, others the default one.
+	if tlsConfig != nil {
+		tlsConfig.GetCertificate = app.Tenants.GetCertificate
+		options = append(options, gluon.WithTLS(tlsConfig))
+	}
+
+	server, err := gluon.New(options...)
 	if err != nil {
-		logrus.WithError(err).Fatal("Failed to create server")
+		return fmt.Errorf("failed to create server: %w", err)
+	}
+
+	instance := factory.NewConnectorFactory(app.DB.Conn, server)
+	if err := instance.SetDefaultDomain(app.Config.IMAP.DEFAULT_DOMAIN); err != nil {
+		return fmt.Errorf("invalid IMAP configuration: %w", err)
+	}
+	instance.SetCascadeMailboxDelete(app.Config.IMAP.CASCADE_DELETE)
+	listeners := NewListenerManager(endpoints)
+	// Users are loaded on their first login rather than all at startup.
+	listeners.OnLogin(instance.LoadOnLogin)
+	// Connections are tracked so the admin API can list and terminate sessions.
+	listeners.OnAccept(instance.TrackConn)
+	// Failed logins slow down, then lock out, the account and the address they come from.
+	listeners.GuardLogins(app.Lockout)
+	instance.SetLockout(app.Lockout)
+	// Tenants decide whether, where and how many of their users' sessions are let in.
+	instance.SetTenants(app.Tenants)
+	listeners.GateSessions(instance.AdmitSession)
+	// GETQUOTA and GETQUOTAROOT report the mailbox size and usage Gluon knows nothing about.
+	listeners.OnQuota(instance.Quota)
+	// Keywords set over IMAP, which Gluon keeps to itself, are written to the messages too.
+	listeners.OnKeywords(instance.StoreKeywords)
+
+	// XOAUTH2 and OAUTHBEARER are offered when an identity provider is configured.
+	if cfg := app.Config.IMAP; cfg.OAUTH_ISSUER != "" {
+		validator, err := oauth.NewValidator(oauth.Config{
+			Issuer:     cfg.OAUTH_ISSUER,
+			Audience:   cfg.OAUTH_AUDIENCE,
+			JWKS:       cfg.OAUTH_JWKS,
+			EmailClaim: cfg.OAUTH_EMAIL_CLAIM,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid OAuth configuration: %w", err)
+		}
+		instance.SetOAuthValidator(validator)
+		listeners.OnOAuth(instance.LoginWithOAuth)
+		log.Printf("✅ OAuth logins enabled for issuer %s", cfg.OAUTH_ISSUER)
 	}
 
-	defer server.Close(ctx)
+	// Changes made by the webmail are pushed to the loaded users as they happen. Listening starts
+	// before the users are loaded so nothing is missed between their initial sync and the LISTEN.
+	changesCtx, stopChanges := context.WithCancel(ctx)
+	changesDone := make(chan struct{})
+	go func() {
+		defer close(changesDone)
+		if err := instance.ListenForChanges(changesCtx, app.DB.NewListener()); err != nil {
+			logrus.WithError(err).Error("Stopped listening for database changes")
+		}
+	}()
+
+	// Idle users are unloaded in the background; the users active recently are preloaded once serving.
+	backgroundCtx, stopBackground := context.WithCancel(ctx)
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		instance.UnloadIdleUsers(backgroundCtx, app.Config.IMAP.IDLE_TTL)
+	}()
+
+	// Stop accepting, pushing database changes and background syncs first, then let Gluon drain
+	// the sessions and close the users it holds, and finally close whatever connectors the factory still tracks.
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), app.Config.API.SHUTDOWN_TIMEOUT)
+		defer cancel()
+
+		app.SetConnectorFactory(nil)
+		stopChanges()
+		<-changesDone
+		stopBackground()
+		background.Wait()
+		instance.StopSyncScheduler()
+
+		err = errors.Join(err,
+			listeners.Close(),
+			closeWithin(shutdownCtx, server.Close),
+			instance.Close(shutdownCtx),
+		)
+		log.Println("🛑 IMAP server stopped")
+	}()
 
 	log.Println("Gluon configured with:")
 	log.Printf("  Data directory: %s (message cache)", dataDir)
 	log.Printf("  State database: %s (IMAP state)", dbPath)
-	// === Add test user ===
-	instance := factory.NewConnectorFactory(app.DB.Conn, server)
-	err = instance.InitializeUsers(ctx)
-	if err != nil {
-		logrus.WithError(err).Fatal("Failed to add user")
-		return
-	}
 
-	host := "localhost:143"
-	if envHost := os.Getenv("GLUON_HOST"); envHost != "" {
-		host = envHost
+	instance.StartSyncScheduler(ctx, app.Config.IMAP.SYNC_INTERVAL, app.Config.IMAP.SYNC_WORKERS)
+
+	if err := listeners.Listen(); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
 	}
 
-	listener, err := net.Listen("tcp", host)
-	if err != nil {
-		logrus.WithError(err).Fatal("Failed to listen")
+	// All endpoints are served through a single Serve call, which does not block. Sessions get a
+	// context that outlives the signal so they are drained by server.Close rather than cut off.
+	if err := server.Serve(context.WithoutCancel(ctx), listeners); err != nil {
+		return fmt.Errorf("failed to serve: %w", err)
 	}
 
-	logrus.Infof("Server is listening on %v", listener.Addr())
+	// The admin API acts on the connectors from now on.
+	app.SetConnectorFactory(instance)
 
-	if err := server.Serve(ctx, listener); err != nil {
-		logrus.WithError(err).Fatal("Failed to serve")
-	}
-	// === Start IMAPS (TLS) on Port 993 ===
-	tlsListener, err := tls.Listen("tcp", "0.0.0.0:993", tlsConfig)
-	if err != nil {
-		log.Printf("❌ Failed to listen on IMAPS (993): %v", err)
-		return
-	}
+	go func() {
+		for err := range server.GetErrorCh() {
+			logrus.WithError(err).Error("Error while serving")
+		}
+	}()
 
-	log.Println("🔒 IMAPS (TLS) server listening on 0.0.0.0:993")
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		if err := instance.PreloadRecentUsers(backgroundCtx, app.Config.IMAP.WARM_WINDOW, app.Config.IMAP.WARM_LIMIT); err != nil {
+			logrus.WithError(err).Error("Failed to preload recently active users")
+		}
+	}()
 
-	if err := server.Serve(ctx, tlsListener); err != nil && err != context.Canceled {
-		log.Printf("❌ IMAPS server error: %v", err)
-	}
-	for err := range server.GetErrorCh() {
-		logrus.WithError(err).Error("Error while serving")
-	}
+	<-ctx.Done()
+	return nil
+}
 
-	if err := listener.Close(); err != nil {
-		logrus.WithError(err).Error("Failed to close listener")
+// closeWithin runs close and stops waiting for it once ctx expires.
+func closeWithin(ctx context.Context, close func(context.Context) error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- close(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for the IMAP server to close: %w", ctx.Err())
 	}
-	<-ctx.Done()
 }
@@ -0,0 +1,294 @@
+package imap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/config"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrTLSRequired is returned when an endpoint needs TLS but no certificate is available.
+var ErrTLSRequired = errors.New("TLS is required but no certificate could be loaded")
+
+// Endpoint is a single address the IMAP server accepts connections on.
+type Endpoint struct {
+	Name    string      // Used in logs, e.g. "imap", "imaps", "unix"
+	Network string      // "tcp" or "unix"
+	Address string      // host:port or socket path
+	TLS     *tls.Config // Implicit TLS when set; plaintext endpoints use STARTTLS instead
+
+	StartTLS   *tls.Config // Certificate offered through STARTTLS on plaintext endpoints, if any
+	RequireTLS bool        // Logins are refused until STARTTLS when set
+}
+
+// endpointsFromConfig builds the endpoints enabled in the IMAP config.
+// A port of "0" or an empty socket path disables the endpoint.
+// Implicit TLS needs a certificate; when it is missing and TLS is required, an error is returned.
+// When TLS is required, the plaintext TCP endpoint only accepts logins after STARTTLS; the unix
+// socket, which never leaves the host, accepts them as they come.
+func endpointsFromConfig(cfg config.IMAPConfig, tlsConfig *tls.Config) ([]Endpoint, error) {
+	var endpoints []Endpoint
+
+	if tlsConfig == nil && cfg.IMAP_REQUIRE_TLS {
+		return nil, ErrTLSRequired
+	}
+
+	if cfg.IMAP_PORT != "" && cfg.IMAP_PORT != "0" {
+		address := net.JoinHostPort(cfg.IMAP_HOST, cfg.IMAP_PORT)
+		// GLUON_HOST predates IMAP_HOST/IMAP_PORT and still overrides the plaintext address.
+		if envHost := os.Getenv("GLUON_HOST"); envHost != "" {
+			address = envHost
+		}
+		endpoints = append(endpoints, Endpoint{
+			Name:       "imap",
+			Network:    "tcp",
+			Address:    address,
+			StartTLS:   tlsConfig,
+			RequireTLS: cfg.IMAP_REQUIRE_TLS,
+		})
+	}
+
+	if cfg.IMAPS_PORT != "" && cfg.IMAPS_PORT != "0" {
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("imaps on port %s: %w", cfg.IMAPS_PORT, ErrTLSRequired)
+		}
+		endpoints = append(endpoints, Endpoint{
+			Name:    "imaps",
+			Network: "tcp",
+			Address: net.JoinHostPort(cfg.IMAP_HOST, cfg.IMAPS_PORT),
+			TLS:     tlsConfig,
+		})
+	}
+
+	if cfg.IMAP_SOCKET != "" {
+		endpoints = append(endpoints, Endpoint{Name: "unix", Network: "unix", Address: cfg.IMAP_SOCKET, StartTLS: tlsConfig})
+	}
+
+	if len(endpoints) == 0 {
+		return nil, errors.New("no IMAP endpoint is enabled")
+	}
+
+	return endpoints, nil
+}
+
+// ListenerManager binds several endpoints and exposes them as a single net.Listener.
+// Gluon starts one accept loop and one connection counter per Serve call, so all
+// endpoints are fanned into one listener and served together.
+type ListenerManager struct {
+	endpoints []Endpoint
+	listeners []net.Listener
+
+	connCh    chan net.Conn
+	done      chan struct{}
+	loginHook LoginHook
+	oauthHook OAuthHook
+	guard     LoginGuard
+	gate      SessionGate
+	quota     QuotaHook
+	keywords  KeywordsHook
+	onAccept  func(net.Conn) net.Conn
+
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewListenerManager creates a manager for the given endpoints. Nothing is bound until Listen is called.
+func NewListenerManager(endpoints []Endpoint) *ListenerManager {
+	return &ListenerManager{
+		endpoints: endpoints,
+		connCh:    make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+}
+
+// OnLogin sets a hook called with the credentials of every login before Gluon handles it.
+// It must be set before Listen.
+func (m *ListenerManager) OnLogin(hook LoginHook) {
+	m.loginHook = hook
+}
+
+// OnOAuth enables XOAUTH2 and OAUTHBEARER logins, checked by hook.
+// It must be set before Listen.
+func (m *ListenerManager) OnOAuth(hook OAuthHook) {
+	m.oauthHook = hook
+}
+
+// GuardLogins has every login throttled by guard.
+// It must be set before Listen.
+func (m *ListenerManager) GuardLogins(guard LoginGuard) {
+	m.guard = guard
+}
+
+// GateSessions has the session of every accepted login admitted by gate.
+// It must be set before Listen.
+func (m *ListenerManager) GateSessions(gate SessionGate) {
+	m.gate = gate
+}
+
+// OnQuota has GETQUOTA and GETQUOTAROOT answered with the quotas hook returns.
+// It must be set before Listen.
+func (m *ListenerManager) OnQuota(hook QuotaHook) {
+	m.quota = hook
+}
+
+// OnKeywords has the keywords of every STORE that Gluon accepted written by hook.
+// It must be set before Listen.
+func (m *ListenerManager) OnKeywords(hook KeywordsHook) {
+	m.keywords = hook
+}
+
+// OnAccept sets a function that wraps every accepted connection before it is handed to Gluon.
+// It must be set before Listen.
+func (m *ListenerManager) OnAccept(wrap func(net.Conn) net.Conn) {
+	m.onAccept = wrap
+}
+
+// Listen binds every endpoint in parallel and starts accepting on each of them.
+// If any endpoint fails to bind, the ones already bound are closed and all errors are returned.
+func (m *ListenerManager) Listen() error {
+	listeners := make([]net.Listener, len(m.endpoints))
+	errs := make([]error, len(m.endpoints))
+
+	var wg sync.WaitGroup
+	for i, endpoint := range m.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listeners[i], errs[i] = endpoint.listen()
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		for _, l := range listeners {
+			if l != nil {
+				_ = l.Close()
+			}
+		}
+		return err
+	}
+
+	m.listeners = listeners
+	for i, l := range listeners {
+		logrus.WithFields(logrus.Fields{
+			"endpoint": m.endpoints[i].Name,
+			"address":  l.Addr().String(),
+			"tls":      m.endpoints[i].TLS != nil,
+		}).Info("IMAP endpoint listening")
+
+		m.wg.Add(1)
+		go m.acceptLoop(m.endpoints[i], l)
+	}
+
+	return nil
+}
+
+// listen binds a single endpoint. A stale unix socket left behind by a previous run is removed first.
+func (e Endpoint) listen() (net.Listener, error) {
+	if e.Network == "unix" {
+		if err := os.Remove(e.Address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: remove stale socket: %w", e.Name, err)
+		}
+	}
+
+	l, err := net.Listen(e.Network, e.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", e.Name, err)
+	}
+
+	if e.TLS != nil {
+		l = tls.NewListener(l, e.TLS)
+	}
+
+	return l, nil
+}
+
+// acceptLoop forwards the connections of one endpoint to Accept until the manager is closed.
+func (m *ListenerManager) acceptLoop(endpoint Endpoint, l net.Listener) {
+	defer m.wg.Done()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+
+			// Gluon stops serving on the first Accept error, so a broken endpoint
+			// only takes itself down and the others keep running.
+			logrus.WithError(err).WithField("endpoint", endpoint.Name).Error("IMAP endpoint stopped accepting")
+			return
+		}
+
+		// TLS endpoints are wrapped as well so that STARTTLS is neither advertised nor handed to Gluon there.
+		if m.loginHook != nil || m.oauthHook != nil || m.guard != nil || m.gate != nil || m.quota != nil ||
+			m.keywords != nil || endpoint.TLS != nil || endpoint.RequireTLS {
+			conn = newLoginConn(conn, m.loginHook, m.oauthHook, m.guard, m.gate, m.quota, m.keywords, endpoint)
+		}
+		if m.onAccept != nil {
+			conn = m.onAccept(conn)
+		}
+
+		select {
+		case m.connCh <- conn:
+		case <-m.done:
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for the next connection on any endpoint. It fails once the manager is closed.
+func (m *ListenerManager) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.connCh:
+		return conn, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes every endpoint and waits for their accept loops to return.
+func (m *ListenerManager) Close() error {
+	var errs []error
+
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if err := l.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		m.wg.Wait()
+
+		for _, endpoint := range m.endpoints {
+			if endpoint.Network == "unix" {
+				_ = os.Remove(endpoint.Address)
+			}
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first endpoint.
+func (m *ListenerManager) Addr() net.Addr {
+	if len(m.listeners) == 0 {
+		return &net.TCPAddr{}
+	}
+	return m.listeners[0].Addr()
+}
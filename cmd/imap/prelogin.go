@@ -0,0 +1,1172 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProtonMail/gluon/imap/command"
+	"github.com/ProtonMail/gluon/rfcparser"
+	"github.com/emersion/go-imap/utf7"
+	factory "github.com/enjoys-in/airsend-imap/internal/core/imap"
+	"github.com/enjoys-in/airsend-imap/internal/core/imap/connector"
+	"github.com/enjoys-in/airsend-imap/internal/core/oauth"
+	"github.com/enjoys-in/airsend-imap/internal/core/tenant"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPreAuthBytes bounds how much client input is inspected before a connection is left alone.
+	maxPreAuthBytes = 64 << 10
+
+	// preAuthReaderSize is the longest command line that can be inspected.
+	preAuthReaderSize = 8 << 10
+
+	// loginHookTimeout bounds how long a login waits for its user to be loaded.
+	loginHookTimeout = time.Minute
+
+	// quotaHookTimeout bounds how long a GETQUOTA or GETQUOTAROOT waits for the account's quota.
+	quotaHookTimeout = 10 * time.Second
+
+	// keywordsHookTimeout bounds how long the reply to a STORE waits for its keywords to be written.
+	keywordsHookTimeout = 10 * time.Second
+
+	// literalAnnouncementSize is the longest literal announcement, as in "{4294967295+}".
+	literalAnnouncementSize = 13
+)
+
+// oauthCapabilities are advertised next to Gluon's AUTH=PLAIN when OAuth logins are enabled.
+const oauthCapabilities = " AUTH=XOAUTH2 AUTH=OAUTHBEARER"
+
+// quotaCapabilities are added to Gluon's capabilities once logged in when quotas are answered.
+const quotaCapabilities = " QUOTA QUOTA=RES-STORAGE QUOTA=RES-MESSAGE"
+
+// LoginHook is called with the credentials of a login before Gluon handles the command. It may
+// return a one-time password Gluon accepts in place of the client's, so that credentials it has
+// already checked are not checked again; nil leaves the client's password.
+type LoginHook func(ctx context.Context, username string, password []byte) (ticket []byte)
+
+// LoginGuard throttles logins by account and by client address. *lockout.Tracker is one.
+type LoginGuard interface {
+	// Check returns how long a login has to wait before it is checked, or an error when it must
+	// be refused without checking it.
+	Check(account, ip string) (time.Duration, error)
+	Failure(ctx context.Context, account, ip string)
+	Success(account string)
+}
+
+// errLoginRefused ends a connection whose login was refused after part of it reached Gluon.
+var errLoginRefused = errors.New("login refused")
+
+// errInputRefused ends a connection that sent a line too long or too much input to be inspected
+// before logging in. Passing it on uninspected would let logins bypass the guard and the gate.
+var errInputRefused = errors.New("too much input before login")
+
+// SessionGate decides whether the session of a login Gluon accepted may go on, given the endpoint
+// it came in on and the TLS server name the client asked for, if any. The returned function is
+// called once the connection is closed.
+type SessionGate func(username, endpoint, serverName string) (release func(), err error)
+
+// errSessionRefused ends a connection whose login Gluon accepted but the SessionGate refused.
+var errSessionRefused = errors.New("session refused")
+
+// OAuthHook checks the bearer token of an XOAUTH2 or OAUTHBEARER login for username, which may
+// be empty. It returns the account to log in and a password Gluon accepts for it, or an error
+// wrapping oauth.ErrInvalidToken when the token is rejected.
+type OAuthHook func(ctx context.Context, username, token string) (email string, password []byte, err error)
+
+// QuotaHook returns the usage and limits of the account a session logged in as.
+type QuotaHook func(ctx context.Context, username string) (connector.Quota, error)
+
+// KeywordsHook writes the keywords of a STORE that Gluon accepted in a session of username,
+// which Gluon keeps to itself rather than hand them to its connector.
+type KeywordsHook func(ctx context.Context, username string, store factory.KeywordStore) error
+
+// loginConn passes a client connection through to Gluon and calls a LoginHook with the
+// credentials of LOGIN and AUTHENTICATE PLAIN before Gluon sees them. Gluon only checks
+// credentials against the users it already has loaded, so this is where a user gets loaded
+// on its first login. A ticket returned by the hook then replaces the password, so Gluon does
+// not check the credentials a second time.
+//
+// AUTHENTICATE is answered here and turned into a LOGIN for Gluon: PLAIN, and XOAUTH2 and
+// OAUTHBEARER when an OAuthHook is set, for which a valid token becomes a one-time password.
+//
+// With a LoginGuard, every login first waits out the delay of its account and address, is
+// refused while either is locked out, and its outcome is read from Gluon's reply.
+// With a SessionGate, a login Gluon accepted is refused and the connection closed unless the gate
+// lets its session go on.
+// With a QuotaHook, GETQUOTA and GETQUOTAROOT, which Gluon does not know, are answered here once
+// logged in, against a single quota root "" holding every mailbox of the account.
+// With a KeywordsHook, the mailbox of each SELECT and EXAMINE is noted, and a STORE in it that
+// Gluon accepted is handed to the hook before its reply is passed on.
+// On an endpoint that requires TLS, LOGIN and AUTHENTICATE are refused until STARTTLS and
+// LOGINDISABLED is advertised in place of AUTH=PLAIN. Once TLS is active, STARTTLS, which Gluon
+// advertises on every connection, is no longer.
+//
+// Only the commands allowed before authentication are inspected; the first other command once
+// logged in, or too much input, turns the connection into a plain pass-through, or with a
+// QuotaHook or a KeywordsHook into one that only looks at the first line of each command. While logins are
+// followed, too much input or a line too long to inspect before logging in ends the connection,
+// so that no login reaches Gluon uninspected. To keep seeing the commands after STARTTLS,
+// the connection performs the upgrade itself rather than leaving it to Gluon.
+type loginConn struct {
+	hook     LoginHook
+	oauth    OAuthHook    // Answers XOAUTH2 and OAUTHBEARER when set
+	guard    LoginGuard   // Throttles logins when set
+	gate     SessionGate  // Admits the sessions of accepted logins when set
+	quota    QuotaHook    // Answers the quota commands when set
+	keywords KeywordsHook // Writes the keywords of accepted STOREs when set
+	endpoint string       // Name of the endpoint the connection came in on
+	ip       string       // Client address the guard counts failures by, empty for unix sockets
+	startTLS *tls.Config  // Upgrades STARTTLS when set; nil on implicit TLS endpoints
+	require  bool         // Logins are refused until TLS is active
+	preAuth  atomic.Bool  // The OAuth mechanisms are added to the capabilities while set
+
+	mu        sync.Mutex
+	conn      net.Conn // The client connection, replaced by the TLS connection after STARTTLS
+	tls       bool
+	loginTag  string // Tag of the login handed to Gluon whose reply is awaited
+	loginUser string
+	loggedIn  string                          // User of the login Gluon accepted, once it did
+	release   func()                          // Returned by the gate for the session, called on Close
+	stores    map[string]factory.KeywordStore // STOREs awaiting Gluon's reply, by tag
+
+	// The fields below are only used by Read.
+	reader       *bufio.Reader
+	pending      []byte // Inspected input not yet handed to Gluon
+	command      []byte // The command being read, literals included
+	literal      int    // Bytes left in the literal being read
+	inspected    int
+	passThrough  bool
+	commandsOnly bool   // Only the first line of each command is inspected
+	continued    bool   // The next line goes on with a command after its literal
+	midLine      bool   // The next input goes on with a line longer than the reader's buffer
+	tail         []byte // End of that line, in which a literal may be announced
+	saslTag      string // Tag of an AUTHENTICATE PLAIN waiting for its response line
+	oauthTag     string // Tag of an OAuth AUTHENTICATE waiting for its response line
+	oauthMech    string // Mechanism of that AUTHENTICATE
+	oauthAbort   string // Tag of a rejected OAuth AUTHENTICATE waiting for the client to acknowledge the error
+	selected     string // Mailbox of the last SELECT or EXAMINE as Gluon names it, empty when unknown
+	err          error
+}
+
+func newLoginConn(conn net.Conn, hook LoginHook, oauthHook OAuthHook, guard LoginGuard, gate SessionGate, quota QuotaHook, keywords KeywordsHook, endpoint Endpoint) *loginConn {
+	_, isTLS := conn.(*tls.Conn)
+
+	c := &loginConn{
+		hook:     hook,
+		oauth:    oauthHook,
+		guard:    guard,
+		gate:     gate,
+		quota:    quota,
+		keywords: keywords,
+		endpoint: endpoint.Name,
+		ip:       remoteIP(conn.RemoteAddr()),
+		startTLS: endpoint.StartTLS,
+		require:  endpoint.RequireTLS,
+		conn:     conn,
+		tls:      isTLS,
+		reader:   bufio.NewReaderSize(conn, preAuthReaderSize),
+	}
+	c.preAuth.Store(oauthHook != nil)
+
+	return c
+}
+
+// Read hands the client input to Gluon, inspecting each command first.
+func (c *loginConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.passThrough {
+			return c.reader.Read(p)
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.commandsOnly {
+			c.err = c.inspectCommand()
+		} else {
+			c.err = c.inspect()
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// inspect reads the next line or literal chunk of client input.
+func (c *loginConn) inspect() error {
+	if c.literal > 0 {
+		chunk := make([]byte, min(c.literal, preAuthReaderSize))
+		n, err := c.reader.Read(chunk)
+		c.literal -= n
+		if err := c.consume(chunk[:n]); err != nil {
+			return err
+		}
+		return err
+	}
+
+	line, err := c.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		if !c.authenticated() {
+			return c.refuseInput("Command line too long")
+		}
+		c.pending = append(c.pending, line...)
+		c.stopInspecting()
+		c.keepTail(line)
+		return nil
+	}
+	if err != nil {
+		c.pending = append(c.pending, line...)
+		return err
+	}
+
+	if err := c.consume(line); err != nil {
+		return err
+	}
+	if c.passThrough || c.commandsOnly {
+		c.endLine(line)
+		return nil
+	}
+
+	// A command ending in a literal goes on after it, and the client only sends the literal
+	// once Gluon has answered the part it has.
+	if n, ok := literalLength(line); ok {
+		c.literal = n
+		return nil
+	}
+
+	command := c.command
+	c.command = nil
+
+	return c.handle(command)
+}
+
+// consume queues input for Gluon and adds it to the command being read.
+func (c *loginConn) consume(input []byte) error {
+	c.pending = append(c.pending, input...)
+	c.command = append(c.command, input...)
+
+	c.inspected += len(input)
+	if c.inspected > maxPreAuthBytes {
+		if !c.authenticated() {
+			return c.refuseInput("Too much input before login")
+		}
+		c.stopInspecting()
+		c.continued = len(c.command) > 0
+		c.command = nil
+	}
+	return nil
+}
+
+// refuseInput ends a connection whose input cannot be inspected before it logs in.
+func (c *loginConn) refuseInput(reason string) error {
+	c.pending, c.command = nil, nil
+	_ = c.reply("* BYE %s\r\n", reason)
+	return errInputRefused
+}
+
+// stopInspecting stops inspecting the commands allowed before authentication. The connection
+// turns into a plain pass-through, or with a QuotaHook or a KeywordsHook only goes on looking at
+// the first line of each command.
+func (c *loginConn) stopInspecting() {
+	if c.quota == nil && c.keywords == nil {
+		c.passThrough = true
+	} else {
+		c.commandsOnly = true
+	}
+	c.preAuth.Store(false)
+}
+
+// inspectCommand reads the next line or literal chunk of client input once only the first line
+// of each command is inspected. Literals and the lines that follow them are passed on as they are.
+func (c *loginConn) inspectCommand() error {
+	if c.literal > 0 {
+		chunk := make([]byte, min(c.literal, preAuthReaderSize))
+		n, err := c.reader.Read(chunk)
+		c.literal -= n
+		c.pending = chunk[:n]
+		return err
+	}
+
+	line, err := c.reader.ReadSlice('\n')
+	c.pending = append(c.pending, line...)
+	if errors.Is(err, bufio.ErrBufferFull) {
+		first := !c.continued && !c.midLine
+		c.keepTail(line)
+		if first {
+			return c.handleCommand(c.pending)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	first := !c.continued && !c.midLine
+	if c.midLine {
+		line = append(c.tail, line...)
+		c.midLine, c.tail = false, nil
+	}
+	c.endLine(line)
+
+	if first {
+		return c.handleCommand(c.pending)
+	}
+	return nil
+}
+
+// keepTail notes that the input goes on with the rest of a line too long for the reader, keeping
+// the end of what was read of it so that a literal announced across two reads is still seen.
+func (c *loginConn) keepTail(line []byte) {
+	if c.midLine {
+		line = append(c.tail, line...)
+	}
+	c.midLine = true
+	c.tail = bytes.Clone(line[max(len(line)-literalAnnouncementSize, 0):])
+}
+
+// endLine notes whether a complete line announced a literal, after which its command goes on.
+func (c *loginConn) endLine(line []byte) {
+	c.literal, c.continued = literalLength(line)
+}
+
+// handle looks at a complete command before it is handed to Gluon.
+func (c *loginConn) handle(command []byte) error {
+	if c.saslTag != "" {
+		tag := c.saslTag
+		c.saslTag = ""
+		c.pending = nil
+		return c.authenticatePlain(tag, bytes.TrimSpace(command))
+	}
+
+	if c.oauthTag != "" {
+		tag, mechanism := c.oauthTag, c.oauthMech
+		c.oauthTag, c.oauthMech = "", ""
+		c.pending = nil
+		return c.authenticateOAuth(tag, mechanism, bytes.TrimSpace(command))
+	}
+
+	if c.oauthAbort != "" {
+		// Whatever the client answered to the error, the exchange ends here.
+		tag := c.oauthAbort
+		c.oauthAbort = ""
+		c.pending = nil
+		return c.reply("%s NO [AUTHENTICATIONFAILED] Authentication failed\r\n", tag)
+	}
+
+	tag, rest, _ := bytes.Cut(bytes.TrimRight(command, "\r\n"), []byte(" "))
+	name, args, _ := bytes.Cut(rest, []byte(" "))
+
+	switch string(bytes.ToUpper(name)) {
+	case "LOGIN":
+		// A LOGIN with literals reached Gluon in parts; only the last one is still here.
+		whole := len(c.pending) == len(command)
+
+		if c.cleartext() {
+			return c.refuseLogin(string(tag), whole, "%s NO [PRIVACYREQUIRED] Use STARTTLS before logging in\r\n")
+		}
+		var password []byte
+		username, rest, ok := parseAString(args)
+		if ok {
+			password, _, ok = parseAString(rest)
+		}
+		if !ok {
+			// What cannot be inspected does not reach Gluon, which might read it differently.
+			return c.refuseLogin(string(tag), whole, "%s BAD Invalid LOGIN arguments\r\n")
+		}
+		if admitted, err := c.admit(string(tag), string(username), whole); !admitted {
+			return err
+		}
+		// A LOGIN that partly reached Gluon keeps the client's password.
+		if ticket := c.callHook(username, password); ticket != nil && whole {
+			c.pending = fmt.Appendf(nil, "%s LOGIN %s %s\r\n", tag, quoteString(string(username)), quoteString(string(ticket)))
+		}
+		c.expectLogin(string(tag), string(username))
+
+	case "AUTHENTICATE":
+		if c.cleartext() {
+			c.pending = nil
+			return c.reply("%s NO [PRIVACYREQUIRED] Use STARTTLS before logging in\r\n", tag)
+		}
+
+		mechanism, response, _ := bytes.Cut(bytes.TrimSpace(args), []byte(" "))
+		switch name := strings.ToUpper(string(mechanism)); {
+		case name == "PLAIN":
+			// The command is answered here and handed to Gluon as a LOGIN.
+			c.pending = nil
+			if len(response) > 0 {
+				return c.authenticatePlain(string(tag), response)
+			}
+			c.saslTag = string(tag)
+			return c.reply("+ \r\n")
+
+		case c.oauth != nil && (name == "XOAUTH2" || name == "OAUTHBEARER"):
+			// The command is answered here, Gluon never sees it.
+			c.pending = nil
+			if len(response) > 0 {
+				return c.authenticateOAuth(string(tag), name, response)
+			}
+			c.oauthTag, c.oauthMech = string(tag), name
+			return c.reply("+ \r\n")
+		}
+
+	case "STARTTLS":
+		if c.startTLS != nil || c.TLSActive() {
+			// The command is answered here, Gluon never sees it.
+			c.pending = nil
+			return c.upgrade(string(tag))
+		}
+
+	case "CAPABILITY", "NOOP", "LOGOUT", "ID":
+
+	default:
+		// Anything else is only valid once authenticated. Until a login is accepted, Gluon refuses
+		// it and the logins that may follow are still inspected.
+		if !c.authenticated() {
+			return nil
+		}
+		c.stopInspecting()
+		if c.commandsOnly {
+			return c.handleCommand(command)
+		}
+	}
+
+	return nil
+}
+
+// handleCommand looks at a command once logged in, or at its first line when that is all there
+// is yet. GETQUOTA and GETQUOTAROOT are answered, and the mailboxes selected and the STOREs made
+// are noted for the KeywordsHook. A command with a literal, or with a line too long to read at
+// once, is left to Gluon.
+func (c *loginConn) handleCommand(command []byte) error {
+	c.mu.Lock()
+	username := c.loggedIn
+	c.mu.Unlock()
+	if username == "" {
+		return nil
+	}
+
+	line := bytes.TrimRight(command, "\r\n")
+	_, continued := literalLength(command)
+	whole := bytes.HasSuffix(command, []byte("\n")) && !continued && !bytes.ContainsAny(line, "\r\n")
+
+	tag, rest, _ := bytes.Cut(line, []byte(" "))
+	name, args, _ := bytes.Cut(rest, []byte(" "))
+
+	switch name := string(bytes.ToUpper(name)); {
+	case c.quota != nil && whole && (name == "GETQUOTA" || name == "GETQUOTAROOT"):
+		return c.answerQuota(string(tag), name, args, username)
+	case c.keywords != nil && (name == "SELECT" || name == "EXAMINE"):
+		// A mailbox that cannot be told from the command leaves none known to be selected.
+		c.selected = ""
+		if whole {
+			c.noteCommand(command)
+		}
+	case c.keywords != nil && whole && (name == "STORE" || name == "UID"):
+		c.noteCommand(command)
+	}
+
+	return nil
+}
+
+// answerQuota answers a GETQUOTA or GETQUOTAROOT for the account username logged in as.
+func (c *loginConn) answerQuota(tag, name string, args []byte, username string) error {
+	// The command is answered here, Gluon never sees it.
+	c.pending = nil
+
+	root, trailing, ok := parseAString(args)
+	if !ok || len(trailing) > 0 {
+		return c.reply("%s BAD Invalid arguments\r\n", tag)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), quotaHookTimeout)
+	defer cancel()
+
+	quota, err := c.quota(ctx, username)
+	if err != nil {
+		logrus.WithError(err).WithField("user", username).Error("Failed to read IMAP quota")
+		return c.reply("%s NO [UNAVAILABLE] Quota is temporarily unavailable\r\n", tag)
+	}
+	resources := quotaResources(quota)
+
+	if name == "GETQUOTAROOT" {
+		// Every mailbox is under the one root, which only exists when something is limited.
+		if resources == "" {
+			return c.reply("* QUOTAROOT %s\r\n%s OK GETQUOTAROOT completed\r\n", quoteString(string(root)), tag)
+		}
+		return c.reply("* QUOTAROOT %s \"\"\r\n* QUOTA \"\" (%s)\r\n%s OK GETQUOTAROOT completed\r\n",
+			quoteString(string(root)), resources, tag)
+	}
+
+	if len(root) > 0 || resources == "" {
+		return c.reply("%s NO [NONEXISTENT] No such quota root\r\n", tag)
+	}
+	return c.reply("* QUOTA \"\" (%s)\r\n%s OK GETQUOTA completed\r\n", resources, tag)
+}
+
+// noteCommand notes the mailbox a SELECT or EXAMINE selects, and a STORE in the selected mailbox
+// to hand to the KeywordsHook once Gluon accepted it. The command is read with Gluon's parser, so
+// that it means the same here as to Gluon.
+func (c *loginConn) noteCommand(line []byte) {
+	parsed, err := command.NewParser(rfcparser.NewScanner(bytes.NewReader(line))).Parse()
+	if err != nil {
+		return
+	}
+
+	var (
+		store *command.Store
+		uid   bool
+	)
+	switch payload := parsed.Payload.(type) {
+	case *command.Select:
+		c.selected = decodeMailboxName(payload.Mailbox)
+	case *command.Examine:
+		c.selected = decodeMailboxName(payload.Mailbox)
+	case *command.Store:
+		store = payload
+	case *command.UID:
+		store, uid = payload.Command.(*command.Store)
+	}
+	if store == nil || c.selected == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stores == nil {
+		c.stores = make(map[string]factory.KeywordStore)
+	}
+	c.stores[parsed.Tag] = factory.KeywordStore{
+		Mailbox: c.selected,
+		UID:     uid,
+		Set:     store.SeqSet,
+		Action:  store.Action,
+		Flags:   store.Flags,
+	}
+}
+
+// storeOutcomeLocked reports whether a line is Gluon's tagged OK to a noted STORE, and returns the
+// STORE. Any tagged reply to the STORE forgets it. The caller must hold c.mu.
+func (c *loginConn) storeOutcomeLocked(line []byte) (factory.KeywordStore, bool) {
+	if len(c.stores) == 0 {
+		return factory.KeywordStore{}, false
+	}
+
+	tag, status, _ := bytes.Cut(line, []byte(" "))
+	store, ok := c.stores[string(tag)]
+	if !ok {
+		return factory.KeywordStore{}, false
+	}
+	delete(c.stores, string(tag))
+
+	return store, bytes.HasPrefix(status, []byte("OK"))
+}
+
+// storeKeywords hands a STORE Gluon accepted to the KeywordsHook. A failure is only logged, the
+// flags have changed in Gluon already.
+func (c *loginConn) storeKeywords(username string, store factory.KeywordStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), keywordsHookTimeout)
+	defer cancel()
+
+	if err := c.keywords(ctx, username, store); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"user":    username,
+			"mailbox": store.Mailbox,
+		}).Error("Failed to store IMAP keywords")
+	}
+}
+
+// upgrade answers a STARTTLS and performs the TLS handshake.
+// Input sent before the handshake is discarded, as RFC 9051 requires.
+func (c *loginConn) upgrade(tag string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tls {
+		_, err := fmt.Fprintf(c.conn, "%s BAD TLS is already active\r\n", tag)
+		return err
+	}
+
+	if _, err := fmt.Fprintf(c.conn, "%s OK Begin TLS negotiation now\r\n", tag); err != nil {
+		return err
+	}
+
+	conn := tls.Server(c.conn, c.startTLS)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.tls = true
+	c.reader = bufio.NewReaderSize(conn, preAuthReaderSize)
+
+	return nil
+}
+
+// authenticatePlain answers the client response of an AUTHENTICATE PLAIN, handing the
+// credentials to Gluon as a LOGIN.
+func (c *loginConn) authenticatePlain(tag string, response []byte) error {
+	if string(response) == "*" {
+		return c.reply("%s BAD Authentication cancelled\r\n", tag)
+	}
+
+	username, password, ok := decodeSASLPlain(response)
+	if !ok {
+		return c.reply("%s BAD Invalid PLAIN response\r\n", tag)
+	}
+
+	if admitted, err := c.admit(tag, string(username), true); !admitted {
+		return err
+	}
+	if ticket := c.callHook(username, password); ticket != nil {
+		password = ticket
+	}
+	c.expectLogin(tag, string(username))
+	c.pending = fmt.Appendf(nil, "%s LOGIN %s %s\r\n", tag, quoteString(string(username)), quoteString(string(password)))
+
+	return nil
+}
+
+// admit makes a login wait out the delay of its account and address, and refuses it while
+// either is locked out. A login Gluon has seen part of, whole being false, can only be refused
+// by ending the connection, which is what the returned error does.
+func (c *loginConn) admit(tag, username string, whole bool) (bool, error) {
+	if c.guard == nil {
+		return true, nil
+	}
+
+	wait, err := c.guard.Check(username, c.ip)
+	if err != nil {
+		return false, c.refuseLogin(tag, whole, "%s NO [UNAVAILABLE] Too many failed logins, try again later\r\n")
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return true, nil
+}
+
+// refuseLogin answers a login with the reply format, which takes the tag. A login Gluon has seen
+// part of, whole being false, can only be refused by ending the connection.
+func (c *loginConn) refuseLogin(tag string, whole bool, format string) error {
+	c.pending = nil
+	if !whole {
+		_ = c.reply("* BYE Login refused\r\n")
+		return errLoginRefused
+	}
+	return c.reply(format, tag)
+}
+
+// expectLogin has the outcome of a login read from Gluon's reply, for the guard, the gate, the
+// quota commands and the keywords hook.
+func (c *loginConn) expectLogin(tag, username string) {
+	if !c.followsLogins() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.loginTag, c.loginUser = tag, username
+}
+
+// followsLogins reports whether the outcome of logins is read from Gluon's replies, which is
+// needed by the guard, the gate, the quota commands, the keywords hook and to refuse logins until
+// TLS is active.
+func (c *loginConn) followsLogins() bool {
+	return c.guard != nil || c.gate != nil || c.quota != nil || c.keywords != nil || c.require
+}
+
+// authenticated reports whether a login Gluon accepted has been seen. When logins are not
+// followed, any command is taken to come after one.
+func (c *loginConn) authenticated() bool {
+	if !c.followsLogins() {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.loggedIn != ""
+}
+
+// loginOutcomeLocked reports whether a line is the reply to the awaited login and whether the login
+// failed. The caller must hold c.mu.
+func (c *loginConn) loginOutcomeLocked(line []byte) (username string, replied, failed bool) {
+	if c.loginTag == "" {
+		return "", false, false
+	}
+
+	status, ok := bytes.CutPrefix(line, []byte(c.loginTag+" "))
+	if !ok {
+		return "", false, false
+	}
+
+	username = c.loginUser
+	c.loginTag, c.loginUser = "", ""
+
+	switch {
+	case bytes.HasPrefix(status, []byte("OK")):
+		return username, true, false
+	case bytes.HasPrefix(status, []byte("NO")):
+		return username, true, true
+	default:
+		// A BAD reply is about the command, not the credentials.
+		return "", false, false
+	}
+}
+
+// authenticateOAuth answers the client response of an XOAUTH2 or OAUTHBEARER login. A valid token
+// is handed to Gluon as a LOGIN with the password returned by the OAuthHook.
+func (c *loginConn) authenticateOAuth(tag, mechanism string, response []byte) error {
+	if string(response) == "*" {
+		return c.reply("%s BAD Authentication cancelled\r\n", tag)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(response))
+	if err != nil {
+		return c.reply("%s BAD Invalid base64 response\r\n", tag)
+	}
+
+	var username, token string
+	if mechanism == "XOAUTH2" {
+		username, token, err = oauth.ParseXOAUTH2(decoded)
+	} else {
+		username, token, err = oauth.ParseOAUTHBEARER(decoded)
+	}
+	if err != nil {
+		return c.reply("%s BAD Malformed %s response\r\n", tag, mechanism)
+	}
+
+	if admitted, err := c.admit(tag, username, true); !admitted {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loginHookTimeout)
+	defer cancel()
+
+	email, password, err := c.oauth(ctx, username, token)
+	if err == nil && (strings.ContainsAny(email, "\r\n\x00") || bytes.ContainsAny(password, "\r\n\x00")) {
+		err = fmt.Errorf("%w: unusable credentials for %q", oauth.ErrInvalidToken, email)
+	}
+	switch {
+	case errors.Is(err, oauth.ErrInvalidToken):
+		logrus.WithError(err).WithField("mechanism", mechanism).Debug("OAuth login rejected")
+		if c.guard != nil {
+			c.guard.Failure(ctx, username, c.ip)
+		}
+		// Both mechanisms send the error as a challenge, and fail once the client answers it.
+		c.oauthAbort = tag
+		return c.reply("+ %s\r\n", base64.StdEncoding.EncodeToString(oauth.FailureResponse()))
+
+	case err != nil:
+		logrus.WithError(err).WithField("mechanism", mechanism).Error("Failed to check OAuth login")
+		return c.reply("%s NO [UNAVAILABLE] Authentication is temporarily unavailable\r\n", tag)
+	}
+
+	c.expectLogin(tag, email)
+	c.pending = fmt.Appendf(nil, "%s LOGIN %s %s\r\n", tag, quoteString(email), quoteString(string(password)))
+
+	return nil
+}
+
+// reply writes a response of the connection itself, bypassing Gluon.
+func (c *loginConn) reply(format string, args ...any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := fmt.Fprintf(c.conn, format, args...)
+	return err
+}
+
+// callHook runs the login hook, which may take a while when the user has to be loaded, and
+// returns the ticket to log in with instead of the password, if any.
+func (c *loginConn) callHook(username, password []byte) []byte {
+	if c.hook == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loginHookTimeout)
+	defer cancel()
+
+	ticket := c.hook(ctx, string(username), password)
+	if bytes.ContainsAny(ticket, "\r\n\x00") {
+		return nil
+	}
+
+	return ticket
+}
+
+// cleartext reports whether a login has to be refused because TLS is required and not yet active.
+func (c *loginConn) cleartext() bool {
+	return c.require && !c.TLSActive()
+}
+
+// TLSActive reports whether the connection is encrypted, either implicitly or after STARTTLS.
+func (c *loginConn) TLSActive() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tls
+}
+
+func (c *loginConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+// Write hands Gluon's output to the client. Before authentication, the OAuth mechanisms are
+// added to the capabilities Gluon advertises, and the reply to a login tells the guard how it
+// went. An accepted login is only passed on once the gate admitted its session, and from then
+// on the quota capabilities are advertised. The OK to a STORE is only passed on once the keywords
+// hook has written the keywords it stored.
+func (c *loginConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	username, replied, failed := c.loginOutcomeLocked(p)
+	store, stored := c.storeOutcomeLocked(p)
+	loggedIn := c.loggedIn
+	c.mu.Unlock()
+
+	if stored {
+		c.storeKeywords(loggedIn, store)
+	}
+
+	if replied && !failed && c.gate != nil {
+		if err := c.admitSession(p, username); err != nil {
+			return 0, err
+		}
+	}
+
+	c.mu.Lock()
+	if replied && !failed {
+		c.loggedIn = username
+	}
+	n, err := c.writeLocked(p)
+	c.mu.Unlock()
+
+	if replied && c.guard != nil {
+		if failed {
+			ctx, cancel := context.WithTimeout(context.Background(), loginHookTimeout)
+			c.guard.Failure(ctx, username, c.ip)
+			cancel()
+		} else {
+			c.guard.Success(username)
+		}
+	}
+
+	return n, err
+}
+
+// admitSession asks the gate whether the session of an accepted login may go on. A refused
+// login is answered with a NO in place of Gluon's reply, and the connection is closed.
+func (c *loginConn) admitSession(reply []byte, username string) error {
+	release, err := c.gate(username, c.endpoint, c.serverName())
+	if err == nil {
+		c.mu.Lock()
+		c.release = release
+		c.mu.Unlock()
+		return nil
+	}
+
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"user":     username,
+		"endpoint": c.endpoint,
+	}).Info("IMAP session refused")
+
+	tag, _, _ := bytes.Cut(reply, []byte(" "))
+	switch {
+	case errors.Is(err, tenant.ErrTooManyConnections):
+		_ = c.reply("%s NO [LIMIT] Too many connections, try again later\r\n", tag)
+	case errors.Is(err, tenant.ErrIMAPDisabled),
+		errors.Is(err, tenant.ErrEndpointNotAllowed),
+		errors.Is(err, tenant.ErrHostnameNotAllowed):
+		_ = c.reply("%s NO [AUTHORIZATIONFAILED] Not available on this server\r\n", tag)
+	default:
+		_ = c.reply("%s NO [UNAVAILABLE] Login is temporarily unavailable\r\n", tag)
+	}
+	_ = c.reply("* BYE Session refused\r\n")
+	_ = c.Close()
+
+	return errSessionRefused
+}
+
+// serverName returns the TLS server name the client asked for, if any.
+func (c *loginConn) serverName() string {
+	if conn, ok := c.current().(*tls.Conn); ok {
+		return conn.ConnectionState().ServerName
+	}
+	return ""
+}
+
+// writeLocked writes Gluon's output. The caller must hold c.mu.
+func (c *loginConn) writeLocked(p []byte) (int, error) {
+	out := p
+	if c.tls || c.startTLS == nil {
+		if advertised, ok := replaceCapability(out, "STARTTLS", ""); ok {
+			out = advertised
+		}
+	}
+	if c.require && !c.tls {
+		if advertised, ok := replaceCapability(out, "AUTH=PLAIN", "LOGINDISABLED"); ok {
+			out = advertised
+		}
+	} else if c.preAuth.Load() {
+		if advertised, ok := advertiseOAuth(out); ok {
+			out = advertised
+		}
+	}
+	if c.quota != nil && c.loggedIn != "" {
+		if advertised, ok := advertiseQuota(out); ok {
+			out = advertised
+		}
+	}
+
+	if n, err := c.conn.Write(out); err != nil {
+		return min(n, len(p)), err
+	}
+	return len(p), nil
+}
+
+// Close closes the client connection and ends the session admitted by the gate, if any.
+func (c *loginConn) Close() error {
+	c.mu.Lock()
+	release := c.release
+	c.release = nil
+	conn := c.conn
+	c.mu.Unlock()
+
+	if release != nil {
+		release()
+	}
+	return conn.Close()
+}
+
+func (c *loginConn) LocalAddr() net.Addr                { return c.current().LocalAddr() }
+func (c *loginConn) RemoteAddr() net.Addr               { return c.current().RemoteAddr() }
+func (c *loginConn) SetDeadline(t time.Time) error      { return c.current().SetDeadline(t) }
+func (c *loginConn) SetReadDeadline(t time.Time) error  { return c.current().SetReadDeadline(t) }
+func (c *loginConn) SetWriteDeadline(t time.Time) error { return c.current().SetWriteDeadline(t) }
+
+// advertiseOAuth adds the OAuth mechanisms after AUTH=PLAIN in a response line listing the
+// capabilities, either a CAPABILITY response or a CAPABILITY response code.
+func advertiseOAuth(line []byte) ([]byte, bool) {
+	i := bytes.Index(line, []byte(" AUTH=PLAIN"))
+	if i < 0 || !bytes.Contains(line[:i], []byte("CAPABILITY")) {
+		return nil, false
+	}
+	end := i + len(" AUTH=PLAIN")
+
+	advertised := make([]byte, 0, len(line)+len(oauthCapabilities))
+	advertised = append(advertised, line[:end]...)
+	advertised = append(advertised, oauthCapabilities...)
+	advertised = append(advertised, line[end:]...)
+
+	return advertised, true
+}
+
+// replaceCapability replaces a capability with another one, or drops it when replacement is
+// empty, in a response line listing the capabilities, either a CAPABILITY response or a
+// CAPABILITY response code.
+func replaceCapability(line []byte, name, replacement string) ([]byte, bool) {
+	start := bytes.Index(line, []byte("CAPABILITY "))
+	if start < 0 {
+		return nil, false
+	}
+	end := len(bytes.TrimRight(line, "\r\n"))
+	if i := bytes.IndexByte(line[start:], ']'); i >= 0 {
+		end = start + i
+	}
+	list := line[:end]
+
+	for _, capability := range bytes.Fields(list[start:]) {
+		if string(capability) != name {
+			continue
+		}
+		i := bytes.Index(list[start:], []byte(" "+name+" "))
+		if i < 0 {
+			// The capability ends the list.
+			i = len(list) - start - len(name) - 1
+		}
+		i += start
+
+		replaced := make([]byte, 0, len(line)+len(replacement))
+		replaced = append(replaced, line[:i]...)
+		if replacement != "" {
+			replaced = append(replaced, ' ')
+			replaced = append(replaced, replacement...)
+		}
+		replaced = append(replaced, line[i+1+len(name):]...)
+
+		return replaced, true
+	}
+
+	return nil, false
+}
+
+// advertiseQuota adds the quota capabilities at the end of a response line listing the
+// capabilities, either a CAPABILITY response or a CAPABILITY response code.
+func advertiseQuota(line []byte) ([]byte, bool) {
+	var end int
+	if bytes.HasPrefix(line, []byte("* CAPABILITY ")) {
+		end = len(bytes.TrimRight(line, "\r\n"))
+	} else {
+		i := bytes.Index(line, []byte(" [CAPABILITY "))
+		if i < 0 {
+			return nil, false
+		}
+		j := bytes.IndexByte(line[i:], ']')
+		if j < 0 {
+			return nil, false
+		}
+		end = i + j
+	}
+
+	advertised := make([]byte, 0, len(line)+len(quotaCapabilities))
+	advertised = append(advertised, line[:end]...)
+	advertised = append(advertised, quotaCapabilities...)
+	advertised = append(advertised, line[end:]...)
+
+	return advertised, true
+}
+
+// quotaResources formats the limited resources of a quota as in a QUOTA response, with storage
+// in units of 1024 octets, or returns "" when nothing is limited.
+func quotaResources(q connector.Quota) string {
+	var resources []string
+	if q.StorageLimit > 0 {
+		resources = append(resources, fmt.Sprintf("STORAGE %d %d", (q.Storage+1023)/1024, q.StorageLimit/1024))
+	}
+	if q.MessageLimit > 0 {
+		resources = append(resources, fmt.Sprintf("MESSAGE %d %d", q.Messages, q.MessageLimit))
+	}
+	return strings.Join(resources, " ")
+}
+
+// remoteIP returns the IP of a TCP client, or "" for other connections.
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return ""
+}
+
+// decodeMailboxName returns the name Gluon stores for a mailbox name sent by a client, decoded the
+// way Gluon's sessions decode it: INBOX in upper case before its children, modified UTF-7 decoded.
+// A name that cannot be decoded is returned empty.
+func decodeMailboxName(name string) string {
+	if parent, child, ok := strings.Cut(name, mailboxDelimiter); ok && strings.EqualFold(parent, "INBOX") {
+		name = "INBOX" + mailboxDelimiter + child
+	}
+
+	decoded, err := utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return ""
+	}
+	return decoded
+}
+
+// quoteString formats s as an IMAP quoted string.
+func quoteString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// literalLength returns the size of the literal announced at the end of a line, as in "{12}" or "{12+}".
+func literalLength(line []byte) (int, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if !bytes.HasSuffix(line, []byte("}")) {
+		return 0, false
+	}
+
+	open := bytes.LastIndexByte(line, '{')
+	if open < 0 {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(string(bytes.TrimSuffix(line[open+1:len(line)-1], []byte("+"))))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// parseAString parses an IMAP astring (atom, quoted string or literal) at the start of b
+// and returns its value and what follows it.
+func parseAString(b []byte) ([]byte, []byte, bool) {
+	b = bytes.TrimLeft(b, " ")
+	if len(b) == 0 {
+		return nil, nil, false
+	}
+
+	switch b[0] {
+	case '"':
+		var value []byte
+		for i := 1; i < len(b); i++ {
+			switch b[i] {
+			case '\\':
+				if i+1 == len(b) {
+					return nil, nil, false
+				}
+				i++
+				value = append(value, b[i])
+			case '"':
+				return value, b[i+1:], true
+			default:
+				value = append(value, b[i])
+			}
+		}
+		return nil, nil, false
+
+	case '{':
+		end := bytes.Index(b, []byte("}\r\n"))
+		if end < 0 {
+			return nil, nil, false
+		}
+		n, ok := literalLength(b[:end+3])
+		if !ok || len(b) < end+3+n {
+			return nil, nil, false
+		}
+		start := end + 3
+		return b[start : start+n], b[start+n:], true
+
+	default:
+		end := bytes.IndexAny(b, " \r\n")
+		if end < 0 {
+			end = len(b)
+		}
+		return b[:end], b[end:], true
+	}
+}
+
+// decodeSASLPlain decodes a PLAIN response: base64 of "authzid\0authcid\0password".
+// Credentials with a line break are rejected, as they cannot be handed to Gluon in a LOGIN line.
+func decodeSASLPlain(response []byte) ([]byte, []byte, bool) {
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(response)))
+	n, err := base64.StdEncoding.Decode(decoded, response)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	parts := bytes.Split(decoded[:n], []byte{0})
+	if len(parts) != 3 || bytes.ContainsAny(parts[1], "\r\n") || bytes.ContainsAny(parts[2], "\r\n") {
+		return nil, nil, false
+	}
+
+	return parts[1], parts[2], true
+}
@@ -0,0 +1,724 @@
+package imap
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gluon/imap/command"
+	factory "github.com/enjoys-in/airsend-imap/internal/core/imap"
+)
+
+// fakeGluon stands in for Gluon behind a loginConn. It records every command it receives,
+// literals included, accepts a LOGIN whose password is "secret", refuses a STORE of "$Refused" and
+// answers anything else OK.
+// Like Gluon with a certificate, it advertises STARTTLS whatever the connection.
+func fakeGluon(conn net.Conn, received chan<- string) {
+	r := bufio.NewReader(conn)
+	for {
+		var command string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(received)
+				return
+			}
+			command += line
+
+			n, ok := literalLength([]byte(line))
+			if !ok {
+				break
+			}
+			if !strings.HasSuffix(strings.TrimRight(line, "\r\n"), "+}") {
+				_, _ = conn.Write([]byte("+ Ready\r\n"))
+			}
+			literal := make([]byte, n)
+			if _, err := io.ReadFull(r, literal); err != nil {
+				close(received)
+				return
+			}
+			command += string(literal)
+		}
+		received <- command
+
+		tag, rest, _ := strings.Cut(strings.TrimRight(command, "\r\n"), " ")
+		name, args, _ := strings.Cut(rest, " ")
+		reply := tag + " OK Completed\r\n"
+		if strings.EqualFold(name, "LOGIN") {
+			_, rest, _ := parseAString([]byte(args))
+			if password, _, _ := parseAString(rest); string(password) == "secret" {
+				reply = tag + " OK [CAPABILITY IDLE IMAP4rev1 STARTTLS] Logged in\r\n"
+			} else {
+				reply = tag + " NO [AUTHENTICATIONFAILED] Invalid credentials\r\n"
+			}
+		}
+		if strings.Contains(args, "$Refused") {
+			reply = tag + " NO Refused\r\n"
+		}
+		if strings.EqualFold(name, "CAPABILITY") {
+			_, _ = conn.Write([]byte("* CAPABILITY AUTH=PLAIN ID IMAP4rev1 STARTTLS\r\n"))
+		}
+		_, _ = conn.Write([]byte(reply))
+	}
+}
+
+// fakeGuard records the logins it is asked about and refuses those of locked accounts.
+type fakeGuard struct {
+	mu        sync.Mutex
+	locked    []string
+	checks    []string
+	failures  []string
+	successes []string
+}
+
+func (g *fakeGuard) Check(account, ip string) (time.Duration, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.checks = append(g.checks, account)
+	if slices.Contains(g.locked, account) {
+		return 0, errors.New("locked")
+	}
+	return 0, nil
+}
+
+func (g *fakeGuard) Failure(ctx context.Context, account, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.failures = append(g.failures, account)
+}
+
+func (g *fakeGuard) Success(account string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.successes = append(g.successes, account)
+}
+
+func (g *fakeGuard) calls() (checks, failures, successes []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return slices.Clone(g.checks), slices.Clone(g.failures), slices.Clone(g.successes)
+}
+
+// testSession is a client talking to a fake Gluon through a loginConn.
+type testSession struct {
+	t        *testing.T
+	client   net.Conn
+	reader   *bufio.Reader
+	conn     *loginConn
+	received chan string
+	logins   chan string // Credentials the login hook was called with, as "username:password"
+	ticket   []byte      // Returned by the login hook
+}
+
+func newTestSession(t *testing.T, guard LoginGuard, endpoint Endpoint) *testSession {
+	t.Helper()
+
+	return startTestSession(t, func(server net.Conn, hook LoginHook) *loginConn {
+		return newLoginConn(server, hook, nil, guard, nil, nil, nil, endpoint)
+	})
+}
+
+// newKeywordsSession starts a session whose accepted STOREs are sent to stores.
+func newKeywordsSession(t *testing.T, stores chan<- factory.KeywordStore) *testSession {
+	t.Helper()
+
+	keywords := func(ctx context.Context, username string, store factory.KeywordStore) error {
+		if username != "alice" {
+			t.Errorf("keywords stored for %q, want alice", username)
+		}
+		stores <- store
+		return nil
+	}
+	return startTestSession(t, func(server net.Conn, hook LoginHook) *loginConn {
+		return newLoginConn(server, hook, nil, nil, nil, nil, keywords, Endpoint{Name: "imap"})
+	})
+}
+
+func startTestSession(t *testing.T, newConn func(server net.Conn, hook LoginHook) *loginConn) *testSession {
+	t.Helper()
+
+	client, server := net.Pipe()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	s := &testSession{
+		t:        t,
+		client:   client,
+		reader:   bufio.NewReader(client),
+		received: make(chan string, 16),
+		logins:   make(chan string, 16),
+	}
+	hook := func(ctx context.Context, username string, password []byte) []byte {
+		s.logins <- username + ":" + string(password)
+		return s.ticket
+	}
+	s.conn = newConn(server, hook)
+
+	go fakeGluon(s.conn, s.received)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = s.conn.Close()
+	})
+
+	return s
+}
+
+func (s *testSession) send(input string) {
+	s.t.Helper()
+
+	if _, err := s.client.Write([]byte(input)); err != nil {
+		s.t.Fatalf("send %q: %v", abbreviate(input), err)
+	}
+}
+
+// sendAsync sends input without waiting for it to be read, for input the connection may not
+// read in full before it answers.
+func (s *testSession) sendAsync(input string) {
+	go func() {
+		_, _ = s.client.Write([]byte(input))
+	}()
+}
+
+// expect reads the next response line and checks that it starts with prefix.
+func (s *testSession) expect(prefix string) {
+	s.t.Helper()
+
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		s.t.Fatalf("waiting for %q: %v", prefix, err)
+	}
+	if !strings.HasPrefix(line, prefix) {
+		s.t.Fatalf("got %q, want %q", line, prefix)
+	}
+}
+
+// expectGluon checks the next command Gluon received.
+func (s *testSession) expectGluon(want string) {
+	s.t.Helper()
+
+	select {
+	case got, ok := <-s.received:
+		if !ok {
+			s.t.Fatalf("connection closed, want %q to reach Gluon", abbreviate(want))
+		}
+		if got != want {
+			s.t.Fatalf("Gluon received %q, want %q", abbreviate(got), abbreviate(want))
+		}
+	case <-time.After(5 * time.Second):
+		s.t.Fatalf("%q never reached Gluon", abbreviate(want))
+	}
+}
+
+// expectClosed checks that the connection to Gluon ends without Gluon receiving anything more.
+func (s *testSession) expectClosed() {
+	s.t.Helper()
+
+	select {
+	case got, ok := <-s.received:
+		if ok {
+			s.t.Fatalf("Gluon received %q, want the connection closed", abbreviate(got))
+		}
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("the connection was not closed")
+	}
+}
+
+// abbreviate shortens long input in test failures.
+func abbreviate(s string) string {
+	if len(s) > 80 {
+		return s[:80] + "..."
+	}
+	return s
+}
+
+func plain(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+}
+
+func TestLoginConnAuthenticatePlain(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string // Start of the reply to the AUTHENTICATE
+		gluon    string // LOGIN handed to Gluon, if any
+		failed   bool
+	}{
+		{
+			name:     "inline",
+			response: plain("alice", "secret"),
+			want:     "a OK",
+			gluon:    "a LOGIN \"alice\" \"secret\"\r\n",
+		},
+		{
+			name:     "wrong password",
+			response: plain("alice", "wrong"),
+			want:     "a NO",
+			gluon:    "a LOGIN \"alice\" \"wrong\"\r\n",
+			failed:   true,
+		},
+		{
+			name:     "quotes and backslashes",
+			response: plain(`al"ice`, `se\cret`),
+			want:     "a NO",
+			gluon:    "a LOGIN \"al\\\"ice\" \"se\\\\cret\"\r\n",
+			failed:   true,
+		},
+		{
+			name:     "password with a line break",
+			response: plain("alice", "x\r\nb LOGIN alice guess1\r\nc LOGIN alice guess2"),
+			want:     "a BAD",
+		},
+		{
+			name:     "username with a line feed",
+			response: plain("alice\nb LOGIN alice guess", "x"),
+			want:     "a BAD",
+		},
+		{
+			name:     "not base64",
+			response: "not base64!",
+			want:     "a BAD",
+		},
+		{
+			name:     "cancelled",
+			response: "*",
+			want:     "a BAD",
+		},
+	}
+	for _, tt := range tests {
+		for _, inline := range []bool{true, false} {
+			t.Run(tt.name, func(t *testing.T) {
+				if inline && tt.response == "*" {
+					t.Skip("only a response sent as a continuation cancels")
+				}
+
+				guard := &fakeGuard{}
+				s := newTestSession(t, guard, Endpoint{Name: "imap"})
+
+				if inline {
+					s.send("a AUTHENTICATE PLAIN " + tt.response + "\r\n")
+				} else {
+					s.send("a AUTHENTICATE PLAIN\r\n")
+					s.expect("+ ")
+					s.send(tt.response + "\r\n")
+				}
+				s.expect(tt.want)
+				if tt.gluon != "" {
+					s.expectGluon(tt.gluon)
+				}
+
+				// Nothing of a refused response reaches Gluon, so this is the next thing it sees.
+				s.send("z NOOP\r\n")
+				s.expectGluon("z NOOP\r\n")
+				s.expect("z OK")
+
+				checks, failures, successes := guard.calls()
+				switch {
+				case tt.gluon == "" && len(checks) > 0:
+					t.Errorf("refused response checked by the guard: %q", checks)
+				case tt.gluon != "" && len(checks) != 1:
+					t.Errorf("guard checks = %q, want one", checks)
+				case tt.failed && len(failures) != 1:
+					t.Errorf("guard failures = %q, want one", failures)
+				case tt.gluon != "" && !tt.failed && len(successes) != 1:
+					t.Errorf("guard successes = %q, want one", successes)
+				}
+			})
+		}
+	}
+}
+
+func TestLoginConnLoginLiterals(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []string // Client input, each but the last answered by a continuation request
+		gluon    string
+		login    string
+		response string
+	}{
+		{
+			name:     "quoted",
+			steps:    []string{"a LOGIN \"alice\" \"secret\"\r\n"},
+			gluon:    "a LOGIN \"alice\" \"secret\"\r\n",
+			login:    "alice:secret",
+			response: "a OK",
+		},
+		{
+			name:     "synchronizing literals",
+			steps:    []string{"a LOGIN {5}\r\n", "alice {6}\r\n", "secret\r\n"},
+			gluon:    "a LOGIN {5}\r\nalice {6}\r\nsecret\r\n",
+			login:    "alice:secret",
+			response: "a OK",
+		},
+		{
+			name:     "non-synchronizing literals",
+			steps:    []string{"a LOGIN {5+}\r\nalice {6+}\r\nsec\r\nt\r\n"},
+			gluon:    "a LOGIN {5+}\r\nalice {6+}\r\nsec\r\nt\r\n",
+			login:    "alice:sec\r\nt",
+			response: "a NO",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard := &fakeGuard{}
+			s := newTestSession(t, guard, Endpoint{Name: "imap"})
+
+			for i, step := range tt.steps {
+				s.send(step)
+				if i < len(tt.steps)-1 {
+					s.expect("+ ")
+				}
+			}
+			s.expectGluon(tt.gluon)
+			s.expect(tt.response)
+
+			if login := <-s.logins; login != tt.login {
+				t.Errorf("login hook called with %q, want %q", login, tt.login)
+			}
+			if checks, _, _ := guard.calls(); !slices.Equal(checks, []string{"alice"}) {
+				t.Errorf("guard checks = %q", checks)
+			}
+		})
+	}
+}
+
+func TestLoginConnTicket(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string // Client input, each but the last answered by a continuation request
+		gluon string
+	}{
+		{
+			name:  "LOGIN",
+			steps: []string{"a LOGIN alice wrong\r\n"},
+			gluon: "a LOGIN \"alice\" \"secret\"\r\n",
+		},
+		{
+			name:  "AUTHENTICATE PLAIN",
+			steps: []string{"a AUTHENTICATE PLAIN " + plain("alice", "wrong") + "\r\n"},
+			gluon: "a LOGIN \"alice\" \"secret\"\r\n",
+		},
+		{
+			// Gluon has seen the username already, the password cannot be replaced.
+			name:  "LOGIN with literals",
+			steps: []string{"a LOGIN {5}\r\n", "alice wrong\r\n"},
+			gluon: "a LOGIN {5}\r\nalice wrong\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(t, nil, Endpoint{Name: "imap"})
+			s.ticket = []byte("secret")
+
+			for i, step := range tt.steps {
+				s.send(step)
+				if i < len(tt.steps)-1 {
+					s.expect("+ ")
+				}
+			}
+			s.expectGluon(tt.gluon)
+			if login := <-s.logins; login != "alice:wrong" {
+				t.Errorf("login hook called with %q, want %q", login, "alice:wrong")
+			}
+		})
+	}
+}
+
+func TestLoginConnRefusesMalformedLogin(t *testing.T) {
+	guard := &fakeGuard{}
+	s := newTestSession(t, guard, Endpoint{Name: "imap"})
+
+	s.send("a LOGIN \"alice secret\r\n")
+	s.expect("a BAD")
+	s.send("b LOGIN {5+}\r\nalice \"secret\r\n")
+	s.expect("* BYE")
+	s.expectClosed()
+	if checks, _, _ := guard.calls(); len(checks) > 0 {
+		t.Errorf("malformed logins checked by the guard: %q", checks)
+	}
+}
+
+func TestLoginConnLockedOut(t *testing.T) {
+	guard := &fakeGuard{locked: []string{"alice"}}
+	s := newTestSession(t, guard, Endpoint{Name: "imap"})
+
+	s.send("a LOGIN alice secret\r\n")
+	s.expect("a NO [UNAVAILABLE]")
+	s.send("b AUTHENTICATE PLAIN " + plain("alice", "secret") + "\r\n")
+	s.expect("b NO [UNAVAILABLE]")
+
+	s.send("c NOOP\r\n")
+	s.expectGluon("c NOOP\r\n")
+}
+
+func TestLoginConnPipelining(t *testing.T) {
+	guard := &fakeGuard{}
+	s := newTestSession(t, guard, Endpoint{Name: "imap"})
+
+	s.send("a CAPABILITY\r\nb LOGIN alice wrong\r\nc LOGIN alice secret\r\nd SELECT INBOX\r\n")
+	for _, tt := range []struct {
+		command string
+		replies []string
+	}{
+		{"a CAPABILITY\r\n", []string{"* CAPABILITY AUTH=PLAIN ID IMAP4rev1\r\n", "a OK"}},
+		{"b LOGIN alice wrong\r\n", []string{"b NO"}},
+		{"c LOGIN alice secret\r\n", []string{"c OK"}},
+		{"d SELECT INBOX\r\n", []string{"d OK"}},
+	} {
+		s.expectGluon(tt.command)
+		for _, reply := range tt.replies {
+			s.expect(reply)
+		}
+	}
+
+	checks, failures, successes := guard.calls()
+	if len(checks) != 2 || len(failures) != 1 || len(successes) != 1 {
+		t.Errorf("guard checks %q, failures %q, successes %q", checks, failures, successes)
+	}
+}
+
+func TestLoginConnLongLines(t *testing.T) {
+	long := "a NOOP " + strings.Repeat("x", preAuthReaderSize) + "\r\n"
+
+	t.Run("before login", func(t *testing.T) {
+		s := newTestSession(t, &fakeGuard{}, Endpoint{Name: "imap"})
+
+		s.sendAsync(long)
+		s.expect("* BYE")
+		s.expectClosed()
+	})
+
+	t.Run("too much input before login", func(t *testing.T) {
+		s := newTestSession(t, &fakeGuard{}, Endpoint{Name: "imap"})
+
+		s.sendAsync("a ID {70000+}\r\n" + strings.Repeat("x", 70000) + "\r\n")
+		s.expect("* BYE")
+	})
+
+	t.Run("without logins to follow", func(t *testing.T) {
+		s := newTestSession(t, nil, Endpoint{Name: "imap"})
+
+		s.sendAsync(long)
+		s.expectGluon(long)
+		s.expect("a OK")
+	})
+
+	t.Run("after login", func(t *testing.T) {
+		s := newTestSession(t, &fakeGuard{}, Endpoint{Name: "imap"})
+
+		s.send("a LOGIN alice secret\r\n")
+		s.expectGluon("a LOGIN alice secret\r\n")
+		s.expect("a OK")
+
+		s.sendAsync(long)
+		s.expectGluon(long)
+		s.expect("a OK")
+		s.send("b NOOP\r\n")
+		s.expectGluon("b NOOP\r\n")
+		s.expect("b OK")
+	})
+}
+
+func TestLoginConnStartTLS(t *testing.T) {
+	guard := &fakeGuard{}
+	s := newTestSession(t, guard, Endpoint{Name: "imap", StartTLS: testTLSConfig(t)})
+
+	s.send("a STARTTLS\r\n")
+	s.expect("a OK")
+
+	tlsClient := tls.Client(s.client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.conn.TLSActive() {
+		t.Error("TLS is not active after STARTTLS")
+	}
+	s.client, s.reader = tlsClient, bufio.NewReader(tlsClient)
+
+	s.send("b STARTTLS\r\n")
+	s.expect("b BAD")
+	s.send("c LOGIN alice secret\r\n")
+	s.expectGluon("c LOGIN alice secret\r\n")
+	s.expect("c OK")
+
+	if _, _, successes := guard.calls(); !slices.Equal(successes, []string{"alice"}) {
+		t.Errorf("guard successes = %q", successes)
+	}
+}
+
+// testTLSConfig returns a server configuration with a self-signed certificate.
+func TestLoginConnRequireTLS(t *testing.T) {
+	guard := &fakeGuard{}
+	s := newTestSession(t, guard, Endpoint{Name: "imap", StartTLS: testTLSConfig(t), RequireTLS: true})
+
+	s.send("a CAPABILITY\r\n")
+	s.expectGluon("a CAPABILITY\r\n")
+	s.expect("* CAPABILITY LOGINDISABLED ID IMAP4rev1 STARTTLS\r\n")
+	s.expect("a OK")
+
+	s.send("b LOGIN alice secret\r\n")
+	s.expect("b NO [PRIVACYREQUIRED]")
+	s.send("c AUTHENTICATE PLAIN " + plain("alice", "secret") + "\r\n")
+	s.expect("c NO [PRIVACYREQUIRED]")
+	s.send("d AUTHENTICATE PLAIN\r\n")
+	s.expect("d NO [PRIVACYREQUIRED]")
+
+	// A login with a literal already reached Gluon in part, so the connection ends.
+	s.send("e LOGIN {5}\r\n")
+	s.expect("+ Ready")
+	s.sendAsync("alice secret\r\n")
+	s.expect("* BYE")
+	s.expectClosed()
+
+	if checks, _, _ := guard.calls(); len(checks) > 0 {
+		t.Errorf("guard checks = %q, want none before TLS", checks)
+	}
+
+	s = newTestSession(t, guard, Endpoint{Name: "imap", StartTLS: testTLSConfig(t), RequireTLS: true})
+	s.send("a STARTTLS\r\n")
+	s.expect("a OK")
+
+	tlsClient := tls.Client(s.client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	s.client, s.reader = tlsClient, bufio.NewReader(tlsClient)
+
+	s.send("b CAPABILITY\r\n")
+	s.expectGluon("b CAPABILITY\r\n")
+	s.expect("* CAPABILITY AUTH=PLAIN ID IMAP4rev1\r\n")
+	s.expect("b OK")
+
+	s.send("c LOGIN alice secret\r\n")
+	s.expectGluon("c LOGIN alice secret\r\n")
+	s.expect("c OK [CAPABILITY IDLE IMAP4rev1] Logged in\r\n")
+}
+
+func TestLoginConnKeywords(t *testing.T) {
+	stores := make(chan factory.KeywordStore, 16)
+	s := newKeywordsSession(t, stores)
+
+	s.send("a LOGIN alice secret\r\n")
+	s.expectGluon("a LOGIN alice secret\r\n")
+	s.expect("a OK")
+
+	for _, tt := range []struct {
+		command string
+		store   *factory.KeywordStore // Handed to the hook, nil when none is
+	}{
+		{"b STORE 1 +FLAGS ($Important)\r\n", nil}, // Nothing selected yet
+		{"c SELECT inbox/&AMk-t&AOk-\r\n", nil},
+		{"d UID STORE 2:* -FLAGS.SILENT (\\Seen $Pinned)\r\n", &factory.KeywordStore{
+			Mailbox: "INBOX/Été", UID: true, Set: []command.SeqRange{{Begin: 2, End: 0}},
+			Action: command.StoreActionRemFlags, Flags: []string{`\Seen`, "$Pinned"},
+		}},
+		{"e STORE 1,3 FLAGS (work)\r\n", &factory.KeywordStore{
+			Mailbox: "INBOX/Été", Set: []command.SeqRange{{Begin: 1, End: 1}, {Begin: 3, End: 3}},
+			Action: command.StoreActionSetFlags, Flags: []string{"work"},
+		}},
+		{"f STORE 1 +FLAGS ($Refused)\r\n", nil},
+		{"g EXAMINE {5}\r\n", nil},
+		{"Trash\r\n", nil},
+		{"h STORE 1 +FLAGS ($Important)\r\n", nil}, // The mailbox of a literal is not known
+		{"i EXAMINE Archive\r\n", nil},
+		{"j STORE 1 +FLAGS ($Important)\r\n", &factory.KeywordStore{
+			Mailbox: "Archive", Set: []command.SeqRange{{Begin: 1, End: 1}},
+			Action: command.StoreActionAddFlags, Flags: []string{"$Important"},
+		}},
+	} {
+		s.send(tt.command)
+		if strings.HasSuffix(tt.command, "}\r\n") {
+			s.expect("+ Ready")
+			continue
+		}
+		tag, _, _ := strings.Cut(tt.command, " ")
+		if tag == "Trash\r\n" {
+			s.expectGluon("g EXAMINE {5}\r\nTrash\r\n")
+			s.expect("g OK")
+			continue
+		}
+		s.expectGluon(tt.command)
+		s.expect(tag + " ")
+
+		select {
+		case store := <-stores:
+			if tt.store == nil {
+				t.Errorf("%q stored %+v", tt.command, store)
+			} else if !reflect.DeepEqual(store, *tt.store) {
+				t.Errorf("%q stored %+v, want %+v", tt.command, store, *tt.store)
+			}
+		default:
+			if tt.store != nil {
+				t.Errorf("%q stored nothing, want %+v", tt.command, *tt.store)
+			}
+		}
+	}
+}
+
+func TestReplaceCapability(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		capability  string
+		replacement string
+		want        string
+	}{
+		{"response", "* CAPABILITY AUTH=PLAIN IMAP4rev1 STARTTLS\r\n", "STARTTLS", "", "* CAPABILITY AUTH=PLAIN IMAP4rev1\r\n"},
+		{"first", "* CAPABILITY AUTH=PLAIN IMAP4rev1\r\n", "AUTH=PLAIN", "LOGINDISABLED", "* CAPABILITY LOGINDISABLED IMAP4rev1\r\n"},
+		{"only", "* CAPABILITY STARTTLS\r\n", "STARTTLS", "", "* CAPABILITY\r\n"},
+		{"response code", "* OK [CAPABILITY IMAP4rev1 STARTTLS UIDPLUS] Ready\r\n", "STARTTLS", "", "* OK [CAPABILITY IMAP4rev1 UIDPLUS] Ready\r\n"},
+		{"last in code", "a OK [CAPABILITY IMAP4rev1 STARTTLS] Logged in\r\n", "STARTTLS", "", "a OK [CAPABILITY IMAP4rev1] Logged in\r\n"},
+		{"prefix of another", "* CAPABILITY AUTH=PLAINX IMAP4rev1\r\n", "AUTH=PLAIN", "LOGINDISABLED", ""},
+		{"outside the list", "* OK [CAPABILITY IMAP4rev1] STARTTLS\r\n", "STARTTLS", "", ""},
+		{"no capabilities", "* OK STARTTLS\r\n", "STARTTLS", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := replaceCapability([]byte(tt.line), tt.capability, tt.replacement)
+			if ok != (tt.want != "") || string(got) != tt.want {
+				t.Errorf("replaceCapability(%q) = %q, %v; want %q", tt.line, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "imap.example.com"},
+		DNSNames:     []string{"imap.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,21 +17,60 @@ import (
 )
 
 // main is the entry point of the program, responsible for starting the IMAP and HTTP APIs
-// in parallel and gracefully shutting down on Ctrl+C or SIGTERM.
+// in parallel and gracefully shutting down on Ctrl+C or SIGTERM. When either service stops,
+// the other one is shut down as well. The database is closed last, and the process exits
+// with a non-zero code if anything failed.
 func main() {
 	app := wireframe.InitWireframe()
-	defer app.DB.Close()
+
+	// The root context is cancelled on the first signal; a second one kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
 
 	// Run IMAP and HTTP in parallel
-	go imap.RunImap(app)
-	go api.RunHttpApi(app)
+	run := func(name string, service func(context.Context, *wireframe.AppWireframe) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stop()
+
+			if err := service(ctx, app); err != nil {
+				log.Printf("❌ %s: %v", name, err)
+
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// The login ban list is reloaded and stale login failures are forgotten in the background.
+	go app.Lockout.Run(ctx, time.Minute)
+	// Tenants are reloaded so renewed certificates and missed changes are picked up.
+	go app.Tenants.Run(ctx, time.Minute)
+
+	run("IMAP", imap.RunImap)
+	run("HTTP", api.RunHttpApi)
 
-	time.Sleep(2 * time.Second)
-	// Graceful shutdown
 	log.Println("🧩 Services started. Press Ctrl+C to stop.")
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	<-ctx.Done()
 
 	log.Println("🛑 Shutting down gracefully...")
+	wg.Wait()
+
+	if err := app.DB.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("DB: %w", err))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("❌ Shutdown finished with errors: %v", err)
+		os.Exit(1)
+	}
+	log.Println("✅ Shutdown complete")
 }
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 
@@ -8,15 +11,12 @@ import (
 	"github.com/enjoys-in/airsend-imap/cmd/wireframe"
 )
 
-// RunHttpApis sets up an HTTP API server with a single endpoint at /login
-// for user login. It uses the AuthHandler.UserLogin function to handle the
-// request. The server is started on port 8080 and runs until
-// interrupted by Ctrl+C or SIGTERM. If the server stops due to an
-// error, it logs the error and exits.
-func RunHttpApi(app *wireframe.AppWireframe) {
-
-	defer app.DB.Close()
-
+// RunHttpApi sets up the HTTP API server and serves it on port 9000 until
+// ctx is cancelled. It then stops accepting requests and waits for the
+// in-flight ones within the configured shutdown deadline. It returns an
+// error if the server cannot start or does not shut down cleanly. The
+// database is owned by the caller and is not closed here.
+func RunHttpApi(ctx context.Context, app *wireframe.AppWireframe) error {
 	mux := routes.InitRoutes(app)
 
 	port := ":9000"
@@ -26,8 +26,28 @@ func RunHttpApi(app *wireframe.AppWireframe) {
 		Handler: mux,
 	}
 
-	log.Println("🚀 HTTP API running on :9000")
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("❌ HTTP server failed: %v", err)
+	errCh := make(chan error, 1)
+	go func() {
+		log.Println("🚀 HTTP API running on :9000")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("HTTP server failed: %w", err)
+		}
+		close(errCh)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
 	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), app.Config.API.SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("HTTP server shutdown: %w", err)
+	}
+	log.Println("🛑 HTTP API stopped")
+
+	return <-errCh
 }
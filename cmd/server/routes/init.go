@@ -1,22 +1,45 @@
 package routes
 
 import (
-	"github.com/enjoys-in/airsend-imap/cmd/wireframe"
 	"net/http"
+
+	"github.com/enjoys-in/airsend-imap/cmd/wireframe"
+	factory "github.com/enjoys-in/airsend-imap/internal/core/imap"
 )
 
 func InitRoutes(app *wireframe.AppWireframe) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/login", app.Handler.AuthHandler.UserLogin)
+	auth := app.Handler.AuthHandler
+	mux.HandleFunc("/login", auth.UserLogin)
+	mux.HandleFunc("/auth/refresh", auth.RefreshToken)
+
+	// Routes acting for a logged in user need a valid access token
+	mux.HandleFunc("/auth/logout", auth.RequireToken(auth.Logout))
+	mux.HandleFunc("/auth/me", auth.RequireToken(auth.Me))
+
+	appPasswords := app.Handler.AppPasswordHandler
+	mux.HandleFunc("GET /auth/app-passwords", auth.RequireToken(appPasswords.List))
+	mux.HandleFunc("POST /auth/app-passwords", auth.RequireToken(appPasswords.Create))
+	mux.HandleFunc("DELETE /auth/app-passwords/{id}", auth.RequireToken(appPasswords.Revoke))
 
-	// mux.HandleFunc("/api/imap/users/add", api.authMiddleware(api.handleAddUser))
-	// mux.HandleFunc("/api/imap/users/add-batch", api.authMiddleware(api.handleAddUserBatch))
-	// mux.HandleFunc("/api/imap/users/remove", api.authMiddleware(api.handleRemoveUser))
-	// mux.HandleFunc("/api/imap/users/list", api.authMiddleware(api.handleListUsers))
-	// mux.HandleFunc("/api/imap/users/check", api.authMiddleware(api.handleCheckUser))
+	// Admin API for the IMAP users, protected by IMAP_API_KEY
+	api := factory.NewAPIServer(app.ConnectorFactory, app.Config.API.IMAP_API_KEY, app.Lockout, app.Tenants)
+	mux.HandleFunc("/api/imap/users/add", api.Protected(api.HandleAddUser))
+	mux.HandleFunc("/api/imap/users/add-batch", api.Protected(api.HandleAddUserBatch))
+	mux.HandleFunc("/api/imap/users/remove", api.Protected(api.HandleRemoveUser))
+	mux.HandleFunc("/api/imap/users/list", api.Protected(api.HandleListUsers))
+	mux.HandleFunc("/api/imap/users/check", api.Protected(api.HandleCheckUser))
+	mux.HandleFunc("/api/imap/users/sync", api.Protected(api.HandleSyncUser))
+	mux.HandleFunc("/api/imap/users/sessions", api.Protected(api.HandleListSessions))
+	mux.HandleFunc("/api/imap/users/disconnect", api.Protected(api.HandleDisconnectUser))
+	mux.HandleFunc("/api/imap/lockouts", api.Protected(api.HandleListLockouts))
+	mux.HandleFunc("/api/imap/lockouts/clear", api.Protected(api.HandleClearLockout))
+	mux.HandleFunc("/api/imap/lockouts/ban", api.Protected(api.HandleBan))
+	mux.HandleFunc("/api/imap/tenants", api.Protected(api.HandleListTenants))
+	mux.HandleFunc("/api/imap/tenants/disconnect", api.Protected(api.HandleDisconnectTenant))
 
-	// // Public endpoint (no auth)
-	// mux.HandleFunc("/api/imap/status", api.handleStatus)
+	// Public endpoint (no auth)
+	mux.HandleFunc("/api/imap/status", api.RateLimitMiddleware(api.HandleStatus))
 
 	// Health check
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
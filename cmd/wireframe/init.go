@@ -1,13 +1,20 @@
 package wireframe
 
 import (
+	"context"
 	"log"
+	"sync/atomic"
 
 	"github.com/enjoys-in/airsend-imap/config"
 	"github.com/enjoys-in/airsend-imap/internal/core/api/handlers"
 	"github.com/enjoys-in/airsend-imap/internal/core/api/repository"
 	"github.com/enjoys-in/airsend-imap/internal/core/api/services"
+	factory "github.com/enjoys-in/airsend-imap/internal/core/imap"
+	"github.com/enjoys-in/airsend-imap/internal/core/lockout"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/enjoys-in/airsend-imap/internal/core/tenant"
 	plugins "github.com/enjoys-in/airsend-imap/internal/plugins/postgres"
+	"github.com/enjoys-in/airsend-imap/internal/utils/encryption"
 )
 
 type AppWireframe struct {
@@ -16,12 +23,27 @@ type AppWireframe struct {
 	Repository *repository.Repository
 	Service    *services.ConcreteServices
 	Handler    *handlers.Handlers
+	Lockout    *lockout.Tracker // Failed logins over IMAP and HTTP
+	Tenants    *tenant.Registry // Per-tenant IMAP access, certificates and limits
+
+	connectors atomic.Pointer[factory.ConnectorFactory] // Set by the IMAP server while it is serving
+}
+
+// SetConnectorFactory publishes the connectors of the running IMAP server, or withdraws them with nil.
+func (app *AppWireframe) SetConnectorFactory(cf *factory.ConnectorFactory) {
+	app.connectors.Store(cf)
+}
+
+// ConnectorFactory returns the connectors of the running IMAP server, or nil while it is not serving.
+func (app *AppWireframe) ConnectorFactory() *factory.ConnectorFactory {
+	return app.connectors.Load()
 }
 
 // InitWireframe initializes the application by creating a DB connection,
-// a repository, a service and a handler. It returns an App struct
-// containing all the necessary components. If the DB connection fails,
-// it logs an error and exits.
+// applying pending schema migrations, selecting the password scheme, and
+// creating the login failure tracker, the tenant registry, a repository, a service and a handler. It returns an App struct containing all the necessary
+// components. If the DB connection or a migration fails, it logs an error
+// and exits.
 func InitWireframe() *AppWireframe {
 	cfg := config.GetConfig()
 	db, err := plugins.CreateDBConnection(cfg.DB.DBHost, cfg.DB.DBPort, cfg.DB.DBUser, cfg.DB.DBPassword, cfg.DB.DBName, cfg.DB.DBSSLMode)
@@ -29,8 +51,34 @@ func InitWireframe() *AppWireframe {
 		log.Fatal("❌ Failed to connect DB:", err)
 	}
 
+	if err := queries.MigrateUp(context.Background(), db.Conn); err != nil {
+		log.Fatal("❌ Failed to migrate DB:", err)
+	}
+
+	if err := encryption.SetPreferredPasswordScheme(cfg.API.PASSWORD_SCHEME); err != nil {
+		log.Printf("⚠️ Keeping the default password scheme: %v", err)
+	}
+
+	tracker := lockout.NewTracker(lockout.Config{
+		AccountLimit: cfg.API.LOGIN_ACCOUNT_LIMIT,
+		IPLimit:      cfg.API.LOGIN_IP_LIMIT,
+		BaseDelay:    cfg.API.LOGIN_BASE_DELAY,
+		MaxDelay:     cfg.API.LOGIN_MAX_DELAY,
+		Lockout:      cfg.API.LOGIN_LOCKOUT,
+		Window:       cfg.API.LOGIN_FAILURE_WINDOW,
+		BanAfter:     cfg.API.LOGIN_BAN_AFTER,
+		BanDuration:  cfg.API.LOGIN_BAN_DURATION,
+
+		DefaultDomain: cfg.IMAP.DEFAULT_DOMAIN,
+	}, lockout.NewPostgresStore(db.Conn))
+
+	tenants := tenant.NewRegistry(db.Conn)
+	if err := tenants.Load(context.Background()); err != nil {
+		log.Fatal("❌ Failed to load tenants:", err)
+	}
+
 	repo := repository.NewRepository(db)
-	svc := services.NewServices(repo)
+	svc := services.NewServices(repo, cfg.API, tracker)
 	h := handlers.NewHandlers(svc)
 	return &AppWireframe{
 		Config:     cfg,
@@ -38,5 +86,7 @@ func InitWireframe() *AppWireframe {
 		Repository: repo,
 		Service:    svc,
 		Handler:    h,
+		Lockout:    tracker,
+		Tenants:    tenants,
 	}
 }
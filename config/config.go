@@ -4,6 +4,8 @@ import (
 	"github.com/joho/godotenv"
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 type DBConfig struct {
@@ -15,13 +17,45 @@ type DBConfig struct {
 	DBSSLMode  string
 }
 type ServerConfig struct {
-	PORT         string
-	IMAP_API_KEY string
+	PORT             string
+	IMAP_API_KEY     string
+	SHUTDOWN_TIMEOUT time.Duration // How long IMAP and HTTP may take to drain on shutdown
+
+	JWT_SECRET        string        // Signs the API session tokens; login is disabled when shorter than 32 bytes
+	ACCESS_TOKEN_TTL  time.Duration // How long an access token is valid
+	REFRESH_TOKEN_TTL time.Duration // How long a login can be refreshed without the password
+	PASSWORD_SCHEME   string        // Scheme passwords are rehashed to on login: ARGON2ID, BLF-CRYPT or PBKDF2
+
+	// Failed logins over IMAP and HTTP, counted by account and by client address
+	LOGIN_ACCOUNT_LIMIT  int           // Failures of one account before it is locked out, 0 disables
+	LOGIN_IP_LIMIT       int           // Failures from one address before it is locked out, 0 disables
+	LOGIN_BASE_DELAY     time.Duration // Wait after the first failure, doubled by every further one
+	LOGIN_MAX_DELAY      time.Duration // Longest wait between two attempts
+	LOGIN_LOCKOUT        time.Duration // How long a lockout lasts
+	LOGIN_FAILURE_WINDOW time.Duration // Failures are forgotten after this long without another one
+	LOGIN_BAN_AFTER      int           // Lockouts of one address before it is banned in the database, 0 never bans
+	LOGIN_BAN_DURATION   time.Duration // How long an automatic ban lasts, 0 bans for good
 }
 type IMAPConfig struct {
-	IMAP_PORT     string
-	TLS_CERT_FILE string
-	TLS_KEY_FILE  string
+	IMAP_HOST        string // Bind address shared by the TCP listeners
+	IMAP_PORT        string // Plaintext IMAP with STARTTLS, "0" disables it
+	IMAPS_PORT       string // Implicit TLS IMAP, "0" disables it
+	IMAP_SOCKET      string // Optional unix socket path for local clients
+	IMAP_REQUIRE_TLS bool   // Fail startup when the TLS certificate cannot be loaded, refuse logins on IMAP_PORT before STARTTLS
+	TLS_CERT_FILE    string
+	TLS_KEY_FILE     string
+	SYNC_INTERVAL    time.Duration // How often each loaded user is synced in the background
+	SYNC_WORKERS     int           // How many background syncs may run at once
+	IDLE_TTL         time.Duration // How long a user without sessions stays loaded, 0 keeps users loaded
+	WARM_WINDOW      time.Duration // Users who logged in within this window are loaded at startup
+	WARM_LIMIT       int           // At most this many users are loaded at startup, 0 disables the preload
+	DEFAULT_DOMAIN   string        // Domain of the tenant whose users may log in with their local part alone
+	CASCADE_DELETE   bool          // DELETE of a folder also deletes subfolders holding messages instead of failing
+
+	OAUTH_ISSUER      string // Issuer of the tokens accepted by XOAUTH2 and OAUTHBEARER, empty disables them
+	OAUTH_AUDIENCE    string // Audience the tokens must be issued for
+	OAUTH_JWKS        string // Path or http(s) URL of the issuer's JSON Web Key Set
+	OAUTH_EMAIL_CLAIM string // Claim holding the account email
 }
 type Config struct {
 	DB   DBConfig
@@ -52,13 +86,44 @@ func GetConfig() Config {
 			DBSSLMode:  os.Getenv("DB_SSLMODE"),
 		},
 		API: ServerConfig{
-			PORT:         os.Getenv("PORT"),
-			IMAP_API_KEY: os.Getenv("IMAP_API_KEY"),
+			PORT:             os.Getenv("PORT"),
+			IMAP_API_KEY:     os.Getenv("IMAP_API_KEY"),
+			SHUTDOWN_TIMEOUT: getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+			JWT_SECRET:        os.Getenv("JWT_SECRET"),
+			ACCESS_TOKEN_TTL:  getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+			REFRESH_TOKEN_TTL: getEnvDuration("REFRESH_TOKEN_TTL", 7*24*time.Hour),
+			PASSWORD_SCHEME:   getEnv("PASSWORD_SCHEME", "ARGON2ID"),
+
+			LOGIN_ACCOUNT_LIMIT:  getEnvInt("LOGIN_ACCOUNT_LIMIT", 5),
+			LOGIN_IP_LIMIT:       getEnvInt("LOGIN_IP_LIMIT", 20),
+			LOGIN_BASE_DELAY:     getEnvDuration("LOGIN_BASE_DELAY", time.Second),
+			LOGIN_MAX_DELAY:      getEnvDuration("LOGIN_MAX_DELAY", 30*time.Second),
+			LOGIN_LOCKOUT:        getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+			LOGIN_FAILURE_WINDOW: getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+			LOGIN_BAN_AFTER:      getEnvInt("LOGIN_BAN_AFTER", 0),
+			LOGIN_BAN_DURATION:   getEnvDuration("LOGIN_BAN_DURATION", 24*time.Hour),
 		},
 		IMAP: IMAPConfig{
-			IMAP_PORT:     os.Getenv("IMAP_PORT"),
-			TLS_CERT_FILE: os.Getenv("TLS_CERT_FILE"),
-			TLS_KEY_FILE:  os.Getenv("TLS_KEY_FILE"),
+			IMAP_HOST:        getEnv("IMAP_HOST", "0.0.0.0"),
+			IMAP_PORT:        getEnv("IMAP_PORT", "143"),
+			IMAPS_PORT:       getEnv("IMAPS_PORT", "993"),
+			IMAP_SOCKET:      os.Getenv("IMAP_SOCKET"),
+			IMAP_REQUIRE_TLS: getEnvBool("IMAP_REQUIRE_TLS", true),
+			TLS_CERT_FILE:    os.Getenv("TLS_CERT_FILE"),
+			TLS_KEY_FILE:     os.Getenv("TLS_KEY_FILE"),
+			SYNC_INTERVAL:    getEnvDuration("SYNC_INTERVAL", 5*time.Minute),
+			SYNC_WORKERS:     getEnvInt("SYNC_WORKERS", 4),
+			IDLE_TTL:         getEnvDuration("IMAP_IDLE_TTL", 30*time.Minute),
+			WARM_WINDOW:      getEnvDuration("IMAP_WARM_WINDOW", 24*time.Hour),
+			WARM_LIMIT:       getEnvInt("IMAP_WARM_LIMIT", 100),
+			DEFAULT_DOMAIN:   os.Getenv("IMAP_DEFAULT_DOMAIN"),
+			CASCADE_DELETE:   getEnvBool("IMAP_CASCADE_DELETE", false),
+
+			OAUTH_ISSUER:      os.Getenv("OAUTH_ISSUER"),
+			OAUTH_AUDIENCE:    os.Getenv("OAUTH_AUDIENCE"),
+			OAUTH_JWKS:        os.Getenv("OAUTH_JWKS"),
+			OAUTH_EMAIL_CLAIM: getEnv("OAUTH_EMAIL_CLAIM", "email"),
 		},
 	}
 	log.Println("✅ Config loaded")
@@ -73,3 +138,30 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// getEnvBool returns the boolean value of the environment variable named by the key.
+// If the variable is not set or cannot be parsed, it returns the fallback value.
+func getEnvBool(key string, fallback bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt returns the integer value of the environment variable named by the key.
+// If the variable is not set or cannot be parsed, it returns the fallback value.
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// getEnvDuration returns the duration value (e.g. "30s") of the environment variable named by the key.
+// If the variable is not set or cannot be parsed, it returns the fallback value.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/api/services"
+)
+
+type AppPasswordHandler struct {
+	service *services.ConcreteServices
+}
+
+// NewAppPasswordHandler creates the handler of the app password endpoints.
+// Every endpoint acts on the account of the request's access token, so
+// they must be wrapped with AuthHandler.RequireToken.
+func NewAppPasswordHandler(service *services.ConcreteServices) *AppPasswordHandler {
+	return &AppPasswordHandler{service: service}
+}
+
+// Create mints an app password. The password is only ever shown in this
+// response.
+// POST /auth/app-passwords
+// Body: {"label": "Phone", "scope": "imap"}
+func (h *AppPasswordHandler) Create(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label string `json:"label"`
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "The request body is not valid JSON")
+		return
+	}
+
+	claims := ClaimsFromContext(r.Context())
+	appPassword, password, err := h.service.AppPasswords.Create(r.Context(), claims.Subject, req.Label, req.Scope)
+	switch {
+	case errors.Is(err, services.ErrInvalidLabel), errors.Is(err, services.ErrInvalidScope):
+		writeError(w, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	case err != nil:
+		log.Printf("API: Failed to create app password for %s: %v", claims.Email, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Something went wrong, try again later")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"success":      true,
+		"app_password": appPassword,
+		"password":     password,
+	})
+}
+
+// List lists the app passwords of the account that are not revoked.
+// GET /auth/app-passwords
+func (h *AppPasswordHandler) List(w http.ResponseWriter, r *http.Request) {
+	claims := ClaimsFromContext(r.Context())
+	appPasswords, err := h.service.AppPasswords.List(r.Context(), claims.Subject)
+	if err != nil {
+		log.Printf("API: Failed to list app passwords of %s: %v", claims.Email, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Something went wrong, try again later")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":       true,
+		"app_passwords": appPasswords,
+	})
+}
+
+// Revoke revokes an app password, which ends the IMAP sessions of the
+// account so the clients using it have to log in again.
+// DELETE /auth/app-passwords/{id}
+func (h *AppPasswordHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !isUUID(id) {
+		writeError(w, http.StatusNotFound, "app_password_not_found", "No such app password")
+		return
+	}
+
+	claims := ClaimsFromContext(r.Context())
+	err := h.service.AppPasswords.Revoke(r.Context(), claims.Subject, id)
+	switch {
+	case errors.Is(err, services.ErrAppPasswordNotFound):
+		writeError(w, http.StatusNotFound, "app_password_not_found", "No such app password")
+		return
+	case err != nil:
+		log.Printf("API: Failed to revoke app password of %s: %v", claims.Email, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Something went wrong, try again later")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"message": "App password revoked",
+	})
+}
+
+// isUUID reports whether s is a UUID in its canonical textual form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -1,16 +1,28 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/enjoys-in/airsend-imap/internal/core/api/services"
+	"github.com/enjoys-in/airsend-imap/internal/core/lockout"
+	"github.com/enjoys-in/airsend-imap/internal/utils/jwt"
 )
 
 type AuthHandler struct {
 	service *services.ConcreteServices
 }
 
+// claimsKey is the context key under which RequireToken stores the claims of the request's token.
+type claimsKey struct{}
+
 // NewUserHandler creates a new instance of the UserHandler with the given
 // AuthService implementation. It takes an AuthService as a parameter and
 // returns a new instance of the UserHandler with the given service.
@@ -18,20 +30,167 @@ func NewAuthHandler(service *services.ConcreteServices) *AuthHandler {
 	return &AuthHandler{service: service}
 }
 
-// UserLogin logs in a user based on their email address. It takes a
-// http.ResponseWriter and a http.Request as parameters and returns the
-// user's information if the user is found, or an error with status
-// http.StatusUnauthorized if the user is not found. The user's
-// information is sent as JSON in the response body.
+// UserLogin checks an email and password against the mail accounts and
+// starts a session. It takes a http.ResponseWriter and a http.Request as
+// parameters. The credentials are read from a JSON body or from form
+// data. On success the response holds an access token and a refresh
+// token; a wrong email or password is answered with
+// http.StatusUnauthorized, without telling which of the two was wrong.
+// After failed attempts, the account and the client address have to wait
+// before the next one, and are locked out after too many: such attempts
+// are answered with http.StatusTooManyRequests and a Retry-After header.
+// POST /login
 func (h *AuthHandler) UserLogin(w http.ResponseWriter, r *http.Request) {
-	email := r.FormValue("email")
-	// password := r.FormValue("password")
-	user, err := h.service.Auth.GetUser(r.Context(), email)
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var creds struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&creds); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", "The request body is not valid JSON")
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		creds.Email = r.PostFormValue("email")
+		creds.Password = r.PostFormValue("password")
+	}
+
+	creds.Email = strings.TrimSpace(creds.Email)
+	if creds.Email == "" || creds.Password == "" {
+		writeError(w, http.StatusBadRequest, "validation_error", "Email and password are required")
+		return
+	}
+
+	tokens, err := h.service.Auth.Login(r.Context(), creds.Email, creds.Password, lockout.HostOf(r.RemoteAddr))
+	if err != nil {
+		h.writeAuthError(w, "login", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// RefreshToken trades a refresh token for a new access token and refresh
+// token. A refresh token can only be used once.
+// POST /auth/refresh
+// Body: {"refresh_token": "..."}
+func (h *AuthHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "The request body is not valid JSON")
+		return
+	}
+	if req.RefreshToken == "" {
+		writeError(w, http.StatusBadRequest, "validation_error", "A refresh token is required")
+		return
+	}
+
+	tokens, err := h.service.Auth.Refresh(r.Context(), req.RefreshToken)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		h.writeAuthError(w, "refresh", err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
+
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// Logout ends the session of the access token the request carries, so
+// neither its access token nor its refresh token are accepted anymore.
+// It must be wrapped with RequireToken.
+// POST /auth/logout
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if err := h.service.Auth.Logout(r.Context(), ClaimsFromContext(r.Context())); err != nil {
+		h.writeAuthError(w, "logout", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"message": "Logged out",
+	})
+}
+
+// Me returns the account the request's access token was issued to.
+// It must be wrapped with RequireToken.
+// GET /auth/me
+func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	claims := ClaimsFromContext(r.Context())
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":    true,
+		"id":         claims.Subject,
+		"email":      claims.Email,
+		"expires_at": claims.ExpiresAt,
+	})
+}
+
+// RequireToken only lets requests through that carry a valid access
+// token in the Authorization header, as "Bearer <token>". The token's
+// claims are available to next through ClaimsFromContext.
+func (h *AuthHandler) RequireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="airsend"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "A bearer token is required")
+			return
+		}
+
+		claims, err := h.service.Auth.Authenticate(r.Context(), token)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="airsend", error="invalid_token"`)
+			}
+			h.writeAuthError(w, "token check", err)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}
+}
+
+// ClaimsFromContext returns the claims stored by RequireToken, or nil.
+func ClaimsFromContext(ctx context.Context) *jwt.Claims {
+	claims, _ := ctx.Value(claimsKey{}).(*jwt.Claims)
+	return claims
+}
+
+// writeAuthError answers with the error of a failed login, refresh or token check.
+// Unexpected errors are logged and never sent to the client.
+func (h *AuthHandler) writeAuthError(w http.ResponseWriter, action string, err error) {
+	var retry *services.RetryError
+	switch {
+	case errors.As(err, &retry):
+		if retry.After > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.After.Seconds()))))
+		}
+		writeError(w, http.StatusTooManyRequests, "too_many_attempts", "Too many failed logins, try again later")
+	case errors.Is(err, services.ErrInvalidCredentials):
+		writeError(w, http.StatusUnauthorized, "invalid_credentials", "Invalid email or password")
+	case errors.Is(err, services.ErrInvalidToken):
+		writeError(w, http.StatusUnauthorized, "invalid_token", "The token is invalid or expired")
+	case errors.Is(err, services.ErrAuthDisabled):
+		writeError(w, http.StatusServiceUnavailable, "auth_disabled", "API login is not configured")
+	default:
+		log.Printf("API: %s failed: %v", action, err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Something went wrong, try again later")
+	}
 }
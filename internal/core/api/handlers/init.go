@@ -5,11 +5,13 @@ import (
 )
 
 type Handlers struct {
-	AuthHandler *AuthHandler
+	AuthHandler        *AuthHandler
+	AppPasswordHandler *AppPasswordHandler
 }
 
 func NewHandlers(svc *services.ConcreteServices) *Handlers {
 	return &Handlers{
-		AuthHandler: NewAuthHandler(svc),
+		AuthHandler:        NewAuthHandler(svc),
+		AppPasswordHandler: NewAppPasswordHandler(svc),
 	}
 }
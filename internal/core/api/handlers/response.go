@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// maxBodyBytes bounds the JSON body of a request.
+const maxBodyBytes = 1 << 20
+
+// errorResponse is the body of every failed request. Code is stable and meant for programs;
+// Message is meant for people and never carries internal error details.
+type errorResponse struct {
+	Success bool   `json:"success"`
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+// writeJSON sends v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("API: Failed to write response: %v", err)
+	}
+}
+
+// writeError sends a structured JSON error.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorResponse{Code: code, Message: message})
+}
+
+// allowMethod rejects requests made with another method than the one an endpoint expects.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use "+method+" for this endpoint")
+	return false
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+)
+
+type AppPasswordRepository interface {
+	Create(ctx context.Context, accountID, label, hash, scope string) (*AppPassword, error)
+	List(ctx context.Context, accountID string) ([]AppPassword, error)
+	Revoke(ctx context.Context, accountID, id string) (bool, error)
+}
+
+// AppPassword describes an app password; the password itself is never stored.
+type AppPassword struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	Scope      string     `json:"scope,omitempty"` // Empty for every mail protocol, "imap" for IMAP only
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type appPasswordRepository struct {
+	db *sql.DB
+}
+
+func NewAppPasswordRepository(db *sql.DB) AppPasswordRepository {
+	return &appPasswordRepository{db: db}
+}
+
+// Create stores the hash of a new app password.
+func (a *appPasswordRepository) Create(ctx context.Context, accountID, label, hash, scope string) (*AppPassword, error) {
+	p := AppPassword{Label: label, Scope: scope}
+	err := a.db.QueryRowContext(ctx, queries.CreateAppPasswordQuery(), accountID, label, hash,
+		sql.NullString{String: scope, Valid: scope != ""}).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// List returns the app passwords of an account that are not revoked, newest first.
+func (a *appPasswordRepository) List(ctx context.Context, accountID string) ([]AppPassword, error) {
+	rows, err := a.db.QueryContext(ctx, queries.ListAppPasswordsQuery(), accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passwords := []AppPassword{}
+	for rows.Next() {
+		var (
+			p        AppPassword
+			scope    sql.NullString
+			lastUsed sql.NullTime
+		)
+		if err := rows.Scan(&p.ID, &p.Label, &scope, &p.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		p.Scope = scope.String
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.Time
+		}
+		passwords = append(passwords, p)
+	}
+	return passwords, rows.Err()
+}
+
+// Revoke revokes an app password of an account. It reports false when the account has no
+// such app password, or it is already revoked.
+func (a *appPasswordRepository) Revoke(ctx context.Context, accountID, id string) (bool, error) {
+	res, err := a.db.ExecContext(ctx, queries.RevokeAppPasswordQuery(), accountID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
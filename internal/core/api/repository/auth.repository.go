@@ -3,17 +3,26 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
 )
 
 type AuthRepository interface {
 	FindOne(ctx context.Context, email string) (*User, error)
+	CreateSession(ctx context.Context, accountID, refreshID string, expiresAt time.Time) (string, error)
+	RotateSession(ctx context.Context, sessionID, refreshID, newRefreshID string) (bool, error)
+	RevokeSession(ctx context.Context, sessionID string) error
+	IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+	UpdatePasswordHash(ctx context.Context, accountID, oldHash, newHash string) error
 }
 
 type User struct {
-	ID       int
-	Name     string
-	Email    string
-	Password string
+	ID       string `json:"id"`
+	Email    string `json:"email"`
+	Password string `json:"-"` // Password hash
 }
 
 type UserSettings struct{}
@@ -29,13 +38,67 @@ func NewAuthRepository(db *sql.DB) AuthRepository {
 	return &authRepository{db: db}
 }
 
-// FindOne implements AuthRepository.
+// FindOne implements AuthRepository. The email is parsed like an IMAP login, so it finds the
+// account however its address is spelled; a malformed email finds nothing.
 func (a *authRepository) FindOne(ctx context.Context, email string) (*User, error) {
-	row := a.db.QueryRowContext(ctx, "SELECT id, name, email, password FROM mai WHERE email = $1", email)
+	id, err := identity.Parse(strings.TrimSpace(email), "")
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	row := a.db.QueryRowContext(ctx, queries.GetAPIAccountQuery(), id.Address())
 
 	var u User
-	if err := row.Scan(&u.ID, &u.Name, &u.Email); err != nil {
+	if err := row.Scan(&u.ID, &u.Email, &u.Password); err != nil {
 		return nil, err
 	}
 	return &u, nil
 }
+
+// CreateSession starts an API session for an account and returns its ID.
+func (a *authRepository) CreateSession(ctx context.Context, accountID, refreshID string, expiresAt time.Time) (string, error) {
+	var sessionID string
+	err := a.db.QueryRowContext(ctx, queries.CreateAPISessionQuery(), accountID, refreshID, expiresAt).Scan(&sessionID)
+	return sessionID, err
+}
+
+// RotateSession swaps the refresh token of a live session. It reports false when refreshID is
+// not the current refresh token of a live session.
+func (a *authRepository) RotateSession(ctx context.Context, sessionID, refreshID, newRefreshID string) (bool, error) {
+	res, err := a.db.ExecContext(ctx, queries.RotateAPISessionQuery(), sessionID, refreshID, newRefreshID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// RevokeSession ends an API session. Revoking an ended session does nothing.
+func (a *authRepository) RevokeSession(ctx context.Context, sessionID string) error {
+	_, err := a.db.ExecContext(ctx, queries.RevokeAPISessionQuery(), sessionID)
+	return err
+}
+
+// IsSessionActive reports whether an API session is neither revoked nor expired.
+func (a *authRepository) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	var active bool
+	err := a.db.QueryRowContext(ctx, queries.IsAPISessionActiveQuery(), sessionID).Scan(&active)
+	return active, err
+}
+
+// UpdatePasswordHash replaces the password hash of an account, unless it changed meanwhile.
+// The change is marked as made by this process, so it is not announced as a password change.
+func (a *authRepository) UpdatePasswordHash(ctx context.Context, accountID, oldHash, newHash string) error {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, queries.SetIMAPOriginQuery()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, queries.UpdatePasswordHashQuery(), accountID, oldHash, newHash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -5,11 +5,13 @@ import (
 )
 
 type Repository struct {
-	Auth AuthRepository
+	Auth         AuthRepository
+	AppPasswords AppPasswordRepository
 }
 
 func NewRepository(db *plugins.DB) *Repository {
 	return &Repository{
-		Auth: NewAuthRepository(db.Conn),
+		Auth:         NewAuthRepository(db.Conn),
+		AppPasswords: NewAppPasswordRepository(db.Conn),
 	}
 }
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/api/repository"
+	"github.com/enjoys-in/airsend-imap/internal/interfaces"
+	"github.com/enjoys-in/airsend-imap/internal/utils/encryption"
+)
+
+// maxLabelLength bounds the label of an app password, in characters.
+const maxLabelLength = 64
+
+var (
+	// ErrInvalidLabel is returned for an empty or too long app password label.
+	ErrInvalidLabel = errors.New("label must be 1 to 64 characters")
+
+	// ErrInvalidScope is returned for an app password scope other than "" or "imap".
+	ErrInvalidScope = errors.New(`scope must be empty or "imap"`)
+
+	// ErrAppPasswordNotFound is returned when revoking an app password the account does not have.
+	ErrAppPasswordNotFound = errors.New("app password not found")
+)
+
+type appPasswordService struct {
+	repo repository.AppPasswordRepository
+}
+
+// NewAppPasswordService returns the service managing app passwords, which
+// let mail clients log in without the account's main password.
+func NewAppPasswordService(repo repository.AppPasswordRepository) interfaces.AppPasswordService {
+	return &appPasswordService{repo: repo}
+}
+
+// Create mints an app password for an account. The password is returned
+// only here; just its hash is stored.
+func (s *appPasswordService) Create(ctx context.Context, accountID, label, scope string) (*repository.AppPassword, string, error) {
+	label = strings.TrimSpace(label)
+	if label == "" || utf8.RuneCountInString(label) > maxLabelLength {
+		return nil, "", ErrInvalidLabel
+	}
+	if scope != "" && scope != "imap" {
+		return nil, "", ErrInvalidScope
+	}
+
+	password, err := encryption.NewAppPassword()
+	if err != nil {
+		return nil, "", err
+	}
+
+	appPassword, err := s.repo.Create(ctx, accountID, label, encryption.HashAppPassword(password), scope)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return appPassword, password, nil
+}
+
+// List returns the app passwords of an account that are not revoked.
+func (s *appPasswordService) List(ctx context.Context, accountID string) ([]repository.AppPassword, error) {
+	return s.repo.List(ctx, accountID)
+}
+
+// Revoke revokes an app password of an account. Its IMAP sessions are
+// ended by the database trigger announcing the revocation.
+func (s *appPasswordService) Revoke(ctx context.Context, accountID, id string) error {
+	revoked, err := s.repo.Revoke(ctx, accountID, id)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrAppPasswordNotFound
+	}
+	return nil
+}
@@ -2,24 +2,79 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
 
 	"github.com/enjoys-in/airsend-imap/internal/core/api/repository"
+	"github.com/enjoys-in/airsend-imap/internal/core/lockout"
 	"github.com/enjoys-in/airsend-imap/internal/interfaces"
+	"github.com/enjoys-in/airsend-imap/internal/utils/encryption"
+	"github.com/enjoys-in/airsend-imap/internal/utils/jwt"
 )
 
+// minSecretLength is the shortest JWT_SECRET accepted for signing tokens.
+const minSecretLength = 32
+
+const (
+	accessTokenType  = "access"
+	refreshTokenType = "refresh"
+)
+
+var (
+	// ErrInvalidCredentials is returned for an unknown email or a wrong password.
+	ErrInvalidCredentials = errors.New("invalid email or password")
+
+	// ErrInvalidToken is returned for tokens that are forged, expired, of the wrong type or
+	// whose session has ended.
+	ErrInvalidToken = errors.New("invalid or expired token")
+
+	// ErrAuthDisabled is returned when no usable JWT_SECRET is configured.
+	ErrAuthDisabled = errors.New("API login is disabled")
+
+	// ErrTooManyAttempts is returned for logins of an account or from an address that failed
+	// too often recently, or is banned.
+	ErrTooManyAttempts = errors.New("too many failed logins")
+)
+
+// RetryError is returned by Login when the account or the client has to wait before the next
+// attempt. It wraps ErrTooManyAttempts.
+type RetryError struct {
+	After time.Duration // How long to wait, 0 when the wait has no end
+}
+
+func (e *RetryError) Error() string { return ErrTooManyAttempts.Error() }
+func (e *RetryError) Unwrap() error { return ErrTooManyAttempts }
+
 //	type AuthService interface {
 //		GetUser(ctx context.Context, email string) (*repository.User, error)
 //	}
 type authService struct {
-	repo repository.AuthRepository
+	repo       repository.AuthRepository
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	timingHash string // Checked when the account does not exist, so unknown emails take as long as wrong passwords
+	lockout    *lockout.Tracker
 }
 
 // NewAuthService returns a new instance of the authService, which is a
-// UserService implementation. It takes a repository.AuthRepository as a
-// parameter and returns a new instance of the authService with the
-// given repository.
-func NewAuthService(repo repository.AuthRepository) interfaces.AuthService {
-	return &authService{repo: repo}
+// UserService implementation. It takes a repository.AuthRepository, the
+// secret and lifetimes of the tokens it issues and the tracker of failed
+// logins as parameters. A secret shorter than 32 bytes disables login.
+func NewAuthService(repo repository.AuthRepository, secret string, accessTTL, refreshTTL time.Duration, tracker *lockout.Tracker) interfaces.AuthService {
+	s := &authService{repo: repo, accessTTL: accessTTL, refreshTTL: refreshTTL, lockout: tracker}
+	if len(secret) >= minSecretLength {
+		s.secret = []byte(secret)
+	} else {
+		log.Println("⚠️ JWT_SECRET is missing or shorter than 32 bytes, API login is disabled")
+	}
+	s.timingHash, _ = encryption.HashPassword(newTokenID())
+	return s
 }
 
 // GetUser retrieves a user by their email address. It takes a context and
@@ -29,3 +84,155 @@ func NewAuthService(repo repository.AuthRepository) interfaces.AuthService {
 func (a *authService) GetUser(ctx context.Context, email string) (*repository.User, error) {
 	return a.repo.FindOne(ctx, email)
 }
+
+// Login checks an email and password and starts a session, returning its first tokens.
+// ip is the address of the client; an account or address that failed too often recently
+// gets a RetryError without its password being checked.
+func (a *authService) Login(ctx context.Context, email, password, ip string) (*interfaces.TokenPair, error) {
+	if a.secret == nil {
+		return nil, ErrAuthDisabled
+	}
+
+	// Rather than holding the request for the delay, the client is told when to come back.
+	if wait, err := a.lockout.Check(email, ip); err != nil || wait > 0 {
+		return nil, &RetryError{After: wait}
+	}
+
+	user, err := a.repo.FindOne(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		encryption.ValidatePassword(a.timingHash, password)
+		a.lockout.Failure(ctx, email, ip)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up account: %w", err)
+	}
+	ok, needsRehash := encryption.VerifyPassword(user.Password, password)
+	if !ok {
+		a.lockout.Failure(ctx, email, ip)
+		return nil, ErrInvalidCredentials
+	}
+	a.lockout.Success(email)
+	if needsRehash {
+		a.rehash(ctx, user, password)
+	}
+
+	now := time.Now()
+	refreshID := newTokenID()
+	sessionID, err := a.repo.CreateSession(ctx, user.ID, refreshID, now.Add(a.refreshTTL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return a.issue(user.ID, user.Email, sessionID, refreshID, now)
+}
+
+// Refresh trades a refresh token for new tokens. Each refresh token works once; presenting
+// one that was already used ends its session, since it has most likely been stolen.
+func (a *authService) Refresh(ctx context.Context, refreshToken string) (*interfaces.TokenPair, error) {
+	if a.secret == nil {
+		return nil, ErrAuthDisabled
+	}
+
+	now := time.Now()
+	claims, err := jwt.Verify(refreshToken, a.secret, now)
+	if err != nil || claims.Type != refreshTokenType {
+		return nil, ErrInvalidToken
+	}
+
+	refreshID := newTokenID()
+	rotated, err := a.repo.RotateSession(ctx, claims.SessionID, claims.ID, refreshID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate session: %w", err)
+	}
+	if !rotated {
+		if err := a.repo.RevokeSession(ctx, claims.SessionID); err != nil {
+			log.Printf("❌ Failed to revoke session %s after refresh token reuse: %v", claims.SessionID, err)
+		}
+		return nil, ErrInvalidToken
+	}
+
+	return a.issue(claims.Subject, claims.Email, claims.SessionID, refreshID, now)
+}
+
+// Logout ends the session an access token belongs to, which invalidates all of its tokens.
+func (a *authService) Logout(ctx context.Context, claims *jwt.Claims) error {
+	return a.repo.RevokeSession(ctx, claims.SessionID)
+}
+
+// Authenticate verifies an access token and checks that its session is still live.
+func (a *authService) Authenticate(ctx context.Context, accessToken string) (*jwt.Claims, error) {
+	if a.secret == nil {
+		return nil, ErrAuthDisabled
+	}
+
+	claims, err := jwt.Verify(accessToken, a.secret, time.Now())
+	if err != nil || claims.Type != accessTokenType {
+		return nil, ErrInvalidToken
+	}
+
+	active, err := a.repo.IsSessionActive(ctx, claims.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check session: %w", err)
+	}
+	if !active {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// rehash stores the password of an account with the preferred scheme. A failure is only
+// logged, the login goes on with the old hash.
+func (a *authService) rehash(ctx context.Context, user *repository.User, password string) {
+	newHash, err := encryption.HashPassword(password)
+	if err == nil {
+		err = a.repo.UpdatePasswordHash(ctx, user.ID, user.Password, newHash)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to rehash the password of %s: %v", user.Email, err)
+	}
+}
+
+// issue signs an access token and a refresh token for a session.
+func (a *authService) issue(accountID, email, sessionID, refreshID string, now time.Time) (*interfaces.TokenPair, error) {
+	access, err := jwt.Sign(jwt.Claims{
+		Subject:   accountID,
+		Email:     email,
+		Type:      accessTokenType,
+		SessionID: sessionID,
+		ID:        newTokenID(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(a.accessTTL).Unix(),
+	}, a.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := jwt.Sign(jwt.Claims{
+		Subject:   accountID,
+		Email:     email,
+		Type:      refreshTokenType,
+		SessionID: sessionID,
+		ID:        refreshID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(a.refreshTTL).Unix(),
+	}, a.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &interfaces.TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(a.accessTTL.Seconds()),
+	}, nil
+}
+
+// newTokenID returns a random token ID.
+func newTokenID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"github.com/enjoys-in/airsend-imap/config"
 	"github.com/enjoys-in/airsend-imap/internal/core/api/repository"
+	"github.com/enjoys-in/airsend-imap/internal/core/lockout"
 	"github.com/enjoys-in/airsend-imap/internal/interfaces"
 )
 
@@ -13,11 +15,12 @@ type ConcreteServices struct {
 	interfaces.Services
 }
 
-func NewServices(repo *repository.Repository) *ConcreteServices {
+func NewServices(repo *repository.Repository, cfg config.ServerConfig, tracker *lockout.Tracker) *ConcreteServices {
 	return &ConcreteServices{
 		Services: interfaces.Services{
-			Auth: NewAuthService(repo.Auth),
-			IMAP: NewImapService(repo.Auth),
+			Auth:         NewAuthService(repo.Auth, cfg.JWT_SECRET, cfg.ACCESS_TOKEN_TTL, cfg.REFRESH_TOKEN_TTL, tracker),
+			IMAP:         NewImapService(repo.Auth),
+			AppPasswords: NewAppPasswordService(repo.AppPasswords),
 		},
 	}
 
@@ -0,0 +1,158 @@
+// Package identity turns what a client types as its login into the address of an account.
+// IMAP logins, OAuth tokens and the failed-login counts all go through Parse, so a login
+// names the same account however it is spelled.
+package identity
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Length limits in octets, from RFC 5321. Longer logins are refused before they are parsed.
+const (
+	maxLoginLength   = 320 // 64 of local part, "@" and 255 of domain
+	maxLocalLength   = 64
+	maxDomainLength  = 253
+	maxLabelLength   = 63
+	maxAddressLength = 254
+)
+
+var (
+	ErrEmpty    = errors.New("empty login")
+	ErrTooLong  = errors.New("login is too long")
+	ErrNoDomain = errors.New("login has no domain and there is no default domain")
+
+	// ErrMalformed is returned for logins that are not valid UTF-8 or hold spaces or control characters.
+	ErrMalformed = errors.New("malformed login")
+
+	ErrInvalidLocalPart = errors.New("invalid local part")
+	ErrInvalidDomain    = errors.New("invalid domain")
+)
+
+// Identity is a parsed login.
+type Identity struct {
+	Local  string // Case-folded local part without the tag
+	Tag    string // What followed the first "+" of the local part, as typed
+	Domain string // Lower-case domain, IDN labels in their ASCII "xn--" form
+}
+
+// Address is the account address the login names: the local part and the domain, without the tag.
+func (id Identity) Address() string {
+	return id.Local + "@" + id.Domain
+}
+
+// Parse reads a login of the form local[+tag][@domain]. A login without a domain gets
+// defaultDomain, the domain of the tenant served by default; there is none when it is empty.
+//
+// Local parts are dot-atoms of RFC 5322, which may also hold letters and digits of any
+// script (RFC 6531), and are case-folded. Quoted local parts and address literals are not
+// accepted. Domains are lower-cased and IDN domains converted to their ASCII form.
+func Parse(login, defaultDomain string) (Identity, error) {
+	switch {
+	case login == "":
+		return Identity{}, ErrEmpty
+	case len(login) > maxLoginLength:
+		return Identity{}, ErrTooLong
+	case !utf8.ValidString(login) || strings.IndexFunc(login, isSpaceOrControl) >= 0:
+		return Identity{}, ErrMalformed
+	}
+
+	local, domain, hasDomain := strings.Cut(login, "@")
+	if !hasDomain {
+		if defaultDomain == "" {
+			return Identity{}, ErrNoDomain
+		}
+		domain = defaultDomain
+	}
+
+	if !isDotAtom(local) || len(local) > maxLocalLength {
+		return Identity{}, ErrInvalidLocalPart
+	}
+	local, tag, _ := strings.Cut(local, "+")
+	if !isDotAtom(local) {
+		return Identity{}, ErrInvalidLocalPart
+	}
+
+	domain, err := ParseDomain(domain)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	id := Identity{
+		Local:  foldLocal(local),
+		Tag:    tag,
+		Domain: domain,
+	}
+	if len(id.Local) > maxLocalLength || len(id.Address()) > maxAddressLength {
+		return Identity{}, ErrTooLong
+	}
+
+	return id, nil
+}
+
+// ParseDomain returns the lower-case ASCII form of a domain, converting IDN labels to
+// their "xn--" form. A single trailing dot is dropped.
+func ParseDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > maxLoginLength || !utf8.ValidString(domain) {
+		return "", ErrInvalidDomain
+	}
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil || ascii == "" || len(ascii) > maxDomainLength {
+		return "", ErrInvalidDomain
+	}
+	// Some inputs map to an ASCII form that is itself not a valid domain.
+	if again, err := idna.Lookup.ToASCII(ascii); err != nil || again != ascii {
+		return "", ErrInvalidDomain
+	}
+
+	for label := range strings.SplitSeq(ascii, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return "", ErrInvalidDomain
+		}
+	}
+
+	return ascii, nil
+}
+
+// foldLocal case-folds a local part, composing it before and after so that it folds the same
+// however its accents were typed.
+func foldLocal(local string) string {
+	return norm.NFC.String(strings.ToLower(norm.NFC.String(local)))
+}
+
+// isDotAtom reports whether s is one or more atoms joined by single dots.
+func isDotAtom(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' || strings.Contains(s, "..") {
+		return false
+	}
+	for _, r := range s {
+		if r != '.' && !isAtext(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAtext reports whether r may appear in an atom: the atext of RFC 5322, and letters,
+// digits and marks beyond ASCII.
+func isAtext(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r < utf8.RuneSelf:
+		return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+	default:
+		return unicode.In(r, unicode.L, unicode.M, unicode.N)
+	}
+}
+
+func isSpaceOrControl(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
@@ -0,0 +1,138 @@
+package identity
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		login, defaultDomain string
+		address, tag         string
+	}{
+		{"alice@example.com", "", "alice@example.com", ""},
+		{"Alice@Example.COM", "", "alice@example.com", ""},
+		{"alice+news@example.com", "", "alice@example.com", "news"},
+		{"alice+News+2024@example.com", "", "alice@example.com", "News+2024"},
+		{"alice+@example.com", "", "alice@example.com", ""},
+		{"first.last@example.com.", "", "first.last@example.com", ""},
+		{"o'brien_{x}@example.com", "", "o'brien_{x}@example.com", ""},
+		{"alice", "example.com", "alice@example.com", ""},
+		{"Alice+x", "Example.com", "alice@example.com", "x"},
+		{"alice@other.org", "example.com", "alice@other.org", ""},
+		{"jürgen@bücher.example", "", "jürgen@xn--bcher-kva.example", ""},
+		{"JÜRGEN@BÜCHER.example", "", "jürgen@xn--bcher-kva.example", ""},
+		{"ju\u0308rgen@xn--bcher-kva.example", "", "jürgen@xn--bcher-kva.example", ""}, // Decomposed ü
+		{"用户@例子.测试", "", "用户@xn--fsqu00a.xn--0zwm56d", ""},
+	}
+	for _, tt := range tests {
+		id, err := Parse(tt.login, tt.defaultDomain)
+		if err != nil {
+			t.Errorf("%q: %v", tt.login, err)
+			continue
+		}
+		if id.Address() != tt.address || id.Tag != tt.tag {
+			t.Errorf("%q: got %q, tag %q", tt.login, id.Address(), id.Tag)
+		}
+	}
+}
+
+func TestParseFailures(t *testing.T) {
+	tests := []struct {
+		login, defaultDomain string
+		err                  error
+	}{
+		{"", "example.com", ErrEmpty},
+		{strings.Repeat("a", 321), "", ErrTooLong},
+		{strings.Repeat("a", 65) + "@example.com", "", ErrInvalidLocalPart},
+		{strings.Repeat("a", 64) + "@" + strings.Repeat("b.", 95) + "com", "", ErrTooLong},
+		{"alice@" + strings.Repeat("a", 64) + ".com", "", ErrInvalidDomain},
+		{"alice", "", ErrNoDomain},
+		{"alice@", "", ErrInvalidDomain},
+		{"alice@.", "", ErrInvalidDomain},
+		{"alice@example..com", "", ErrInvalidDomain},
+		{"alice@exa_mple.com", "", ErrInvalidDomain},
+		{"alice@[192.0.2.1]", "", ErrInvalidDomain},
+		{"alice@bob@example.com", "", ErrInvalidDomain},
+		{"alice", "not a domain", ErrInvalidDomain},
+		{"alice", "bad@domain", ErrInvalidDomain},
+		{"@example.com", "", ErrInvalidLocalPart},
+		{"+tag@example.com", "", ErrInvalidLocalPart},
+		{".alice@example.com", "", ErrInvalidLocalPart},
+		{"alice.@example.com", "", ErrInvalidLocalPart},
+		{"alice.+tag@example.com", "", ErrInvalidLocalPart},
+		{"al..ice@example.com", "", ErrInvalidLocalPart},
+		{`"alice"@example.com`, "", ErrInvalidLocalPart},
+		{"al(ice)@example.com", "", ErrInvalidLocalPart},
+		{"alice @example.com", "", ErrMalformed},
+		{"alice\x00@example.com", "", ErrMalformed},
+		{"alice\r\n@example.com", "", ErrMalformed},
+		{"\xffalice@example.com", "", ErrMalformed},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.login, tt.defaultDomain); !errors.Is(err, tt.err) {
+			t.Errorf("%q: got %v, want %v", tt.login, err, tt.err)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"alice@example.com",
+		"Alice+tag@Example.COM.",
+		"alice",
+		"@",
+		"+@",
+		"a@b@c",
+		"jürgen@bücher.example",
+		"jürgen@xn--bcher-kva.example",
+		"alice@xn--",
+		"alice@xn--zz",
+		"İ@example.com",
+		"K@example.com", // Kelvin sign, lower-cases to ASCII k
+		strings.Repeat("a", 64) + "@" + strings.Repeat("b", 63) + ".com",
+	} {
+		f.Add(seed, "")
+		f.Add(seed, "example.com")
+	}
+
+	f.Fuzz(func(t *testing.T, login, defaultDomain string) {
+		id, err := Parse(login, defaultDomain)
+		if err != nil {
+			if id != (Identity{}) {
+				t.Fatalf("%q: got %+v with error %v", login, id, err)
+			}
+			return
+		}
+
+		address := id.Address()
+		if !utf8.ValidString(address) || len(address) > maxAddressLength || len(id.Local) > maxLocalLength {
+			t.Fatalf("%q: invalid address %q", login, address)
+		}
+		if strings.Count(address, "@") != 1 || strings.Contains(id.Local, "+") {
+			t.Fatalf("%q: address %q has a tag or several @", login, address)
+		}
+		if id.Domain != strings.ToLower(id.Domain) {
+			t.Fatalf("%q: domain %q is not lower-case", login, id.Domain)
+		}
+
+		// An address names its own account: parsing it again gives it back.
+		again, err := Parse(address, "")
+		if err != nil {
+			t.Fatalf("%q: address %q does not parse: %v", login, address, err)
+		}
+		if again.Address() != address || again.Tag != "" {
+			t.Fatalf("%q: address %q parses as %q", login, address, again.Address())
+		}
+
+		// The tag does not change the account.
+		if len(id.Local)+2 > maxLocalLength {
+			return
+		}
+		if tagged, err := Parse(id.Local+"+x@"+id.Domain, ""); err != nil || tagged.Address() != address {
+			t.Fatalf("%q: tagged address of %q does not parse back: %v", login, address, err)
+		}
+	})
+}
@@ -0,0 +1,747 @@
+package imap
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
+	"github.com/enjoys-in/airsend-imap/internal/core/lockout"
+)
+
+const (
+	// maxAPIBodyBytes bounds the JSON body of an admin request.
+	maxAPIBodyBytes = 1 << 20
+
+	// maxBatchSize bounds the number of emails in a single add-batch request.
+	maxBatchSize = 100
+
+	// addUserTimeout bounds loading a user, which includes its first full sync.
+	addUserTimeout = 2 * time.Minute
+
+	// addBatchTimeout bounds a whole add-batch request; users not loaded by then fail.
+	addBatchTimeout = 5 * time.Minute
+
+	// addBatchWorkers is how many users of an add-batch request are loaded at once.
+	addBatchWorkers = 4
+
+	// removeUserTimeout bounds taking a user out of Gluon.
+	removeUserTimeout = 30 * time.Second
+
+	// lockoutTimeout bounds changing the ban list in the database.
+	lockoutTimeout = 10 * time.Second
+
+	// tenantUsersTimeout bounds looking up the accounts of a tenant.
+	tenantUsersTimeout = 10 * time.Second
+)
+
+// apiError is the body of every failed admin request. Code is stable and meant for programs;
+// Message is meant for people and never carries internal error details.
+type apiError struct {
+	Success bool   `json:"success"`
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+// emailRequest is the body of the requests that act on a single user.
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+// batchResult is the outcome of one email of an add-batch request.
+type batchResult struct {
+	Email   string `json:"email"`
+	ID      string `json:"id,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// tenantRequest is the body of the requests that act on a tenant.
+type tenantRequest struct {
+	Tenant string `json:"tenant"`
+}
+
+// lockoutRequest is the body of the requests that act on the lockout of an account or address.
+type lockoutRequest struct {
+	Kind     string `json:"kind"`  // "account" or "ip"
+	Value    string `json:"value"` // The email or the client address
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // Like "24h", empty bans for good
+}
+
+// writeJSON sends v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("API: Failed to write response: %v", err)
+	}
+}
+
+// writeError sends a structured JSON error.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{Code: code, Message: message})
+}
+
+// allowMethod rejects requests made with another method than the one an endpoint expects.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use "+method+" for this endpoint")
+	return false
+}
+
+// decodeBody decodes the JSON body of a request, answering with an error when it is not valid.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "The request body is not valid JSON")
+		return false
+	}
+	return true
+}
+
+// normalizeEmail returns the account address an email names, the way logins name it (see
+// identity.Parse), and whether it is a valid email.
+func normalizeEmail(email string) (string, bool) {
+	id, err := identity.Parse(strings.TrimSpace(email), "")
+	if err != nil {
+		return "", false
+	}
+	return id.Address(), true
+}
+
+// accountEmail resolves the address a request is about to the email its user is loaded under.
+// It writes an error response and returns false when the account could not be looked up.
+func accountEmail(w http.ResponseWriter, r *http.Request, cf *ConnectorFactory, address string) (string, bool) {
+	email, err := cf.storedEmail(r.Context(), address)
+	if err != nil {
+		log.Printf("API: %v", err)
+		writeError(w, http.StatusInternalServerError, "lookup_failed", "The account could not be looked up")
+		return "", false
+	}
+	return email, true
+}
+
+// key returns the account or address a request is about, normalized the way failures are counted.
+func (req lockoutRequest) key() (lockout.Key, bool) {
+	value := strings.TrimSpace(req.Value)
+	switch req.Kind {
+	case lockout.KindAccount:
+		email, ok := normalizeEmail(value)
+		return lockout.AccountKey(email, ""), ok
+	case lockout.KindIP:
+		// IPv6 clients are counted by their /64, which List shows as a prefix.
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			return lockout.IPKey(prefix.Addr().String()), prefix.Addr().Is6() && prefix.Bits() == 64
+		}
+		if _, err := netip.ParseAddr(value); err != nil {
+			return lockout.Key{}, false
+		}
+		return lockout.IPKey(value), true
+	default:
+		return lockout.Key{}, false
+	}
+}
+
+// factory returns the connector factory, answering with an error while the IMAP server is not serving.
+func (api *APIServer) factory(w http.ResponseWriter) (*ConnectorFactory, bool) {
+	cf := api.cf()
+	if cf == nil {
+		writeError(w, http.StatusServiceUnavailable, "imap_unavailable", "The IMAP server is not running")
+		return nil, false
+	}
+	return cf, true
+}
+
+// AuthMiddleware only lets requests through that carry the IMAP_API_KEY in the X-API-Key header.
+// Without a configured key the admin API is disabled.
+func (api *APIServer) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.apiKey == "" {
+			writeError(w, http.StatusServiceUnavailable, "admin_api_disabled", "IMAP_API_KEY is not configured")
+			return
+		}
+
+		apiKey := r.Header.Get("X-API-Key")
+		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(api.apiKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid or missing API key")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// RateLimitMiddleware rejects requests beyond the rate shared by the whole admin API.
+func (api *APIServer) RateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !api.limiter.Allow() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many requests, try again later")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Protected wraps an admin endpoint with the rate limit and the API key check.
+func (api *APIServer) Protected(next http.HandlerFunc) http.HandlerFunc {
+	return api.RateLimitMiddleware(api.AuthMiddleware(next))
+}
+
+// HandleAddUser loads a user into the IMAP server.
+// POST /api/imap/users/add
+// Body: {"email": "user@example.com"}
+func (api *APIServer) HandleAddUser(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req emailRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", "A valid email is required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+	if email, ok = accountEmail(w, r, cf, email); !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), addUserTimeout)
+	defer cancel()
+
+	gluonUserID, err := cf.LoadUser(ctx, email)
+	switch {
+	case errors.Is(err, ErrUnknownUser):
+		writeError(w, http.StatusNotFound, "user_not_found", "No IMAP enabled account for this email")
+		return
+	case err != nil:
+		log.Printf("API: Failed to add user %s: %v", email, err)
+		writeError(w, http.StatusInternalServerError, "user_add_failed", "The user could not be loaded")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"message": "User added to IMAP server",
+		"email":   email,
+		"id":      gluonUserID,
+	})
+}
+
+// HandleAddUserBatch loads several users into the IMAP server, a few at a time and within
+// addBatchTimeout for the whole request.
+// POST /api/imap/users/add-batch
+// Body: {"emails": ["user1@example.com", "user2@example.com"]}
+func (api *APIServer) HandleAddUserBatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Emails []string `json:"emails"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if len(req.Emails) == 0 || len(req.Emails) > maxBatchSize {
+		writeError(w, http.StatusBadRequest, "validation_error", "Between 1 and 100 emails are required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), addBatchTimeout)
+	defer cancel()
+
+	results := make([]batchResult, len(req.Emails))
+	slots := make(chan struct{}, addBatchWorkers)
+	var wg sync.WaitGroup
+
+	for i, email := range req.Emails {
+		results[i].Email = email
+
+		email, ok := normalizeEmail(email)
+		if !ok {
+			results[i].Error = "validation_error"
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *batchResult) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				result.Error = "user_add_failed"
+				return
+			}
+
+			userCtx, cancel := context.WithTimeout(ctx, addUserTimeout)
+			defer cancel()
+
+			email, err := cf.storedEmail(userCtx, email)
+			if err != nil {
+				log.Printf("API: %v", err)
+				result.Error = "user_add_failed"
+				return
+			}
+
+			gluonUserID, err := cf.LoadUser(userCtx, email)
+			switch {
+			case errors.Is(err, ErrUnknownUser):
+				result.Error = "user_not_found"
+			case err != nil:
+				log.Printf("API: Failed to add user %s: %v", email, err)
+				result.Error = "user_add_failed"
+			default:
+				result.ID = gluonUserID
+				result.Success = true
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	added := 0
+	for _, result := range results {
+		if result.Success {
+			added++
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"total":   len(req.Emails),
+		"added":   added,
+		"failed":  len(req.Emails) - added,
+		"results": results,
+	})
+}
+
+// HandleRemoveUser terminates the sessions of a user, takes it out of the IMAP server and deletes its Gluon store.
+// DELETE /api/imap/users/remove
+// Body: {"email": "user@example.com"}
+func (api *APIServer) HandleRemoveUser(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+
+	var req emailRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", "A valid email is required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+	if email, ok = accountEmail(w, r, cf, email); !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), removeUserTimeout)
+	defer cancel()
+
+	err := cf.RemoveUser(ctx, email)
+	switch {
+	case errors.Is(err, ErrUserNotLoaded):
+		writeError(w, http.StatusNotFound, "user_not_loaded", "The user is not loaded")
+		return
+	case err != nil:
+		log.Printf("API: Failed to remove user %s: %v", email, err)
+		writeError(w, http.StatusInternalServerError, "user_remove_failed", "The user could not be removed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"message": "User removed from IMAP server",
+		"email":   email,
+	})
+}
+
+// HandleListUsers lists the users loaded in the IMAP server, or those of a single tenant.
+// GET /api/imap/users/list[?tenant=acme]
+func (api *APIServer) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+
+	var (
+		users []string
+		count int
+	)
+	if name := r.URL.Query().Get("tenant"); name != "" {
+		ctx, cancel := context.WithTimeout(r.Context(), tenantUsersTimeout)
+		defer cancel()
+
+		var err error
+		if users, err = cf.TenantUsers(ctx, name); err != nil {
+			log.Printf("API: Failed to list the users of tenant %s: %v", name, err)
+			writeError(w, http.StatusInternalServerError, "list_failed", "The users could not be listed")
+			return
+		}
+		count = len(users)
+	} else {
+		users, count = cf.GetActiveUserCount()
+		slices.Sort(users)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"count":   count,
+		"users":   users,
+	})
+}
+
+// HandleCheckUser reports whether a user is loaded in the IMAP server.
+// GET /api/imap/users/check?email=user@example.com
+func (api *APIServer) HandleCheckUser(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	email, ok := normalizeEmail(r.URL.Query().Get("email"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", "A valid email parameter is required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+	if email, ok = accountEmail(w, r, cf, email); !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"email":   email,
+		"loaded":  cf.IsUserLoaded(email),
+	})
+}
+
+// HandleListSessions lists the open IMAP sessions of a loaded user.
+// GET /api/imap/users/sessions?email=user@example.com
+func (api *APIServer) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	email, ok := normalizeEmail(r.URL.Query().Get("email"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", "A valid email parameter is required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+	if email, ok = accountEmail(w, r, cf, email); !ok {
+		return
+	}
+
+	sessions, err := cf.ListSessions(email)
+	if errors.Is(err, ErrUserNotLoaded) {
+		writeError(w, http.StatusNotFound, "user_not_loaded", "The user is not loaded")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"email":    email,
+		"count":    len(sessions),
+		"sessions": sessions,
+	})
+}
+
+// HandleDisconnectUser terminates the open IMAP sessions of a user, who stays loaded.
+// POST /api/imap/users/disconnect
+// Body: {"email": "user@example.com"}
+func (api *APIServer) HandleDisconnectUser(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req emailRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", "A valid email is required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+	if email, ok = accountEmail(w, r, cf, email); !ok {
+		return
+	}
+
+	if !cf.IsUserLoaded(email) {
+		writeError(w, http.StatusNotFound, "user_not_loaded", "The user is not loaded")
+		return
+	}
+	terminated := cf.DisconnectUser(email)
+	log.Printf("API: Terminated %d IMAP sessions of %s", terminated, email)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":    true,
+		"email":      email,
+		"terminated": terminated,
+	})
+}
+
+// HandleSyncUser syncs a loaded user right away and returns once the sync has run.
+// POST /api/imap/users/sync
+// Body: {"email": "user@example.com"}
+func (api *APIServer) HandleSyncUser(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req emailRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", "A valid email is required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+	if email, ok = accountEmail(w, r, cf, email); !ok {
+		return
+	}
+
+	start := time.Now()
+	err := cf.SyncNow(email)
+	switch {
+	case errors.Is(err, ErrUserNotLoaded):
+		writeError(w, http.StatusNotFound, "user_not_loaded", "The user is not loaded")
+		return
+	case err != nil:
+		log.Printf("API: Failed to sync user %s: %v", email, err)
+		writeError(w, http.StatusInternalServerError, "user_sync_failed", "The user could not be synced")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":     true,
+		"email":       email,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
+// HandleStatus reports whether the IMAP server is running and how many users it has loaded.
+// GET /api/imap/status
+func (api *APIServer) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	status, count := "unavailable", 0
+	if cf := api.cf(); cf != nil {
+		status = "running"
+		_, count = cf.GetActiveUserCount()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":      true,
+		"status":       status,
+		"active_users": count,
+		"timestamp":    time.Now().Unix(),
+	})
+}
+
+// HandleListLockouts lists the accounts and addresses with failed logins, and the ban list.
+// GET /api/imap/lockouts
+func (api *APIServer) HandleListLockouts(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	lockouts, bans := api.lockout.List(), api.lockout.Bans()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"lockouts": lockouts,
+		"bans":     bans,
+	})
+}
+
+// HandleClearLockout forgets the failures of an account or address and lifts its lockout and ban.
+// POST /api/imap/lockouts/clear
+// Body: {"kind": "account", "value": "user@example.com"}
+func (api *APIServer) HandleClearLockout(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req lockoutRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	key, ok := req.key()
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", `A kind of "account" or "ip" and a valid value are required`)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), lockoutTimeout)
+	defer cancel()
+
+	cleared, err := api.lockout.Clear(ctx, key)
+	switch {
+	case err != nil:
+		log.Printf("API: Failed to clear the lockout of %s %s: %v", key.Kind, key.Value, err)
+		writeError(w, http.StatusInternalServerError, "lockout_clear_failed", "The lockout could not be cleared")
+		return
+	case !cleared:
+		writeError(w, http.StatusNotFound, "not_locked", "There are no failed logins to clear")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"kind":    key.Kind,
+		"value":   key.Value,
+	})
+}
+
+// HandleBan keeps an account or address from logging in, for a while or for good.
+// POST /api/imap/lockouts/ban
+// Body: {"kind": "ip", "value": "203.0.113.7", "reason": "credential stuffing", "duration": "24h"}
+func (api *APIServer) HandleBan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req lockoutRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	key, ok := req.key()
+	if !ok {
+		writeError(w, http.StatusBadRequest, "validation_error", `A kind of "account" or "ip" and a valid value are required`)
+		return
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(req.Duration); err != nil || duration <= 0 {
+			writeError(w, http.StatusBadRequest, "validation_error", `The duration must be positive, like "24h"`)
+			return
+		}
+	}
+
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		reason = "banned by an administrator"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), lockoutTimeout)
+	defer cancel()
+
+	if err := api.lockout.Ban(ctx, key, reason, duration); err != nil {
+		log.Printf("API: Failed to ban %s %s: %v", key.Kind, key.Value, err)
+		writeError(w, http.StatusInternalServerError, "ban_failed", "The ban could not be stored")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"kind":    key.Kind,
+		"value":   key.Value,
+	})
+}
+
+// HandleListTenants lists the tenants with the number of IMAP sessions their users have open.
+// GET /api/imap/tenants
+func (api *APIServer) HandleListTenants(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	tenants := api.tenants.List()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"count":   len(tenants),
+		"tenants": tenants,
+	})
+}
+
+// HandleDisconnectTenant terminates the open IMAP sessions of the users of a tenant, who stay loaded.
+// POST /api/imap/tenants/disconnect
+// Body: {"tenant": "acme"}
+func (api *APIServer) HandleDisconnectTenant(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req tenantRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	name := strings.TrimSpace(req.Tenant)
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "validation_error", "A tenant is required")
+		return
+	}
+
+	cf, ok := api.factory(w)
+	if !ok {
+		return
+	}
+
+	terminated := cf.DisconnectTenant(name)
+	log.Printf("API: Terminated %d IMAP sessions of tenant %s", terminated, name)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success":    true,
+		"tenant":     name,
+		"terminated": terminated,
+	})
+}
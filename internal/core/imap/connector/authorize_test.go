@@ -0,0 +1,225 @@
+package connector
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/enjoys-in/airsend-imap/internal/utils/encryption"
+)
+
+// fakeAccount is a mail_accounts row of the fake database.
+type fakeAccount struct {
+	id, email, domain, tenant, password, appPassword string
+}
+
+var fakeAccounts = []fakeAccount{
+	{id: "a1", email: "alice@example.com", domain: "example.com", tenant: "acme", password: "secret", appPassword: "abcdefghijklmnop"},
+	{id: "a2", email: "Bob@Example.com", domain: "Example.com", tenant: "acme", password: "hunter2"},
+	{id: "a3", email: "jürgen@xn--bcher-kva.example", domain: "xn--bcher-kva.example", tenant: "books", password: "lesen"},
+}
+
+// fakeDB answers the queries Authorize makes from fakeAccounts, and fails any other query.
+type fakeDB struct{}
+
+func (fakeDB) Open(string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare is not supported")
+}
+func (fakeConn) Close() error              { return nil }
+func (fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("transactions are not supported") }
+
+func (fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch query {
+	case queries.GetAuthUserQuery():
+		email, domain := args[0].Value.(string), args[1].Value.(string)
+		for _, a := range fakeAccounts {
+			if strings.ToLower(a.email) == email && strings.ToLower(a.domain) == domain {
+				return &fakeRows{
+					columns: []string{"id", "email", "hash", "tenant_name", "mailbox_size", "usage", "key", "open_pgp", "system_email"},
+					values:  [][]driver.Value{{a.id, a.email, "{PLAIN}" + a.password, a.tenant, int64(0), int64(0), "", []byte("{}"), []byte("{}")}},
+				}, nil
+			}
+		}
+		return &fakeRows{columns: []string{"id"}}, nil
+
+	case queries.UseIMAPAppPasswordQuery():
+		id, hash := args[0].Value.(string), args[1].Value.(string)
+		for _, a := range fakeAccounts {
+			if a.id == id && a.appPassword != "" && encryption.HashAppPassword(a.appPassword) == hash {
+				return &fakeRows{columns: []string{"id"}, values: [][]driver.Value{{"p1"}}}, nil
+			}
+		}
+		return &fakeRows{columns: []string{"id"}}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected query: %s", query)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// plainScheme compares passwords as they are, so checking them costs nothing while fuzzing.
+type plainScheme struct{}
+
+func (plainScheme) Hash(password string) (string, error) { return password, nil }
+func (plainScheme) Verify(hash, password string) bool    { return hash == password }
+func (plainScheme) NeedsRehash(string) bool              { return false }
+
+var registerFakeDB sync.Once
+
+func openFakeDB(t testing.TB) *sql.DB {
+	registerFakeDB.Do(func() {
+		sql.Register("fake-accounts", fakeDB{})
+		encryption.RegisterPasswordScheme("PLAIN", plainScheme{})
+		if err := encryption.SetPreferredPasswordScheme("PLAIN"); err != nil {
+			panic(err)
+		}
+	})
+
+	db, err := sql.Open("fake-accounts", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func newFakeConnectors(t testing.TB, db *sql.DB, defaultDomain string) []*MyDBConnector {
+	connectors := make([]*MyDBConnector, len(fakeAccounts))
+	for i, a := range fakeAccounts {
+		c := NewConnector(db, a.email)
+		c.SetDefaultDomain(defaultDomain)
+		t.Cleanup(func() { c.Close(context.Background()) })
+		connectors[i] = c
+	}
+	return connectors
+}
+
+func TestAuthorize(t *testing.T) {
+	db := openFakeDB(t)
+	alice, bob, jurgen := func() (*MyDBConnector, *MyDBConnector, *MyDBConnector) {
+		c := newFakeConnectors(t, db, "example.com")
+		return c[0], c[1], c[2]
+	}()
+
+	tests := []struct {
+		c        *MyDBConnector
+		username string
+		password string
+		want     bool
+	}{
+		{alice, "alice@example.com", "secret", true},
+		{alice, "ALICE+imap@Example.COM", "secret", true},
+		{alice, "alice", "secret", true},
+		{alice, "alice", "abcdefghijklmnop", true},
+		{alice, "alice@example.com", "wrong", false},
+		{alice, "bob@example.com", "secret", false},
+		{alice, "alice@example.org", "secret", false},
+		{alice, "alice@", "secret", false},
+		{alice, "", "secret", false},
+		{alice, "@", "secret", false},
+		{alice, "alice@@example.com", "secret", false},
+		{bob, "bob@example.com", "hunter2", true},
+		{bob, "Bob", "hunter2", true},
+		{jurgen, "JÜRGEN@bücher.example", "lesen", true},
+		{jurgen, "jürgen", "lesen", false}, // Not in the default domain
+	}
+	for _, tt := range tests {
+		if got := tt.c.Authorize(context.Background(), tt.username, []byte(tt.password)); got != tt.want {
+			t.Errorf("%s: Authorize(%q, %q) = %v, want %v", tt.c.email, tt.username, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizeAccountMismatch(t *testing.T) {
+	db := openFakeDB(t)
+	alice := newFakeConnectors(t, db, "")[0]
+
+	if !alice.Authorize(context.Background(), "alice@example.com", []byte("secret")) {
+		t.Fatal("first login failed")
+	}
+
+	// The account was recreated since the connector was loaded.
+	alice.user.ID = "a0"
+	if alice.Authorize(context.Background(), "alice@example.com", []byte("secret")) {
+		t.Error("login into a recreated account succeeded")
+	}
+
+	// The account moved to another tenant.
+	alice.user.ID, alice.user.TenantName = "a1", "other"
+	if alice.Authorize(context.Background(), "alice@example.com", []byte("secret")) {
+		t.Error("login into an account of another tenant succeeded")
+	}
+
+	// A connector of an email that only differs in case from the account's.
+	mixed := NewConnector(db, "Alice@example.com")
+	defer mixed.Close(context.Background())
+	if mixed.Authorize(context.Background(), "alice@example.com", []byte("secret")) {
+		t.Error("login into another account's connector succeeded")
+	}
+}
+
+func FuzzAuthorize(f *testing.F) {
+	for _, seed := range []struct{ username, password string }{
+		{"alice@example.com", "secret"},
+		{"Alice+tag@EXAMPLE.com.", "secret"},
+		{"alice", "abcdefghijklmnop"},
+		{"bob", "hunter2"},
+		{"BOB@example.com", "hunter2"},
+		{"jürgen@bücher.example", "lesen"},
+		{"jürgen@xn--bcher-kva.example", "lesen"},
+		{"alice@", "secret"},
+		{"@example.com", "secret"},
+		{"alice@example.com@example.com", "secret"},
+		{"alice\x00@example.com", "secret"},
+		{"\"alice\"@example.com", "secret"},
+		{strings.Repeat("a", 400), ""},
+	} {
+		f.Add(seed.username, []byte(seed.password))
+	}
+
+	db := openFakeDB(f)
+	connectors := newFakeConnectors(f, db, "example.com")
+
+	f.Fuzz(func(t *testing.T, username string, password []byte) {
+		id, err := identity.Parse(username, "example.com")
+
+		for i, c := range connectors {
+			a := fakeAccounts[i]
+			// App passwords are typed without regard to case, so they are compared by their hash.
+			appPassword := a.appPassword != "" && encryption.HashAppPassword(string(password)) == encryption.HashAppPassword(a.appPassword)
+			want := err == nil && id.Address() == c.login && (string(password) == a.password || appPassword)
+
+			if got := c.Authorize(context.Background(), username, password); got != want {
+				t.Fatalf("%s: Authorize(%q, %q) = %v, want %v", a.email, username, password, got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ProtonMail/gluon/imap"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	pgp "github.com/enjoys-in/airsend-imap/internal/crypto"
+	user "github.com/enjoys-in/airsend-imap/internal/interfaces/user"
+)
+
+var (
+	ErrEmptyContent     = errors.New("message has no content")
+	ErrDecryptionFailed = errors.New("message could not be decrypted")
+	ErrInvalidLiteral   = errors.New("message is not valid MIME")
+)
+
+const pgpArmorHeader = "-----BEGIN PGP MESSAGE-----"
+
+// storedMessage holds the columns of a messages row needed to build its literal.
+type storedMessage struct {
+	id                  string
+	content             []byte
+	date                time.Time
+	threadID            sql.NullString
+	plainText, htmlText sql.NullString
+	subject, from       sql.NullString
+	to, cc              []byte // JSON arrays
+
+	createseq, modseq int64 // Transactions that created and last changed the row
+}
+
+// encodeContent encodes a literal for the content column.
+// Stored content is always base64; the decoded payload is either raw MIME or an armored OpenPGP message.
+func encodeContent(literal []byte) string {
+	return base64.StdEncoding.EncodeToString(literal)
+}
+
+// decodeContent reverses encodeContent.
+// Content that is not valid base64 is assumed to be a raw literal stored by an older writer.
+func decodeContent(content []byte) []byte {
+	trimmed := bytes.TrimSpace(content)
+
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(trimmed)))
+	n, err := base64.StdEncoding.Decode(decoded, trimmed)
+	if err != nil {
+		return content
+	}
+
+	return decoded[:n]
+}
+
+// isOpenPGP reports whether a decoded payload is an OpenPGP message rather than raw MIME: either
+// armored, or starting with one of the packets an encrypted binary message starts with.
+func isOpenPGP(payload []byte) bool {
+	if bytes.HasPrefix(bytes.TrimSpace(payload), []byte(pgpArmorHeader)) {
+		return true
+	}
+	if len(payload) == 0 || payload[0]&0x80 == 0 {
+		return false
+	}
+
+	// The packet tag is in the low six bits of the first byte in the new format, and in the
+	// four bits above the length type in the old one (RFC 9580, section 4.2).
+	tag := payload[0] & 0x3f
+	if payload[0]&0x40 == 0 {
+		tag = (payload[0] >> 2) & 0x0f
+	}
+
+	switch tag {
+	case 1, 3: // Public-key and symmetric-key encrypted session keys
+		return true
+	case 8, 10: // Compressed data, marker
+		return true
+	case 18, 20: // Symmetrically encrypted integrity protected data, AEAD encrypted data
+		return true
+	default:
+		return false
+	}
+}
+
+// buildLiteral runs stored message content through the decode pipeline and returns the RFC 5322 literal
+// with its parsed form: base64 -> OpenPGP encrypted message -> inner MIME message.
+// Rows without content are synthesized from their plain_text, html_text and metadata columns.
+// Messages that cannot be decrypted or parsed are replaced by a placeholder explaining why.
+// It is used both at sync time and when Gluon asks for a literal it no longer has cached.
+func (c *MyDBConnector) buildLiteral(msg storedMessage) ([]byte, *imap.ParsedMessage, error) {
+	messageID, date := msg.id, msg.date
+
+	var literal []byte
+
+	if len(bytes.TrimSpace(msg.content)) == 0 {
+		if !msg.hasSynthesizableBody() {
+			return nil, nil, ErrEmptyContent
+		}
+
+		synthesized, err := c.synthesizeLiteral(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		literal = synthesized
+	} else {
+		literal = decodeContent(msg.content)
+
+		if isOpenPGP(literal) {
+			u := c.currentUser()
+			if u == nil {
+				return c.placeholderLiteral(messageID, date, ErrNotAuthorized)
+			}
+
+			decrypter, err := c.decrypterOf(u)
+			if err != nil {
+				log.Printf("Failed to unlock the key of %s: %v", c.email, err)
+				return c.placeholderLiteral(messageID, date, ErrDecryptionFailed)
+			}
+
+			decrypted, err := decrypter.Decrypt(literal)
+			if err != nil {
+				log.Printf("Failed to decrypt message %s: %v", messageID, err)
+				return c.placeholderLiteral(messageID, date, ErrDecryptionFailed)
+			}
+			literal = decrypted
+		}
+	}
+
+	parsed, err := imap.NewParsedMessage(literal)
+	if err != nil {
+		log.Printf("Failed to parse message %s: %v", messageID, err)
+		return c.placeholderLiteral(messageID, date, ErrInvalidLiteral)
+	}
+
+	return literal, parsed, nil
+}
+
+// decrypterOf returns the private key of account u unlocked. The key is only unlocked on first
+// use, and again once the account's key or password changed.
+func (c *MyDBConnector) decrypterOf(u *user.UserConfig) (*pgp.Decrypter, error) {
+	c.decrypterLock.Lock()
+	defer c.decrypterLock.Unlock()
+
+	key := [2]string{u.OpenPGP.PrivateKey, u.Key}
+	if c.decrypter != nil && c.decrypterKey == key {
+		return c.decrypter, nil
+	}
+
+	decrypter, err := pgp.NewDecrypter(u.OpenPGP.PrivateKey, u.Key)
+	if err != nil {
+		return nil, err
+	}
+	// The previous key may still be in use by a concurrent call, so it is left to the GC.
+	c.decrypter, c.decrypterKey = decrypter, key
+
+	return decrypter, nil
+}
+
+// placeholderLiteral builds a plain text message standing in for one whose content is unusable.
+// It carries the X-Airsend-Placeholder header so that clients and support can tell it apart.
+func (c *MyDBConnector) placeholderLiteral(messageID string, date time.Time, reason error) ([]byte, *imap.ParsedMessage, error) {
+	domain := c.emailDomain()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: \"Mail System\" <mailer-daemon@%s>\r\n", domain)
+	fmt.Fprintf(&b, "To: <%s>\r\n", c.email)
+	fmt.Fprintf(&b, "Subject: [Message unavailable] %s\r\n", reason)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s.placeholder@%s>\r\n", messageID, domain)
+	b.WriteString("X-Airsend-Placeholder: " + reason.Error() + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 7bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("The original content of this message could not be displayed (" + reason.Error() + ").\r\n")
+	b.WriteString("Open it in webmail or contact support with message ID " + messageID + ".\r\n")
+
+	literal := b.Bytes()
+
+	parsed, err := imap.NewParsedMessage(literal)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return literal, parsed, nil
+}
+
+// GetMessageLiteral is intended to be used by Gluon when, for some reason, the local cached data no longer exists.
+// Note: this can get called from different go routines.
+// It only reads from the database and from fields guarded by userLock, so concurrent calls are safe.
+func (c *MyDBConnector) GetMessageLiteral(ctx context.Context, id imap.MessageID) ([]byte, error) {
+	msg := storedMessage{id: string(id)}
+
+	err := c.db.QueryRowContext(ctx, queries.GetMessageContentQuery(), string(id), c.email).Scan(
+		&msg.content,
+		&msg.date,
+		&msg.threadID,
+		&msg.plainText,
+		&msg.htmlText,
+		&msg.subject,
+		&msg.from,
+		&msg.to,
+		&msg.cc,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoSuchMessage
+	} else if err != nil {
+		return nil, err
+	}
+
+	literal, _, err := c.buildLiteral(msg)
+
+	return literal, err
+}
@@ -0,0 +1,105 @@
+package connector
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v3/crypto"
+	user "github.com/enjoys-in/airsend-imap/internal/interfaces/user"
+)
+
+func TestIsOpenPGP(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"armored", []byte("\r\n-----BEGIN PGP MESSAGE-----\r\n\r\nwV4D..."), true},
+		{"new format PKESK", []byte{0xc1, 0x5e, 0x03}, true},
+		{"new format SEIPD", []byte{0xd2, 0x54, 0x01}, true},
+		{"old format PKESK", []byte{0x84, 0x5e, 0x03}, true},
+		{"old format compressed", []byte{0xa3, 0x01}, true},
+		{"new format literal data", []byte{0xcb, 0x0c, 0x62}, false},
+		{"old format signature", []byte{0x89, 0x01, 0x33}, false},
+		{"UTF-8 byte order mark", []byte("\xef\xbb\xbfFrom: a@example.com\r\n"), false},
+		{"UTF-8 header", []byte("Sübject: hi\r\n"), false},
+		{"MIME", []byte("From: a@example.com\r\nSubject: hi\r\n\r\nbody\r\n"), false},
+		{"empty", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isOpenPGP(tt.payload); got != tt.want {
+				t.Errorf("isOpenPGP(%q) = %v, want %v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildLiteralDecrypts(t *testing.T) {
+	pgp := crypto.PGP()
+	key, err := pgp.KeyGeneration().AddUserId("Alice", "alice@example.com").New().GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err := pgp.LockKey(key, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	armoredKey, err := locked.Armor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryption, err := pgp.Encryption().Recipient(key).New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mime := "From: bob@example.com\r\nTo: alice@example.com\r\nSubject: Hello\r\n\r\nHi Alice\r\n"
+	encrypted, err := encryption.Encrypt([]byte(mime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored, err := encrypted.ArmorBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConnector(nil, "alice@example.com")
+	defer c.Close(t.Context())
+	c.user = &user.UserConfig{ID: "a1", Email: "alice@example.com", Key: "passphrase", OpenPGP: user.OpenPGPKeys{PrivateKey: armoredKey}}
+
+	for _, payload := range [][]byte{armored, encrypted.Bytes()} {
+		msg := storedMessage{id: "m1", date: time.Now(), content: []byte(base64.StdEncoding.EncodeToString(payload))}
+		literal, _, err := c.buildLiteral(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(literal) != mime {
+			t.Errorf("literal = %q, want %q", literal, mime)
+		}
+	}
+	first := c.decrypter
+
+	if _, _, err := c.buildLiteral(storedMessage{id: "m1", date: time.Now(), content: armored}); err != nil {
+		t.Fatal(err)
+	}
+	if c.decrypter != first {
+		t.Error("the key was unlocked again")
+	}
+
+	// The key is unlocked once, and again only when it changes.
+	c.user = &user.UserConfig{ID: "a1", Email: "alice@example.com", Key: "wrong", OpenPGP: user.OpenPGPKeys{PrivateKey: armoredKey}}
+	literal, _, err := c.buildLiteral(storedMessage{id: "m2", date: time.Now(), content: armored})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(literal, []byte("X-Airsend-Placeholder: "+ErrDecryptionFailed.Error())) {
+		t.Errorf("literal with a wrong passphrase = %q, want a placeholder", literal)
+	}
+	if c.decrypter != first || first == nil {
+		t.Error("the decrypter changed although the key could not be unlocked")
+	}
+}
@@ -0,0 +1,127 @@
+package connector
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/ProtonMail/gluon/imap"
+)
+
+// Custom keywords mapped onto message columns. They are written when a message is appended.
+// Gluon only hands \Seen, \Flagged and $Forwarded changes of a STORE to the connector, so the
+// login proxy writes the keywords and tags of a STORE Gluon accepted (MarkMessagesKeywords,
+// SetMessagesKeywords); changes of \Answered, \Deleted and \Draft stay in Gluon's own state.
+const (
+	FlagImportant      = "$Important"
+	FlagPinned         = "$Pinned"
+	FlagHighPriority   = "$HighPriority"
+	FlagNormalPriority = "$NormalPriority"
+	FlagLowPriority    = "$LowPriority"
+)
+
+// messageFlags mirrors the flag columns of a messages row.
+type messageFlags struct {
+	isRead, isStarred, isReplied, isDeleted, isDraft, isImportant, isPinned, isForwarded bool
+	priority                                                                             MessagePriority
+	tags                                                                                 []string
+}
+
+// newMessageFlags translates an IMAP flag set into message columns.
+// Keywords that have no dedicated column are kept as tags; unknown system flags are dropped.
+func newMessageFlags(flags imap.FlagSet) messageFlags {
+	mf := messageFlags{priority: PriorityNormal, tags: []string{}}
+
+	for _, flag := range flags.ToSlice() {
+		switch strings.ToLower(flag) {
+		case imap.FlagSeenLowerCase:
+			mf.isRead = true
+		case imap.FlagFlaggedLowerCase:
+			mf.isStarred = true
+		case imap.FlagAnsweredLowerCase:
+			mf.isReplied = true
+		case imap.FlagDeletedLowerCase:
+			mf.isDeleted = true
+		case imap.FlagDraftLowerCase:
+			mf.isDraft = true
+		case imap.XFlagDollarForwardedLowerCase, imap.XFlagForwardedLowerCase:
+			mf.isForwarded = true
+		case strings.ToLower(FlagImportant):
+			mf.isImportant = true
+		case strings.ToLower(FlagPinned):
+			mf.isPinned = true
+		case strings.ToLower(FlagHighPriority):
+			mf.priority = PriorityHigh
+		case strings.ToLower(FlagLowPriority):
+			mf.priority = PriorityLow
+		case strings.ToLower(FlagNormalPriority):
+			mf.priority = PriorityNormal
+		default:
+			if strings.HasPrefix(flag, `\`) {
+				continue
+			}
+			mf.tags = append(mf.tags, flag)
+		}
+	}
+
+	return mf
+}
+
+// tagsJSON returns the tags encoded for the JSONB tags column.
+func (mf messageFlags) tagsJSON() []byte {
+	b, err := json.Marshal(mf.tags)
+	if err != nil || mf.tags == nil {
+		return []byte("[]")
+	}
+	return b
+}
+
+// toFlagSet builds the IMAP flag set exposed to clients for these columns.
+func (mf messageFlags) toFlagSet() imap.FlagSet {
+	flags := imap.NewFlagSet()
+
+	// Standard IMAP flags
+	if mf.isRead {
+		flags = flags.Add(imap.FlagSeen)
+	}
+	if mf.isStarred {
+		flags = flags.Add(imap.FlagFlagged)
+	}
+	if mf.isDeleted {
+		flags = flags.Add(imap.FlagDeleted)
+	}
+	if mf.isReplied {
+		flags = flags.Add(imap.FlagAnswered)
+	}
+	if mf.isDraft {
+		flags = flags.Add(imap.FlagDraft)
+	}
+	if mf.isForwarded {
+		flags = flags.Add(imap.ForwardFlagList...)
+	}
+
+	// Gmail/Outlook specific flags (as custom keywords)
+	// These appear as custom flags in IMAP clients
+	if mf.isImportant {
+		flags = flags.Add(FlagImportant)
+	}
+	if mf.isPinned {
+		flags = flags.Add(FlagPinned)
+	}
+
+	// Handle priority flags
+	switch mf.priority {
+	case PriorityHigh:
+		flags = flags.Add(FlagHighPriority)
+	case PriorityLow:
+		flags = flags.Add(FlagLowPriority)
+	default:
+		flags = flags.Add(FlagNormalPriority)
+	}
+
+	// Add each tag as a custom keyword
+	for _, tag := range mf.tags {
+		flags = flags.Add(tag)
+	}
+
+	return flags
+}
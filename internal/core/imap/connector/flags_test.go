@@ -0,0 +1,24 @@
+package connector
+
+import (
+	"testing"
+
+	"github.com/ProtonMail/gluon/imap"
+)
+
+func TestMessageFlagsRoundTrip(t *testing.T) {
+	flags := imap.NewFlagSet(imap.FlagSeen, imap.FlagFlagged, imap.FlagAnswered, imap.FlagDeleted, imap.FlagDraft,
+		FlagImportant, FlagPinned, FlagHighPriority, "project-x")
+
+	mf := newMessageFlags(flags)
+	if !mf.isDraft {
+		t.Error(`\Draft is not stored`)
+	}
+	if string(mf.tagsJSON()) != `["project-x"]` {
+		t.Errorf("tags = %s, want only the keyword without a column", mf.tagsJSON())
+	}
+
+	if got := mf.toFlagSet(); !got.Equals(flags) {
+		t.Errorf("flags = %v, want %v", got.ToSlice(), flags.ToSlice())
+	}
+}
@@ -2,20 +2,28 @@ package connector
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"sync"
-
+	"sync/atomic"
 	"time"
 
 	"github.com/ProtonMail/gluon/connector"
 	"github.com/ProtonMail/gluon/imap"
+	"github.com/bradenaw/juniper/xslices"
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
 	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/enjoys-in/airsend-imap/internal/core/tenant"
+	pgp "github.com/enjoys-in/airsend-imap/internal/crypto"
 	user "github.com/enjoys-in/airsend-imap/internal/interfaces/user"
 	"github.com/enjoys-in/airsend-imap/internal/utils/encryption"
+	"github.com/lib/pq"
 )
 
 var (
@@ -25,7 +33,26 @@ var (
 	ErrInvalidPrefix   = errors.New("invalid prefix")
 	ErrRenameForbidden = errors.New("rename operation is not allowed")
 	ErrDeleteForbidden = errors.New("delete operation is not allowed")
+	ErrNotAuthorized   = errors.New("connector is not authorized")
+
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrAccountMismatch    = errors.New("account is not the one the connector was loaded for")
+	ErrTenantDisabled     = errors.New("IMAP is disabled for the account's tenant")
+
+	ErrMailboxHasChildren = errors.New("mailbox has inferior mailboxes containing messages")
+	ErrMailboxExists      = errors.New("a mailbox with that name already exists")
 )
+
+// mailboxDelimiter is the hierarchy delimiter used when joining mailbox names into paths.
+// It must match the delimiter the Gluon server is configured with.
+const mailboxDelimiter = "/"
+
+// loginTicketTTL is how long a ticket from IssueLoginTicket can be used.
+const loginTicketTTL = time.Minute
+
+// messageBatchSize bounds the number of message IDs bound to a single statement.
+const messageBatchSize = 500
+
 var defaultFlags imap.FlagSet = imap.NewFlagSet(
 	imap.FlagSeen,
 	imap.FlagAnswered,
@@ -40,46 +67,274 @@ var defaultFlags imap.FlagSet = imap.NewFlagSet(
 type MyDBConnector struct {
 	db                         *sql.DB
 	email                      string
+	login                      string // Address of the account as logins name it, see identity.Parse
+	defaultDomain              string // Domain of logins that have none
 	updates                    chan imap.Update
 	state                      *MailboxState
 	user                       *user.UserConfig
-	lastClientIMAPID           imap.IMAPID
+	userLock                   sync.RWMutex
+	decrypter                  *pgp.Decrypter // Private key of the account, unlocked on first use
+	decrypterKey               [2]string      // Armored private key and password decrypter was unlocked with
+	decrypterLock              sync.Mutex
+	lastClientIMAPID           imap.IMAPID // Last IMAP ID sent by a client of this user
+	imapIDLock                 sync.Mutex
+	tickets                    map[string]time.Time // One-time login ticket -> expiry
+	ticketLock                 sync.Mutex
+	locks                      LoginLocks // Nil when failed logins are not tracked
+	tenants                    Tenants    // Nil when tenants do not restrict anything
 	allowUnknownMailbox        bool
 	folderPrefix, labelsPrefix string
+	cascadeMailboxDelete       bool
 	updatesAllowedToFail       int32
+	updateFailures             int32     // Failed updates in a row, only touched by runUpdates
+	lastResync                 time.Time // Only touched by runUpdates
+	resyncing                  atomic.Bool
 	queueLock                  sync.Mutex
-	queue                      []imap.Update
+	queue                      []queuedUpdate
+	queueSignal                chan struct{}
+	syncLock                   sync.Mutex
 	mailboxVisibilities        map[imap.MailboxID]imap.MailboxVisibility
+	ctx                        context.Context
+	cancel                     context.CancelFunc
+	updatesDone                chan struct{}
+	closeOnce                  sync.Once
 }
 
 func NewConnector(db *sql.DB, email string) *MyDBConnector {
-	return &MyDBConnector{
-		db:                  db,
-		email:               email,
-		updates:             make(chan imap.Update, 100),
-		state:               newMailboxState(defaultFlags, defaultFlags, imap.FlagSet{}),
-		user:                nil,
-		lastClientIMAPID:    imap.NewIMAPID(),
-		allowUnknownMailbox: true,
-		folderPrefix:        "",
-		labelsPrefix:        "",
-		mailboxVisibilities: make(map[imap.MailboxID]imap.MailboxVisibility),
+	ctx, cancel := context.WithCancel(context.Background())
+
+	login := strings.ToLower(email)
+	if id, err := identity.Parse(email, ""); err == nil {
+		login = id.Address()
+	}
+
+	c := &MyDBConnector{
+		db:                   db,
+		email:                email,
+		login:                login,
+		updates:              make(chan imap.Update),
+		updatesAllowedToFail: defaultUpdatesAllowedToFail,
+		queueSignal:          make(chan struct{}, 1),
+		ctx:                  ctx,
+		cancel:               cancel,
+		updatesDone:          make(chan struct{}),
+		state:                newMailboxState(defaultFlags, defaultFlags, imap.FlagSet{}),
+		user:                 nil,
+		lastClientIMAPID:     imap.NewIMAPID(),
+		tickets:              make(map[string]time.Time),
+		allowUnknownMailbox:  true,
+		folderPrefix:         "",
+		labelsPrefix:         "",
+		mailboxVisibilities:  make(map[imap.MailboxID]imap.MailboxVisibility),
 	}
+
+	go c.runUpdates()
+
+	return c
+}
+
+// LoginLocks tells which accounts are locked out after too many failed logins.
+type LoginLocks interface {
+	Locked(account string) bool
+}
+
+// SetLoginLocks makes Authorize refuse the account while locks reports it locked out.
+// It must be called before the connector is handed to Gluon.
+func (c *MyDBConnector) SetLoginLocks(locks LoginLocks) {
+	c.locks = locks
+}
+
+// Tenants returns the settings of the tenants accounts belong to.
+type Tenants interface {
+	Lookup(name string) (tenant.Tenant, bool)
+}
+
+// SetTenants makes Authorize refuse the accounts of tenants with IMAP disabled and cap their
+// mailbox size by their tenant's. It must be called before the connector is handed to Gluon.
+func (c *MyDBConnector) SetTenants(tenants Tenants) {
+	c.tenants = tenants
+}
+
+// SetDefaultDomain sets the domain of logins that have none. It must be called before the
+// connector is handed to Gluon.
+func (c *MyDBConnector) SetDefaultDomain(domain string) {
+	c.defaultDomain = domain
 }
 
 func (c *MyDBConnector) Init(ctx context.Context, cache connector.IMAPState) error { return nil }
 
 // Authorize returns whether the given username/password combination are valid for this connector.
+// Gluon asks every loaded connector in turn, so only the connector's own account is accepted,
+// however the login spells it (see identity.Parse); other and malformed logins are turned down
+// without touching the database. The password may also be a login ticket issued by IssueLoginTicket.
+// A locked out account is refused without checking the password, and so is an account that no
+// longer is the one the connector was loaded for or whose tenant has IMAP disabled.
 func (c *MyDBConnector) Authorize(ctx context.Context, username string, password []byte) bool {
+	id, err := identity.Parse(username, c.defaultDomain)
+	if err != nil || id.Address() != c.login {
+		return false
+	}
+	if c.locks != nil && c.locks.Locked(c.login) {
+		log.Printf("Authorize: %s: locked out after too many failed logins", c.login)
+		return false
+	}
+
+	var userConfig *user.UserConfig
+	if c.consumeLoginTicket(password) {
+		userConfig, err = LookupAccount(ctx, c.db, c.login)
+	} else {
+		userConfig, err = Authenticate(ctx, c.db, c.login, password)
+	}
+	if err != nil {
+		log.Printf("Authorize: %s: %v", c.login, err)
+		return false
+	}
+	if err := c.applyTenant(userConfig); err != nil {
+		log.Printf("⚠️ Authorize: %s: %v", c.login, err)
+		return false
+	}
+
+	c.userLock.Lock()
+	defer c.userLock.Unlock()
+
+	if err := c.checkSameAccount(userConfig); err != nil {
+		log.Printf("⚠️ Authorize: %s: %v", c.login, err)
+		return false
+	}
+	c.user = userConfig
+
+	return true
+}
+
+// checkSameAccount returns an error when account is not the account the connector serves: another
+// account whose email only differs in case, or the account recreated or moved to another tenant
+// since it last logged in. The caller must hold c.userLock.
+func (c *MyDBConnector) checkSameAccount(account *user.UserConfig) error {
+	if account.Email != c.email {
+		return fmt.Errorf("%w: login resolved to %s", ErrAccountMismatch, account.Email)
+	}
+	if c.user == nil {
+		return nil
+	}
+	if account.ID != c.user.ID {
+		return fmt.Errorf("%w: account %s replaced by %s", ErrAccountMismatch, c.user.ID, account.ID)
+	}
+	if account.TenantName != c.user.TenantName {
+		return fmt.Errorf("%w: tenant %q changed to %q", ErrAccountMismatch, c.user.TenantName, account.TenantName)
+	}
+	return nil
+}
+
+// applyTenant refuses an account whose tenant has IMAP disabled, and caps its mailbox size by
+// its tenant's.
+func (c *MyDBConnector) applyTenant(account *user.UserConfig) error {
+	if c.tenants == nil {
+		return nil
+	}
+
+	t, ok := c.tenants.Lookup(account.TenantName)
+	if !ok {
+		return nil
+	}
+	if !t.IMAPEnabled {
+		return fmt.Errorf("%w: %s", ErrTenantDisabled, t.Name)
+	}
+	account.MailboxSize = t.MailboxSize(account.MailboxSize)
+
+	return nil
+}
+
+// IssueLoginTicket returns a one-time password Authorize accepts for this connector's account
+// within loginTicketTTL. It lets a login checked by other means, such as an OAuth bearer token,
+// go through Gluon, which only knows passwords.
+func (c *MyDBConnector) IssueLoginTicket() ([]byte, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(raw)
+
+	c.ticketLock.Lock()
+	defer c.ticketLock.Unlock()
+
+	now := time.Now()
+	for t, expires := range c.tickets {
+		if now.After(expires) {
+			delete(c.tickets, t)
+		}
+	}
+	c.tickets[ticket] = now.Add(loginTicketTTL)
+
+	return []byte(ticket), nil
+}
+
+// consumeLoginTicket reports whether password is a live login ticket, which can then not be used again.
+func (c *MyDBConnector) consumeLoginTicket(password []byte) bool {
+	c.ticketLock.Lock()
+	defer c.ticketLock.Unlock()
+
+	expires, ok := c.tickets[string(password)]
+	if !ok {
+		return false
+	}
+	delete(c.tickets, string(password))
+
+	return time.Now().Before(expires)
+}
+
+// Authenticate checks an address/password combination against the IMAP enabled accounts and
+// returns the account. The address is the Address of a parsed login. The password may be the
+// account's main password or one of its app passwords. It needs no loaded connector, so a login
+// can be checked before its user is loaded.
+func Authenticate(ctx context.Context, db *sql.DB, address string, password []byte) (*user.UserConfig, error) {
+	account, err := LookupAccount(ctx, db, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// App passwords are checked first: they are cheap to check, and clients that use them
+	// log in far more often than people type their main password.
+	appPassword, err := useAppPassword(ctx, db, account.ID, string(password))
+	if err != nil {
+		return nil, err
+	}
+
+	ok, needsRehash := appPassword, false
+	if !appPassword {
+		ok, needsRehash = encryption.VerifyPassword(account.Hash, string(password))
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	if needsRehash {
+		if upgraded, err := upgradePasswordHash(ctx, db, account.ID, account.Hash, string(password)); err != nil {
+			log.Printf("⚠️ Failed to rehash the password of %s: %v", account.Email, err)
+		} else {
+			account.Hash = upgraded
+		}
+	}
+
+	return account, nil
+}
+
+// LookupAccount returns the IMAP enabled account of an address, without checking any password.
+// The account's Email is the email as stored, which may differ in case from the address.
+// Unknown accounts are reported as ErrInvalidCredentials.
+func LookupAccount(ctx context.Context, db *sql.DB, address string) (*user.UserConfig, error) {
 	var (
-		id, hash, tenant, key     string
-		mailboxSize, usage        int
-		openPGPJSON, sysEmailJSON []byte
+		id, email, hash, tenant, key string
+		mailboxSize, usage           int
+		openPGPJSON, sysEmailJSON    []byte
 	)
 
-	parts := strings.Split(username, "@")
-	row := c.db.QueryRowContext(ctx, queries.GetAuthUserQuery(), username, parts[1])
+	_, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	row := db.QueryRowContext(ctx, queries.GetAuthUserQuery(), address, domain)
 	err := row.Scan(&id,
+		&email,
 		&hash,
 		&tenant,
 		&mailboxSize,
@@ -88,35 +343,31 @@ func (c *MyDBConnector) Authorize(ctx context.Context, username string, password
 		&openPGPJSON,
 		&sysEmailJSON)
 
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	}
 	if err != nil {
-		log.Print("Scanning Rows", err)
-		return false
+		return nil, err
 	}
 
-	isMatch := encryption.ValidatePassword(hash, string(password))
-
-	if !isMatch {
-		log.Print("Password Mismatch", err)
-		return false
-	}
 	// Unmarshal JSON columns
 	var openPGP user.OpenPGPKeys
 	if len(openPGPJSON) > 0 {
 		if err := json.Unmarshal(openPGPJSON, &openPGP); err != nil {
-			log.Printf("⚠️ Failed to parse OpenPGP JSON for %s: %v", username, err)
+			log.Printf("⚠️ Failed to parse OpenPGP JSON for %s: %v", email, err)
 		}
 	}
 
 	var sysEmail user.SystemEmail
 	if len(sysEmailJSON) > 0 {
 		if err := json.Unmarshal(sysEmailJSON, &sysEmail); err != nil {
-			log.Printf("⚠️ Failed to parse SystemEmail JSON for %s: %v", username, err)
+			log.Printf("⚠️ Failed to parse SystemEmail JSON for %s: %v", email, err)
 		}
 	}
 
-	user := &user.UserConfig{
+	return &user.UserConfig{
 		ID:          id,
-		Email:       username,
+		Email:       email,
 		Hash:        hash,
 		TenantName:  tenant,
 		MailboxSize: mailboxSize,
@@ -124,22 +375,157 @@ func (c *MyDBConnector) Authorize(ctx context.Context, username string, password
 		Key:         key,
 		OpenPGP:     openPGP,
 		SystemEmail: sysEmail,
+	}, nil
+}
+
+// useAppPassword reports whether password is a live IMAP app password of an account, and
+// records its use if so.
+func useAppPassword(ctx context.Context, db *sql.DB, accountID, password string) (bool, error) {
+	var appPasswordID string
+	err := db.QueryRowContext(ctx, queries.UseIMAPAppPasswordQuery(), accountID, encryption.HashAppPassword(password)).Scan(&appPasswordID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
-	c.user = user
 
-	return true
+	return true, nil
 }
 
-// CreateMailbox creates a mailbox with the given name.
+// upgradePasswordHash replaces a stored password hash with one of the preferred scheme and returns
+// the hash now stored.
+// The hash is only replaced if it did not change meanwhile, and the change is not announced as a
+// password change, since the password stays the same.
+func upgradePasswordHash(ctx context.Context, db *sql.DB, accountID, oldHash, password string) (string, error) {
+	newHash, err := encryption.HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := beginIMAPTx(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, queries.UpdatePasswordHashQuery(), accountID, oldHash, newHash)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return oldHash, err
+	}
+	return newHash, nil
+}
+
+// Login returns the address of the connector's account as logins name it.
+func (c *MyDBConnector) Login() string {
+	return c.login
+}
+
+// TenantName returns the tenant of the account as of its last successful Authorize, or "" before.
+func (c *MyDBConnector) TenantName() string {
+	if u := c.currentUser(); u != nil {
+		return u.TenantName
+	}
+	return ""
+}
+
+// currentUser returns the account loaded by the last successful Authorize, or nil.
+// The account is never changed in place, so it can be read without holding c.userLock.
+func (c *MyDBConnector) currentUser() *user.UserConfig {
+	c.userLock.RLock()
+	defer c.userLock.RUnlock()
+
+	return c.user
+}
+
+// setUsage records the usage of the account after a write, unless another account was
+// authorized since. The account is copied so that readers of the previous one are not raced.
+func (c *MyDBConnector) setUsage(accountID string, usage int) {
+	c.userLock.Lock()
+	defer c.userLock.Unlock()
+
+	if c.user == nil || c.user.ID != accountID {
+		return
+	}
+	u := *c.user
+	u.Usage = usage
+	c.user = &u
+}
+
+// CreateMailbox creates a mailbox with the given name, and its missing superiors.
+// ErrMailboxExists is returned when the name is taken.
 func (c *MyDBConnector) CreateMailbox(ctx context.Context, cache connector.IMAPStateWrite, name []string) (imap.Mailbox, error) {
+	u := c.currentUser()
+	if u == nil {
+		return imap.Mailbox{}, ErrNotAuthorized
+	}
 
-	return imap.Mailbox{}, nil
+	exclusive, err := c.validateName(name)
+	if err != nil {
+		return imap.Mailbox{}, err
+	}
+
+	tx, err := c.beginTx(ctx)
+	if err != nil {
+		return imap.Mailbox{}, err
+	}
+	defer tx.Rollback()
+
+	// Gluon creates the superiors it knows to be missing first; those it takes for existing
+	// are created here when the database lacks them.
+	superiors := make(map[imap.MailboxID][]string)
+	for i := 1; i < len(name); i++ {
+		id, err := insertMailbox(ctx, tx, u.ID, name[:i])
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return imap.Mailbox{}, err
+		}
+		superiors[id] = name[:i]
+	}
+
+	id, err := insertMailbox(ctx, tx, u.ID, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return imap.Mailbox{}, ErrMailboxExists
+	} else if err != nil {
+		return imap.Mailbox{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return imap.Mailbox{}, err
+	}
+
+	for superiorID, superiorName := range superiors {
+		superiorExclusive, err := c.validateName(superiorName)
+		if err != nil {
+			return imap.Mailbox{}, err
+		}
+		c.enqueue(imap.NewMailboxCreated(c.state.createMailbox(superiorID, superiorName, superiorExclusive)))
+	}
+
+	return c.state.createMailbox(id, name, exclusive), nil
 }
 
-// GetMessageLiteral is intended to be used by Gluon when, for some reason, the local cached data no longer exists.
-// Note: this can get called from different go routines.
-func (c *MyDBConnector) GetMessageLiteral(ctx context.Context, id imap.MessageID) ([]byte, error) {
-	return []byte("fdffd"), nil
+// insertMailbox creates one of the account's mailboxes. sql.ErrNoRows is returned when one with
+// the same name exists already.
+func insertMailbox(ctx context.Context, tx *sql.Tx, accountID string, name []string) (imap.MailboxID, error) {
+	var id string
+	if err := tx.QueryRowContext(ctx, queries.InsertMailboxQuery(),
+		accountID,
+		name[len(name)-1],
+		strings.Join(name, mailboxDelimiter),
+		mailboxDelimiter,
+	).Scan(&id); err != nil {
+		return "", err
+	}
+
+	return imap.MailboxID(id), nil
 }
 
 // GetMailboxVisibility can be used to retrieve the visibility of mailboxes for connected clients.
@@ -149,49 +535,487 @@ func (c *MyDBConnector) GetMailboxVisibility(ctx context.Context, mboxID imap.Ma
 }
 
 // UpdateMailboxName sets the name of the mailbox with the given ID.
+// Inferior mailboxes are moved along with it; system folders cannot be renamed.
 func (c *MyDBConnector) UpdateMailboxName(ctx context.Context, cache connector.IMAPStateWrite, mboxID imap.MailboxID, newName []string) error {
+	u := c.currentUser()
+	if u == nil {
+		return ErrNotAuthorized
+	}
+	if _, err := c.validateName(newName); err != nil {
+		return err
+	}
+
+	tx, err := c.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	oldPath, delimiter, err := c.getMailboxPath(ctx, tx, u.ID, mboxID)
+	if err != nil {
+		return err
+	}
+	if isSystemMailbox(strings.Split(oldPath, delimiter)) {
+		return ErrRenameForbidden
+	}
+
+	newPath := strings.Join(newName, delimiter)
+	if _, err := tx.ExecContext(ctx, queries.RenameMailboxQuery(), u.ID, string(mboxID), newName[len(newName)-1], newPath); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, queries.RenameMailboxInferiorsQuery(), u.ID, oldPath, newPath, delimiter)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	inferiors := make(map[imap.MailboxID][]string)
+	for rows.Next() {
+		var id, path string
+		if err := rows.Scan(&id, &path); err != nil {
+			return err
+		}
+		inferiors[imap.MailboxID(id)] = strings.Split(path, delimiter)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.state.updateMailboxName(mboxID, newName)
+	for id, name := range inferiors {
+		c.state.updateMailboxName(id, name)
+	}
+
 	return nil
 }
 
 // DeleteMailbox deletes the mailbox with the given ID.
+// Empty inferior mailboxes are deleted along with it. Inferiors holding messages are only deleted
+// when cascading deletes are enabled, otherwise ErrMailboxHasChildren is returned. System folders cannot be deleted.
+// Messages that are also in other mailboxes are kept there; the size of the others is given
+// back to the account usage.
 func (c *MyDBConnector) DeleteMailbox(ctx context.Context, cache connector.IMAPStateWrite, mboxID imap.MailboxID) error {
+	u := c.currentUser()
+	if u == nil {
+		return ErrNotAuthorized
+	}
+
+	tx, err := c.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	path, delimiter, err := c.getMailboxPath(ctx, tx, u.ID, mboxID)
+	if err != nil {
+		return err
+	}
+	if isSystemMailbox(strings.Split(path, delimiter)) {
+		return ErrDeleteForbidden
+	}
+
+	rows, err := tx.QueryContext(ctx, queries.GetMailboxInferiorsQuery(), u.ID, path, delimiter)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var inferiors []imap.MailboxID
+	for rows.Next() {
+		var (
+			id, inferiorPath string
+			count            int
+		)
+		if err := rows.Scan(&id, &inferiorPath, &count); err != nil {
+			return err
+		}
+		if count > 0 && !c.cascadeMailboxDelete {
+			return ErrMailboxHasChildren
+		}
+		inferiors = append(inferiors, imap.MailboxID(id))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ids := []string{string(mboxID)}
+	for _, id := range inferiors {
+		ids = append(ids, string(id))
+	}
+	// Messages also in other mailboxes move there first, the others go with the mailboxes.
+	for _, query := range []string{
+		queries.PromoteMailboxesMessagesQuery(),
+		queries.ReleaseMailboxesUsageQuery(),
+		queries.DeleteMailboxesQuery(),
+	} {
+		if _, err := tx.ExecContext(ctx, query, u.ID, pq.Array(ids)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.state.deleteMailbox(mboxID)
+	// Gluon only removes the target mailbox locally, the inferiors need an update of their own.
+	for _, id := range inferiors {
+		c.state.deleteMailbox(id)
+		c.PushMailboxDeleted(id)
+	}
+
 	return nil
 }
 
+// getMailboxPath returns the path and delimiter of one of the account's mailboxes, locking its row.
+func (c *MyDBConnector) getMailboxPath(ctx context.Context, tx *sql.Tx, accountID string, mboxID imap.MailboxID) (string, string, error) {
+	var path, delimiter string
+
+	err := tx.QueryRowContext(ctx, queries.GetMailboxPathQuery(), accountID, string(mboxID)).Scan(&path, &delimiter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrNoSuchMailbox
+	}
+
+	return path, delimiter, err
+}
+
 // CreateMessage creates a new message on the remote.
+// The literal is stored as-is in the target folder and the flags are translated back into message columns.
+// Its size is added to the account usage, and ErrOverQuota is returned when that exceeds the account's quota.
 func (c *MyDBConnector) CreateMessage(ctx context.Context, cache connector.IMAPStateWrite, mboxID imap.MailboxID, literal []byte, flags imap.FlagSet, date time.Time) (imap.Message, []byte, error) {
-	return imap.Message{}, nil, nil
+	u := c.currentUser()
+	if u == nil {
+		return imap.Message{}, nil, ErrNotAuthorized
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	mf := newMessageFlags(flags)
+
+	tx, err := c.beginTx(ctx)
+	if err != nil {
+		return imap.Message{}, nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		messageID string
+		size      int
+	)
+	err = tx.QueryRowContext(ctx, queries.InsertMessageQuery(),
+		u.ID,
+		string(mboxID),
+		mf.priority,
+		mf.isRead,
+		mf.isPinned,
+		mf.isReplied,
+		mf.isDeleted,
+		mf.isImportant,
+		mf.isStarred,
+		mf.tagsJSON(),
+		encodeContent(literal),
+		date,
+		mf.isForwarded,
+		mf.isDraft,
+	).Scan(&messageID, &size)
+	if errors.Is(err, sql.ErrNoRows) {
+		return imap.Message{}, nil, ErrNoSuchMailbox
+	} else if err != nil {
+		return imap.Message{}, nil, err
+	}
+
+	// Adding to the usage locks the account row until the quota is checked.
+	var usage int
+	if err := tx.QueryRowContext(ctx, queries.AddUsageQuery(), u.ID, size).Scan(&usage); err != nil {
+		return imap.Message{}, nil, err
+	}
+	quota, err := c.quotaAfterWrite(ctx, tx, u)
+	if err != nil {
+		return imap.Message{}, nil, err
+	}
+	if quota.StorageExceeded() || quota.MessagesExceeded() {
+		return imap.Message{}, nil, ErrOverQuota
+	}
+
+	if err := tx.Commit(); err != nil {
+		return imap.Message{}, nil, err
+	}
+	c.setUsage(u.ID, usage)
+
+	return imap.Message{
+		ID:    imap.MessageID(messageID),
+		Flags: mf.toFlagSet(),
+		Date:  date,
+	}, literal, nil
 }
 
 // AddMessagesToMailbox adds the given messages to the given mailbox.
+// The messages keep their home folder; the mailbox becomes an additional membership (COPY or label).
+// ErrOverQuota is returned when the account would have more messages than its quota allows.
 func (c *MyDBConnector) AddMessagesToMailbox(ctx context.Context, cache connector.IMAPStateWrite, messageIDs []imap.MessageID, mboxID imap.MailboxID) error {
-	return nil
+	u := c.currentUser()
+	if u == nil {
+		return ErrNotAuthorized
+	}
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	tx, err := c.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Copies only add memberships, so they count against the message limit but not the storage.
+	if _, err := tx.ExecContext(ctx, queries.LockAccountQuery(), u.ID); err != nil {
+		return err
+	}
+	for _, batch := range xslices.Chunk(messageIDs, messageBatchSize) {
+		ids := xslices.Map(batch, func(id imap.MessageID) string { return string(id) })
+		if _, err := tx.ExecContext(ctx, queries.AddMessagesToMailboxQuery(), u.ID, pq.Array(ids), string(mboxID)); err != nil {
+			return err
+		}
+	}
+
+	quota, err := c.quotaAfterWrite(ctx, tx, u)
+	if err != nil {
+		return err
+	}
+	if quota.MessagesExceeded() {
+		return ErrOverQuota
+	}
+
+	return tx.Commit()
 }
 
 // RemoveMessagesFromMailbox removes the given messages from the given mailbox.
+// Messages that are left without any mailbox are deleted, and their size given back to the account usage.
 func (c *MyDBConnector) RemoveMessagesFromMailbox(ctx context.Context, cache connector.IMAPStateWrite, messageIDs []imap.MessageID, mboxID imap.MailboxID) error {
-	return nil
+	return c.updateMessages(ctx, messageIDs, func(tx *sql.Tx, accountID string, ids any) error {
+		for _, query := range []string{
+			queries.RemoveMessagesFromMailboxQuery(),
+			queries.DeleteOrphanMessagesQuery(),
+			queries.PromoteMessagesFolderQuery(),
+		} {
+			if _, err := tx.ExecContext(ctx, query, accountID, ids, string(mboxID)); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, queries.DeleteRedundantMembershipsQuery(), accountID, ids)
+		return err
+	})
 }
 
 // MoveMessages removes the given messages from one mailbox and adds them to the another mailbox.
 // Returns true if the original messages should be removed from mboxFromID (e.g: Distinguishing between labels and folders).
+// Only a move from a folder to a label keeps the messages in the source.
 func (c *MyDBConnector) MoveMessages(ctx context.Context, cache connector.IMAPStateWrite, messageIDs []imap.MessageID, mboxFromID, mboxToID imap.MailboxID) (bool, error) {
-	return true, nil
+	fromLabel, toLabel := c.isLabel(mboxFromID), c.isLabel(mboxToID)
+	from, to := string(mboxFromID), string(mboxToID)
+
+	err := c.updateMessages(ctx, messageIDs, func(tx *sql.Tx, accountID string, ids any) error {
+		exec := func(query string, args ...any) error {
+			_, err := tx.ExecContext(ctx, query, append([]any{accountID, ids}, args...)...)
+			return err
+		}
+
+		switch {
+		case toLabel && !fromLabel:
+			return exec(queries.AddMessagesToMailboxQuery(), to)
+
+		case toLabel && fromLabel:
+			if err := exec(queries.RemoveMessagesFromMailboxQuery(), from); err != nil {
+				return err
+			}
+			return exec(queries.AddMessagesToMailboxQuery(), to)
+
+		case fromLabel:
+			if err := exec(queries.RemoveMessagesFromMailboxQuery(), from); err != nil {
+				return err
+			}
+			if err := exec(queries.SetMessagesFolderQuery(), to); err != nil {
+				return err
+			}
+
+		default:
+			// Messages either live in the source folder or were copied there.
+			if err := exec(queries.AddMessagesToMailboxQuery(), to); err != nil {
+				return err
+			}
+			if err := exec(queries.RemoveMessagesFromMailboxQuery(), from); err != nil {
+				return err
+			}
+			if err := exec(queries.MoveMessagesFolderQuery(), from, to); err != nil {
+				return err
+			}
+		}
+
+		return exec(queries.DeleteRedundantMembershipsQuery())
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return !toLabel || fromLabel, nil
+}
+
+// isLabel reports whether the mailbox is a Gmail-style label rather than an exclusive folder.
+// Without a labels prefix every mailbox is a folder.
+func (c *MyDBConnector) isLabel(mboxID imap.MailboxID) bool {
+	if c.labelsPrefix == "" {
+		return false
+	}
+
+	mbox, err := c.state.getMailbox(mboxID)
+	if err != nil || len(mbox.Name) == 0 || mbox.Name[0] != c.labelsPrefix {
+		return false
+	}
+
+	exclusive, err := c.validateName(mbox.Name)
+
+	return err == nil && !exclusive
 }
 
 // MarkMessagesSeen sets the seen value of the given messages.
 func (c *MyDBConnector) MarkMessagesSeen(ctx context.Context, cache connector.IMAPStateWrite, messageIDs []imap.MessageID, seen bool) error {
-	return nil
+	return c.updateMessages(ctx, messageIDs, func(tx *sql.Tx, accountID string, ids any) error {
+		_, err := tx.ExecContext(ctx, queries.SetMessagesReadQuery(), accountID, ids, seen)
+		return err
+	})
 }
 
 // MarkMessagesFlagged sets the flagged value of the given messages.
 func (c *MyDBConnector) MarkMessagesFlagged(ctx context.Context, cache connector.IMAPStateWrite, messageIDs []imap.MessageID, flagged bool) error {
-	return nil
+	return c.updateMessages(ctx, messageIDs, func(tx *sql.Tx, accountID string, ids any) error {
+		_, err := tx.ExecContext(ctx, queries.SetMessagesStarredQuery(), accountID, ids, flagged)
+		return err
+	})
 }
 
 // MarkMessagesForwarded sets the forwarded value of the give messages.
 func (c *MyDBConnector) MarkMessagesForwarded(ctx context.Context, cache connector.IMAPStateWrite, messageIDs []imap.MessageID, forwarded bool) error {
-	return nil
+	return c.updateMessages(ctx, messageIDs, func(tx *sql.Tx, accountID string, ids any) error {
+		_, err := tx.ExecContext(ctx, queries.SetMessagesForwardedQuery(), accountID, ids, forwarded)
+		return err
+	})
+}
+
+// MarkMessagesKeywords adds (set=true) or removes the given custom keywords on the given messages.
+// $Important, $Pinned and the priority keywords map onto their columns, any other keyword onto tags.
+// Gluon keeps custom keywords in its own state and never routes them to the connector, so the
+// login proxy calls this for the keywords of a STORE that Gluon accepted.
+func (c *MyDBConnector) MarkMessagesKeywords(ctx context.Context, messageIDs []imap.MessageID, keywords imap.FlagSet, set bool) error {
+	mf := newMessageFlags(keywords)
+
+	var priorities []MessagePriority
+	if keywords.Contains(FlagHighPriority) {
+		priorities = append(priorities, PriorityHigh)
+	}
+	if keywords.Contains(FlagNormalPriority) {
+		priorities = append(priorities, PriorityNormal)
+	}
+	if keywords.Contains(FlagLowPriority) {
+		priorities = append(priorities, PriorityLow)
+	}
+
+	return c.updateMessages(ctx, messageIDs, func(tx *sql.Tx, accountID string, ids any) error {
+		if mf.isImportant {
+			if _, err := tx.ExecContext(ctx, queries.SetMessagesImportantQuery(), accountID, ids, set); err != nil {
+				return err
+			}
+		}
+		if mf.isPinned {
+			if _, err := tx.ExecContext(ctx, queries.SetMessagesPinnedQuery(), accountID, ids, set); err != nil {
+				return err
+			}
+		}
+		for _, priority := range priorities {
+			query := queries.ClearMessagesPriorityQuery()
+			if set {
+				query = queries.SetMessagesPriorityQuery()
+			}
+			if _, err := tx.ExecContext(ctx, query, accountID, ids, priority); err != nil {
+				return err
+			}
+		}
+		if len(mf.tags) > 0 {
+			var err error
+			if set {
+				_, err = tx.ExecContext(ctx, queries.AddMessagesTagsQuery(), accountID, ids, mf.tagsJSON())
+			} else {
+				_, err = tx.ExecContext(ctx, queries.RemoveMessagesTagsQuery(), accountID, ids, pq.Array(mf.tags))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetMessagesKeywords replaces the custom keywords of the given messages, as a STORE FLAGS does:
+// the keyword columns and tags are set from keywords, and whatever keywords lacks is cleared.
+func (c *MyDBConnector) SetMessagesKeywords(ctx context.Context, messageIDs []imap.MessageID, keywords imap.FlagSet) error {
+	mf := newMessageFlags(keywords)
+
+	return c.updateMessages(ctx, messageIDs, func(tx *sql.Tx, accountID string, ids any) error {
+		_, err := tx.ExecContext(ctx, queries.SetMessagesKeywordsQuery(), accountID, ids,
+			mf.isImportant, mf.isPinned, mf.priority, mf.tagsJSON())
+		return err
+	})
+}
+
+// updateMessages runs apply once per batch of message IDs, all within a single transaction.
+// ids is passed to apply as a Postgres array ready to be bound to a query, along with the account.
+func (c *MyDBConnector) updateMessages(ctx context.Context, messageIDs []imap.MessageID, apply func(tx *sql.Tx, accountID string, ids any) error) error {
+	u := c.currentUser()
+	if u == nil {
+		return ErrNotAuthorized
+	}
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	tx, err := c.beginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, batch := range xslices.Chunk(messageIDs, messageBatchSize) {
+		ids := xslices.Map(batch, func(id imap.MessageID) string { return string(id) })
+		if err := apply(tx, u.ID, pq.Array(ids)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// beginTx starts a transaction for a write made on behalf of an IMAP client.
+// The transaction is marked so the change triggers do not echo it back to Gluon.
+func (c *MyDBConnector) beginTx(ctx context.Context) (*sql.Tx, error) {
+	return beginIMAPTx(ctx, c.db)
+}
+
+// beginIMAPTx starts a transaction marked as made by the IMAP process, so the change triggers ignore it.
+func beginIMAPTx(ctx context.Context, db *sql.DB) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, queries.SetIMAPOriginQuery()); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
 }
 
 // GetUpdates returns a stream of updates that the gluon server should apply.
@@ -199,7 +1023,21 @@ func (c *MyDBConnector) GetUpdates() <-chan imap.Update {
 	return c.updates
 }
 
+// Close stops the update stream. Gluon calls it when the user is removed or the server is
+// closed, and the factory calls it again on shutdown, so only the first call has an effect.
+// Updates still queued are dropped; the next sync of the user catches up on them.
 func (c *MyDBConnector) Close(ctx context.Context) error {
-	close(c.updates)
+	c.closeOnce.Do(func() {
+		c.cancel()
+		<-c.updatesDone
+		failUpdates(c.popUpdates(), ErrConnectorClosed)
+		close(c.updates)
+
+		c.decrypterLock.Lock()
+		if c.decrypter != nil {
+			c.decrypter.Close()
+		}
+		c.decrypterLock.Unlock()
+	})
 	return nil
 }
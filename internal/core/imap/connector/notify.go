@@ -0,0 +1,88 @@
+package connector
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/ProtonMail/gluon/imap"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+)
+
+// Change operations announced by the database triggers.
+const (
+	ChangeInsert = "INSERT"
+	ChangeUpdate = "UPDATE"
+	ChangeMove   = "MOVE" // Home folder or extra memberships changed
+	ChangeDelete = "DELETE"
+)
+
+// ApplyMessageChange pushes a message change made outside IMAP, e.g. by the webmail, to Gluon.
+// Changes to messages that no longer exist are ignored; their DELETE follows.
+func (c *MyDBConnector) ApplyMessageChange(ctx context.Context, op string, messageID imap.MessageID) error {
+	if op == ChangeDelete {
+		c.enqueue(imap.NewMessagesDeleted(messageID))
+		return nil
+	}
+
+	msg, mf, mboxIDs, err := scanMessage(c.db.QueryRowContext(ctx, queries.GetMessageByIDQuery(), string(messageID), c.email))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	switch op {
+	case ChangeInsert:
+		created, err := c.newMessageCreated(msg, mf, mboxIDs)
+		if err != nil {
+			return err
+		}
+		c.enqueue(imap.NewMessagesCreated(true, created))
+		return nil
+
+	case ChangeMove:
+		c.enqueue(imap.NewMessageMailboxesUpdated(messageID, mboxIDs, mf.toFlagSet()))
+		return nil
+
+	default:
+		c.enqueue(imap.NewMessageFlagsUpdated(messageID, mf.toFlagSet()))
+		return nil
+	}
+}
+
+// ApplyMailboxChange pushes a mailbox created, renamed or deleted outside IMAP to Gluon.
+func (c *MyDBConnector) ApplyMailboxChange(ctx context.Context, op string, mboxID imap.MailboxID) error {
+	if op == ChangeDelete {
+		c.state.deleteMailbox(mboxID)
+		c.enqueue(imap.NewMailboxDeleted(mboxID))
+		return nil
+	}
+
+	var title, path, delimiter string
+	err := c.db.QueryRowContext(ctx, queries.GetMailboxOfUserByIDQuery(), string(mboxID), c.email).Scan(&title, &path, &delimiter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	name := []string{title}
+	if path != "" && delimiter != "" {
+		name = strings.Split(path, delimiter)
+	}
+
+	if op == ChangeInsert {
+		exclusive, err := c.validateName(name)
+		if err != nil {
+			return err
+		}
+		c.enqueue(imap.NewMailboxCreated(c.state.createMailbox(mboxID, name, exclusive)))
+		return nil
+	}
+
+	c.state.updateMailboxName(mboxID, name)
+	c.enqueue(imap.NewMailboxUpdated(mboxID, name))
+	return nil
+}
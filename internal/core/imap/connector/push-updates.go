@@ -11,16 +11,12 @@ import (
 
 // PushMailboxCreated notifies Gluon about new mailbox
 func (c *MyDBConnector) PushMailboxCreated(mbox imap.Mailbox) {
-	c.updates <- &imap.MailboxCreated{
-		Mailbox: mbox,
-	}
+	c.enqueue(imap.NewMailboxCreated(mbox))
 }
 
 // PushMailboxDeleted notifies Gluon about deleted mailbox
 func (c *MyDBConnector) PushMailboxDeleted(mboxID imap.MailboxID) {
-	c.updates <- &imap.MailboxDeleted{
-		MailboxID: mboxID,
-	}
+	c.enqueue(imap.NewMailboxDeleted(mboxID))
 }
 
 // // PushMailboxRenamed notifies Gluon about renamed mailbox
@@ -41,9 +37,7 @@ func (c *MyDBConnector) PushMailboxDeleted(mboxID imap.MailboxID) {
 
 // PushMessageDeleted notifies Gluon about deleted message
 func (c *MyDBConnector) PushMessageDeleted(messageID imap.MessageID) {
-	c.updates <- &imap.MessageDeleted{
-		MessageID: messageID,
-	}
+	c.enqueue(imap.NewMessagesDeleted(messageID))
 }
 
 // PushMessageFlagsChanged notifies Gluon about flag changes
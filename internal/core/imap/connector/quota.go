@@ -0,0 +1,90 @@
+package connector
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ProtonMail/gluon/connector"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	user "github.com/enjoys-in/airsend-imap/internal/interfaces/user"
+)
+
+// ErrOverQuota is returned by an APPEND or COPY that would take the account over its quota.
+// Gluon sends the message of a failed write to the client as is, so it starts with the
+// OVERQUOTA response code, and it counts as a size limit so that Gluon does not keep the
+// refused message in its recovery mailbox.
+var ErrOverQuota error = overQuotaError{}
+
+type overQuotaError struct{}
+
+func (overQuotaError) Error() string { return "[OVERQUOTA] Quota exceeded" }
+
+func (overQuotaError) Is(target error) bool { return target == connector.ErrMessageSizeExceedsLimits }
+
+// Quota is what an account stores against the limits of its quota root. A zero limit is unlimited.
+type Quota struct {
+	Storage      int64 // Bytes, as counted in the account usage
+	StorageLimit int64
+	Messages     int64 // Messages in all mailboxes, once per mailbox a message is in; only counted under a limit
+	MessageLimit int64
+}
+
+// StorageExceeded reports whether the account stores more bytes than its limit allows.
+func (q Quota) StorageExceeded() bool {
+	return q.StorageLimit > 0 && q.Storage > q.StorageLimit
+}
+
+// MessagesExceeded reports whether the account has more messages than its limit allows.
+func (q Quota) MessagesExceeded() bool {
+	return q.MessageLimit > 0 && q.Messages > q.MessageLimit
+}
+
+// queryRower is a *sql.DB or a *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Quota returns the usage and limits of the account. The account's mailbox size is capped by
+// its tenant's, which may also limit its messages.
+func (c *MyDBConnector) Quota(ctx context.Context) (Quota, error) {
+	u := c.currentUser()
+	if u == nil {
+		return Quota{}, ErrNotAuthorized
+	}
+
+	return c.readQuota(ctx, c.db, u.ID, u.TenantName)
+}
+
+// readQuota reads the quota of an account through db. The messages of the account are only
+// counted when its tenant limits them, as counting them scans all of the account's messages.
+func (c *MyDBConnector) readQuota(ctx context.Context, db queryRower, accountID, tenantName string) (Quota, error) {
+	var (
+		q           Quota
+		mailboxSize int
+	)
+	if err := db.QueryRowContext(ctx, queries.GetQuotaQuery(), accountID).Scan(&q.Storage, &mailboxSize); err != nil {
+		return Quota{}, err
+	}
+	q.StorageLimit = int64(mailboxSize)
+
+	if c.tenants != nil {
+		if t, ok := c.tenants.Lookup(tenantName); ok {
+			q.StorageLimit = int64(t.MailboxSize(mailboxSize))
+			q.MessageLimit = int64(t.MaxMessages)
+		}
+	}
+
+	if q.MessageLimit > 0 {
+		if err := db.QueryRowContext(ctx, queries.CountAccountMessagesQuery(), accountID).Scan(&q.Messages); err != nil {
+			return Quota{}, err
+		}
+	}
+
+	return q, nil
+}
+
+// quotaAfterWrite returns the quota of account u as the writes of tx left it. The account row
+// must be locked by tx, so that concurrent writes are checked one after the other.
+func (c *MyDBConnector) quotaAfterWrite(ctx context.Context, tx *sql.Tx, u *user.UserConfig) (Quota, error) {
+	return c.readQuota(ctx, tx, u.ID, u.TenantName)
+}
@@ -3,29 +3,12 @@ package connector
 import (
 	"context"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/ProtonMail/gluon/imap"
 )
 
-// ClearUpdates clears all pending updates in the channel
-// Useful for testing or resetting state
-func (c *MyDBConnector) ClearUpdates() {
-	log.Printf("ClearUpdates: Clearing pending updates")
-
-	// Drain the updates channel
-	for {
-		select {
-		case <-c.updates:
-			// Discard update
-		default:
-			// Channel is empty
-			log.Printf("ClearUpdates: All updates cleared")
-			return
-		}
-	}
-}
-
 // Flush flushes any pending operations
 // Useful for ensuring all writes are committed
 func (c *MyDBConnector) Flush() {
@@ -37,22 +20,27 @@ func (c *MyDBConnector) Flush() {
 // GetLastRecordedIMAPID returns the last IMAP ID received from client
 // Used for tracking client information
 func (c *MyDBConnector) GetLastRecordedIMAPID() imap.IMAPID {
-	log.Printf("GetLastRecordedIMAPID: Retrieving last recorded IMAP ID")
+	c.imapIDLock.Lock()
+	defer c.imapIDLock.Unlock()
 
-	// If you're tracking client IMAP IDs, return them here
-	// This stores information sent by client via IMAP ID command
 	return c.lastClientIMAPID
 }
 
+// RecordIMAPID stores the IMAP ID sent by a client logged in as this user.
+func (c *MyDBConnector) RecordIMAPID(id imap.IMAPID) {
+	c.imapIDLock.Lock()
+	defer c.imapIDLock.Unlock()
+
+	c.lastClientIMAPID = id
+}
+
 // MailboxCreated simulates external mailbox creation
 // Used to test mailbox creation from external source (e.g., webmail)
 func (c *MyDBConnector) MailboxCreated(mbox imap.Mailbox) error {
 	log.Printf("MailboxCreated: Simulating mailbox creation: %s", mbox.Name)
 
 	// Push update to Gluon
-	c.updates <- &imap.MailboxCreated{
-		Mailbox: mbox,
-	}
+	c.enqueue(imap.NewMailboxCreated(mbox))
 
 	return nil
 }
@@ -62,9 +50,7 @@ func (c *MyDBConnector) MailboxDeleted(mboxID imap.MailboxID) error {
 	log.Printf("MailboxDeleted: Simulating mailbox deletion: %s", mboxID)
 
 	// Push update to Gluon
-	c.updates <- &imap.MailboxDeleted{
-		MailboxID: mboxID,
-	}
+	c.enqueue(imap.NewMailboxDeleted(mboxID))
 
 	return nil
 }
@@ -74,10 +60,7 @@ func (c *MyDBConnector) MessageAdded(messageID imap.MessageID, mboxID imap.Mailb
 	log.Printf("MessageAdded: Simulating message %s added to mailbox %s", messageID, mboxID)
 
 	// Push update to Gluon
-	c.updates <- &imap.MessageMailboxesUpdated{
-		MessageID:  messageID,
-		MailboxIDs: []imap.MailboxID{mboxID},
-	}
+	c.enqueue(imap.NewMessageMailboxesUpdated(messageID, []imap.MailboxID{mboxID}, imap.NewFlagSet()))
 
 	return nil
 }
@@ -87,17 +70,19 @@ func (c *MyDBConnector) MessageAdded(messageID imap.MessageID, mboxID imap.Mailb
 func (c *MyDBConnector) MessageCreated(message imap.Message, literal []byte, mboxIDs []imap.MailboxID) error {
 	log.Printf("MessageCreated: Simulating message creation: %s in %d mailboxes", message.ID, len(mboxIDs))
 
+	parsed, err := imap.NewParsedMessage(literal)
+	if err != nil {
+		return err
+	}
+
 	// In production, you'd save the message to database here
 	// Then push update to Gluon
-	c.updates <- &imap.MessagesCreated{
-		Messages: []*imap.MessageCreated{
-			{
-				Message:    message,
-				Literal:    literal,
-				MailboxIDs: mboxIDs,
-			},
-		},
-	}
+	c.enqueue(imap.NewMessagesCreated(false, &imap.MessageCreated{
+		Message:       message,
+		Literal:       literal,
+		MailboxIDs:    mboxIDs,
+		ParsedMessage: parsed,
+	}))
 
 	return nil
 }
@@ -109,17 +94,20 @@ func (c *MyDBConnector) MessagesCreated(messages []imap.Message, literals [][]by
 	// Convert to MessageCreated slice
 	messageCreated := make([]*imap.MessageCreated, len(messages))
 	for i, msg := range messages {
+		parsed, err := imap.NewParsedMessage(literals[i])
+		if err != nil {
+			return err
+		}
 		messageCreated[i] = &imap.MessageCreated{
-			Message:    msg,
-			Literal:    literals[i],
-			MailboxIDs: mboxIDs[i],
+			Message:       msg,
+			Literal:       literals[i],
+			MailboxIDs:    mboxIDs[i],
+			ParsedMessage: parsed,
 		}
 	}
 
 	// Push update to Gluon
-	c.updates <- &imap.MessagesCreated{
-		Messages: messageCreated,
-	}
+	c.enqueue(imap.NewMessagesCreated(false, messageCreated...))
 
 	return nil
 }
@@ -129,9 +117,7 @@ func (c *MyDBConnector) MessageDeleted(messageID imap.MessageID) error {
 	log.Printf("MessageDeleted: Simulating message deletion: %s", messageID)
 
 	// Push update to Gluon
-	c.updates <- &imap.MessageDeleted{
-		MessageID: messageID,
-	}
+	c.enqueue(imap.NewMessagesDeleted(messageID))
 
 	return nil
 }
@@ -146,10 +132,7 @@ func (c *MyDBConnector) MessageFlagged(messageID imap.MessageID, flagged bool) e
 	}
 
 	// Push update to Gluon
-	c.updates <- &imap.MessageFlagsUpdated{
-		MessageID: messageID,
-		Flags:     flags,
-	}
+	c.enqueue(imap.NewMessageFlagsUpdated(messageID, flags))
 
 	return nil
 }
@@ -164,10 +147,7 @@ func (c *MyDBConnector) MessageSeen(messageID imap.MessageID, seen bool) error {
 	}
 
 	// Push update to Gluon
-	c.updates <- &imap.MessageFlagsUpdated{
-		MessageID: messageID,
-		Flags:     flags,
-	}
+	c.enqueue(imap.NewMessageFlagsUpdated(messageID, flags))
 
 	return nil
 }
@@ -177,9 +157,7 @@ func (c *MyDBConnector) MessageRemoved(messageID imap.MessageID, mboxID imap.Mai
 	log.Printf("MessageRemoved: Simulating message %s removed from mailbox %s", messageID, mboxID)
 
 	// Push update to Gluon
-	c.updates <- &imap.MessageDeleted{
-		MessageID: messageID,
-	}
+	c.enqueue(imap.NewMessagesDeleted(messageID))
 	return nil
 }
 
@@ -187,11 +165,14 @@ func (c *MyDBConnector) MessageRemoved(messageID imap.MessageID, mboxID imap.Mai
 func (c *MyDBConnector) MessageUpdated(message imap.Message, literal []byte, mboxIDs []imap.MailboxID) error {
 	log.Printf("MessageUpdated: Simulating message update: %s", message.ID)
 
-	// Push update to Gluon
-	c.updates <- &imap.MessageUpdated{
-		Message: message,
+	parsed, err := imap.NewParsedMessage(literal)
+	if err != nil {
+		return err
 	}
 
+	// Push update to Gluon
+	c.enqueue(imap.NewMessageUpdated(message, literal, mboxIDs, parsed, false, false))
+
 	return nil
 }
 
@@ -228,6 +209,13 @@ func (c *MyDBConnector) SetLabelsPrefix(pfx string) {
 	c.labelsPrefix = pfx
 }
 
+// SetCascadeMailboxDelete controls DELETE of folders whose subfolders hold messages
+// If true, the whole subtree is deleted; otherwise the delete is rejected
+func (c *MyDBConnector) SetCascadeMailboxDelete(value bool) {
+	log.Printf("SetCascadeMailboxDelete: Setting to %v", value)
+	c.cascadeMailboxDelete = value
+}
+
 // SetMailboxVisibility sets visibility for a mailbox
 // Used to hide/show mailboxes in LIST responses
 func (c *MyDBConnector) SetMailboxVisibility(id imap.MailboxID, visibility imap.MailboxVisibility) {
@@ -247,11 +235,11 @@ func (c *MyDBConnector) SetMailboxVisibility(id imap.MailboxID, visibility imap.
 	}
 }
 
-// SetUpdatesAllowedToFail controls whether update failures are fatal
-// If true, failed updates won't stop the connector
+// SetUpdatesAllowedToFail sets how many updates in a row may fail to apply
+// before the connector resyncs the user from the database
 func (c *MyDBConnector) SetUpdatesAllowedToFail(value int32) {
 	log.Printf("SetUpdatesAllowedToFail: Setting to %v", value)
-	c.updatesAllowedToFail = value
+	atomic.StoreInt32(&c.updatesAllowedToFail, value)
 }
 
 // Example: When new email arrives via SMTP
@@ -103,3 +103,19 @@ func (state *MailboxState) getMailbox(mboxID imap.MailboxID) (imap.Mailbox, erro
 
 	return state.toMailbox(mboxID), nil
 }
+
+func (state *MailboxState) updateMailboxName(mboxID imap.MailboxID, newName []string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	if mbox, ok := state.mailboxes[mboxID]; ok {
+		mbox.name = newName
+	}
+}
+
+func (state *MailboxState) deleteMailbox(mboxID imap.MailboxID) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	delete(state.mailboxes, mboxID)
+}
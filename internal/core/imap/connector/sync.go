@@ -7,10 +7,11 @@ import (
 	"fmt"
 	"log"
 	"strings"
-	"time"
 
 	"github.com/ProtonMail/gluon/imap"
+	"github.com/bradenaw/juniper/xslices"
 	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/lib/pq"
 )
 
 type MessagePriority string
@@ -21,56 +22,284 @@ const (
 	PriorityLow    MessagePriority = "low"
 )
 
-func (conn *MyDBConnector) popUpdates() []imap.Update {
-	conn.queueLock.Lock()
-	defer conn.queueLock.Unlock()
+// syncUserData loads mailboxes and messages from DB and pushes to Gluon.
+// Only the changes since the account's sync cursor are pushed; without a cursor everything is.
+// The cursor only moves forward once Gluon has applied the updates, and stays below the
+// messages that could not be pushed so that they are tried again on the next sync.
+func (c *MyDBConnector) syncUserDataAfterAuth(ctx context.Context) error {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
 
-	var updates []imap.Update
+	var (
+		accountID string
+		cursor    sql.NullInt64
+		watermark int64
+	)
+	if err := c.db.QueryRowContext(ctx, queries.GetSyncCursorQuery(), c.email).Scan(&accountID, &cursor, &watermark); err != nil {
+		return fmt.Errorf("failed to read sync cursor: %w", err)
+	}
 
-	updates, conn.queue = conn.queue, []imap.Update{}
+	mailboxes, err := c.loadMailboxes(ctx)
+	if err != nil {
+		return err
+	}
 
-	return updates
+	var failed syncFailures
+	if cursor.Valid {
+		err = c.syncChanges(ctx, mailboxes, cursor.Int64, &failed)
+	} else {
+		err = c.syncAll(ctx, mailboxes, &failed)
+	}
+	if err != nil {
+		return err
+	}
+
+	next := failed.cursor(watermark)
+	if next < watermark {
+		log.Printf("Keeping the sync cursor of %s back for %d messages that could not be synced", c.email, failed.count)
+	}
+
+	if _, err := c.db.ExecContext(ctx, queries.SetSyncCursorQuery(), accountID, next); err != nil {
+		return fmt.Errorf("failed to store sync cursor: %w", err)
+	}
+
+	return nil
 }
 
-// syncUserData loads mailboxes and messages from DB and pushes to Gluon
-func (c *MyDBConnector) syncUserDataAfterAuth(ctx context.Context) error {
-	c.queueLock.Lock()
-	defer c.queueLock.Unlock()
+// syncFailures tracks the oldest transaction whose rows could not be pushed during a sync.
+// Rows changed at or after the cursor are synced again, so keeping the cursor at that
+// transaction retries them.
+type syncFailures struct {
+	seq   int64
+	count int
+}
+
+// add records a row that could not be pushed, with the transaction the next sync has to start
+// from to push it again.
+func (f *syncFailures) add(seq int64) {
+	if f.count == 0 || seq < f.seq {
+		f.seq = seq
+	}
+	f.count++
+}
+
+// cursor returns the cursor to store after a sync up to watermark.
+func (f *syncFailures) cursor(watermark int64) int64 {
+	if f.count > 0 && f.seq < watermark {
+		return f.seq
+	}
+	return watermark
+}
+
+// storedMailbox is a mailbox row together with the transaction that last changed it.
+type storedMailbox struct {
+	mbox   imap.Mailbox
+	modseq int64
+}
+
+// loadMailboxes reads every mailbox of the user into the connector state.
+func (c *MyDBConnector) loadMailboxes(ctx context.Context) ([]storedMailbox, error) {
 	rows, err := c.db.QueryContext(ctx,
 		queries.GetMailboxOfUserQuery(),
 		c.email,
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
+	var mailboxes []storedMailbox
+
 	for rows.Next() {
 		var id, title, path, delimiter, listed, subscribed string
 		var uid_validity uint32
-		if err := rows.Scan(&id, &title, &path, &delimiter, &listed, &subscribed, &uid_validity); err != nil {
+		var modseq int64
+		if err := rows.Scan(&id, &title, &path, &delimiter, &listed, &subscribed, &uid_validity, &modseq); err != nil {
 			continue
 		}
-		exclusive, err := c.validateName([]string{title})
+		name := []string{title}
+		if path != "" && delimiter != "" {
+			name = strings.Split(path, delimiter)
+		}
+
+		exclusive, err := c.validateName(name)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		mbox := c.state.createMailbox(imap.MailboxID(id), []string{title}, exclusive)
-		update := imap.NewMailboxCreated(mbox)
+		mailboxes = append(mailboxes, storedMailbox{
+			mbox:   c.state.createMailbox(imap.MailboxID(id), name, exclusive),
+			modseq: modseq,
+		})
+	}
 
-		c.updates <- update
-		err, ok := update.WaitContext(ctx)
-		if ok && err != nil {
-			return fmt.Errorf("failed to apply update %v:%w", update.String(), err)
+	return mailboxes, rows.Err()
+}
+
+// syncAll pushes every mailbox and message of the user.
+func (c *MyDBConnector) syncAll(ctx context.Context, mailboxes []storedMailbox, failed *syncFailures) error {
+	for _, mailbox := range mailboxes {
+		if err := c.applyUpdates(ctx, imap.NewMailboxCreated(mailbox.mbox)); err != nil {
+			return err
 		}
 
 		// Load messages for this mailbox
-		c.loadMailboxMessages(ctx, imap.MailboxID(id))
+		if err := c.loadMailboxMessages(ctx, mailbox.mbox.ID, failed); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// syncChanges pushes the mailboxes and messages created, changed or deleted since the cursor.
+func (c *MyDBConnector) syncChanges(ctx context.Context, mailboxes []storedMailbox, since int64, failed *syncFailures) error {
+	var updates []imap.Update
+
+	for _, mailbox := range mailboxes {
+		if mailbox.modseq >= since {
+			updates = append(updates, imap.NewMailboxUpdatedOrCreated(mailbox.mbox))
+		}
+	}
+
+	created, err := loadMessageUpdates(ctx, c, queries.GetCreatedMessagesQuery(), since,
+		func(msg storedMessage, mf messageFlags, mboxIDs []imap.MailboxID) (*imap.MessageCreated, error) {
+			created, err := c.newMessageCreated(msg, mf, mboxIDs)
+			if err != nil {
+				failed.add(msg.createseq)
+			}
+			return created, err
+		})
+	if err != nil {
+		return err
+	}
+	for _, batch := range xslices.Chunk(created, messageBatchSize) {
+		updates = append(updates, imap.NewMessagesCreated(true, batch...))
+	}
+
+	var changedSeqs []int64
+	changed, err := loadMessageUpdates(ctx, c, queries.GetChangedMessagesQuery(), since,
+		func(msg storedMessage, mf messageFlags, mboxIDs []imap.MailboxID) (imap.Update, error) {
+			changedSeqs = append(changedSeqs, msg.modseq)
+			return imap.NewMessageMailboxesUpdated(imap.MessageID(msg.id), mboxIDs, mf.toFlagSet()), nil
+		})
+	if err != nil {
+		return err
+	}
+
+	deleted, err := c.loadTombstones(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	if n := len(updates) + len(changed) + len(deleted); n > 0 {
+		log.Printf("Syncing %d changes for %s", n, c.email)
+	}
+
+	if err := c.applyUpdates(ctx, updates...); err != nil {
+		return err
+	}
+
+	// Gluon rejects changes to messages it does not know. Each is applied on its own so that a
+	// rejected one only holds the cursor back from its own row.
+	results, err := c.applyEachUpdate(ctx, changed...)
+	if err != nil {
+		return err
+	}
+	for i, err := range results {
+		if err != nil {
+			log.Printf("Message change for %s was not applied: %v", c.email, err)
+			failed.add(changedSeqs[i])
+		}
+	}
+
+	return c.applyUpdates(ctx, deleted...)
+}
+
+// loadMessageUpdates runs one of the changed-messages queries and turns each row into an update.
+// Rows that cannot be read or converted are logged and skipped, like during a full sync.
+func loadMessageUpdates[T any](ctx context.Context, c *MyDBConnector, query string, since int64, convert func(storedMessage, messageFlags, []imap.MailboxID) (T, error)) ([]T, error) {
+	rows, err := c.db.QueryContext(ctx, query, c.email, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var updates []T
+
+	for rows.Next() {
+		msg, mf, mboxIDs, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("Failed to scan message row: %v", err)
+			continue
+		}
+
+		update, err := convert(msg, mf, mboxIDs)
+		if err != nil {
+			log.Printf("Failed to load message %s: %v", msg.id, err)
+			continue
+		}
+
+		updates = append(updates, update)
+	}
+
+	return updates, rows.Err()
+}
+
+// loadTombstones returns the deletions recorded since the cursor, messages first.
+func (c *MyDBConnector) loadTombstones(ctx context.Context, since int64) ([]imap.Update, error) {
+	rows, err := c.db.QueryContext(ctx, queries.GetTombstonesQuery(), c.email, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var updates []imap.Update
+
+	for rows.Next() {
+		var objectType, id string
+		if err := rows.Scan(&objectType, &id); err != nil {
+			return nil, err
+		}
+
+		if objectType == "mailbox" {
+			c.state.deleteMailbox(imap.MailboxID(id))
+			updates = append(updates, imap.NewMailboxDeleted(imap.MailboxID(id)))
+		} else {
+			updates = append(updates, imap.NewMessagesDeleted(imap.MessageID(id)))
+		}
+	}
+
+	return updates, rows.Err()
+}
+
+// ResetSyncCursor forgets the sync cursor so the next Sync pushes everything again.
+// It is needed whenever Gluon starts from an empty store for the user.
+func (c *MyDBConnector) ResetSyncCursor(ctx context.Context) error {
+	_, err := c.db.ExecContext(ctx, queries.ResetSyncCursorQuery(), c.email)
+	return err
+}
+
+// systemMailboxNames are the top-level folders every account has; they cannot be renamed or deleted.
+var systemMailboxNames = map[string]struct{}{
+	"inbox":   {},
+	"sent":    {},
+	"drafts":  {},
+	"trash":   {},
+	"spam":    {},
+	"junk":    {},
+	"archive": {},
+}
+
+// isSystemMailbox reports whether name refers to one of the system folders.
+func isSystemMailbox(name []string) bool {
+	if len(name) != 1 {
+		return false
+	}
+	_, ok := systemMailboxNames[strings.ToLower(name[0])]
+	return ok
+}
+
 func getMailboxAttributes(mailboxName string, hasChildren bool) imap.FlagSet {
 	attrs := imap.NewFlagSet()
 	if hasChildren {
@@ -98,7 +327,7 @@ func getMailboxAttributes(mailboxName string, hasChildren bool) imap.FlagSet {
 }
 
 // loadMailboxMessages loads messages for a specific mailbox
-func (c *MyDBConnector) loadMailboxMessages(ctx context.Context, mboxID imap.MailboxID) error {
+func (c *MyDBConnector) loadMailboxMessages(ctx context.Context, mboxID imap.MailboxID, failed *syncFailures) error {
 	log.Printf("Loading messages for mailbox %s", mboxID)
 	rows, err := c.db.QueryContext(ctx,
 		queries.GetMailboxByIDQuery(),
@@ -114,109 +343,20 @@ func (c *MyDBConnector) loadMailboxMessages(ctx context.Context, mboxID imap.Mai
 	messages := []*imap.MessageCreated{}
 
 	for rows.Next() {
-		var (
-			messageID                                                      string
-			priority                                                       MessagePriority
-			isRead, isPinned, isReplied, isDeleted, isImportant, isStarred bool
-			threadID                                                       sql.NullString
-			tags                                                           []byte // JSON array
-			plainText                                                      sql.NullString
-			folder                                                         string
-			content                                                        []byte // Raw email content
-			timestamp                                                      time.Time
-			literal                                                        []byte
-		)
-
-		err := rows.Scan(
-			&messageID,
-			&priority,
-			&isRead,
-			&isPinned,
-			&isReplied,
-			&threadID,
-			&isDeleted,
-			&isImportant,
-			&isStarred,
-			&tags,
-			&plainText,
-			&folder,
-			&content,
-			&timestamp,
-		)
-
+		msg, mf, mboxIDs, err := scanMessage(rows)
 		if err != nil {
 			log.Printf("Failed to scan message row: %v", err)
 			continue
 		}
 
-		// Build IMAP flags based on your database fields
-		flags := imap.NewFlagSet()
-
-		// Standard IMAP flags
-		if isRead {
-			flags = flags.Add(imap.FlagSeen)
-		}
-		if isStarred {
-			flags = flags.Add(imap.FlagFlagged)
-		}
-		if isDeleted {
-			flags = flags.Add(imap.FlagDeleted)
-		}
-		if isReplied {
-			flags = flags.Add(imap.FlagAnswered)
-		}
-
-		// Gmail/Outlook specific flags (as custom keywords)
-		// These appear as custom flags in IMAP clients
-		if isImportant {
-			flags = flags.Add("$Important")
-		}
-		if isPinned {
-			flags = flags.Add("$Pinned")
-		}
-
-		// Handle priority flags
-		switch priority {
-		case PriorityHigh:
-			flags = flags.Add("$HighPriority")
-		case PriorityLow:
-			flags = flags.Add("$LowPriority")
-		default:
-			flags = flags.Add("$NormalPriority")
-		}
-
-		// Parse and add custom tags as IMAP keywords
-		if len(tags) > 0 {
-			var tagList []string
-			if err := json.Unmarshal(tags, &tagList); err == nil {
-				for _, tag := range tagList {
-					// Add each tag as a custom keyword
-					// IMAP keywords should start with $ or be alphanumeric
-					flags = flags.Add(tag)
-				}
-			}
+		created, err := c.newMessageCreated(msg, mf, mboxIDs)
+		if err != nil {
+			log.Printf("Failed to build literal of message %s: %v", msg.id, err)
+			failed.add(msg.createseq)
+			continue
 		}
 
-		// Create IMAP message
-		// Decode First layer of MEssage base64 -> OpenPGP encrypted message -> Parse OpenPGP -> Extract inner MIME message
-		// parsed, err := imap.NewParsedMessage(content)
-		// if err != nil {
-		// 	// fallback: just send literal
-		// 	parsed = nil
-		// }
-
-		messages = append(messages,
-			&imap.MessageCreated{
-				Message: imap.Message{
-					ID:    imap.MessageID(messageID),
-					Flags: flags,
-					Date:  timestamp,
-				},
-				Literal:    literal,
-				MailboxIDs: []imap.MailboxID{mboxID},
-				// ParsedMessage: nil, // optional: populate if you have parsed message data
-			})
-
+		messages = append(messages, created)
 	}
 
 	// Check for any row iteration errors
@@ -226,13 +366,94 @@ func (c *MyDBConnector) loadMailboxMessages(ctx context.Context, mboxID imap.Mai
 	}
 
 	// Push messages to Gluon in batches (avoid overwhelming the channel)
+	var updates []imap.Update
+	for _, batch := range xslices.Chunk(messages, messageBatchSize) {
+		updates = append(updates, imap.NewMessagesCreated(true, batch...))
+	}
 
-	if len(messages) > 0 {
-		// Split into batches of 100 messages
-		c.updates <- imap.NewMessagesCreated(true, messages...)
+	return c.applyUpdates(ctx, updates...)
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage reads a row selected with the message columns of GetMailboxByIDQuery.
+// It returns the stored content, the flag columns and every mailbox the message belongs to,
+// home folder first.
+func scanMessage(row rowScanner) (storedMessage, messageFlags, []imap.MailboxID, error) {
+	var (
+		msg             storedMessage
+		mf              messageFlags
+		otherMailboxIDs []string
+		tags            []byte // JSON array
+		folder          string
+	)
+
+	err := row.Scan(
+		&msg.id,
+		&mf.priority,
+		&mf.isRead,
+		&mf.isPinned,
+		&mf.isReplied,
+		&msg.threadID,
+		&mf.isDeleted,
+		&mf.isImportant,
+		&mf.isStarred,
+		&tags,
+		&msg.plainText,
+		&folder,
+		&msg.content, // Raw email content
+		&msg.date,
+		&mf.isForwarded,
+		&mf.isDraft,
+		pq.Array(&otherMailboxIDs),
+		&msg.htmlText,
+		&msg.subject,
+		&msg.from,
+		&msg.to,
+		&msg.cc,
+		&msg.createseq,
+		&msg.modseq,
+	)
+	if err != nil {
+		return storedMessage{}, messageFlags{}, nil, err
 	}
 
-	return nil
+	// Parse custom tags, they appear as IMAP keywords
+	if len(tags) > 0 {
+		if err := json.Unmarshal(tags, &mf.tags); err != nil {
+			log.Printf("Failed to parse tags of message %s: %v", msg.id, err)
+		}
+	}
+
+	mboxIDs := []imap.MailboxID{imap.MailboxID(folder)}
+	for _, id := range otherMailboxIDs {
+		mboxIDs = append(mboxIDs, imap.MailboxID(id))
+	}
+
+	return msg, mf, mboxIDs, nil
+}
+
+// newMessageCreated builds the Gluon representation of a stored message.
+// Decode First layer of MEssage base64 -> OpenPGP encrypted message -> Parse OpenPGP -> Extract inner MIME message
+func (c *MyDBConnector) newMessageCreated(msg storedMessage, mf messageFlags, mboxIDs []imap.MailboxID) (*imap.MessageCreated, error) {
+	literal, parsed, err := c.buildLiteral(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imap.MessageCreated{
+		Message: imap.Message{
+			ID:    imap.MessageID(msg.id),
+			Flags: mf.toFlagSet(),
+			Date:  msg.date,
+		},
+		Literal:       literal,
+		MailboxIDs:    mboxIDs,
+		ParsedMessage: parsed,
+	}, nil
 }
 
 // Sync synchronizes the connector state with your database
@@ -0,0 +1,187 @@
+package connector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// headerSanitizer strips line breaks so stored fields cannot inject headers.
+var headerSanitizer = strings.NewReplacer("\r", "", "\n", " ")
+
+// synthesizeLiteral builds an RFC 5322 message for a row that has no raw MIME content,
+// typically one written by the webmail composer. The result only depends on the row,
+// so sync and GetMessageLiteral produce the same bytes.
+func (c *MyDBConnector) synthesizeLiteral(msg storedMessage) ([]byte, error) {
+	domain := c.emailDomain()
+
+	from := c.email
+	if msg.from.Valid && strings.TrimSpace(msg.from.String) != "" {
+		from = msg.from.String
+	}
+
+	var b bytes.Buffer
+	writeHeader := func(key, value string) {
+		if value == "" {
+			return
+		}
+		fmt.Fprintf(&b, "%s\r\n", foldHeader(key+": "+headerSanitizer.Replace(value)))
+	}
+
+	writeHeader("Date", msg.date.Format(time.RFC1123Z))
+	writeHeader("From", formatAddressList([]string{from}))
+	writeHeader("To", formatAddressList(decodeAddressList(msg.to)))
+	writeHeader("Cc", formatAddressList(decodeAddressList(msg.cc)))
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", msg.subject.String))
+	writeHeader("Message-ID", messageIDHeader(msg.id, domain))
+	if msg.threadID.Valid && msg.threadID.String != "" && msg.threadID.String != msg.id {
+		parent := messageIDHeader(msg.threadID.String, domain)
+		writeHeader("In-Reply-To", parent)
+		writeHeader("References", parent)
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	plain, html := msg.plainText.String, msg.htmlText.String
+
+	switch {
+	case plain != "" && html != "":
+		mw := multipart.NewWriter(&b)
+		if err := mw.SetBoundary("airsend-alt-" + strings.ReplaceAll(msg.id, "-", "")); err != nil {
+			return nil, err
+		}
+		writeHeader("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+		b.WriteString("\r\n")
+
+		for _, part := range []struct{ mediaType, body string }{
+			{"text/plain", plain},
+			{"text/html", html},
+		} {
+			w, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {part.mediaType + "; charset=utf-8"},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if err := writeQuotedPrintable(w, part.body); err != nil {
+				return nil, err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+
+	default:
+		mediaType, body := "text/plain", plain
+		if plain == "" {
+			mediaType, body = "text/html", html
+		}
+		writeHeader("Content-Type", mediaType+"; charset=utf-8")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		if err := writeQuotedPrintable(&b, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// hasSynthesizableBody reports whether the row has enough data for synthesizeLiteral.
+func (msg storedMessage) hasSynthesizableBody() bool {
+	return (msg.plainText.Valid && msg.plainText.String != "") || (msg.htmlText.Valid && msg.htmlText.String != "")
+}
+
+// emailDomain returns the domain part of the connector's email address.
+func (c *MyDBConnector) emailDomain() string {
+	if _, domain, ok := strings.Cut(c.email, "@"); ok && domain != "" {
+		return domain
+	}
+	return "localhost"
+}
+
+// messageIDHeader turns a stored ID into a Message-ID header value.
+// IDs that already look like <local@domain> are kept as they are.
+func messageIDHeader(id, domain string) string {
+	id = strings.TrimSpace(id)
+	if strings.HasPrefix(id, "<") && strings.HasSuffix(id, ">") {
+		return id
+	}
+	if strings.Contains(id, "@") {
+		return "<" + id + ">"
+	}
+	return "<" + id + "@" + domain + ">"
+}
+
+// decodeAddressList decodes a JSON array of addresses as stored in to_addresses and cc_addresses.
+func decodeAddressList(raw []byte) []string {
+	var list []string
+	if len(raw) == 0 || json.Unmarshal(raw, &list) != nil {
+		return nil
+	}
+	return list
+}
+
+// formatAddressList renders addresses for an address header, encoding display names as needed.
+// Entries that do not parse as addresses are kept verbatim.
+func formatAddressList(addresses []string) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if parsed, err := mail.ParseAddress(address); err == nil {
+			formatted = append(formatted, parsed.String())
+		} else {
+			formatted = append(formatted, address)
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// maxHeaderLine is the line length RFC 5322 recommends header fields are folded at.
+const maxHeaderLine = 78
+
+// foldHeader breaks a header field into lines of at most maxHeaderLine characters at its spaces,
+// so that long subjects and address lists stay within the line limit. Unfolding gives the field back.
+func foldHeader(field string) string {
+	var b strings.Builder
+	line := 0 // Start of the current line in b
+	for i, word := range strings.Split(field, " ") {
+		if i > 0 {
+			current := b.String()[line:]
+			if word != "" && len(current)+1+len(word) > maxHeaderLine && strings.TrimSpace(current) != "" {
+				b.WriteString("\r\n")
+				line = b.Len()
+			}
+			b.WriteByte(' ')
+		}
+		b.WriteString(word)
+	}
+	return b.String()
+}
+
+// writeQuotedPrintable writes body with CRLF line endings in quoted-printable encoding.
+func writeQuotedPrintable(w io.Writer, body string) error {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	body = strings.ReplaceAll(body, "\n", "\r\n")
+
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("\r\n"))
+	return err
+}
@@ -0,0 +1,247 @@
+package connector
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatAddressList(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		want      string
+	}{
+		{"bare", []string{"bob@example.com"}, "<bob@example.com>"},
+		{"display name", []string{"Bob Smith <bob@example.com>"}, `"Bob Smith" <bob@example.com>`},
+		{"quoted display name", []string{`"Smith, Bob" <bob@example.com>`}, `"Smith, Bob" <bob@example.com>`},
+		{"non-ASCII display name", []string{"Jürgen Groß <j@example.com>"}, "=?utf-8?q?J=C3=BCrgen_Gro=C3=9F?= <j@example.com>"},
+		{"encoded display name", []string{"=?utf-8?q?J=C3=BCrgen?= <j@example.com>"}, "=?utf-8?q?J=C3=BCrgen?= <j@example.com>"},
+		{"non-ASCII local part", []string{"用户@example.com"}, "<用户@example.com>"},
+		{"several", []string{"a@example.com", " ", "B <b@example.com>"}, `<a@example.com>, "B" <b@example.com>`},
+		{"unparsable kept", []string{"not an address"}, "not an address"},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatAddressList(tt.addresses); got != tt.want {
+				t.Errorf("formatAddressList(%q) = %q, want %q", tt.addresses, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteQuotedPrintable(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+	}{
+		{"ASCII", "Hello\nworld", "Hello\r\nworld"},
+		{"CRLF kept", "Hello\r\nworld\r\n", "Hello\r\nworld\r\n"},
+		{"non-ASCII", "Grüße, 你好 👋", "Grüße, 你好 👋"},
+		{"long line", strings.Repeat("0123456789", 50), strings.Repeat("0123456789", 50)},
+		{"long non-ASCII line", strings.Repeat("ü", 300), strings.Repeat("ü", 300)},
+		{"trailing spaces", "a  \nb\t", "a  \r\nb\t"},
+		{"equals sign", "a=b", "a=b"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeQuotedPrintable(&b, tt.body); err != nil {
+				t.Fatal(err)
+			}
+
+			encoded := b.String()
+			if !strings.HasSuffix(encoded, "\r\n") {
+				t.Errorf("encoded body %q does not end with CRLF", encoded)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(encoded, "\r\n"), "\r\n") {
+				if len(line) > 76 {
+					t.Errorf("line of %d characters: %q", len(line), line)
+				}
+				for _, r := range line {
+					if r > '~' || r < ' ' && r != '\t' {
+						t.Errorf("line with unencoded %q: %q", r, line)
+					}
+				}
+			}
+
+			decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(encoded)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The body always ends with a line break of its own.
+			if got := string(decoded); got != tt.want+"\r\n" {
+				t.Errorf("decoded body = %q, want %q", got, tt.want+"\r\n")
+			}
+		})
+	}
+}
+
+func TestSynthesizeLiteral(t *testing.T) {
+	date := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	text := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+
+	tests := []struct {
+		name    string
+		msg     storedMessage
+		headers map[string]string // Decoded values
+		parts   map[string]string // Media type -> decoded body
+	}{
+		{
+			name: "plain text",
+			msg: storedMessage{
+				id: "m1", date: date,
+				subject: text("Grüße aus Köln"), from: text("Jürgen <j@example.com>"),
+				to: []byte(`["Bob Smith <bob@example.com>", "carol@example.com"]`), cc: []byte(`["Ünal <u@example.com>"]`),
+				plainText: text("Hallo,\nschöne Grüße\n" + strings.Repeat("x", 200)),
+			},
+			headers: map[string]string{
+				"Subject":    "Grüße aus Köln",
+				"From":       "Jürgen <j@example.com>",
+				"To":         `"Bob Smith" <bob@example.com>, <carol@example.com>`,
+				"Cc":         "Ünal <u@example.com>",
+				"Date":       "Fri, 01 Mar 2024 09:30:00 +0000",
+				"Message-ID": "<m1@example.com>",
+			},
+			parts: map[string]string{"text/plain": "Hallo,\r\nschöne Grüße\r\n" + strings.Repeat("x", 200)},
+		},
+		{
+			name: "HTML only, reply",
+			msg: storedMessage{
+				id: "m2", date: date, threadID: text("m1"),
+				subject: text("Re: " + strings.Repeat("ü", 400)), htmlText: text("<p>" + strings.Repeat("日本語", 100) + "</p>"),
+			},
+			headers: map[string]string{
+				"Subject":     "Re: " + strings.Repeat("ü", 400),
+				"From":        "<alice@example.com>",
+				"In-Reply-To": "<m1@example.com>",
+				"References":  "<m1@example.com>",
+			},
+			parts: map[string]string{"text/html": "<p>" + strings.Repeat("日本語", 100) + "</p>"},
+		},
+		{
+			name: "alternative",
+			msg: storedMessage{
+				id: "5f0e-41c2", date: date, threadID: text("5f0e-41c2"),
+				subject: text("Hi"), plainText: text("Hi ☺"), htmlText: text("<b>Hi ☺</b>"),
+			},
+			headers: map[string]string{"In-Reply-To": ""},
+			parts:   map[string]string{"text/plain": "Hi ☺", "text/html": "<b>Hi ☺</b>"},
+		},
+		{
+			name: "header injection",
+			msg: storedMessage{
+				id: "m3", date: date,
+				subject:   text("hi\r\nBcc: eve@example.com"),
+				to:        []byte(`["bob@example.com\r\nBcc: eve@example.com"]`),
+				plainText: text("body"),
+			},
+			headers: map[string]string{"Subject": "hi\r\nBcc: eve@example.com", "Bcc": ""},
+			parts:   map[string]string{"text/plain": "body"},
+		},
+		{
+			name: "long address list",
+			msg: storedMessage{
+				id: "m4", date: date,
+				subject:   text("A subject long enough to be folded, written in plain ASCII words only, twice over"),
+				to:        []byte(`["Alice Andersson <alice@example.com>", "Bob Berg <bob@example.com>", "Carol Cruz <carol@example.com>"]`),
+				plainText: text("body"),
+			},
+			headers: map[string]string{
+				"Subject": "A subject long enough to be folded, written in plain ASCII words only, twice over",
+				"To":      `"Alice Andersson" <alice@example.com>, "Bob Berg" <bob@example.com>, "Carol Cruz" <carol@example.com>`,
+			},
+			parts: map[string]string{"text/plain": "body"},
+		},
+	}
+
+	c := NewConnector(nil, "alice@example.com")
+	defer c.Close(t.Context())
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			literal, err := c.synthesizeLiteral(tt.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := c.synthesizeLiteral(tt.msg); !bytes.Equal(again, literal) {
+				t.Error("the literal differs between two calls")
+			}
+			header, _, _ := bytes.Cut(literal, []byte("\r\n\r\n"))
+			for _, line := range bytes.Split(header, []byte("\r\n")) {
+				if len(line) > 78 || bytes.ContainsAny(line, "\r\n") || len(bytes.TrimSpace(line)) == 0 {
+					t.Errorf("invalid header line %q", line)
+				}
+			}
+
+			parsed, err := mail.ReadMessage(bytes.NewReader(literal))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dec mime.WordDecoder
+			for key, want := range tt.headers {
+				got, err := dec.DecodeHeader(parsed.Header.Get(key))
+				if err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+				if got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+
+			parts := readParts(t, parsed.Header.Get("Content-Type"), parsed.Header.Get("Content-Transfer-Encoding"), parsed.Body)
+			if len(parts) != len(tt.parts) {
+				t.Errorf("parts = %q, want %q", parts, tt.parts)
+			}
+			for mediaType, want := range tt.parts {
+				if got := strings.TrimSuffix(parts[mediaType], "\r\n"); got != want {
+					t.Errorf("%s body = %q, want %q", mediaType, got, want)
+				}
+			}
+		})
+	}
+}
+
+// readParts returns the decoded text parts of a message body by media type.
+func readParts(t *testing.T, contentType, encoding string, body io.Reader) map[string]string {
+	t.Helper()
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := make(map[string]string)
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		if params["charset"] != "utf-8" || encoding != "quoted-printable" {
+			t.Errorf("%s part with charset %q and encoding %q", mediaType, params["charset"], encoding)
+		}
+		decoded, err := io.ReadAll(quotedprintable.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[mediaType] = string(decoded)
+		return parts
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range readParts(t, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part) {
+			parts[k] = v
+		}
+	}
+}
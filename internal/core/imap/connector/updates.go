@@ -0,0 +1,212 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProtonMail/gluon/imap"
+)
+
+// ErrUpdatesCleared is reported for updates dropped by ClearUpdates before Gluon got them.
+var ErrUpdatesCleared = errors.New("update was cleared before it was applied")
+
+// ErrConnectorClosed is reported for updates still pending when the connector is closed.
+var ErrConnectorClosed = errors.New("connector is closed")
+
+// ErrUpdateTimeout is reported for updates Gluon did not apply within updateTimeout.
+var ErrUpdateTimeout = errors.New("update was not applied in time")
+
+const (
+	// updateTimeout bounds how long the update loop waits for Gluon to apply a single update.
+	updateTimeout = 2 * time.Minute
+
+	// defaultUpdatesAllowedToFail is the number of updates in a row that may fail before
+	// the connector gives up on its incremental state and resyncs the user.
+	defaultUpdatesAllowedToFail = 5
+
+	// resyncInterval is the minimum time between two resyncs, so an update that keeps
+	// failing cannot make the connector resync in a loop.
+	resyncInterval = 5 * time.Minute
+
+	// resyncTimeout bounds a full resync.
+	resyncTimeout = 10 * time.Minute
+)
+
+// queuedUpdate is an update waiting to be handed to Gluon.
+// result, when set, receives the outcome once Gluon has applied the update or given up on it.
+type queuedUpdate struct {
+	update imap.Update
+	result chan error
+}
+
+// enqueue queues updates for Gluon without blocking; the queue has no bound.
+func (c *MyDBConnector) enqueue(updates ...imap.Update) {
+	queued := make([]queuedUpdate, 0, len(updates))
+	for _, update := range updates {
+		queued = append(queued, queuedUpdate{update: update})
+	}
+	c.enqueueQueued(queued...)
+}
+
+func (c *MyDBConnector) enqueueQueued(queued ...queuedUpdate) {
+	c.queueLock.Lock()
+	c.queue = append(c.queue, queued...)
+	c.queueLock.Unlock()
+
+	select {
+	case c.queueSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *MyDBConnector) popUpdates() []queuedUpdate {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	var updates []queuedUpdate
+
+	updates, c.queue = c.queue, nil
+
+	return updates
+}
+
+// applyUpdates queues updates and waits until Gluon has applied all of them.
+func (c *MyDBConnector) applyUpdates(ctx context.Context, updates ...imap.Update) error {
+	results, err := c.applyEachUpdate(ctx, updates...)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(results...)
+}
+
+// applyEachUpdate queues updates and waits until Gluon has applied all of them, returning the
+// outcome of each. The error is only set when ctx ends first.
+func (c *MyDBConnector) applyEachUpdate(ctx context.Context, updates ...imap.Update) ([]error, error) {
+	queued := make([]queuedUpdate, 0, len(updates))
+	for _, update := range updates {
+		queued = append(queued, queuedUpdate{update: update, result: make(chan error, 1)})
+	}
+	c.enqueueQueued(queued...)
+
+	results := make([]error, len(queued))
+	for i, q := range queued {
+		select {
+		case err := <-q.result:
+			if err != nil {
+				results[i] = fmt.Errorf("failed to apply update %v: %w", q.update.String(), err)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return results, nil
+}
+
+// runUpdates hands the queued updates to Gluon one at a time until the connector is closed.
+// Producers never block on Gluon: a slow apply only makes the queue grow.
+func (c *MyDBConnector) runUpdates() {
+	defer close(c.updatesDone)
+
+	for {
+		select {
+		case <-c.queueSignal:
+		case <-c.ctx.Done():
+			return
+		}
+
+		pending := c.popUpdates()
+		for i, q := range pending {
+			select {
+			case c.updates <- q.update:
+			case <-c.ctx.Done():
+				failUpdates(pending[i:], ErrConnectorClosed)
+				return
+			}
+
+			err := c.waitForUpdate(q.update)
+			if q.result != nil {
+				q.result <- err
+			}
+		}
+	}
+}
+
+// waitForUpdate waits for Gluon to apply an update and counts it against the failure budget.
+func (c *MyDBConnector) waitForUpdate(update imap.Update) error {
+	ctx, cancel := context.WithTimeout(c.ctx, updateTimeout)
+	defer cancel()
+
+	err, ok := update.WaitContext(ctx)
+	if !ok && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = ErrUpdateTimeout
+	}
+
+	if err == nil {
+		c.updateFailures = 0
+		return nil
+	}
+
+	c.updateFailures++
+	log.Printf("❌ Update %v for %s failed (%d in a row): %v", update.String(), c.email, c.updateFailures, err)
+
+	if c.updateFailures > atomic.LoadInt32(&c.updatesAllowedToFail) {
+		c.updateFailures = 0
+		c.resync()
+	}
+
+	return err
+}
+
+// resync pushes the whole state of the user to Gluon again once too many updates failed in a row,
+// since Gluon's view has probably drifted from the database. It runs in the background, at most
+// once per resyncInterval.
+func (c *MyDBConnector) resync() {
+	if time.Since(c.lastResync) < resyncInterval || !c.resyncing.CompareAndSwap(false, true) {
+		return
+	}
+	c.lastResync = time.Now()
+
+	go func() {
+		defer c.resyncing.Store(false)
+
+		ctx, cancel := context.WithTimeout(c.ctx, resyncTimeout)
+		defer cancel()
+
+		log.Printf("⚠️ Too many failed updates for %s, resyncing", c.email)
+
+		if err := c.ResetSyncCursor(ctx); err != nil {
+			log.Printf("❌ Failed to reset the sync cursor of %s: %v", c.email, err)
+			return
+		}
+		if err := c.Sync(ctx); err != nil {
+			log.Printf("❌ Resync of %s failed: %v", c.email, err)
+			return
+		}
+
+		log.Printf("✅ Resync of %s done", c.email)
+	}()
+}
+
+// ClearUpdates drops the updates not yet handed to Gluon.
+// Callers waiting on them are told with ErrUpdatesCleared rather than left hanging.
+func (c *MyDBConnector) ClearUpdates() {
+	dropped := c.popUpdates()
+	failUpdates(dropped, ErrUpdatesCleared)
+
+	log.Printf("ClearUpdates: Dropped %d pending updates for %s", len(dropped), c.email)
+}
+
+// failUpdates reports err to whoever waits on updates that will never reach Gluon.
+func failUpdates(updates []queuedUpdate, err error) {
+	for _, q := range updates {
+		if q.result != nil {
+			q.result <- err
+		}
+	}
+}
@@ -3,129 +3,397 @@ package imap
 import (
 	"context"
 	"database/sql"
+	"errors"
 
 	"fmt"
 	"log"
 
 	"github.com/ProtonMail/gluon"
+	"github.com/ProtonMail/gluon/events"
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
 	"github.com/enjoys-in/airsend-imap/internal/core/imap/connector"
 	_ "github.com/enjoys-in/airsend-imap/internal/core/imap/connector"
+	"github.com/enjoys-in/airsend-imap/internal/core/lockout"
+	"github.com/enjoys-in/airsend-imap/internal/core/oauth"
 	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/enjoys-in/airsend-imap/internal/core/tenant"
 	"golang.org/x/time/rate"
 
 	"sync"
+	"time"
 )
 
 type ConnectorFactory struct {
 	db             *sql.DB
 	server         *gluon.Server
-	userConnectors map[string]string // email -> gluonUserID
+	userConnectors map[string]string                   // email -> gluonUserID
+	connectors     map[string]*connector.MyDBConnector // email -> connector
+	sessions       *sessionTracker
+	scheduler      *syncScheduler
+	loading        map[string]chan struct{} // email -> closed once the user has been loaded or failed to load
+	lastActive     map[string]time.Time     // email -> last load, login or logout, for the idle unload
+	oauth          *oauth.Validator         // Checks XOAUTH2 and OAUTHBEARER logins, nil when they are disabled
+	lockout        *lockout.Tracker         // Failed logins, nil when they are not tracked
+	defaultDomain  string                   // Domain of logins that have none, empty when they are refused
+	cascadeDelete  bool                     // DELETE of a folder takes subfolders holding messages with it
+	tenants        *tenant.Registry         // Per-tenant access and limits, nil when tenants are not restricted
 	mu             sync.RWMutex
 }
 type APIServer struct {
-	cf      *ConnectorFactory
-	apiKey  string // Simple API key for authentication
+	cf      func() *ConnectorFactory // The factory of the running IMAP server, nil while it is not serving
+	apiKey  string                   // Simple API key for authentication
 	limiter *rate.Limiter
+	lockout *lockout.Tracker // Failed logins of IMAP and HTTP
+	tenants *tenant.Registry // Tenants and their open sessions
 }
 
 var defaultPass = []byte("default_password")
 
-// NewAPIServer creates a new API server instance, given a connector factory and an API key.
-// The API server is used to authenticate and authorize API requests.
+// ErrUserNotLoaded is returned for users that have no connector in this process.
+var ErrUserNotLoaded = errors.New("user not loaded")
 
-func NewAPIServer(cf *ConnectorFactory, apiKey string) *APIServer {
+// ErrUnknownUser is returned for emails without an IMAP enabled account.
+var ErrUnknownUser = errors.New("no IMAP enabled account for this email")
+
+// NewAPIServer creates a new API server instance, given a connector factory, an API key, the
+// login failure tracker and the tenant registry. The API server is used to authenticate and authorize API requests. The
+// factory is looked up on every request, since the HTTP API starts serving before the IMAP server is up.
+func NewAPIServer(cf func() *ConnectorFactory, apiKey string, tracker *lockout.Tracker, tenants *tenant.Registry) *APIServer {
 	return &APIServer{
 		cf:      cf,
 		apiKey:  apiKey,
 		limiter: rate.NewLimiter(10, 50), // 10 req/sec, burst of 50
+		lockout: tracker,
+		tenants: tenants,
 	}
 }
 
 func NewConnectorFactory(db *sql.DB, server *gluon.Server) *ConnectorFactory {
-	return &ConnectorFactory{
+	cf := &ConnectorFactory{
 		db:             db,
 		server:         server,
 		userConnectors: make(map[string]string),
+		connectors:     make(map[string]*connector.MyDBConnector),
+		sessions:       newSessionTracker(),
+		loading:        make(map[string]chan struct{}),
+		lastActive:     make(map[string]time.Time),
 	}
+
+	go cf.watchSessions(server.AddWatcher(events.SessionAdded{}, events.IMAPID{}, events.Login{}, events.SessionRemoved{}))
+
+	return cf
 }
 
-// GetOrCreateUser returns the Gluon user ID for an email, creating if needed
-func (cf *ConnectorFactory) InitializeUsers(ctx context.Context) error {
+// SetLockout makes the connectors refuse accounts locked out by tracker.
+// It must be called before any user is loaded.
+func (cf *ConnectorFactory) SetLockout(tracker *lockout.Tracker) {
+	cf.lockout = tracker
+}
 
-	users, err := cf.GetAllUsersWithImapEnabled(ctx)
+// SetDefaultDomain lets users of domain log in with their local part alone. An empty domain
+// makes logins without a domain fail. It must be called before any user is loaded.
+func (cf *ConnectorFactory) SetDefaultDomain(domain string) error {
+	if domain == "" {
+		cf.defaultDomain = ""
+		return nil
+	}
 
+	ascii, err := identity.ParseDomain(domain)
 	if err != nil {
-		return fmt.Errorf("failed to get users with IMAP enabled: %w", err)
-	}
-	for _, u := range users {
-		log.Printf("→ Initializing IMAP user: %s", u.EmailID)
-		gid, err := cf.GetOrCreateUser(ctx, u.EmailID, u.GluonID)
-		if err != nil {
-			log.Printf("❌ Failed to initialize IMAP user %s: %v", u.EmailID, err)
-			continue
-		}
-		log.Printf("✅ IMAP user initialized: %s (Gluon ID: %s)", u.EmailID, gid)
+		return fmt.Errorf("default login domain %q: %w", domain, err)
 	}
+	cf.defaultDomain = ascii
+
 	return nil
 }
-func (cf *ConnectorFactory) GetOrCreateUser(ctx context.Context, email string, gluon_id *string) (string, error) {
-	// Check if user is already loaded
+
+// SetCascadeMailboxDelete makes DELETE of a folder also delete subfolders that hold messages,
+// rather than refusing it. It must be called before any user is loaded.
+func (cf *ConnectorFactory) SetCascadeMailboxDelete(value bool) {
+	cf.cascadeDelete = value
+}
+
+// StartSyncScheduler syncs every loaded user in the background, roughly every interval,
+// with at most workers syncs running at once. Users loaded before and after the call are both scheduled.
+func (cf *ConnectorFactory) StartSyncScheduler(ctx context.Context, interval time.Duration, workers int) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.scheduler != nil {
+		return
+	}
+
+	cf.scheduler = newSyncScheduler(ctx, interval, workers)
+	for email, userConnector := range cf.connectors {
+		cf.scheduler.add(email, userConnector, cf.sessions.count(cf.userConnectors[email]) > 0)
+	}
+	log.Printf("→ Background sync every %s with %d workers", interval, workers)
+}
+
+// StopSyncScheduler stops the background syncs and waits for those in progress.
+// It must be called before the Gluon server is closed.
+func (cf *ConnectorFactory) StopSyncScheduler() {
+	cf.mu.Lock()
+	scheduler := cf.scheduler
+	cf.scheduler = nil
+	cf.mu.Unlock()
+
+	if scheduler != nil {
+		scheduler.stop()
+	}
+}
+
+// SyncNow syncs a loaded user right away, even while its background sync is paused,
+// and returns once the sync has run. The sync is bounded like a background one.
+func (cf *ConnectorFactory) SyncNow(email string) error {
 	cf.mu.RLock()
-	defer cf.mu.RUnlock()
+	scheduler := cf.scheduler
+	userConnector, ok := cf.connectors[email]
+	cf.mu.RUnlock()
+
+	if !ok {
+		return ErrUserNotLoaded
+	}
+	if scheduler != nil && scheduler.poll(email) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+
+	return userConnector.Sync(ctx)
+}
+
+// GetOrCreateUser returns the Gluon user ID for an email, creating if needed
+// Concurrent calls for the same email load the user once; other users are not held up meanwhile.
+func (cf *ConnectorFactory) GetOrCreateUser(ctx context.Context, email string, gluon_id *string) (string, error) {
+	for {
+		// Check if user is already loaded
+		cf.mu.Lock()
+		if gluonUserID, ok := cf.userConnectors[email]; ok {
+			cf.mu.Unlock()
+			return gluonUserID, nil
+		}
+
+		loading, busy := cf.loading[email]
+		if !busy {
+			done := make(chan struct{})
+			cf.loading[email] = done
+			cf.mu.Unlock()
+
+			gluonUserID, err := cf.loadUser(ctx, email, gluon_id)
+
+			cf.mu.Lock()
+			delete(cf.loading, email)
+			cf.mu.Unlock()
+			close(done)
+
+			return gluonUserID, err
+		}
+		cf.mu.Unlock()
+
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
 
+// loadUser adds or loads a user into Gluon, registers its connector and syncs it.
+func (cf *ConnectorFactory) loadUser(ctx context.Context, email string, gluon_id *string) (string, error) {
 	var gluonUserID string
 
 	userConnector := connector.NewConnector(cf.db, email)
+	userConnector.SetDefaultDomain(cf.defaultDomain)
+	userConnector.SetCascadeMailboxDelete(cf.cascadeDelete)
+	if cf.lockout != nil {
+		userConnector.SetLoginLocks(cf.lockout)
+	}
+	if cf.tenants != nil {
+		userConnector.SetTenants(cf.tenants)
+	}
 	// If gluonID is provided, use it; otherwise, try loading from DB
+	// A user whose Gluon store starts out empty needs a full sync rather than the changes since its cursor.
+	var freshStore bool
 	if gluon_id == nil {
-		gluonUserID, err := cf.server.AddUser(ctx, userConnector, defaultPass)
+		newID, err := cf.server.AddUser(ctx, userConnector, defaultPass)
 		if err != nil {
+			_ = userConnector.Close(ctx)
 			return "", fmt.Errorf("failed to add user to Gluon: %w", err)
 		}
-		if err := cf.saveGluonIDToDB(ctx, email, gluonUserID); err != nil {
+		if err := cf.saveGluonIDToDB(ctx, email, newID); err != nil {
 			log.Printf("⚠️ Failed to save new Gluon ID for %s: %v", email, err)
 		}
 
-		gluonUserID = gluonUserID
+		gluonUserID = newID
+		freshStore = true
 		log.Printf("Dynamically added user: %s (Gluon ID: %s)", email, gluonUserID)
 	} else {
-		gluonUserID := *gluon_id
-		if exists, err := cf.server.LoadUser(ctx, userConnector, gluonUserID, defaultPass); err == nil && !exists {
+		gluonUserID = *gluon_id
+		isNew, err := cf.server.LoadUser(ctx, userConnector, gluonUserID, defaultPass)
+		if err != nil {
+			_ = userConnector.Close(ctx)
+			return "", fmt.Errorf("failed to load user into Gluon: %w", err)
+		}
+		if !isNew {
 			log.Printf("✅ Loaded existing Gluon user: %s (%s)", email, gluonUserID)
 		}
+		freshStore = isNew
+	}
 
+	if freshStore {
+		if err := userConnector.ResetSyncCursor(ctx); err != nil {
+			// The store is deleted, so that it starts out empty again on the next load.
+			cf.unloadFailed(ctx, email, gluonUserID, userConnector, true)
+			return "", fmt.Errorf("failed to reset sync cursor of %s: %w", email, err)
+		}
 	}
 
+	cf.mu.Lock()
 	cf.userConnectors[email] = gluonUserID
+	cf.connectors[email] = userConnector
+	cf.lastActive[email] = time.Now()
+	cf.mu.Unlock()
+
 	if err := userConnector.Sync(ctx); err != nil {
-		fmt.Printf("❌ Failed to sync user %s: %v", email, err)
+		log.Printf("❌ Failed to sync user %s: %v", email, err)
+		// Not scheduled for sync yet, so the user is taken back out rather than left unsynced.
+		cf.mu.Lock()
+		delete(cf.userConnectors, email)
+		delete(cf.connectors, email)
+		delete(cf.lastActive, email)
+		cf.mu.Unlock()
+		cf.unloadFailed(ctx, email, gluonUserID, userConnector, false)
 		return "", fmt.Errorf("failed to sync user %s: %w", email, err)
 	}
+
+	cf.mu.RLock()
+	if cf.scheduler != nil {
+		cf.scheduler.add(email, userConnector, cf.sessions.count(gluonUserID) > 0)
+	}
+	cf.mu.RUnlock()
 	log.Printf("→ IMAP user ready: %s (Gluon ID: %s)", email, gluonUserID)
 	return gluonUserID, nil
 }
+
+// unloadFailed takes a user whose load failed out of Gluon again, which also closes its
+// connector. The store is deleted with removeFiles. The caller still holds the user's slot in
+// cf.loading, so no other load starts meanwhile.
+func (cf *ConnectorFactory) unloadFailed(ctx context.Context, email, gluonUserID string, userConnector *connector.MyDBConnector, removeFiles bool) {
+	ctx = context.WithoutCancel(ctx)
+	if err := cf.server.RemoveUser(ctx, gluonUserID, removeFiles); err != nil {
+		log.Printf("⚠️ Failed to remove %s from Gluon after its load failed: %v", email, err)
+		_ = userConnector.Close(ctx)
+	}
+}
+
 func (cf *ConnectorFactory) saveGluonIDToDB(ctx context.Context, email, gluonID string) error {
 	_, err := cf.db.ExecContext(ctx, `UPDATE mail_accounts SET gluon_id = $1 WHERE email = $2;`,
 		gluonID, email)
 	return err
 }
 
+// RemoveUser terminates the sessions of a user, takes it out of Gluon and deletes its Gluon store.
+// A user still being loaded is removed once it is loaded.
 func (cf *ConnectorFactory) RemoveUser(ctx context.Context, email string) error {
-	cf.mu.Lock()
-	defer cf.mu.Unlock()
+	for {
+		cf.mu.Lock()
+		if loading, busy := cf.loading[email]; busy {
+			cf.mu.Unlock()
 
-	gluonUserID, exists := cf.userConnectors[email]
-	if !exists {
-		return fmt.Errorf("user not loaded")
+			select {
+			case <-loading:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		gluonUserID, exists := cf.userConnectors[email]
+		if !exists {
+			cf.mu.Unlock()
+			return ErrUserNotLoaded
+		}
+		disconnected := cf.sessions.disconnect(gluonUserID)
+		dropped := cf.takeUserLocked(email)
+		cf.mu.Unlock()
+
+		cf.dropUser(ctx, dropped, true)
+		log.Printf("→ Removed IMAP user: %s (%d sessions terminated)", email, disconnected)
+
+		return nil
 	}
+}
 
-	// Remove from Gluon (if API exists)
-	cf.server.RemoveUser(ctx, gluonUserID, true)
+// droppedUser is a user taken out of the factory that still has to be taken out of Gluon.
+type droppedUser struct {
+	email       string
+	gluonUserID string
+	scheduler   *syncScheduler
+	done        chan struct{} // Held in cf.loading until the user is out of Gluon
+}
+
+// takeUserLocked forgets the connector of a loaded user that is not being loaded, so that it can
+// be taken out of Gluon by dropUser without holding cf.mu. Until then the user counts as being
+// loaded, and a login waits rather than loading it into Gluon a second time.
+// The caller must hold cf.mu.
+func (cf *ConnectorFactory) takeUserLocked(email string) droppedUser {
+	dropped := droppedUser{
+		email:       email,
+		gluonUserID: cf.userConnectors[email],
+		scheduler:   cf.scheduler,
+		done:        make(chan struct{}),
+	}
+	cf.loading[email] = dropped.done
 
 	delete(cf.userConnectors, email)
-	log.Printf("→ Removed IMAP user: %s", email)
+	delete(cf.connectors, email)
+	delete(cf.lastActive, email)
 
-	return nil
+	return dropped
+}
+
+// dropUser stops the background sync of a user taken by takeUserLocked and takes it out of Gluon.
+// The Gluon store is deleted with removeFiles, otherwise it is kept so the user loads again quickly.
+// Both may wait for a sync in progress, so cf.mu must not be held.
+func (cf *ConnectorFactory) dropUser(ctx context.Context, dropped droppedUser, removeFiles bool) {
+	defer func() {
+		cf.mu.Lock()
+		delete(cf.loading, dropped.email)
+		cf.mu.Unlock()
+		close(dropped.done)
+	}()
+
+	if dropped.scheduler != nil {
+		dropped.scheduler.remove(dropped.email)
+	}
+
+	if err := cf.server.RemoveUser(ctx, dropped.gluonUserID, removeFiles); err != nil {
+		log.Printf("⚠️ Failed to remove %s from Gluon: %v", dropped.email, err)
+	}
+}
+
+// Close closes the connector of every loaded user and forgets them.
+// It runs after the Gluon server is closed, which already closes the connectors it holds;
+// closing a connector twice is harmless.
+func (cf *ConnectorFactory) Close(ctx context.Context) error {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	var errs []error
+	for email, userConnector := range cf.connectors {
+		if err := userConnector.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("close connector for %s: %w", email, err))
+		}
+	}
+
+	clear(cf.connectors)
+	clear(cf.userConnectors)
+	clear(cf.lastActive)
+	log.Println("→ Closed all IMAP connectors")
+
+	return errors.Join(errs...)
 }
 
 func (cf *ConnectorFactory) GetActiveUserCount() ([]string, int) {
@@ -139,10 +407,16 @@ func (cf *ConnectorFactory) GetActiveUserCount() ([]string, int) {
 }
 
 func (cf *ConnectorFactory) IsUserLoaded(email string) bool {
+	_, exists := cf.gluonIDOf(email)
+	return exists
+}
+
+// gluonIDOf returns the Gluon user ID of a loaded user.
+func (cf *ConnectorFactory) gluonIDOf(email string) (string, bool) {
 	cf.mu.RLock()
 	defer cf.mu.RUnlock()
-	_, exists := cf.userConnectors[email]
-	return exists
+	gluonUserID, exists := cf.userConnectors[email]
+	return gluonUserID, exists
 }
 func (cf *ConnectorFactory) GetAllUsersWithImapEnabled(ctx context.Context) ([]struct {
 	GluonID *string
@@ -0,0 +1,138 @@
+package imap
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ProtonMail/gluon/imap"
+	"github.com/ProtonMail/gluon/imap/command"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Tables of a user's Gluon database, as of the Gluon version in go.mod.
+const (
+	gluonMailboxesTable      = "mailboxes_v2"
+	gluonMailboxMessageTable = "mailbox_message_%d" // Messages of one mailbox, by its internal ID
+)
+
+// KeywordStore is a STORE command Gluon accepted, as the login proxy read it.
+type KeywordStore struct {
+	Mailbox string // Selected mailbox, named the way Gluon stores it
+	UID     bool   // Set holds UIDs rather than sequence numbers
+	Set     []command.SeqRange
+	Action  command.StoreAction
+	Flags   []string // All flags of the command, system flags included
+}
+
+// StoreKeywords writes the custom keywords of a STORE that Gluon accepted in a session of
+// username to the messages, as the webmail sees them. Gluon keeps keywords in its own state
+// and only hands \Seen, \Flagged and $Forwarded changes to the connector.
+func (cf *ConnectorFactory) StoreKeywords(ctx context.Context, username string, store KeywordStore) error {
+	keywords := imap.NewFlagSet()
+	for _, flag := range store.Flags {
+		if strings.HasPrefix(flag, `\`) || slices.Contains(imap.ForwardFlagListLowerCase, strings.ToLower(flag)) {
+			continue
+		}
+		keywords = keywords.Add(flag)
+	}
+	if keywords.Len() == 0 && store.Action != command.StoreActionSetFlags {
+		return nil
+	}
+
+	c, gluonUserID, err := cf.connectorOfLogin(username)
+	if err != nil {
+		return err
+	}
+
+	messageIDs, err := cf.gluonMessageIDs(ctx, gluonUserID, store)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the messages of a STORE in %s: %w", store.Mailbox, err)
+	}
+
+	switch store.Action {
+	case command.StoreActionAddFlags:
+		return c.MarkMessagesKeywords(ctx, messageIDs, keywords, true)
+	case command.StoreActionRemFlags:
+		return c.MarkMessagesKeywords(ctx, messageIDs, keywords, false)
+	default:
+		return c.SetMessagesKeywords(ctx, messageIDs, keywords)
+	}
+}
+
+// gluonMessageIDs returns the IDs of the messages a STORE names, read from the user's Gluon
+// database, which maps the UIDs of each mailbox to the IDs the connector gave the messages.
+// Sequence numbers are taken in UID order, which they follow unless another session expunged
+// messages the STORE's session has not been told about yet.
+func (cf *ConnectorFactory) gluonMessageIDs(ctx context.Context, gluonUserID string, store KeywordStore) ([]imap.MessageID, error) {
+	// Gluon keeps the database open as well; WAL lets a reader in alongside it.
+	path := filepath.Join(cf.server.GetDatabasePath(), gluonUserID+".db")
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", url.PathEscape(path)))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var mailboxID uint64
+	err = db.QueryRowContext(ctx, fmt.Sprintf("SELECT id FROM %s WHERE name = ?", gluonMailboxesTable), store.Mailbox).Scan(&mailboxID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	table := fmt.Sprintf(gluonMailboxMessageTable, mailboxID)
+
+	// "*" is the last message of the mailbox.
+	var last int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", table)
+	if store.UID {
+		query = fmt.Sprintf("SELECT COALESCE(MAX(uid), 0) FROM %s", table)
+	}
+	if err := db.QueryRowContext(ctx, query).Scan(&last); err != nil {
+		return nil, err
+	}
+
+	var messageIDs []imap.MessageID
+	for _, r := range store.Set {
+		begin, end := seqNumber(r.Begin, last), seqNumber(r.End, last)
+		begin, end = min(begin, end), max(begin, end)
+
+		query, args := fmt.Sprintf("SELECT message_remote_id FROM %s WHERE uid BETWEEN ? AND ?", table), []any{begin, end}
+		if !store.UID {
+			query, args = fmt.Sprintf("SELECT message_remote_id FROM %s ORDER BY uid LIMIT ? OFFSET ?", table), []any{end - begin + 1, begin - 1}
+		}
+
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			messageIDs = append(messageIDs, imap.MessageID(id))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return messageIDs, nil
+}
+
+// seqNumber returns the number n stands for, last when it is "*".
+func seqNumber(n command.SeqNum, last int) int {
+	if n.IsAsterisk() {
+		return last
+	}
+	return int(n)
+}
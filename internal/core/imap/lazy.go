@@ -0,0 +1,246 @@
+package imap
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
+	"github.com/enjoys-in/airsend-imap/internal/core/imap/connector"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+)
+
+// loginRecordTimeout bounds the update of an account's last IMAP login.
+const loginRecordTimeout = 10 * time.Second
+
+// LoadOnLogin loads the user behind a login that is about to reach Gluon, which only checks
+// credentials against the users it has loaded. Users are only loaded for valid credentials of
+// tenants with IMAP enabled; anything else, malformed logins included, is left for Gluon to reject.
+// A login that loaded its user gets a login ticket back, which Gluon accepts in place of the
+// password without checking it again.
+func (cf *ConnectorFactory) LoadOnLogin(ctx context.Context, username string, password []byte) []byte {
+	id, err := identity.Parse(username, cf.defaultDomain)
+	if err != nil {
+		return nil
+	}
+	address := id.Address()
+
+	// Users are loaded under the email of their account as stored, which may differ in case.
+	account, err := connector.LookupAccount(ctx, cf.db, address)
+	if err != nil {
+		if !errors.Is(err, connector.ErrInvalidCredentials) {
+			log.Printf("❌ Failed to look up the account of %s: %v", address, err)
+		}
+		return nil
+	}
+	if cf.IsUserLoaded(account.Email) {
+		return nil
+	}
+
+	account, err = connector.Authenticate(ctx, cf.db, address, password)
+	if err != nil {
+		if !errors.Is(err, connector.ErrInvalidCredentials) {
+			log.Printf("❌ Failed to check the login of %s: %v", address, err)
+		}
+		return nil
+	}
+	if cf.imapDisabled(account.TenantName) {
+		return nil
+	}
+
+	start := time.Now()
+	if _, err := cf.LoadUser(ctx, account.Email); err != nil {
+		log.Printf("❌ Failed to load IMAP user %s on login: %v", account.Email, err)
+		return nil
+	}
+	log.Printf("→ Loaded IMAP user %s on login in %s", account.Email, time.Since(start).Round(time.Millisecond))
+
+	ticket, err := cf.issueLoginTicket(account.Email)
+	if err != nil {
+		log.Printf("⚠️ Failed to issue a login ticket for %s: %v", account.Email, err)
+		return nil
+	}
+
+	return ticket
+}
+
+// issueLoginTicket returns a one-time password Gluon accepts for a loaded user.
+func (cf *ConnectorFactory) issueLoginTicket(email string) ([]byte, error) {
+	cf.mu.RLock()
+	c, ok := cf.connectors[email]
+	cf.mu.RUnlock()
+	if !ok {
+		return nil, ErrUserNotLoaded
+	}
+
+	return c.IssueLoginTicket()
+}
+
+// storedEmail returns the email of the account an address names as it is stored, which users
+// are loaded under and may differ in case from the address. An address without an IMAP enabled
+// account is returned as is.
+func (cf *ConnectorFactory) storedEmail(ctx context.Context, address string) (string, error) {
+	account, err := connector.LookupAccount(ctx, cf.db, address)
+	if errors.Is(err, connector.ErrInvalidCredentials) {
+		return address, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the account of %s: %w", address, err)
+	}
+
+	return account.Email, nil
+}
+
+// LoadUser loads an IMAP enabled account, if it is not loaded yet, and returns its Gluon user ID.
+// It returns ErrUnknownUser when there is no such account or IMAP is disabled for it.
+func (cf *ConnectorFactory) LoadUser(ctx context.Context, email string) (string, error) {
+	if gluonUserID, ok := cf.gluonIDOf(email); ok {
+		return gluonUserID, nil
+	}
+
+	var gluonID sql.NullString
+	err := cf.db.QueryRowContext(ctx, queries.GetImapUserQuery(), email).Scan(&gluonID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUnknownUser
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up IMAP user %s: %w", email, err)
+	}
+
+	var gluonIDPtr *string
+	if gluonID.Valid {
+		gluonIDPtr = &gluonID.String
+	}
+
+	return cf.GetOrCreateUser(ctx, email, gluonIDPtr)
+}
+
+// PreloadRecentUsers loads the users who logged in within window, most recent first and at most
+// limit of them, so their first login after a restart does not wait for a full load.
+func (cf *ConnectorFactory) PreloadRecentUsers(ctx context.Context, window time.Duration, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	rows, err := cf.db.QueryContext(ctx, queries.GetRecentImapUsersQuery(), window.Seconds(), limit)
+	if err != nil {
+		return fmt.Errorf("failed to query recent IMAP users: %w", err)
+	}
+
+	type recentUser struct {
+		gluonID *string
+		email   string
+	}
+
+	var users []recentUser
+	for rows.Next() {
+		var (
+			gluonID sql.NullString
+			email   string
+		)
+		if err := rows.Scan(&gluonID, &email); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan recent IMAP user: %w", err)
+		}
+
+		user := recentUser{email: email}
+		if gluonID.Valid {
+			user.gluonID = &gluonID.String
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, err := cf.GetOrCreateUser(ctx, user.email, user.gluonID); err != nil {
+			log.Printf("❌ Failed to preload IMAP user %s: %v", user.email, err)
+		}
+	}
+	log.Printf("✅ Preloaded %d recently active IMAP users", len(users))
+
+	return nil
+}
+
+// UnloadIdleUsers unloads the users that have had no session for longer than ttl, until ctx is
+// cancelled. Their Gluon store is kept, so a later login only syncs what changed meanwhile.
+func (cf *ConnectorFactory) UnloadIdleUsers(ctx context.Context, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(min(ttl, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cf.mu.RLock()
+		var idle []string
+		for email := range cf.userConnectors {
+			if cf.isIdleLocked(email, ttl) {
+				idle = append(idle, email)
+			}
+		}
+		cf.mu.RUnlock()
+
+		for _, email := range idle {
+			cf.unloadIfIdle(ctx, email, ttl)
+		}
+	}
+}
+
+// unloadIfIdle unloads a user unless it became active since it was found idle.
+func (cf *ConnectorFactory) unloadIfIdle(ctx context.Context, email string, ttl time.Duration) {
+	cf.mu.Lock()
+	if _, busy := cf.loading[email]; busy || !cf.isIdleLocked(email, ttl) {
+		cf.mu.Unlock()
+		return
+	}
+	dropped := cf.takeUserLocked(email)
+	cf.mu.Unlock()
+
+	cf.dropUser(ctx, dropped, false)
+	log.Printf("→ Unloaded idle IMAP user: %s", email)
+}
+
+// isIdleLocked reports whether a loaded user has no session and has not been active within ttl.
+// The caller must hold cf.mu.
+func (cf *ConnectorFactory) isIdleLocked(email string, ttl time.Duration) bool {
+	gluonUserID, ok := cf.userConnectors[email]
+	if !ok || cf.sessions.count(gluonUserID) > 0 {
+		return false
+	}
+
+	return time.Since(cf.lastActive[email]) > ttl
+}
+
+// recordLogin stores the time of a user's login, which decides whether it is preloaded after a restart.
+func (cf *ConnectorFactory) recordLogin(gluonUserID string) {
+	cf.mu.RLock()
+	email, ok := cf.emailOf(gluonUserID)
+	cf.mu.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loginRecordTimeout)
+	defer cancel()
+
+	if _, err := cf.db.ExecContext(ctx, queries.TouchImapLoginQuery(), email); err != nil {
+		log.Printf("⚠️ Failed to record the IMAP login of %s: %v", email, err)
+	}
+}
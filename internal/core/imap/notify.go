@@ -0,0 +1,120 @@
+package imap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ProtonMail/gluon/imap"
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/lib/pq"
+)
+
+// listenerPingInterval keeps the LISTEN connection alive while no notifications arrive.
+const listenerPingInterval = 90 * time.Second
+
+// changeNotification is the payload sent by the change triggers.
+type changeNotification struct {
+	Op     string `json:"op"`
+	Email  string `json:"email"`
+	ID     string `json:"id"`
+	Tenant string `json:"tenant"` // Set by tenant changes only
+}
+
+// ListenForChanges applies the changes announced by the database triggers to the connectors
+// of the loaded users until ctx is cancelled, then closes the listener. Changes of users
+// that are not loaded are skipped; their next Sync picks them up.
+func (cf *ConnectorFactory) ListenForChanges(ctx context.Context, listener *pq.Listener) error {
+	// Closing also unblocks Listen, which waits for the connection to come up.
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for _, channel := range []string{queries.MessageChangesChannel, queries.MailboxChangesChannel, queries.AccountChangesChannel} {
+		if err := listener.Listen(channel); err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", channel, err)
+		}
+	}
+
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case notification := <-listener.Notify:
+			if notification == nil {
+				log.Println("⚠️ Change listener reconnected, changes made meanwhile show up on the next sync")
+				continue
+			}
+			cf.applyChange(ctx, notification)
+
+		case <-ping.C:
+			if err := listener.Ping(); err != nil {
+				log.Printf("⚠️ Change listener ping failed: %v", err)
+			}
+		}
+	}
+}
+
+// applyChange routes a single notification to the connector of its user.
+func (cf *ConnectorFactory) applyChange(ctx context.Context, notification *pq.Notification) {
+	var change changeNotification
+	if err := json.Unmarshal([]byte(notification.Extra), &change); err != nil {
+		log.Printf("❌ Invalid change notification on %s: %v", notification.Channel, err)
+		return
+	}
+
+	if notification.Channel == queries.AccountChangesChannel {
+		cf.applyAccountChange(ctx, change)
+		return
+	}
+
+	cf.mu.RLock()
+	_, loaded := cf.userConnectors[change.Email]
+	userConnector := cf.connectors[change.Email]
+	cf.mu.RUnlock()
+
+	if !loaded || userConnector == nil {
+		return
+	}
+
+	var err error
+	switch notification.Channel {
+	case queries.MessageChangesChannel:
+		err = userConnector.ApplyMessageChange(ctx, change.Op, imap.MessageID(change.ID))
+	case queries.MailboxChangesChannel:
+		err = userConnector.ApplyMailboxChange(ctx, change.Op, imap.MailboxID(change.ID))
+	}
+
+	if err != nil {
+		log.Printf("❌ Failed to apply %s of %s for %s: %v", change.Op, change.ID, change.Email, err)
+	}
+}
+
+// applyAccountChange ends the sessions of an account whose password changed, and unloads an
+// account that lost IMAP access, so no client keeps using credentials that are no longer valid.
+// Tenant changes are applied to the sessions of the tenant's accounts.
+func (cf *ConnectorFactory) applyAccountChange(ctx context.Context, change changeNotification) {
+	switch change.Op {
+	case "PASSWORD":
+		if n := cf.DisconnectUser(change.Email); n > 0 {
+			log.Printf("→ Password of %s changed, terminated %d IMAP sessions", change.Email, n)
+		}
+
+	case "TENANT":
+		cf.applyTenantChange(ctx, change.Tenant)
+
+	case "DISABLED", "DELETE":
+		err := cf.RemoveUser(ctx, change.Email)
+		if err != nil && !errors.Is(err, ErrUserNotLoaded) {
+			log.Printf("❌ Failed to remove IMAP user %s after %s: %v", change.Email, change.Op, err)
+		}
+	}
+}
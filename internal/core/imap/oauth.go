@@ -0,0 +1,74 @@
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
+	"github.com/enjoys-in/airsend-imap/internal/core/imap/connector"
+	"github.com/enjoys-in/airsend-imap/internal/core/oauth"
+)
+
+// SetOAuthValidator enables XOAUTH2 and OAUTHBEARER logins, checked with v.
+// It must be called before the server starts serving.
+func (cf *ConnectorFactory) SetOAuthValidator(v *oauth.Validator) {
+	cf.oauth = v
+}
+
+// LoginWithOAuth checks the bearer token of an XOAUTH2 or OAUTHBEARER login, loads the account
+// named by its email claim and returns the email and a one-time password Gluon accepts for it.
+// username is the user the client asked for, if any; it has to name the token's account.
+// Rejected tokens and accounts are reported as oauth.ErrInvalidToken.
+func (cf *ConnectorFactory) LoginWithOAuth(ctx context.Context, username, token string) (string, []byte, error) {
+	if cf.oauth == nil {
+		return "", nil, fmt.Errorf("%w: OAuth is not configured", oauth.ErrInvalidToken)
+	}
+
+	claims, err := cf.oauth.Validate(ctx, token)
+	if errors.Is(err, oauth.ErrNoEmail) {
+		return "", nil, fmt.Errorf("%w: %w", oauth.ErrInvalidToken, err)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := identity.Parse(claims.Email, "")
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: email claim %q: %w", oauth.ErrInvalidToken, claims.Email, err)
+	}
+	if username != "" {
+		// The SASL username may be any spelling of the token's account, such as a plus-address.
+		if login, err := identity.Parse(username, cf.defaultDomain); err != nil || login.Address() != id.Address() {
+			return "", nil, fmt.Errorf("%w: token of %s used to log in as %s", oauth.ErrInvalidToken, claims.Email, username)
+		}
+	}
+
+	account, err := connector.LookupAccount(ctx, cf.db, id.Address())
+	if errors.Is(err, connector.ErrInvalidCredentials) {
+		return "", nil, fmt.Errorf("%w: %w", oauth.ErrInvalidToken, ErrUnknownUser)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if cf.imapDisabled(account.TenantName) {
+		return "", nil, fmt.Errorf("%w: IMAP is disabled for tenant %s", oauth.ErrInvalidToken, account.TenantName)
+	}
+
+	email := account.Email
+	if _, err := cf.LoadUser(ctx, email); err != nil {
+		if errors.Is(err, ErrUnknownUser) {
+			return "", nil, fmt.Errorf("%w: %w", oauth.ErrInvalidToken, err)
+		}
+		return "", nil, err
+	}
+
+	ticket, err := cf.issueLoginTicket(email)
+	if err != nil {
+		return "", nil, err
+	}
+	log.Printf("→ Accepted OAuth token of %s (subject %s)", email, claims.Subject)
+
+	return email, ticket, nil
+}
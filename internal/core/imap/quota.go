@@ -0,0 +1,39 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
+	"github.com/enjoys-in/airsend-imap/internal/core/imap/connector"
+)
+
+// connectorOfLogin returns the connector and the Gluon user ID of the loaded account a login
+// names, however it spells it.
+func (cf *ConnectorFactory) connectorOfLogin(username string) (*connector.MyDBConnector, string, error) {
+	id, err := identity.Parse(username, cf.defaultDomain)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+
+	for email, c := range cf.connectors {
+		if c.Login() == id.Address() {
+			return c, cf.userConnectors[email], nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s", ErrUserNotLoaded, id.Address())
+}
+
+// Quota returns the usage and limits of the account a session logged in as, for GETQUOTA and
+// GETQUOTAROOT.
+func (cf *ConnectorFactory) Quota(ctx context.Context, username string) (connector.Quota, error) {
+	c, _, err := cf.connectorOfLogin(username)
+	if err != nil {
+		return connector.Quota{}, err
+	}
+
+	return c.Quota(ctx)
+}
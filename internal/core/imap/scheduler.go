@@ -0,0 +1,167 @@
+package imap
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/imap/connector"
+	"github.com/enjoys-in/airsend-imap/internal/utils/ticker"
+)
+
+// syncJitter is the fraction by which each user's sync interval is randomly stretched or
+// shrunk, so users loaded together do not keep syncing on the same tick.
+const syncJitter = 0.2
+
+// syncTimeout bounds a single background Sync.
+const syncTimeout = 2 * time.Minute
+
+// syncScheduler runs the Sync of every loaded connector in the background.
+// Each user has its own ticker, paused while the user has no sessions open, and a
+// bounded pool of workers limits how many syncs hit the database at once.
+type syncScheduler struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	interval time.Duration
+	slots    chan struct{}
+
+	mu    sync.Mutex
+	users map[string]*scheduledUser // email -> ticker
+}
+
+// scheduledUser is the ticker of one user and the channel closed once it has stopped ticking.
+type scheduledUser struct {
+	ticker *ticker.Ticker
+	done   chan struct{}
+}
+
+func newSyncScheduler(ctx context.Context, interval time.Duration, workers int) *syncScheduler {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &syncScheduler{
+		ctx:      ctx,
+		cancel:   cancel,
+		interval: interval,
+		slots:    make(chan struct{}, max(workers, 1)),
+		users:    make(map[string]*scheduledUser),
+	}
+}
+
+// add schedules the sync of a user. Inactive users start out paused.
+func (s *syncScheduler) add(email string, userConnector *connector.MyDBConnector, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[email]; ok || s.ctx.Err() != nil {
+		return
+	}
+
+	user := &scheduledUser{
+		ticker: ticker.New(s.jitteredInterval()),
+		done:   make(chan struct{}),
+	}
+	if !active {
+		user.ticker.Pause()
+	}
+	s.users[email] = user
+
+	go func() {
+		defer close(user.done)
+		user.ticker.Tick(func(time.Time) {
+			s.sync(email, userConnector)
+		})
+	}()
+}
+
+// halt stops the ticker and waits for a sync in progress to finish.
+func (user *scheduledUser) halt() {
+	user.ticker.Stop()
+	user.ticker.Pause()
+	<-user.done
+}
+
+// remove stops the sync of a user, waiting for a sync in progress to finish.
+func (s *syncScheduler) remove(email string) {
+	s.mu.Lock()
+	user, ok := s.users[email]
+	delete(s.users, email)
+	s.mu.Unlock()
+
+	if ok {
+		user.halt()
+	}
+}
+
+// setActive resumes or pauses the sync of a user. A resumed user is synced right away,
+// to catch up on what changed while it was paused.
+func (s *syncScheduler) setActive(email string, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[email]
+	if !ok {
+		return
+	}
+
+	if active {
+		user.ticker.Resume()
+		go user.ticker.Poll()
+	} else {
+		user.ticker.Pause()
+	}
+}
+
+// poll syncs a user now, whether or not it is paused, and waits for the sync to finish.
+func (s *syncScheduler) poll(email string) bool {
+	s.mu.Lock()
+	user, ok := s.users[email]
+	s.mu.Unlock()
+
+	if ok {
+		user.ticker.Poll()
+	}
+
+	return ok
+}
+
+// stop stops every ticker and waits for the syncs in progress.
+func (s *syncScheduler) stop() {
+	s.cancel()
+
+	s.mu.Lock()
+	users := s.users
+	s.users = make(map[string]*scheduledUser)
+	s.mu.Unlock()
+
+	for _, user := range users {
+		user.halt()
+	}
+}
+
+// sync runs one Sync once a worker is free.
+func (s *syncScheduler) sync(email string, userConnector *connector.MyDBConnector) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-s.ctx.Done():
+		return
+	}
+	defer func() { <-s.slots }()
+
+	ctx, cancel := context.WithTimeout(s.ctx, syncTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := userConnector.Sync(ctx); err != nil {
+		log.Printf("❌ Background sync of %s failed: %v", email, err)
+		return
+	}
+	log.Printf("→ Background sync of %s done in %s", email, time.Since(start).Round(time.Millisecond))
+}
+
+// jitteredInterval returns the interval stretched or shrunk by up to syncJitter.
+func (s *syncScheduler) jitteredInterval() time.Duration {
+	jitter := (rand.Float64()*2 - 1) * syncJitter
+	return time.Duration(float64(s.interval) * (1 + jitter))
+}
@@ -0,0 +1,358 @@
+package imap
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/gluon/events"
+	"github.com/ProtonMail/gluon/imap"
+)
+
+// sessionTracker follows the Gluon session events to know which users have sessions open,
+// and keeps the client connection of each session so it can be listed and disconnected.
+type sessionTracker struct {
+	mu       sync.Mutex
+	conns    map[net.Addr]*trackedConn // remote address -> connection not yet claimed by a session
+	sessions map[int]*session          // session ID -> session
+	users    map[string]int            // Gluon user ID -> number of logged in sessions
+}
+
+// session is a Gluon session and the client connection it serves.
+type session struct {
+	id          int
+	userID      string // Empty until logged in
+	remoteAddr  string
+	localAddr   string
+	conn        *trackedConn // Nil for connections that were not accepted through TrackConn
+	connectedAt time.Time
+	loginAt     time.Time
+	imapID      *imap.IMAPID // Set once the client sent an ID command
+}
+
+// SessionInfo describes a logged in IMAP session.
+type SessionInfo struct {
+	ID          int         `json:"id"`
+	RemoteAddr  string      `json:"remote_addr"`
+	LocalAddr   string      `json:"local_addr"`
+	TLS         bool        `json:"tls"`
+	ConnectedAt time.Time   `json:"connected_at"`
+	LoginAt     time.Time   `json:"login_at"`
+	Client      *ClientInfo `json:"client,omitempty"`
+}
+
+// ClientInfo is what a client said about itself with the IMAP ID command (RFC 2971).
+type ClientInfo struct {
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"`
+	OS        string `json:"os,omitempty"`
+	OSVersion string `json:"os_version,omitempty"`
+	Vendor    string `json:"vendor,omitempty"`
+}
+
+// tlsState is implemented by connections that upgrade to TLS in place, such as after STARTTLS.
+type tlsState interface {
+	TLSActive() bool
+}
+
+// trackedConn is a client connection known to the session tracker.
+// Its remote address is fixed at accept time, so it matches the one Gluon reports for its session.
+type trackedConn struct {
+	net.Conn
+	remote  net.Addr
+	tracker *sessionTracker
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr { return c.remote }
+
+// Close closes the connection and forgets it if no session claimed it.
+func (c *trackedConn) Close() error {
+	c.tracker.forgetConn(c)
+	return c.Conn.Close()
+}
+
+// tls reports whether the connection is encrypted, either implicitly or after STARTTLS.
+func (c *trackedConn) tls() bool {
+	switch conn := c.Conn.(type) {
+	case tlsState:
+		return conn.TLSActive()
+	case *tls.Conn:
+		return true
+	default:
+		return false
+	}
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{
+		conns:    make(map[net.Addr]*trackedConn),
+		sessions: make(map[int]*session),
+		users:    make(map[string]int),
+	}
+}
+
+// track registers a connection accepted for Gluon.
+func (t *sessionTracker) track(conn net.Conn) *trackedConn {
+	tracked := &trackedConn{Conn: conn, remote: conn.RemoteAddr(), tracker: t}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conns[tracked.remote] = tracked
+
+	return tracked
+}
+
+// forgetConn drops a connection that is closed before its session was added.
+func (t *sessionTracker) forgetConn(conn *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[conn.remote] == conn {
+		delete(t.conns, conn.remote)
+	}
+}
+
+// add records a new session and claims its connection.
+func (t *sessionTracker) add(sessionID int, remoteAddr, localAddr net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &session{id: sessionID, connectedAt: time.Now()}
+	if remoteAddr != nil {
+		s.remoteAddr = remoteAddr.String()
+		s.conn = t.conns[remoteAddr]
+		delete(t.conns, remoteAddr)
+	}
+	if localAddr != nil {
+		s.localAddr = localAddr.String()
+	}
+
+	t.sessions[sessionID] = s
+}
+
+// login records a logged in session and returns the user's session count, along with
+// the IMAP ID the client sent before logging in, if any.
+func (t *sessionTracker) login(sessionID int, userID string) (int, *imap.IMAPID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[sessionID]
+	if !ok {
+		s = &session{id: sessionID, connectedAt: time.Now()}
+		t.sessions[sessionID] = s
+	}
+	if s.userID != "" {
+		return t.users[userID], s.imapID
+	}
+
+	s.userID = userID
+	s.loginAt = time.Now()
+	t.users[userID]++
+
+	return t.users[userID], s.imapID
+}
+
+// setIMAPID records the IMAP ID sent by the client of a session. It returns the user the
+// session is logged in as, if any.
+func (t *sessionTracker) setIMAPID(sessionID int, id imap.IMAPID) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[sessionID]
+	if !ok {
+		return ""
+	}
+	s.imapID = &id
+
+	return s.userID
+}
+
+// remove forgets a session. It returns the user the session was logged in as, if any,
+// and that user's remaining session count.
+func (t *sessionTracker) remove(sessionID int) (string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[sessionID]
+	if !ok {
+		return "", 0
+	}
+	delete(t.sessions, sessionID)
+
+	if s.userID == "" {
+		return "", 0
+	}
+
+	t.users[s.userID]--
+	remaining := t.users[s.userID]
+	if remaining <= 0 {
+		delete(t.users, s.userID)
+	}
+
+	return s.userID, remaining
+}
+
+// count returns the number of logged in sessions of a user.
+func (t *sessionTracker) count(userID string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.users[userID]
+}
+
+// list describes the logged in sessions of a user, oldest login first.
+func (t *sessionTracker) list(userID string) []SessionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, t.users[userID])
+	for _, s := range t.sessions {
+		if s.userID != userID {
+			continue
+		}
+
+		info := SessionInfo{
+			ID:          s.id,
+			RemoteAddr:  s.remoteAddr,
+			LocalAddr:   s.localAddr,
+			TLS:         s.conn != nil && s.conn.tls(),
+			ConnectedAt: s.connectedAt,
+			LoginAt:     s.loginAt,
+		}
+		if s.imapID != nil {
+			info.Client = &ClientInfo{
+				Name:      s.imapID.Name,
+				Version:   s.imapID.Version,
+				OS:        s.imapID.OS,
+				OSVersion: s.imapID.OSVersion,
+				Vendor:    s.imapID.Vendor,
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b SessionInfo) int {
+		return a.LoginAt.Compare(b.LoginAt)
+	})
+
+	return infos
+}
+
+// disconnect closes the connections of the logged in sessions of a user and returns how many
+// it closed. Gluon ends each session once its connection is gone.
+func (t *sessionTracker) disconnect(userID string) int {
+	t.mu.Lock()
+	var conns []*trackedConn
+	for _, s := range t.sessions {
+		if s.userID == userID && s.conn != nil {
+			conns = append(conns, s.conn)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	return len(conns)
+}
+
+// TrackConn registers a client connection so its session can be listed and disconnected.
+// The returned connection must be handed to Gluon in place of conn.
+func (cf *ConnectorFactory) TrackConn(conn net.Conn) net.Conn {
+	return cf.sessions.track(conn)
+}
+
+// ListSessions describes the open IMAP sessions of a loaded user.
+func (cf *ConnectorFactory) ListSessions(email string) ([]SessionInfo, error) {
+	gluonUserID, ok := cf.gluonIDOf(email)
+	if !ok {
+		return nil, ErrUserNotLoaded
+	}
+
+	return cf.sessions.list(gluonUserID), nil
+}
+
+// DisconnectUser terminates the open IMAP sessions of a user and returns how many it terminated.
+// The user stays loaded; its clients have to log in again.
+func (cf *ConnectorFactory) DisconnectUser(email string) int {
+	gluonUserID, ok := cf.gluonIDOf(email)
+	if !ok {
+		return 0
+	}
+
+	return cf.sessions.disconnect(gluonUserID)
+}
+
+// watchSessions consumes the Gluon session events until the server is closed.
+// The sync of a user runs only while that user has sessions open.
+func (cf *ConnectorFactory) watchSessions(eventCh <-chan events.Event) {
+	for event := range eventCh {
+		switch event := event.(type) {
+		case events.SessionAdded:
+			cf.sessions.add(event.SessionID, event.RemoteAddr, event.LocalAddr)
+
+		case events.IMAPID:
+			if userID := cf.sessions.setIMAPID(event.SessionID, event.IMAPID); userID != "" {
+				cf.recordIMAPID(userID, event.IMAPID)
+			}
+
+		case events.Login:
+			go cf.recordLogin(event.UserID)
+			count, imapID := cf.sessions.login(event.SessionID, event.UserID)
+			if imapID != nil {
+				cf.recordIMAPID(event.UserID, *imapID)
+			}
+			if count == 1 {
+				cf.setUserActive(event.UserID, true)
+			}
+
+		case events.SessionRemoved:
+			if userID, remaining := cf.sessions.remove(event.SessionID); userID != "" && remaining == 0 {
+				cf.setUserActive(userID, false)
+			}
+		}
+	}
+}
+
+// recordIMAPID hands the IMAP ID of a client to the connector of the user it logged in as.
+func (cf *ConnectorFactory) recordIMAPID(gluonUserID string, id imap.IMAPID) {
+	cf.mu.RLock()
+	email, ok := cf.emailOf(gluonUserID)
+	userConnector := cf.connectors[email]
+	cf.mu.RUnlock()
+
+	if ok && userConnector != nil {
+		userConnector.RecordIMAPID(id)
+	}
+}
+
+// setUserActive resumes or pauses the background sync of a user and restarts its idle countdown.
+func (cf *ConnectorFactory) setUserActive(gluonUserID string, active bool) {
+	cf.mu.Lock()
+	scheduler := cf.scheduler
+	email, ok := cf.emailOf(gluonUserID)
+	if ok {
+		cf.lastActive[email] = time.Now()
+	}
+	cf.mu.Unlock()
+
+	if ok && scheduler != nil {
+		scheduler.setActive(email, active)
+	}
+}
+
+// emailOf returns the email of a loaded user given its Gluon user ID.
+// The caller must hold cf.mu.
+func (cf *ConnectorFactory) emailOf(gluonUserID string) (string, bool) {
+	for email, id := range cf.userConnectors {
+		if id == gluonUserID {
+			return email, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,133 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/enjoys-in/airsend-imap/internal/core/tenant"
+)
+
+// SetTenants makes the connectors apply the tenants of registry: users of tenants with IMAP
+// disabled are not loaded nor let in, and mailbox sizes are capped by the tenant's.
+// It must be called before any user is loaded.
+func (cf *ConnectorFactory) SetTenants(registry *tenant.Registry) {
+	cf.tenants = registry
+}
+
+// imapDisabled reports whether the named tenant has IMAP disabled.
+func (cf *ConnectorFactory) imapDisabled(name string) bool {
+	if cf.tenants == nil {
+		return false
+	}
+	t, ok := cf.tenants.Lookup(name)
+	return ok && !t.IMAPEnabled
+}
+
+// AdmitSession lets the session of a login Gluon accepted on endpoint, under the TLS server name
+// serverName, go on as long as its account's tenant allows it. The returned function must be
+// called once the session's connection is closed.
+func (cf *ConnectorFactory) AdmitSession(username, endpoint, serverName string) (func(), error) {
+	if cf.tenants == nil {
+		return func() {}, nil
+	}
+
+	// The connector that accepted the login knows the account's tenant as of that login.
+	c, _, err := cf.connectorOfLogin(username)
+	if err != nil {
+		return nil, err
+	}
+
+	return cf.tenants.Admit(c.TenantName(), endpoint, serverName)
+}
+
+// TenantUsers returns the loaded users of a tenant.
+func (cf *ConnectorFactory) TenantUsers(ctx context.Context, name string) ([]string, error) {
+	rows, err := cf.db.QueryContext(ctx, queries.GetTenantEmailsQuery(), name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the accounts of tenant %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		if cf.IsUserLoaded(email) {
+			users = append(users, email)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(users)
+
+	return users, nil
+}
+
+// DisconnectTenant terminates the open IMAP sessions of the loaded users of a tenant and returns
+// how many it terminated.
+func (cf *ConnectorFactory) DisconnectTenant(name string) int {
+	cf.mu.RLock()
+	var gluonUserIDs []string
+	for email, c := range cf.connectors {
+		if c.TenantName() == name {
+			gluonUserIDs = append(gluonUserIDs, cf.userConnectors[email])
+		}
+	}
+	cf.mu.RUnlock()
+
+	n := 0
+	for _, gluonUserID := range gluonUserIDs {
+		n += cf.sessions.disconnect(gluonUserID)
+	}
+	return n
+}
+
+// applyTenantChange reloads the tenants after one of them changed, and ends the sessions of a
+// tenant that lost IMAP access or some of its endpoints.
+func (cf *ConnectorFactory) applyTenantChange(ctx context.Context, name string) {
+	if cf.tenants == nil {
+		return
+	}
+
+	before, existed := cf.tenants.Lookup(name)
+	if !existed {
+		// Until then its accounts were not restricted.
+		before = tenant.Tenant{Name: name, IMAPEnabled: true}
+	}
+	if err := cf.tenants.Load(ctx); err != nil {
+		log.Printf("❌ Failed to reload the tenants after %s changed: %v", name, err)
+		return
+	}
+	after, exists := cf.tenants.Lookup(name)
+
+	if !restricts(before, after, exists) {
+		return
+	}
+	if n := cf.DisconnectTenant(name); n > 0 {
+		log.Printf("→ Tenant %s changed, terminated %d IMAP sessions", name, n)
+	}
+}
+
+// restricts reports whether the tenant after a change refuses sessions it let in before: IMAP
+// was disabled or endpoints were taken away. Deleting a tenant lifts its restrictions, so it
+// does not end any session.
+func restricts(before, after tenant.Tenant, exists bool) bool {
+	if !exists {
+		return false
+	}
+	if before.IMAPEnabled && !after.IMAPEnabled {
+		return true
+	}
+	if len(after.Endpoints) == 0 {
+		return false
+	}
+	return len(before.Endpoints) == 0 || slices.ContainsFunc(before.Endpoints, func(endpoint string) bool {
+		return !after.AllowsEndpoint(endpoint)
+	})
+}
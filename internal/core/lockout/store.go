@@ -0,0 +1,83 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+)
+
+// Ban keeps an account or address from logging in until it expires, or for good.
+type Ban struct {
+	Key
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"` // Nil for a permanent ban
+}
+
+func (b Ban) activeAt(now time.Time) bool {
+	return b.ExpiresAt == nil || now.Before(*b.ExpiresAt)
+}
+
+// BanStore keeps the ban list.
+type BanStore interface {
+	List(ctx context.Context) ([]Ban, error)
+	Ban(ctx context.Context, ban Ban) error
+	Unban(ctx context.Context, key Key) (bool, error)
+}
+
+// postgresStore keeps the ban list in the login_bans table.
+type postgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore returns a BanStore backed by the login_bans table.
+func NewPostgresStore(db *sql.DB) BanStore {
+	return &postgresStore{db: db}
+}
+
+// List returns the bans that have not expired.
+func (s *postgresStore) List(ctx context.Context) ([]Ban, error) {
+	rows, err := s.db.QueryContext(ctx, queries.ListLoginBansQuery())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var (
+			ban     Ban
+			expires sql.NullTime
+		)
+		if err := rows.Scan(&ban.Kind, &ban.Value, &ban.Reason, &ban.CreatedAt, &expires); err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			ban.ExpiresAt = &expires.Time
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// Ban adds a ban, replacing any ban of the same account or address.
+func (s *postgresStore) Ban(ctx context.Context, ban Ban) error {
+	var expires sql.NullTime
+	if ban.ExpiresAt != nil {
+		expires = sql.NullTime{Time: *ban.ExpiresAt, Valid: true}
+	}
+	_, err := s.db.ExecContext(ctx, queries.UpsertLoginBanQuery(), ban.Kind, ban.Value, ban.Reason, ban.CreatedAt, expires)
+	return err
+}
+
+// Unban lifts the ban of an account or address. It reports false when there was none.
+func (s *postgresStore) Unban(ctx context.Context, key Key) (bool, error) {
+	res, err := s.db.ExecContext(ctx, queries.DeleteLoginBanQuery(), key.Kind, key.Value)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
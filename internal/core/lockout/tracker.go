@@ -0,0 +1,439 @@
+// Package lockout slows down and stops password guessing. It counts the failed logins of every
+// account and every client address, makes each further attempt wait longer, locks an account or
+// address out for a while once it failed too often, and can ban addresses that keep coming back
+// in a ban list stored in Postgres. IMAP and the HTTP login share one Tracker.
+package lockout
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/identity"
+)
+
+// Kinds of keys failures are counted by.
+const (
+	KindAccount = "account"
+	KindIP      = "ip"
+)
+
+// maxEntries bounds the number of accounts and addresses tracked at once.
+const maxEntries = 100_000
+
+// ErrLocked is returned for logins of an account or from an address that is locked out or banned.
+var ErrLocked = errors.New("too many failed logins")
+
+// Config sets how failures are counted and punished. A limit of 0 disables that lockout.
+type Config struct {
+	AccountLimit int           // Failures of one account before it is locked out
+	IPLimit      int           // Failures from one address before it is locked out
+	BaseDelay    time.Duration // Wait after the first failure, doubled by every further one
+	MaxDelay     time.Duration // Longest wait between two attempts
+	Lockout      time.Duration // How long a lockout lasts
+	Window       time.Duration // Failures are forgotten after this long without another one
+	BanAfter     int           // Lockouts of one address before it is banned, 0 never bans
+	BanDuration  time.Duration // How long an automatic ban lasts, 0 bans for good
+
+	// DefaultDomain is the domain of logins that have none, so that they count against the
+	// account they log in to. Empty when such logins are refused.
+	DefaultDomain string
+}
+
+// Key is an account or a client address.
+type Key struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Status describes the failures and lockout of an account or address.
+type Status struct {
+	Key
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	Lockouts    int        `json:"lockouts"`
+}
+
+// entry is the failure count of one key.
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	lockouts    int // Lockouts within the window, which lead to a ban
+}
+
+// Tracker counts failed logins by account and by address.
+type Tracker struct {
+	cfg   Config
+	store BanStore // Nil when bans are only kept in memory
+
+	mu      sync.Mutex
+	entries map[Key]*entry
+	bans    map[Key]Ban
+
+	now func() time.Time
+}
+
+// NewTracker creates a tracker. store may be nil, in which case bans do not survive a restart.
+func NewTracker(cfg Config, store BanStore) *Tracker {
+	return &Tracker{
+		cfg:     cfg,
+		store:   store,
+		entries: make(map[Key]*entry),
+		bans:    make(map[Key]Ban),
+		now:     time.Now,
+	}
+}
+
+// AccountKey returns the key of an account, given the domain of logins that have none. Logins that
+// name the same account, like its plus-addresses, share the key.
+func AccountKey(account, defaultDomain string) Key {
+	if id, err := identity.Parse(account, defaultDomain); err == nil {
+		return Key{Kind: KindAccount, Value: id.Address()}
+	}
+	return Key{Kind: KindAccount, Value: strings.ToLower(strings.TrimSpace(account))}
+}
+
+// AccountKey returns the key of an account with the tracker's default domain.
+func (t *Tracker) AccountKey(account string) Key {
+	return AccountKey(account, t.cfg.DefaultDomain)
+}
+
+// IPKey returns the key of a client address. IPv6 clients are counted by their /64, since
+// anyone holding one address usually holds the whole prefix.
+func IPKey(ip string) Key {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Key{Kind: KindIP, Value: ip}
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return Key{Kind: KindIP, Value: prefix.String()}
+	}
+	return Key{Kind: KindIP, Value: addr.String()}
+}
+
+// HostOf returns the IP of a client address, such as a net.Addr or an http.Request RemoteAddr.
+func HostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// keys returns the keys of a login. Either may be empty, which leaves it out.
+func (t *Tracker) keys(account, ip string) []Key {
+	var ks []Key
+	if account = strings.TrimSpace(account); account != "" {
+		ks = append(ks, t.AccountKey(account))
+	}
+	if ip != "" {
+		ks = append(ks, IPKey(ip))
+	}
+	return ks
+}
+
+// Check decides whether a login of account from ip may be checked now. It returns ErrLocked when
+// the account or the address is locked out or banned, with how long that lasts, 0 meaning for good.
+// Otherwise the login has to wait the returned delay, which grows with every recent failure.
+func (t *Tracker) Check(account, ip string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	var wait time.Duration
+	for _, key := range t.keys(account, ip) {
+		if ban, ok := t.bans[key]; ok && ban.activeAt(now) {
+			if ban.ExpiresAt == nil {
+				return 0, ErrLocked
+			}
+			return ban.ExpiresAt.Sub(now), ErrLocked
+		}
+
+		e, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		if now.Before(e.lockedUntil) {
+			return e.lockedUntil.Sub(now), ErrLocked
+		}
+		if e.failures > 0 {
+			wait = max(wait, e.lastFailure.Add(t.delay(e.failures)).Sub(now))
+		}
+	}
+
+	return max(wait, 0), nil
+}
+
+// Locked reports whether an account is locked out or banned, whatever address it is used from.
+func (t *Tracker) Locked(account string) bool {
+	_, err := t.Check(account, "")
+	return errors.Is(err, ErrLocked)
+}
+
+// delay is the wait after failures failures in a row.
+func (t *Tracker) delay(failures int) time.Duration {
+	d := t.cfg.BaseDelay
+	for i := 1; i < failures && d < t.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, t.cfg.MaxDelay)
+}
+
+// Failure records a failed login of account from ip. Failures while locked out are not counted,
+// so a lockout ends when it was meant to. An address locked out BanAfter times is banned.
+func (t *Tracker) Failure(ctx context.Context, account, ip string) {
+	var banned []Key
+
+	t.mu.Lock()
+	now := t.now()
+	for _, key := range t.keys(account, ip) {
+		limit := t.cfg.AccountLimit
+		if key.Kind == KindIP {
+			limit = t.cfg.IPLimit
+		}
+
+		e := t.entryLocked(key, now)
+		if now.Before(e.lockedUntil) {
+			continue
+		}
+		e.failures++
+		e.lastFailure = now
+
+		if limit <= 0 || e.failures < limit {
+			continue
+		}
+		e.failures = 0
+		e.lockedUntil = now.Add(t.cfg.Lockout)
+		e.lockouts++
+		log.Printf("⚠️ Locked out %s %s for %s after %d failed logins", key.Kind, key.Value, t.cfg.Lockout, limit)
+
+		if key.Kind == KindIP && t.cfg.BanAfter > 0 && e.lockouts >= t.cfg.BanAfter {
+			banned = append(banned, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, key := range banned {
+		if err := t.Ban(ctx, key, "too many failed logins", t.cfg.BanDuration); err != nil {
+			log.Printf("❌ Failed to ban %s %s: %v", key.Kind, key.Value, err)
+		}
+	}
+}
+
+// entryLocked returns the entry of a key, starting it over when its failures are older than the
+// window. The caller must hold t.mu.
+func (t *Tracker) entryLocked(key Key, now time.Time) *entry {
+	e, ok := t.entries[key]
+	if ok && now.Before(e.lockedUntil) {
+		return e
+	}
+	if ok && t.cfg.Window > 0 && now.Sub(e.lastFailure) > t.cfg.Window && now.Sub(e.lockedUntil) > t.cfg.Window {
+		ok = false
+	}
+	if !ok {
+		if len(t.entries) >= maxEntries {
+			t.pruneLocked(now)
+		}
+		e = &entry{}
+		t.entries[key] = e
+	}
+	return e
+}
+
+// Success records a successful login. The account starts over; the address does not, since one
+// working password does not make the other attempts from it any less suspicious.
+func (t *Tracker) Success(account string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := t.AccountKey(account)
+	if e, ok := t.entries[key]; ok && !t.now().Before(e.lockedUntil) {
+		delete(t.entries, key)
+	}
+}
+
+// List returns the accounts and addresses that recently failed or are locked out, locked out first.
+func (t *Tracker) List() []Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	statuses := make([]Status, 0, len(t.entries))
+	for key, e := range t.entries {
+		if e.failures == 0 && !now.Before(e.lockedUntil) {
+			continue
+		}
+		status := Status{Key: key, Failures: e.failures, LastFailure: e.lastFailure, Lockouts: e.lockouts}
+		if now.Before(e.lockedUntil) {
+			until := e.lockedUntil
+			status.LockedUntil = &until
+		}
+		statuses = append(statuses, status)
+	}
+
+	slices.SortFunc(statuses, func(a, b Status) int {
+		if (a.LockedUntil != nil) != (b.LockedUntil != nil) {
+			if a.LockedUntil != nil {
+				return -1
+			}
+			return 1
+		}
+		return b.LastFailure.Compare(a.LastFailure)
+	})
+
+	return statuses
+}
+
+// Clear forgets the failures of an account or address, ends its lockout and lifts its ban.
+// It reports whether there was anything to clear.
+func (t *Tracker) Clear(ctx context.Context, key Key) (bool, error) {
+	t.mu.Lock()
+	_, tracked := t.entries[key]
+	_, banned := t.bans[key]
+	delete(t.entries, key)
+	delete(t.bans, key)
+	t.mu.Unlock()
+
+	if t.store != nil {
+		removed, err := t.store.Unban(ctx, key)
+		if err != nil {
+			return tracked || banned, err
+		}
+		banned = banned || removed
+	}
+
+	if tracked || banned {
+		log.Printf("→ Cleared the login lockout of %s %s", key.Kind, key.Value)
+	}
+
+	return tracked || banned, nil
+}
+
+// Ban bans an account or address for duration, or for good when duration is 0.
+func (t *Tracker) Ban(ctx context.Context, key Key, reason string, duration time.Duration) error {
+	ban := Ban{Key: key, Reason: reason, CreatedAt: t.now()}
+	if duration > 0 {
+		expires := ban.CreatedAt.Add(duration)
+		ban.ExpiresAt = &expires
+	}
+
+	if t.store != nil {
+		if err := t.store.Ban(ctx, ban); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.bans[key] = ban
+	t.mu.Unlock()
+
+	log.Printf("⚠️ Banned %s %s from logging in: %s", key.Kind, key.Value, reason)
+
+	return nil
+}
+
+// Bans returns the bans in effect.
+func (t *Tracker) Bans() []Ban {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	bans := make([]Ban, 0, len(t.bans))
+	for _, ban := range t.bans {
+		if ban.activeAt(now) {
+			bans = append(bans, ban)
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return b.CreatedAt.Compare(a.CreatedAt) })
+
+	return bans
+}
+
+// LoadBans replaces the bans in memory with the ones in the store, which may have been changed
+// by another process.
+func (t *Tracker) LoadBans(ctx context.Context) error {
+	if t.store == nil {
+		return nil
+	}
+
+	bans, err := t.store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[Key]Ban, len(bans))
+	for _, ban := range bans {
+		loaded[ban.Key] = ban
+	}
+
+	t.mu.Lock()
+	t.bans = loaded
+	t.mu.Unlock()
+
+	return nil
+}
+
+// Run reloads the bans and forgets stale failures every interval, until ctx is cancelled.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	if err := t.LoadBans(ctx); err != nil {
+		log.Printf("❌ Failed to load the login ban list: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := t.LoadBans(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("⚠️ Failed to reload the login ban list: %v", err)
+		}
+
+		t.mu.Lock()
+		t.pruneLocked(t.now())
+		t.mu.Unlock()
+	}
+}
+
+// pruneLocked drops the entries that are neither locked out nor failed within the window. When
+// that is not enough to make room, the oldest half is dropped. The caller must hold t.mu.
+func (t *Tracker) pruneLocked(now time.Time) {
+	for key, e := range t.entries {
+		if now.Before(e.lockedUntil) {
+			continue
+		}
+		if now.Sub(e.lastFailure) > t.cfg.Window && now.Sub(e.lockedUntil) > t.cfg.Window {
+			delete(t.entries, key)
+		}
+	}
+
+	if len(t.entries) < maxEntries {
+		return
+	}
+
+	type aged struct {
+		key  Key
+		last time.Time
+	}
+	all := make([]aged, 0, len(t.entries))
+	for key, e := range t.entries {
+		all = append(all, aged{key, e.lastFailure})
+	}
+	slices.SortFunc(all, func(a, b aged) int { return a.last.Compare(b.last) })
+	for _, a := range all[:len(all)/2] {
+		delete(t.entries, a.key)
+	}
+}
@@ -0,0 +1,215 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAccountKeyDefaultDomain(t *testing.T) {
+	tests := []struct {
+		account, defaultDomain string
+		want                   string
+	}{
+		{"alice", "example.com", "alice@example.com"},
+		{"Alice+news", "Example.com", "alice@example.com"},
+		{"alice@example.com", "", "alice@example.com"},
+		{"alice@other.example", "example.com", "alice@other.example"},
+		{"alice", "", "alice"},
+	}
+
+	for _, tt := range tests {
+		if got := AccountKey(tt.account, tt.defaultDomain); got != (Key{Kind: KindAccount, Value: tt.want}) {
+			t.Errorf("AccountKey(%q, %q) = %v, want %q", tt.account, tt.defaultDomain, got, tt.want)
+		}
+	}
+}
+
+func TestLoginsWithoutDomainLockTheAccount(t *testing.T) {
+	tracker := NewTracker(Config{AccountLimit: 2, Lockout: time.Minute, Window: time.Minute, DefaultDomain: "example.com"}, nil)
+
+	tracker.Failure(context.Background(), "alice", "192.0.2.1")
+	tracker.Failure(context.Background(), "Alice@Example.com", "192.0.2.2")
+
+	for _, account := range []string{"alice", "alice@example.com", "alice+imap@example.com"} {
+		if !tracker.Locked(account) {
+			t.Errorf("%s is not locked out", account)
+		}
+	}
+
+	tracker.Success("alice@example.com")
+	if !tracker.Locked("alice") {
+		t.Error("a success ended the lockout of alice")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	tracker := NewTracker(Config{BaseDelay: time.Second, MaxDelay: 10 * time.Second}, nil)
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{64, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := tracker.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestTrackerFailures(t *testing.T) {
+	const (
+		account = "alice@example.com"
+		ip      = "192.0.2.1"
+	)
+
+	// A step moves the clock on, records failures failed logins and then checks the login.
+	type step struct {
+		advance  time.Duration
+		failures int
+		wait     time.Duration
+		locked   bool
+	}
+
+	tests := []struct {
+		name        string
+		cfg         Config
+		account, ip string
+		steps       []step
+		bans        int
+	}{
+		{
+			name:    "delay doubles with every failure",
+			cfg:     Config{BaseDelay: time.Second, MaxDelay: 4 * time.Second},
+			account: account,
+			steps: []step{
+				{failures: 1, wait: time.Second},
+				{failures: 1, wait: 2 * time.Second},
+				{failures: 1, wait: 4 * time.Second},
+				{failures: 1, wait: 4 * time.Second},
+				{advance: 3 * time.Second, wait: time.Second},
+				{advance: 2 * time.Second, wait: 0},
+			},
+		},
+		{
+			name:    "account locked out after the limit",
+			cfg:     Config{AccountLimit: 3, BaseDelay: time.Second, MaxDelay: time.Second, Lockout: time.Minute},
+			account: account,
+			steps: []step{
+				{failures: 2, wait: time.Second},
+				{failures: 1, wait: time.Minute, locked: true},
+				{advance: 40 * time.Second, wait: 20 * time.Second, locked: true},
+				{advance: 20 * time.Second, wait: 0},
+				{failures: 1, wait: time.Second},
+			},
+		},
+		{
+			name: "address locked out after its own limit",
+			cfg:  Config{AccountLimit: 2, IPLimit: 3, Lockout: time.Minute},
+			ip:   ip,
+			steps: []step{
+				{failures: 2},
+				{failures: 1, wait: time.Minute, locked: true},
+			},
+		},
+		{
+			name:    "failures during a lockout are not counted",
+			cfg:     Config{AccountLimit: 2, BaseDelay: time.Second, MaxDelay: time.Minute, Lockout: time.Minute},
+			account: account,
+			steps: []step{
+				{failures: 2, wait: time.Minute, locked: true},
+				{advance: 30 * time.Second, failures: 5, wait: 30 * time.Second, locked: true},
+				{advance: 30 * time.Second, wait: 0},
+				{failures: 1, wait: time.Second},
+			},
+		},
+		{
+			name:    "failures within the window add up",
+			cfg:     Config{AccountLimit: 3, Lockout: time.Minute, Window: 10 * time.Minute},
+			account: account,
+			steps: []step{
+				{failures: 2},
+				{advance: 9 * time.Minute, failures: 1, wait: time.Minute, locked: true},
+			},
+		},
+		{
+			name:    "failures older than the window are forgotten",
+			cfg:     Config{AccountLimit: 3, BaseDelay: time.Second, MaxDelay: time.Minute, Lockout: time.Minute, Window: 10 * time.Minute},
+			account: account,
+			steps: []step{
+				{failures: 2, wait: 2 * time.Second},
+				{advance: 11 * time.Minute, failures: 1, wait: time.Second},
+			},
+		},
+		{
+			name: "address banned after repeated lockouts",
+			cfg:  Config{IPLimit: 1, Lockout: time.Minute, Window: 10 * time.Minute, BanAfter: 2, BanDuration: time.Hour},
+			ip:   ip,
+			steps: []step{
+				{failures: 1, wait: time.Minute, locked: true},
+				{advance: time.Minute, failures: 1, wait: time.Hour, locked: true},
+				{advance: time.Minute, wait: time.Hour - time.Minute, locked: true},
+			},
+			bans: 1,
+		},
+		{
+			name: "address banned for good",
+			cfg:  Config{IPLimit: 1, Lockout: time.Minute, BanAfter: 1},
+			ip:   ip,
+			steps: []step{
+				{failures: 1, wait: 0, locked: true},
+				{advance: 24 * time.Hour, wait: 0, locked: true},
+			},
+			bans: 1,
+		},
+		{
+			name: "lockouts older than the window do not lead to a ban",
+			cfg:  Config{IPLimit: 1, Lockout: time.Minute, Window: 10 * time.Minute, BanAfter: 2, BanDuration: time.Hour},
+			ip:   ip,
+			steps: []step{
+				{failures: 1, wait: time.Minute, locked: true},
+				{advance: 12 * time.Minute, failures: 1, wait: time.Minute, locked: true},
+			},
+		},
+		{
+			name:    "accounts are never banned",
+			cfg:     Config{AccountLimit: 1, Lockout: time.Minute, BanAfter: 1},
+			account: account,
+			steps: []step{
+				{failures: 1, wait: time.Minute, locked: true},
+				{advance: time.Minute, wait: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+			tracker := NewTracker(tt.cfg, nil)
+			tracker.now = func() time.Time { return now }
+
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				for range s.failures {
+					tracker.Failure(context.Background(), tt.account, tt.ip)
+				}
+
+				wait, err := tracker.Check(tt.account, tt.ip)
+				if wait != s.wait || (err == ErrLocked) != s.locked {
+					t.Errorf("step %d: Check = %s, %v, want %s, locked %v", i, wait, err, s.wait, s.locked)
+				}
+			}
+
+			if bans := tracker.Bans(); len(bans) != tt.bans {
+				t.Errorf("bans = %v, want %d", bans, tt.bans)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMaxAge is how long a fetched key set is used before it is fetched again.
+	jwksMaxAge = time.Hour
+
+	// jwksMinRefresh is the minimum time between two fetches caused by a token signed with an
+	// unknown key, so forged key IDs cannot make us hammer the identity provider.
+	jwksMinRefresh = time.Minute
+
+	// jwksFetchTimeout bounds fetching a key set from a URL.
+	jwksFetchTimeout = 10 * time.Second
+
+	// maxJWKSBytes bounds the size of a key set.
+	maxJWKSBytes = 1 << 20
+)
+
+// jwk is a single JSON Web Key (RFC 7517). Only public RSA and EC signing keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey is a verification key and the algorithm it is restricted to, if any.
+type publicKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// keySet is the JSON Web Key Set tokens are checked against, loaded from a file or a URL and
+// fetched again once it is old or a token names a key it does not have.
+type keySet struct {
+	source string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      []publicKey
+	fetchedAt time.Time
+	fetching  chan struct{} // Closed when the fetch in flight is done, nil when there is none
+}
+
+func newKeySet(source string) *keySet {
+	return &keySet{
+		source: source,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+}
+
+// find returns the keys a token signed with kid and alg may have been signed with.
+func (ks *keySet) find(ctx context.Context, kid, alg string, now time.Time) ([]publicKey, error) {
+	ks.mu.Lock()
+	keys, fetchedAt := ks.keys, ks.fetchedAt
+	ks.mu.Unlock()
+
+	if keys == nil || now.Sub(fetchedAt) > jwksMaxAge {
+		refreshed, err := ks.refresh(ctx, now, fetchedAt)
+		if err != nil && refreshed == nil {
+			return nil, err
+		}
+		keys, fetchedAt = refreshed, now
+	}
+
+	matched := matchKeys(keys, kid, alg)
+	if len(matched) == 0 && now.Sub(fetchedAt) > jwksMinRefresh {
+		refreshed, err := ks.refresh(ctx, now, fetchedAt)
+		if err != nil {
+			return nil, err
+		}
+		matched = matchKeys(refreshed, kid, alg)
+	}
+
+	return matched, nil
+}
+
+// refresh loads the key set again, unless it was fetched since seen, and returns the keys in use,
+// the old ones when the fetch failed. ks.mu is not held during the fetch; concurrent refreshes
+// wait for the one in flight instead of fetching again.
+func (ks *keySet) refresh(ctx context.Context, now, seen time.Time) ([]publicKey, error) {
+	ks.mu.Lock()
+	for ks.fetching != nil {
+		done := ks.fetching
+		ks.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		ks.mu.Lock()
+	}
+	if !ks.fetchedAt.Equal(seen) {
+		keys := ks.keys
+		ks.mu.Unlock()
+		return keys, nil
+	}
+	// A failed fetch is not retried right away either.
+	ks.fetchedAt = now
+	done := make(chan struct{})
+	ks.fetching = done
+	ks.mu.Unlock()
+
+	keys, err := ks.fetch(ctx)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if err == nil {
+		ks.keys = keys
+	}
+	ks.fetching = nil
+	close(done)
+
+	return ks.keys, err
+}
+
+// fetch loads and parses the key set.
+func (ks *keySet) fetch(ctx context.Context) ([]publicKey, error) {
+	data, err := ks.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	return keys, nil
+}
+
+// load reads the key set from its file or URL.
+func (ks *keySet) load(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(ks.source, "https://") && !strings.HasPrefix(ks.source, "http://") {
+		return os.ReadFile(ks.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+}
+
+// parseJWKS decodes the signing keys of a key set. Keys of unsupported types are skipped.
+func parseJWKS(data []byte) ([]publicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]publicKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, publicKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing key")
+	}
+
+	return keys, nil
+}
+
+// publicKey decodes an RSA or EC public key.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// matchKeys returns the keys that may have signed a token with kid and alg.
+// A token without kid may have been signed with any key.
+func matchKeys(keys []publicKey, kid, alg string) []publicKey {
+	var matched []publicKey
+	for _, k := range keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		matched = append(matched, k)
+	}
+	return matched
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,124 @@
+package oauth
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrMalformedResponse is returned for SASL client responses that do not follow the mechanism.
+var ErrMalformedResponse = errors.New("malformed SASL response")
+
+// ParseXOAUTH2 decodes the initial client response of the XOAUTH2 mechanism:
+// "user=<email>^Aauth=Bearer <token>^A^A", already base64-decoded.
+func ParseXOAUTH2(resp []byte) (user, token string, err error) {
+	fields, ok := strings.CutSuffix(string(resp), "\x01\x01")
+	if !ok {
+		return "", "", ErrMalformedResponse
+	}
+
+	for _, field := range strings.Split(fields, "\x01") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return "", "", ErrMalformedResponse
+		}
+		switch key {
+		case "user":
+			user = value
+		case "auth":
+			token = bearerToken(value)
+		}
+	}
+
+	if user == "" || token == "" {
+		return "", "", ErrMalformedResponse
+	}
+
+	return user, token, nil
+}
+
+// ParseOAUTHBEARER decodes the initial client response of the OAUTHBEARER mechanism (RFC 7628):
+// a GS2 header "n,a=<authzid>," followed by "^A"-separated key/value pairs holding
+// "auth=Bearer <token>", ending in "^A^A", already base64-decoded. user is the authorization
+// identity of the GS2 header, which may be empty.
+func ParseOAUTHBEARER(resp []byte) (user, token string, err error) {
+	gs2, rest, ok := strings.Cut(string(resp), "\x01")
+	if !ok {
+		return "", "", ErrMalformedResponse
+	}
+
+	// gs2-header = gs2-cbind-flag "," [ gs2-authzid ] ","
+	flag, authzid, ok := strings.Cut(gs2, ",")
+	if !ok || (flag != "n" && flag != "y") {
+		return "", "", ErrMalformedResponse
+	}
+	authzid, ok = strings.CutSuffix(authzid, ",")
+	if !ok {
+		return "", "", ErrMalformedResponse
+	}
+	if authzid != "" {
+		name, ok := strings.CutPrefix(authzid, "a=")
+		if !ok {
+			return "", "", ErrMalformedResponse
+		}
+		if user, err = decodeSASLName(name); err != nil {
+			return "", "", err
+		}
+	}
+
+	kvpairs, ok := strings.CutSuffix(rest, "\x01\x01")
+	if !ok {
+		return "", "", ErrMalformedResponse
+	}
+
+	for _, kv := range strings.Split(kvpairs, "\x01") {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return "", "", ErrMalformedResponse
+		}
+		if key == "auth" {
+			token = bearerToken(value)
+		}
+	}
+
+	if token == "" {
+		return "", "", ErrMalformedResponse
+	}
+
+	return user, token, nil
+}
+
+// FailureResponse is the JSON error sent in a challenge when a bearer token is rejected,
+// which both mechanisms expect before the final NO.
+func FailureResponse() []byte {
+	return []byte(`{"status":"invalid_token","schemes":"bearer"}`)
+}
+
+// bearerToken returns the token of an "auth" value, "Bearer <token>".
+func bearerToken(value string) string {
+	scheme, token, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// decodeSASLName undoes the escaping of "," and "=" in a GS2 saslname.
+func decodeSASLName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", ErrMalformedResponse
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
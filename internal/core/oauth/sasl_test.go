@@ -0,0 +1,61 @@
+package oauth
+
+import "testing"
+
+func TestParseXOAUTH2(t *testing.T) {
+	user, token, err := ParseXOAUTH2([]byte("user=alice@example.com\x01auth=Bearer ya29.abc\x01\x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "alice@example.com" || token != "ya29.abc" {
+		t.Fatalf("got %q, %q", user, token)
+	}
+
+	for _, resp := range []string{
+		"",
+		"\x01\x01",
+		"user=alice@example.com\x01auth=Bearer ya29.abc",      // Not terminated
+		"user=alice@example.com\x01auth=Basic abc\x01\x01",    // Not a bearer token
+		"auth=Bearer ya29.abc\x01\x01",                        // No user
+		"user=alice@example.com\x01auth=Bearer \x01\x01",      // Empty token
+		"user=alice@example.com\x01garbage\x01auth=x\x01\x01", // Not a key/value pair
+	} {
+		if _, _, err := ParseXOAUTH2([]byte(resp)); err == nil {
+			t.Errorf("%q: expected an error", resp)
+		}
+	}
+}
+
+func TestParseOAUTHBEARER(t *testing.T) {
+	tests := []struct {
+		resp, user, token string
+	}{
+		{"n,a=alice@example.com,\x01host=imap.example.com\x01port=993\x01auth=Bearer tok\x01\x01", "alice@example.com", "tok"},
+		{"n,,\x01auth=Bearer tok\x01\x01", "", "tok"},
+		{"n,a=a=2Cb=3Dc@example.com,\x01auth=bearer tok\x01\x01", "a,b=c@example.com", "tok"},
+	}
+	for _, tt := range tests {
+		user, token, err := ParseOAUTHBEARER([]byte(tt.resp))
+		if err != nil {
+			t.Errorf("%q: %v", tt.resp, err)
+			continue
+		}
+		if user != tt.user || token != tt.token {
+			t.Errorf("%q: got %q, %q", tt.resp, user, token)
+		}
+	}
+
+	for _, resp := range []string{
+		"",
+		"p=tls-unique,,\x01auth=Bearer tok\x01\x01", // Channel binding is not supported
+		"n,a=alice@example.com\x01auth=Bearer tok\x01\x01",
+		"n,b=alice,\x01auth=Bearer tok\x01\x01",
+		"n,a=bad=2X,\x01auth=Bearer tok\x01\x01",
+		"n,,\x01host=imap.example.com\x01\x01",
+		"n,,\x01auth=Bearer tok\x01",
+	} {
+		if _, _, err := ParseOAUTHBEARER([]byte(resp)); err == nil {
+			t.Errorf("%q: expected an error", resp)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Package oauth checks the OAuth 2.0 bearer tokens IMAP clients log in with through the
+// XOAUTH2 and OAUTHBEARER SASL mechanisms. Tokens are JWTs issued by the identity provider
+// of the deployment and verified against its JSON Web Key Set.
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is the leeway given to the exp and nbf claims.
+const clockSkew = time.Minute
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed, badly signed, expired, or
+	// issued by another issuer or for another audience.
+	ErrInvalidToken = errors.New("invalid bearer token")
+
+	// ErrNoEmail is returned for valid tokens without a usable email claim.
+	ErrNoEmail = errors.New("token has no verified email")
+)
+
+// Config describes the identity provider tokens are accepted from.
+type Config struct {
+	Issuer     string // Expected iss claim
+	Audience   string // Must be one of the aud claim values
+	JWKS       string // Path or http(s) URL of the JSON Web Key Set
+	EmailClaim string // Claim holding the account email, "email" when empty
+}
+
+// Claims are the claims of a valid token the IMAP login needs.
+type Claims struct {
+	Subject   string
+	Email     string
+	ExpiresAt time.Time
+}
+
+// Validator checks bearer tokens against the configured issuer, audience and key set.
+type Validator struct {
+	cfg  Config
+	keys *keySet
+	now  func() time.Time
+}
+
+// NewValidator creates a validator. The key set is loaded on the first token.
+func NewValidator(cfg Config) (*Validator, error) {
+	if cfg.Issuer == "" || cfg.Audience == "" || cfg.JWKS == "" {
+		return nil, errors.New("issuer, audience and JWKS are required")
+	}
+	if cfg.EmailClaim == "" {
+		cfg.EmailClaim = "email"
+	}
+
+	return &Validator{
+		cfg:  cfg,
+		keys: newKeySet(cfg.JWKS),
+		now:  time.Now,
+	}, nil
+}
+
+// signingAlgs are the JWS algorithms accepted for tokens. Symmetric algorithms and "none"
+// are never accepted, whatever the key set contains.
+var signingAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// Validate verifies the signature, issuer, audience and lifetime of a token and returns its claims.
+// Errors other than ErrInvalidToken and ErrNoEmail mean the key set could not be loaded.
+func (v *Validator) Validate(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWT", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header", ErrInvalidToken)
+	}
+
+	hash, ok := signingAlgs[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: algorithm %q is not accepted", ErrInvalidToken, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrInvalidToken)
+	}
+
+	now := v.now()
+	keys, err := v.keys.find(ctx, header.Kid, header.Alg, now)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	verified := false
+	for _, k := range keys {
+		if verifySignature(header.Alg, hash, k.key, digest, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature does not match", ErrInvalidToken)
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad payload", ErrInvalidToken)
+	}
+
+	return v.checkClaims(claims, now)
+}
+
+// checkClaims checks the issuer, audience and lifetime of a token and extracts its email.
+func (v *Validator) checkClaims(claims map[string]any, now time.Time) (*Claims, error) {
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if !hasAudience(claims["aud"], v.cfg.Audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if !now.Before(exp.Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(clockSkew).Before(nbf) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+
+	email, _ := claims[v.cfg.EmailClaim].(string)
+	if email = strings.TrimSpace(email); email == "" {
+		return nil, ErrNoEmail
+	}
+	// Providers that say whether the email is verified must say it is.
+	if verified, present := claims["email_verified"]; present && verified != true && verified != "true" {
+		return nil, ErrNoEmail
+	}
+
+	subject, _ := claims["sub"].(string)
+
+	return &Claims{Subject: subject, Email: email, ExpiresAt: exp}, nil
+}
+
+// verifySignature checks a JWS signature made with alg over digest.
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, digest, signature []byte) bool {
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		// The curve has to be the one the algorithm names, e.g. P-256 for ES256.
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size || curveAlg(pub) != alg {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+
+	return false
+}
+
+// curveAlg returns the ECDSA algorithm that goes with the curve of a key.
+func curveAlg(pub *ecdsa.PublicKey) string {
+	switch pub.Curve.Params().Name {
+	case "P-256":
+		return "ES256"
+	case "P-384":
+		return "ES384"
+	case "P-521":
+		return "ES512"
+	}
+	return ""
+}
+
+// hasAudience reports whether an aud claim, a string or an array of strings, contains audience.
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// numericDate decodes a JWT NumericDate claim.
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// decodeSegment decodes a base64url JSON segment of a JWT.
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,407 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://id.example.com"
+	testAudience = "airsend-imap"
+)
+
+var testNow = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testKey is a locally generated signing key and its JWK.
+type testKey struct {
+	kid  string
+	alg  string
+	priv crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid, alg string) testKey {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, alg: alg, priv: priv}
+}
+
+func newECKey(t *testing.T, kid, alg string, curve elliptic.Curve) testKey {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, alg: alg, priv: priv}
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func (k testKey) jwk() map[string]string {
+	switch pub := k.priv.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA", "kid": k.kid, "use": "sig", "alg": k.alg,
+			"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC", "kid": k.kid, "use": "sig", "alg": k.alg, "crv": pub.Curve.Params().Name,
+			"x": b64(pub.X.FillBytes(make([]byte, size))), "y": b64(pub.Y.FillBytes(make([]byte, size))),
+		}
+	}
+	panic("unsupported key")
+}
+
+func jwksJSON(t *testing.T, keys ...testKey) []byte {
+	t.Helper()
+	set := map[string][]map[string]string{"keys": {}}
+	for _, k := range keys {
+		set["keys"] = append(set["keys"], k.jwk())
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func writeJWKS(t *testing.T, keys ...testKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwksJSON(t, keys...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sign makes a JWT of claims with key, using the header alg and kid of the key.
+func sign(t *testing.T, key testKey, claims map[string]any) string {
+	t.Helper()
+	return signWithHeader(t, key, map[string]any{"alg": key.alg, "kid": key.kid, "typ": "JWT"}, claims)
+}
+
+func signWithHeader(t *testing.T, key testKey, header, claims map[string]any) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+
+	hash := signingAlgs[key.alg]
+	hf := hash.New()
+	hf.Write([]byte(input))
+	digest := hf.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch priv := key.priv.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(key.alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, priv, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, priv, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, priv, digest)
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return input + "." + b64(sig)
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"sub":   "user-1",
+		"email": "alice@example.com",
+		"iat":   testNow.Add(-time.Minute).Unix(),
+		"exp":   testNow.Add(time.Hour).Unix(),
+	}
+}
+
+func newTestValidator(t *testing.T, jwks string) *Validator {
+	t.Helper()
+	v, err := NewValidator(Config{Issuer: testIssuer, Audience: testAudience, JWKS: jwks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func TestValidateAlgorithms(t *testing.T) {
+	keys := []testKey{
+		newRSAKey(t, "rs256", "RS256"),
+		newRSAKey(t, "ps384", "PS384"),
+		newECKey(t, "es256", "ES256", elliptic.P256()),
+		newECKey(t, "es384", "ES384", elliptic.P384()),
+		newECKey(t, "es512", "ES512", elliptic.P521()),
+	}
+	v := newTestValidator(t, writeJWKS(t, keys...))
+
+	for _, key := range keys {
+		t.Run(key.alg, func(t *testing.T) {
+			claims, err := v.Validate(context.Background(), sign(t, key, validClaims()))
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if claims.Email != "alice@example.com" || claims.Subject != "user-1" {
+				t.Fatalf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	key := newRSAKey(t, "k1", "RS256")
+	other := newRSAKey(t, "k1", "RS256") // Same kid, key not in the set
+	v := newTestValidator(t, writeJWKS(t, key))
+
+	with := func(change func(map[string]any)) map[string]any {
+		c := validClaims()
+		change(c)
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"wrong issuer", sign(t, key, with(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), ErrInvalidToken},
+		{"no issuer", sign(t, key, with(func(c map[string]any) { delete(c, "iss") })), ErrInvalidToken},
+		{"wrong audience", sign(t, key, with(func(c map[string]any) { c["aud"] = "another-app" })), ErrInvalidToken},
+		{"audience not in list", sign(t, key, with(func(c map[string]any) { c["aud"] = []string{"a", "b"} })), ErrInvalidToken},
+		{"expired", sign(t, key, with(func(c map[string]any) { c["exp"] = testNow.Add(-2 * time.Minute).Unix() })), ErrInvalidToken},
+		{"no expiry", sign(t, key, with(func(c map[string]any) { delete(c, "exp") })), ErrInvalidToken},
+		{"not valid yet", sign(t, key, with(func(c map[string]any) { c["nbf"] = testNow.Add(5 * time.Minute).Unix() })), ErrInvalidToken},
+		{"no email", sign(t, key, with(func(c map[string]any) { delete(c, "email") })), ErrNoEmail},
+		{"email not verified", sign(t, key, with(func(c map[string]any) { c["email_verified"] = false })), ErrNoEmail},
+		{"signed by another key", sign(t, other, validClaims()), ErrInvalidToken},
+		{"not a JWT", "abc.def", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := v.Validate(context.Background(), tt.token); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAcceptsAudienceListAndSkew(t *testing.T) {
+	key := newECKey(t, "k1", "ES256", elliptic.P256())
+	v := newTestValidator(t, writeJWKS(t, key))
+
+	claims := validClaims()
+	claims["aud"] = []string{"webmail", testAudience}
+	claims["exp"] = testNow.Add(-30 * time.Second).Unix() // Within the allowed clock skew
+	claims["email_verified"] = true
+
+	if _, err := v.Validate(context.Background(), sign(t, key, claims)); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestValidateRejectsTamperedToken(t *testing.T) {
+	key := newRSAKey(t, "k1", "RS256")
+	v := newTestValidator(t, writeJWKS(t, key))
+
+	token := sign(t, key, validClaims())
+	parts := strings.Split(token, ".")
+
+	forged := validClaims()
+	forged["email"] = "mallory@example.com"
+	payload, _ := json.Marshal(forged)
+	parts[1] = b64(payload)
+
+	if _, err := v.Validate(context.Background(), strings.Join(parts, ".")); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestValidateRejectsUnsafeAlgorithms(t *testing.T) {
+	key := newRSAKey(t, "k1", "RS256")
+	v := newTestValidator(t, writeJWKS(t, key))
+
+	claims, _ := json.Marshal(validClaims())
+	for _, alg := range []string{"none", "HS256"} {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "k1"})
+		token := b64(header) + "." + b64(claims) + "."
+		if _, err := v.Validate(context.Background(), token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("alg %s: got %v, want ErrInvalidToken", alg, err)
+		}
+	}
+
+	// A token claiming an algorithm the key is not meant for.
+	ps := key
+	ps.alg = "PS256"
+	if _, err := v.Validate(context.Background(), sign(t, ps, validClaims())); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("PS256 with an RS256 key: got %v, want ErrInvalidToken", err)
+	}
+
+	// An ES384 signature checked as ES256 against a P-384 key.
+	ec := newECKey(t, "ec", "", elliptic.P384())
+	v = newTestValidator(t, writeJWKS(t, ec))
+	ec.alg = "ES384"
+	token := sign(t, ec, validClaims())
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "ec"})
+	parts := strings.Split(token, ".")
+	parts[0] = b64(header)
+	if _, err := v.Validate(context.Background(), strings.Join(parts, ".")); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("ES256 with a P-384 key: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestValidateCustomEmailClaim(t *testing.T) {
+	key := newRSAKey(t, "k1", "RS256")
+	v, err := NewValidator(Config{Issuer: testIssuer, Audience: testAudience, JWKS: writeJWKS(t, key), EmailClaim: "upn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+
+	claims := validClaims()
+	claims["upn"] = "bob@example.com"
+
+	got, err := v.Validate(context.Background(), sign(t, key, claims))
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if got.Email != "bob@example.com" {
+		t.Fatalf("got email %q, want bob@example.com", got.Email)
+	}
+}
+
+func TestValidateFetchesRotatedKeys(t *testing.T) {
+	oldKey := newRSAKey(t, "old", "RS256")
+	newKey := newRSAKey(t, "new", "RS256")
+
+	var current atomic.Value
+	current.Store(jwksJSON(t, oldKey))
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(current.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	v := newTestValidator(t, srv.URL)
+	now := testNow
+	v.now = func() time.Time { return now }
+
+	if _, err := v.Validate(context.Background(), sign(t, oldKey, validClaims())); err != nil {
+		t.Fatalf("Validate with the old key: %v", err)
+	}
+
+	// The provider rotates its keys. A token with the new key is not accepted before the
+	// minimum refresh interval passed, then the key set is fetched again.
+	current.Store(jwksJSON(t, newKey))
+	if _, err := v.Validate(context.Background(), sign(t, newKey, validClaims())); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got %v before the refresh interval, want ErrInvalidToken", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := v.Validate(context.Background(), sign(t, newKey, validClaims())); err != nil {
+		t.Fatalf("Validate with the new key: %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("key set fetched %d times, want 2", n)
+	}
+}
+
+func TestValidateDoesNotWaitForKeyFetch(t *testing.T) {
+	oldKey := newRSAKey(t, "old", "RS256")
+	newKey := newRSAKey(t, "new", "RS256")
+
+	started, release := make(chan struct{}), make(chan struct{})
+	releaseFetch := sync.OnceFunc(func() { close(release) })
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fetches.Add(1) == 1 {
+			w.Write(jwksJSON(t, oldKey))
+			return
+		}
+		close(started)
+		<-release
+		w.Write(jwksJSON(t, oldKey, newKey))
+	}))
+	defer srv.Close()
+	defer releaseFetch()
+
+	v := newTestValidator(t, srv.URL)
+	if _, err := v.Validate(context.Background(), sign(t, oldKey, validClaims())); err != nil {
+		t.Fatalf("Validate with the old key: %v", err)
+	}
+	v.now = func() time.Time { return testNow.Add(2 * time.Minute) }
+
+	// A token with an unknown key fetches the key set, which hangs for a while.
+	rotated := make(chan error, 1)
+	go func() {
+		_, err := v.Validate(context.Background(), sign(t, newKey, validClaims()))
+		rotated <- err
+	}()
+	<-started
+
+	// Tokens with a known key are checked meanwhile.
+	validated := make(chan error, 1)
+	go func() {
+		_, err := v.Validate(context.Background(), sign(t, oldKey, validClaims()))
+		validated <- err
+	}()
+	select {
+	case err := <-validated:
+		if err != nil {
+			t.Fatalf("Validate with the old key during the fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Validate with the old key waited for the fetch")
+	}
+
+	releaseFetch()
+	if err := <-rotated; err != nil {
+		t.Fatalf("Validate with the new key: %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("key set fetched %d times, want 2", n)
+	}
+}
+
+func TestValidateUnreachableJWKS(t *testing.T) {
+	key := newRSAKey(t, "k1", "RS256")
+	v := newTestValidator(t, filepath.Join(t.TempDir(), "missing.json"))
+
+	_, err := v.Validate(context.Background(), sign(t, key, validClaims()))
+	if err == nil || errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("got %v, want a key set error", err)
+	}
+}
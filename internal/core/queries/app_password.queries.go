@@ -0,0 +1,43 @@
+package queries
+
+// CreateAppPasswordQuery stores a new app password.
+// Args: $1 account id, $2 label, $3 hash, $4 scope (NULL for every protocol).
+// Columns: id, created_at.
+func CreateAppPasswordQuery() string {
+	return `
+		INSERT INTO app_passwords (account_id, label, hash, scope)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;`
+}
+
+// ListAppPasswordsQuery returns the app passwords of an account that are not revoked, newest first.
+// Args: $1 account id.
+// Columns: id, label, scope, created_at, last_used_at.
+func ListAppPasswordsQuery() string {
+	return `
+		SELECT id, label, scope, created_at, last_used_at
+		FROM app_passwords
+		WHERE account_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC;`
+}
+
+// RevokeAppPasswordQuery revokes an app password of an account.
+// Args: $1 account id, $2 app password id.
+func RevokeAppPasswordQuery() string {
+	return `
+		UPDATE app_passwords
+		SET revoked_at = NOW()
+		WHERE account_id = $1 AND id = $2 AND revoked_at IS NULL;`
+}
+
+// UseIMAPAppPasswordQuery finds a live app password valid for IMAP and records its use.
+// Args: $1 account id, $2 hash.
+// Columns: id.
+func UseIMAPAppPasswordQuery() string {
+	return `
+		UPDATE app_passwords
+		SET last_used_at = NOW()
+		WHERE account_id = $1 AND hash = $2 AND revoked_at IS NULL
+		  AND (scope IS NULL OR scope = 'imap')
+		RETURNING id;`
+}
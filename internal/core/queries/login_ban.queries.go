@@ -0,0 +1,28 @@
+package queries
+
+// ListLoginBansQuery returns the login bans that have not expired.
+// Columns: kind, value, reason, created_at, expires_at.
+func ListLoginBansQuery() string {
+	return `
+		SELECT kind, value, reason, created_at, expires_at
+		FROM login_bans
+		WHERE expires_at IS NULL OR expires_at > NOW();`
+}
+
+// UpsertLoginBanQuery bans an account or address, replacing its previous ban.
+// Args: $1 kind ('account' or 'ip'), $2 value, $3 reason, $4 created at, $5 expires at (NULL for good).
+func UpsertLoginBanQuery() string {
+	return `
+		INSERT INTO login_bans (kind, value, reason, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (kind, value) DO UPDATE
+		SET reason = EXCLUDED.reason, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at;`
+}
+
+// DeleteLoginBanQuery lifts the ban of an account or address.
+// Args: $1 kind, $2 value.
+func DeleteLoginBanQuery() string {
+	return `
+		DELETE FROM login_bans
+		WHERE kind = $1 AND value = $2;`
+}
@@ -0,0 +1,122 @@
+package queries
+
+// GetMailboxOfUserQuery returns all mailboxes of an account.
+// Args: $1 email.
+// Columns: id, title, path, delimiter, listed, subscribed, uid_validity, modseq.
+func GetMailboxOfUserQuery() string {
+	return `
+		SELECT m.id, m.title, m.path, m.delimiter, m.listed, m.subscribed, m.uid_validity, m.modseq
+		FROM mailboxes m
+		JOIN mail_accounts a ON a.id = m.account_id
+		WHERE a.email = $1
+		ORDER BY m.path;`
+}
+
+// GetMailboxByIDQuery returns the messages stored in a single mailbox, either as their
+// home folder or through message_mailboxes.
+// Args: $1 mailbox id, $2 email.
+// Columns: id, priority, is_read, is_pinned, is_replied, thread_id, is_deleted,
+// is_important, is_starred, tags, plain_text, folder, content, received_at, is_forwarded,
+// is_draft, other mailbox ids (text[]), html_text, subject, from_address, to_addresses,
+// cc_addresses, createseq, modseq.
+func GetMailboxByIDQuery() string {
+	return `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN mail_accounts a ON a.id = m.account_id
+		WHERE a.email = $2
+		  AND (m.folder = $1 OR EXISTS (
+		      SELECT 1 FROM message_mailboxes mm WHERE mm.message_id = m.id AND mm.mailbox_id = $1))
+		ORDER BY m.received_at, m.id;`
+}
+
+// GetMailboxOfUserByIDQuery returns a single mailbox of an account.
+// Args: $1 mailbox id, $2 email.
+// Columns: title, path, delimiter.
+func GetMailboxOfUserByIDQuery() string {
+	return `
+		SELECT m.title, m.path, m.delimiter
+		FROM mailboxes m
+		JOIN mail_accounts a ON a.id = m.account_id
+		WHERE m.id = $1 AND a.email = $2;`
+}
+
+// InsertMailboxQuery creates a mailbox. No row is returned when the path is already taken.
+// Args: $1 account id, $2 title, $3 path, $4 delimiter.
+// Columns: id.
+func InsertMailboxQuery() string {
+	return `
+		INSERT INTO mailboxes (account_id, title, path, delimiter, listed, subscribed)
+		VALUES ($1, $2, $3, $4, TRUE, TRUE)
+		ON CONFLICT (account_id, path) DO NOTHING
+		RETURNING id;`
+}
+
+// GetMailboxPathQuery returns the path of a single mailbox.
+// Args: $1 account id, $2 mailbox id.
+// Columns: path, delimiter.
+func GetMailboxPathQuery() string {
+	return `SELECT path, delimiter FROM mailboxes WHERE account_id = $1 AND id = $2 FOR UPDATE;`
+}
+
+// RenameMailboxQuery sets the title and path of a single mailbox.
+// Args: $1 account id, $2 mailbox id, $3 title, $4 path.
+func RenameMailboxQuery() string {
+	return `UPDATE mailboxes SET title = $3, path = $4 WHERE account_id = $1 AND id = $2;`
+}
+
+// GetMailboxInferiorsQuery returns the mailboxes nested below a path.
+// Args: $1 account id, $2 path, $3 delimiter.
+// Columns: id, path, message count (home folder and memberships).
+func GetMailboxInferiorsQuery() string {
+	return `
+		SELECT mb.id, mb.path,
+			(SELECT COUNT(*) FROM messages m WHERE m.folder = mb.id) +
+			(SELECT COUNT(*) FROM message_mailboxes mm WHERE mm.mailbox_id = mb.id)
+		FROM mailboxes mb
+		WHERE mb.account_id = $1 AND left(mb.path, length($2) + length($3)) = $2 || $3
+		ORDER BY mb.path;`
+}
+
+// RenameMailboxInferiorsQuery moves the mailboxes nested below an old path under a new one.
+// Args: $1 account id, $2 old path, $3 new path, $4 delimiter.
+// Columns: id, path.
+func RenameMailboxInferiorsQuery() string {
+	return `
+		UPDATE mailboxes
+		SET path = $3 || substr(path, length($2) + 1)
+		WHERE account_id = $1 AND left(path, length($2) + length($4)) = $2 || $4
+		RETURNING id, path;`
+}
+
+// PromoteMailboxesMessagesQuery moves the messages whose home folder is one of the mailboxes
+// about to be deleted to one of their other mailboxes, so copies outlive the deletion, and drops
+// the memberships that became their home folder.
+// Args: $1 account id, $2 mailbox ids (uuid[]).
+func PromoteMailboxesMessagesQuery() string {
+	return `
+		WITH promoted AS (
+			UPDATE messages m
+			SET folder = mm.mailbox_id
+			FROM (
+				SELECT DISTINCT ON (mm.message_id) mm.message_id, mm.mailbox_id
+				FROM message_mailboxes mm
+				JOIN messages m ON m.id = mm.message_id
+				WHERE m.account_id = $1 AND m.folder = ANY($2::uuid[])
+				  AND mm.mailbox_id <> ALL($2::uuid[])
+				ORDER BY mm.message_id, mm.created_at, mm.mailbox_id
+			) mm
+			WHERE m.id = mm.message_id
+			RETURNING m.id, m.folder
+		)
+		DELETE FROM message_mailboxes mm
+		USING promoted p
+		WHERE mm.message_id = p.id AND mm.mailbox_id = p.folder;`
+}
+
+// DeleteMailboxesQuery deletes mailboxes, the messages still homed there are removed by the
+// foreign key cascade.
+// Args: $1 account id, $2 mailbox ids (uuid[]).
+func DeleteMailboxesQuery() string {
+	return `DELETE FROM mailboxes WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
@@ -0,0 +1,211 @@
+package queries
+
+// messageColumns is the select list shared by the queries that load full messages rows.
+// Columns: id, priority, is_read, is_pinned, is_replied, thread_id, is_deleted,
+// is_important, is_starred, tags, plain_text, folder, content, received_at, is_forwarded,
+// is_draft, other mailbox ids (text[]), html_text, subject, from_address, to_addresses,
+// cc_addresses, createseq, modseq.
+const messageColumns = `m.id, m.priority, m.is_read, m.is_pinned, m.is_replied, m.thread_id, m.is_deleted,
+		       m.is_important, m.is_starred, m.tags, m.plain_text, m.folder, m.content, m.received_at,
+		       m.is_forwarded, m.is_draft,
+		       ARRAY(SELECT mm.mailbox_id::text FROM message_mailboxes mm WHERE mm.message_id = m.id),
+		       m.html_text, m.subject, m.from_address, m.to_addresses, m.cc_addresses,
+		       m.createseq, m.modseq`
+
+// InsertMessageQuery stores a message in one of the account's mailboxes.
+// Nothing is inserted when the mailbox does not belong to the account.
+// Args: $1 account id, $2 mailbox id, $3 priority, $4 is_read, $5 is_pinned,
+// $6 is_replied, $7 is_deleted, $8 is_important, $9 is_starred, $10 tags,
+// $11 content, $12 received_at, $13 is_forwarded, $14 is_draft.
+// Columns: id, size.
+func InsertMessageQuery() string {
+	return `
+		INSERT INTO messages (account_id, folder, priority, is_read, is_pinned, is_replied, is_deleted,
+		                      is_important, is_starred, tags, content, received_at, is_forwarded, is_draft)
+		SELECT $1, mb.id, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14
+		FROM mailboxes mb
+		WHERE mb.id = $2 AND mb.account_id = $1
+		RETURNING id, size;`
+}
+
+// AddUsageQuery adds a (possibly negative) number of bytes to the account usage.
+// Args: $1 account id, $2 delta.
+// Columns: usage.
+func AddUsageQuery() string {
+	return `
+		UPDATE mail_accounts
+		SET usage = GREATEST(usage + $2, 0), updated_at = NOW()
+		WHERE id = $1
+		RETURNING usage;`
+}
+
+// The SetMessages*Query statements below update a batch of messages of one account.
+// Args: $1 account id, $2 message ids (uuid[]), $3 new value.
+
+// SetMessagesReadQuery sets is_read.
+func SetMessagesReadQuery() string {
+	return `UPDATE messages SET is_read = $3 WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// SetMessagesStarredQuery sets is_starred.
+func SetMessagesStarredQuery() string {
+	return `UPDATE messages SET is_starred = $3 WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// SetMessagesForwardedQuery sets is_forwarded.
+func SetMessagesForwardedQuery() string {
+	return `UPDATE messages SET is_forwarded = $3 WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// SetMessagesImportantQuery sets is_important.
+func SetMessagesImportantQuery() string {
+	return `UPDATE messages SET is_important = $3 WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// SetMessagesPinnedQuery sets is_pinned.
+func SetMessagesPinnedQuery() string {
+	return `UPDATE messages SET is_pinned = $3 WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// SetMessagesPriorityQuery sets priority.
+func SetMessagesPriorityQuery() string {
+	return `UPDATE messages SET priority = $3 WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// ClearMessagesPriorityQuery resets priority to normal where it currently equals $3.
+func ClearMessagesPriorityQuery() string {
+	return `UPDATE messages SET priority = 'normal' WHERE account_id = $1 AND id = ANY($2::uuid[]) AND priority = $3;`
+}
+
+// AddMessagesTagsQuery merges the JSON array $3 into tags, without duplicates.
+func AddMessagesTagsQuery() string {
+	return `
+		UPDATE messages
+		SET tags = (
+			SELECT COALESCE(jsonb_agg(DISTINCT t), '[]'::jsonb)
+			FROM jsonb_array_elements_text(tags || $3::jsonb) AS t
+		)
+		WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// RemoveMessagesTagsQuery removes the tags listed in the text array $3.
+func RemoveMessagesTagsQuery() string {
+	return `UPDATE messages SET tags = tags - $3::text[] WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// SetMessagesKeywordsQuery replaces the columns custom keywords map onto.
+// Args: $1 account id, $2 message ids (uuid[]), $3 is_important, $4 is_pinned, $5 priority,
+// $6 tags (JSON array).
+func SetMessagesKeywordsQuery() string {
+	return `
+		UPDATE messages
+		SET is_important = $3, is_pinned = $4, priority = $5, tags = $6::jsonb
+		WHERE account_id = $1 AND id = ANY($2::uuid[]);`
+}
+
+// The statements below manage which mailboxes a batch of messages belongs to.
+// A message always has a home folder (messages.folder); COPY targets and labels are
+// extra rows in message_mailboxes.
+// Args: $1 account id, $2 message ids (uuid[]), then the mailbox ids noted per query.
+
+// AddMessagesToMailboxQuery adds a membership in mailbox $3 unless it is the home folder.
+func AddMessagesToMailboxQuery() string {
+	return `
+		INSERT INTO message_mailboxes (message_id, mailbox_id)
+		SELECT m.id, mb.id
+		FROM messages m
+		JOIN mailboxes mb ON mb.id = $3 AND mb.account_id = m.account_id
+		WHERE m.account_id = $1 AND m.id = ANY($2::uuid[]) AND m.folder <> mb.id
+		ON CONFLICT DO NOTHING;`
+}
+
+// RemoveMessagesFromMailboxQuery removes the membership in mailbox $3.
+func RemoveMessagesFromMailboxQuery() string {
+	return `
+		DELETE FROM message_mailboxes mm
+		USING messages m
+		WHERE mm.message_id = m.id AND m.account_id = $1
+		  AND mm.message_id = ANY($2::uuid[]) AND mm.mailbox_id = $3;`
+}
+
+// MoveMessagesFolderQuery changes the home folder from $3 to $4.
+func MoveMessagesFolderQuery() string {
+	return `
+		UPDATE messages m
+		SET folder = mb.id
+		FROM mailboxes mb
+		WHERE mb.id = $4 AND mb.account_id = m.account_id
+		  AND m.account_id = $1 AND m.id = ANY($2::uuid[]) AND m.folder = $3;`
+}
+
+// SetMessagesFolderQuery sets the home folder to $3, whatever it was.
+func SetMessagesFolderQuery() string {
+	return `
+		UPDATE messages m
+		SET folder = mb.id
+		FROM mailboxes mb
+		WHERE mb.id = $3 AND mb.account_id = m.account_id
+		  AND m.account_id = $1 AND m.id = ANY($2::uuid[]);`
+}
+
+// DeleteOrphanMessagesQuery deletes the messages whose home folder is $3 and that
+// belong to no other mailbox, and gives their size back to the account usage.
+func DeleteOrphanMessagesQuery() string {
+	return `
+		WITH deleted AS (
+			DELETE FROM messages m
+			WHERE m.account_id = $1 AND m.id = ANY($2::uuid[]) AND m.folder = $3
+			  AND NOT EXISTS (SELECT 1 FROM message_mailboxes mm WHERE mm.message_id = m.id)
+			RETURNING m.size
+		)
+		UPDATE mail_accounts
+		SET usage = GREATEST(usage - (SELECT SUM(size) FROM deleted), 0), updated_at = NOW()
+		WHERE id = $1 AND EXISTS (SELECT 1 FROM deleted);`
+}
+
+// PromoteMessagesFolderQuery moves messages whose home folder is $3 to one of their
+// other mailboxes.
+func PromoteMessagesFolderQuery() string {
+	return `
+		UPDATE messages m
+		SET folder = mm.mailbox_id
+		FROM (
+			SELECT DISTINCT ON (message_id) message_id, mailbox_id
+			FROM message_mailboxes
+			WHERE message_id = ANY($2::uuid[])
+			ORDER BY message_id, created_at, mailbox_id
+		) mm
+		WHERE m.id = mm.message_id AND m.account_id = $1 AND m.folder = $3;`
+}
+
+// DeleteRedundantMembershipsQuery drops memberships that duplicate the home folder.
+func DeleteRedundantMembershipsQuery() string {
+	return `
+		DELETE FROM message_mailboxes mm
+		USING messages m
+		WHERE mm.message_id = m.id AND mm.mailbox_id = m.folder
+		  AND m.account_id = $1 AND m.id = ANY($2::uuid[]);`
+}
+
+// GetMessageByIDQuery returns a single message with the same columns as GetMailboxByIDQuery.
+// Args: $1 message id, $2 email.
+func GetMessageByIDQuery() string {
+	return `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN mail_accounts a ON a.id = m.account_id
+		WHERE m.id = $1 AND a.email = $2;`
+}
+
+// GetMessageContentQuery returns the stored content of a single message.
+// Args: $1 message id, $2 email.
+// Columns: content, received_at, thread_id, plain_text, html_text, subject,
+// from_address, to_addresses, cc_addresses.
+func GetMessageContentQuery() string {
+	return `
+		SELECT m.content, m.received_at, m.thread_id, m.plain_text, m.html_text, m.subject,
+		       m.from_address, m.to_addresses, m.cc_addresses
+		FROM messages m
+		JOIN mail_accounts a ON a.id = m.account_id
+		WHERE m.id = $1 AND a.email = $2;`
+}
@@ -0,0 +1,200 @@
+package queries
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the pg_advisory_xact_lock key used so that only one
+// process applies migrations at a time.
+const migrationLockID = 7_413_221
+
+// Migration is one versioned schema change made of an up and a down script.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// LoadMigrations reads the embedded migrations/NNNN_name.{up,down}.sql files
+// and returns them sorted by version.
+func LoadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q", fileName)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q: %w", fileName, err)
+		}
+
+		body, err := migrationFiles.ReadFile("migrations/" + fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// MigrateUp applies every embedded migration that is not yet recorded in
+// schema_migrations. Each migration runs in its own transaction.
+func MigrateUp(ctx context.Context, db *sql.DB) error {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := applyMigration(ctx, db, m, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts applied migrations, newest first, until the schema is at
+// the target version. A target of 0 reverts everything.
+func MigrateDown(ctx context.Context, db *sql.DB, target int) error {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if migrations[i].Version <= target {
+			break
+		}
+		if err := applyMigration(ctx, db, migrations[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CurrentSchemaVersion returns the highest applied migration version, or 0.
+func CurrentSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	if err := ensureMigrationsTable(ctx, db); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations;`).Scan(&version)
+	return version, err
+}
+
+func ensureMigrationsTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT        NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`)
+	return err
+}
+
+// applyMigration runs the up or down script of m if its recorded state requires it.
+func applyMigration(ctx context.Context, db *sql.DB, m Migration, up bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1);`, migrationLockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+
+	var applied bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1);`, m.Version,
+	).Scan(&applied); err != nil {
+		return err
+	}
+
+	switch {
+	case up && !applied:
+		if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+			return fmt.Errorf("migration %04d_%s up failed: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`, m.Version, m.Name,
+		); err != nil {
+			return err
+		}
+		log.Printf("✅ Applied migration %04d_%s", m.Version, m.Name)
+
+	case !up && applied:
+		if m.Down == "" {
+			return fmt.Errorf("migration %04d_%s has no down script", m.Version, m.Name)
+		}
+		if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+			return fmt.Errorf("migration %04d_%s down failed: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1;`, m.Version); err != nil {
+			return err
+		}
+		log.Printf("↩️ Reverted migration %04d_%s", m.Version, m.Name)
+
+	default:
+		return nil
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,55 @@
+-- Accounts, folders and messages backing the IMAP connector.
+
+CREATE TABLE IF NOT EXISTS mail_accounts (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email         TEXT        NOT NULL UNIQUE,
+    domain        TEXT        NOT NULL,
+    hash          TEXT        NOT NULL,
+    tenant_name   TEXT        NOT NULL DEFAULT '',
+    mailbox_size  BIGINT      NOT NULL DEFAULT 0,
+    usage         BIGINT      NOT NULL DEFAULT 0,
+    key           TEXT        NOT NULL DEFAULT '',
+    open_pgp      JSONB       NOT NULL DEFAULT '{}'::jsonb,
+    system_email  JSONB       NOT NULL DEFAULT '{}'::jsonb,
+    imap_enabled  BOOLEAN     NOT NULL DEFAULT FALSE,
+    gluon_id      TEXT,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_mail_accounts_domain ON mail_accounts (domain);
+
+CREATE TABLE IF NOT EXISTS mailboxes (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_id    UUID        NOT NULL REFERENCES mail_accounts (id) ON DELETE CASCADE,
+    title         TEXT        NOT NULL,
+    path          TEXT        NOT NULL,
+    delimiter     TEXT        NOT NULL DEFAULT '/',
+    listed        BOOLEAN     NOT NULL DEFAULT TRUE,
+    subscribed    BOOLEAN     NOT NULL DEFAULT TRUE,
+    hidden        BOOLEAN     NOT NULL DEFAULT FALSE,
+    uid_validity  BIGINT      NOT NULL DEFAULT (EXTRACT(EPOCH FROM NOW()))::BIGINT,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (account_id, path)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_id    UUID        NOT NULL REFERENCES mail_accounts (id) ON DELETE CASCADE,
+    folder        UUID        NOT NULL REFERENCES mailboxes (id) ON DELETE CASCADE,
+    priority      TEXT        NOT NULL DEFAULT 'normal',
+    is_read       BOOLEAN     NOT NULL DEFAULT FALSE,
+    is_pinned     BOOLEAN     NOT NULL DEFAULT FALSE,
+    is_replied    BOOLEAN     NOT NULL DEFAULT FALSE,
+    thread_id     TEXT,
+    is_deleted    BOOLEAN     NOT NULL DEFAULT FALSE,
+    is_important  BOOLEAN     NOT NULL DEFAULT FALSE,
+    is_starred    BOOLEAN     NOT NULL DEFAULT FALSE,
+    tags          JSONB       NOT NULL DEFAULT '[]'::jsonb,
+    plain_text    TEXT,
+    content       TEXT        NOT NULL DEFAULT '',
+    received_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_account_folder ON messages (account_id, folder);
@@ -0,0 +1,10 @@
+-- Additional mailbox memberships of a message besides its home folder:
+-- IMAP COPY targets and Gmail-style labels.
+CREATE TABLE IF NOT EXISTS message_mailboxes (
+    message_id  UUID        NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    mailbox_id  UUID        NOT NULL REFERENCES mailboxes (id) ON DELETE CASCADE,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, mailbox_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_mailboxes_mailbox ON message_mailboxes (mailbox_id);
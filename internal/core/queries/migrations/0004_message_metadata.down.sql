@@ -0,0 +1,6 @@
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS subject,
+    DROP COLUMN IF EXISTS from_address,
+    DROP COLUMN IF EXISTS to_addresses,
+    DROP COLUMN IF EXISTS cc_addresses,
+    DROP COLUMN IF EXISTS html_text;
@@ -0,0 +1,7 @@
+-- Metadata used to synthesize RFC 5322 messages for rows without raw MIME content.
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS subject      TEXT,
+    ADD COLUMN IF NOT EXISTS from_address TEXT,
+    ADD COLUMN IF NOT EXISTS to_addresses JSONB NOT NULL DEFAULT '[]'::jsonb,
+    ADD COLUMN IF NOT EXISTS cc_addresses JSONB NOT NULL DEFAULT '[]'::jsonb,
+    ADD COLUMN IF NOT EXISTS html_text    TEXT;
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS mailboxes_notify_change ON mailboxes;
+DROP TRIGGER IF EXISTS message_mailboxes_notify_change ON message_mailboxes;
+DROP TRIGGER IF EXISTS messages_notify_change ON messages;
+
+DROP FUNCTION IF EXISTS airsend_notify_mailbox_change();
+DROP FUNCTION IF EXISTS airsend_notify_membership_change();
+DROP FUNCTION IF EXISTS airsend_notify_message_change();
@@ -0,0 +1,111 @@
+-- Announce changes to messages and mailboxes so the IMAP process can push them to
+-- connected clients. Writes made by the IMAP connector itself set airsend.origin = 'imap'
+-- in their transaction and are not announced, since Gluon has already applied them.
+-- Payload: {"op": "INSERT" | "UPDATE" | "MOVE" | "DELETE", "email": ..., "id": ...}
+
+CREATE OR REPLACE FUNCTION airsend_notify_message_change() RETURNS trigger AS $$
+DECLARE
+    rec           RECORD;
+    op            TEXT := TG_OP;
+    account_email TEXT;
+BEGIN
+    IF current_setting('airsend.origin', true) = 'imap' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF OLD IS NOT DISTINCT FROM NEW THEN
+            RETURN NULL;
+        END IF;
+        IF OLD.folder IS DISTINCT FROM NEW.folder THEN
+            op := 'MOVE';
+        END IF;
+    END IF;
+
+    -- The account is already gone when its rows are removed by the cascade.
+    SELECT a.email INTO account_email FROM mail_accounts a WHERE a.id = rec.account_id;
+    IF account_email IS NOT NULL THEN
+        PERFORM pg_notify('airsend_messages',
+            json_build_object('op', op, 'email', account_email, 'id', rec.id)::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- A change of the extra memberships (COPY targets, labels) is announced as a MOVE of the message.
+CREATE OR REPLACE FUNCTION airsend_notify_membership_change() RETURNS trigger AS $$
+DECLARE
+    rec           RECORD;
+    account_email TEXT;
+BEGIN
+    IF current_setting('airsend.origin', true) = 'imap' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    SELECT a.email INTO account_email
+    FROM messages m
+    JOIN mail_accounts a ON a.id = m.account_id
+    WHERE m.id = rec.message_id;
+    IF account_email IS NOT NULL THEN
+        PERFORM pg_notify('airsend_messages',
+            json_build_object('op', 'MOVE', 'email', account_email, 'id', rec.message_id)::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION airsend_notify_mailbox_change() RETURNS trigger AS $$
+DECLARE
+    rec           RECORD;
+    account_email TEXT;
+BEGIN
+    IF current_setting('airsend.origin', true) = 'imap' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    -- Only renames are visible to IMAP clients.
+    IF TG_OP = 'UPDATE' AND OLD.path IS NOT DISTINCT FROM NEW.path THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT a.email INTO account_email FROM mail_accounts a WHERE a.id = rec.account_id;
+    IF account_email IS NOT NULL THEN
+        PERFORM pg_notify('airsend_mailboxes',
+            json_build_object('op', TG_OP, 'email', account_email, 'id', rec.id)::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON messages
+    FOR EACH ROW EXECUTE FUNCTION airsend_notify_message_change();
+
+CREATE TRIGGER message_mailboxes_notify_change
+    AFTER INSERT OR DELETE ON message_mailboxes
+    FOR EACH ROW EXECUTE FUNCTION airsend_notify_membership_change();
+
+CREATE TRIGGER mailboxes_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON mailboxes
+    FOR EACH ROW EXECUTE FUNCTION airsend_notify_mailbox_change();
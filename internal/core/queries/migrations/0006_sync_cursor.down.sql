@@ -0,0 +1,59 @@
+CREATE OR REPLACE FUNCTION airsend_notify_message_change() RETURNS trigger AS $$
+DECLARE
+    rec           RECORD;
+    op            TEXT := TG_OP;
+    account_email TEXT;
+BEGIN
+    IF current_setting('airsend.origin', true) = 'imap' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF OLD IS NOT DISTINCT FROM NEW THEN
+            RETURN NULL;
+        END IF;
+        IF OLD.folder IS DISTINCT FROM NEW.folder THEN
+            op := 'MOVE';
+        END IF;
+    END IF;
+
+    SELECT a.email INTO account_email FROM mail_accounts a WHERE a.id = rec.account_id;
+    IF account_email IS NOT NULL THEN
+        PERFORM pg_notify('airsend_messages',
+            json_build_object('op', op, 'email', account_email, 'id', rec.id)::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS mailboxes_record_tombstone ON mailboxes;
+DROP TRIGGER IF EXISTS messages_record_tombstone ON messages;
+DROP TRIGGER IF EXISTS message_mailboxes_bump_modseq ON message_mailboxes;
+DROP TRIGGER IF EXISTS mailboxes_bump_modseq ON mailboxes;
+DROP TRIGGER IF EXISTS messages_bump_modseq ON messages;
+
+DROP FUNCTION IF EXISTS airsend_record_tombstone();
+DROP FUNCTION IF EXISTS airsend_bump_message_modseq();
+DROP FUNCTION IF EXISTS airsend_bump_modseq();
+
+DROP TABLE IF EXISTS sync_tombstones;
+
+DROP INDEX IF EXISTS idx_messages_account_modseq;
+DROP INDEX IF EXISTS idx_mailboxes_account_modseq;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS createseq,
+    DROP COLUMN IF EXISTS modseq;
+
+ALTER TABLE mailboxes
+    DROP COLUMN IF EXISTS modseq;
+
+ALTER TABLE mail_accounts
+    DROP COLUMN IF EXISTS sync_modseq;
@@ -0,0 +1,120 @@
+-- Incremental sync. Every messages and mailboxes row records the transaction that last
+-- changed it (modseq) and, for messages, the one that created it (createseq). Each account
+-- keeps the point up to which IMAP has synced in sync_modseq; NULL means nothing is synced.
+-- Deleted rows leave a tombstone until every change before it has been synced.
+
+ALTER TABLE mail_accounts
+    ADD COLUMN IF NOT EXISTS sync_modseq BIGINT;
+
+ALTER TABLE mailboxes
+    ADD COLUMN IF NOT EXISTS modseq BIGINT NOT NULL DEFAULT txid_current();
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS modseq    BIGINT NOT NULL DEFAULT txid_current(),
+    ADD COLUMN IF NOT EXISTS createseq BIGINT NOT NULL DEFAULT txid_current();
+
+CREATE INDEX IF NOT EXISTS idx_mailboxes_account_modseq ON mailboxes (account_id, modseq);
+CREATE INDEX IF NOT EXISTS idx_messages_account_modseq ON messages (account_id, modseq);
+
+CREATE TABLE IF NOT EXISTS sync_tombstones (
+    account_id  UUID        NOT NULL,
+    object_type TEXT        NOT NULL CHECK (object_type IN ('message', 'mailbox')),
+    object_id   UUID        NOT NULL,
+    modseq      BIGINT      NOT NULL DEFAULT txid_current(),
+    deleted_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (object_type, object_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_tombstones_account_modseq ON sync_tombstones (account_id, modseq);
+
+CREATE OR REPLACE FUNCTION airsend_bump_modseq() RETURNS trigger AS $$
+BEGIN
+    NEW.modseq := txid_current();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- A change of the extra memberships (COPY targets, labels) is a change of the message.
+CREATE OR REPLACE FUNCTION airsend_bump_message_modseq() RETURNS trigger AS $$
+DECLARE
+    rec RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    UPDATE messages SET modseq = txid_current() WHERE id = rec.message_id;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION airsend_record_tombstone() RETURNS trigger AS $$
+BEGIN
+    -- Rows removed together with their account need no tombstone.
+    IF EXISTS (SELECT 1 FROM mail_accounts a WHERE a.id = OLD.account_id) THEN
+        INSERT INTO sync_tombstones (account_id, object_type, object_id)
+        VALUES (OLD.account_id, TG_ARGV[0], OLD.id)
+        ON CONFLICT (object_type, object_id) DO UPDATE SET modseq = EXCLUDED.modseq, deleted_at = NOW();
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_bump_modseq
+    BEFORE UPDATE ON messages
+    FOR EACH ROW EXECUTE FUNCTION airsend_bump_modseq();
+
+CREATE TRIGGER mailboxes_bump_modseq
+    BEFORE UPDATE ON mailboxes
+    FOR EACH ROW EXECUTE FUNCTION airsend_bump_modseq();
+
+CREATE TRIGGER message_mailboxes_bump_modseq
+    AFTER INSERT OR DELETE ON message_mailboxes
+    FOR EACH ROW EXECUTE FUNCTION airsend_bump_message_modseq();
+
+CREATE TRIGGER messages_record_tombstone
+    AFTER DELETE ON messages
+    FOR EACH ROW EXECUTE FUNCTION airsend_record_tombstone('message');
+
+CREATE TRIGGER mailboxes_record_tombstone
+    AFTER DELETE ON mailboxes
+    FOR EACH ROW EXECUTE FUNCTION airsend_record_tombstone('mailbox');
+
+-- Updates that only bump modseq are not announced to the IMAP process.
+CREATE OR REPLACE FUNCTION airsend_notify_message_change() RETURNS trigger AS $$
+DECLARE
+    rec           RECORD;
+    op            TEXT := TG_OP;
+    account_email TEXT;
+BEGIN
+    IF current_setting('airsend.origin', true) = 'imap' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    IF TG_OP = 'UPDATE' THEN
+        IF to_jsonb(OLD) - 'modseq' = to_jsonb(NEW) - 'modseq' THEN
+            RETURN NULL;
+        END IF;
+        IF OLD.folder IS DISTINCT FROM NEW.folder THEN
+            op := 'MOVE';
+        END IF;
+    END IF;
+
+    -- The account is already gone when its rows are removed by the cascade.
+    SELECT a.email INTO account_email FROM mail_accounts a WHERE a.id = rec.account_id;
+    IF account_email IS NOT NULL THEN
+        PERFORM pg_notify('airsend_messages',
+            json_build_object('op', op, 'email', account_email, 'id', rec.id)::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_mail_accounts_last_imap_login;
+
+ALTER TABLE mail_accounts
+    DROP COLUMN IF EXISTS last_imap_login;
@@ -0,0 +1,7 @@
+-- When each account last logged in over IMAP. The accounts that logged in recently are
+-- loaded at startup; every other account is loaded on its first login.
+ALTER TABLE mail_accounts
+    ADD COLUMN IF NOT EXISTS last_imap_login TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_mail_accounts_last_imap_login
+    ON mail_accounts (last_imap_login DESC) WHERE imap_enabled = TRUE;
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS mail_accounts_notify_change ON mail_accounts;
+
+DROP FUNCTION IF EXISTS airsend_notify_account_change();
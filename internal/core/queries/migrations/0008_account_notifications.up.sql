@@ -0,0 +1,37 @@
+-- Announce password changes and accounts losing IMAP access, so the IMAP process can end
+-- their open sessions. Writes made by the IMAP process itself set airsend.origin = 'imap'
+-- and are not announced.
+-- Payload: {"op": "PASSWORD" | "DISABLED" | "DELETE", "email": ..., "id": ...}
+
+CREATE OR REPLACE FUNCTION airsend_notify_account_change() RETURNS trigger AS $$
+DECLARE
+    op TEXT;
+BEGIN
+    IF current_setting('airsend.origin', true) = 'imap' THEN
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('airsend_accounts',
+            json_build_object('op', 'DELETE', 'email', OLD.email, 'id', OLD.id)::text);
+        RETURN NULL;
+    END IF;
+
+    IF OLD.imap_enabled AND NOT NEW.imap_enabled THEN
+        op := 'DISABLED';
+    ELSIF OLD.hash IS DISTINCT FROM NEW.hash THEN
+        op := 'PASSWORD';
+    ELSE
+        RETURN NULL;
+    END IF;
+
+    PERFORM pg_notify('airsend_accounts',
+        json_build_object('op', op, 'email', NEW.email, 'id', NEW.id)::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER mail_accounts_notify_change
+    AFTER UPDATE OR DELETE ON mail_accounts
+    FOR EACH ROW EXECUTE FUNCTION airsend_notify_account_change();
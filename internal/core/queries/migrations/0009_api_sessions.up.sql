@@ -0,0 +1,13 @@
+-- Logins to the HTTP API. Access tokens name their session, which logout revokes; the session
+-- remembers the ID of its current refresh token so a refresh token can only be used once.
+
+CREATE TABLE IF NOT EXISTS api_sessions (
+    id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_id  UUID        NOT NULL REFERENCES mail_accounts (id) ON DELETE CASCADE,
+    refresh_id  TEXT        NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at  TIMESTAMPTZ NOT NULL,
+    revoked_at  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_sessions_account ON api_sessions (account_id);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS app_passwords_notify_revoked ON app_passwords;
+
+DROP FUNCTION IF EXISTS airsend_notify_app_password_revoked();
+
+DROP TABLE IF EXISTS app_passwords;
@@ -0,0 +1,43 @@
+-- Application-specific passwords, so mail clients do not need the account's main password.
+-- Only a SHA-256 of each password is stored: they are long random strings, not something a
+-- person chose. A NULL scope allows every mail protocol, 'imap' only IMAP.
+-- Revoking one is announced like a password change, so its IMAP sessions are ended.
+
+CREATE TABLE IF NOT EXISTS app_passwords (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_id    UUID        NOT NULL REFERENCES mail_accounts (id) ON DELETE CASCADE,
+    label         TEXT        NOT NULL,
+    hash          TEXT        NOT NULL,
+    scope         TEXT        CHECK (scope IN ('imap')),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at  TIMESTAMPTZ,
+    revoked_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_app_passwords_account_hash
+    ON app_passwords (account_id, hash) WHERE revoked_at IS NULL;
+
+CREATE OR REPLACE FUNCTION airsend_notify_app_password_revoked() RETURNS trigger AS $$
+DECLARE
+    account_email TEXT;
+BEGIN
+    IF TG_OP = 'UPDATE' AND NOT (OLD.revoked_at IS NULL AND NEW.revoked_at IS NOT NULL) THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'DELETE' AND OLD.revoked_at IS NOT NULL THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT a.email INTO account_email FROM mail_accounts a WHERE a.id = OLD.account_id;
+    IF account_email IS NOT NULL THEN
+        PERFORM pg_notify('airsend_accounts',
+            json_build_object('op', 'PASSWORD', 'email', account_email, 'id', OLD.account_id)::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER app_passwords_notify_revoked
+    AFTER UPDATE OR DELETE ON app_passwords
+    FOR EACH ROW EXECUTE FUNCTION airsend_notify_app_password_revoked();
@@ -0,0 +1,12 @@
+-- Accounts and client addresses that may not log in, over IMAP or HTTP. Addresses that keep
+-- getting locked out for failed logins are added automatically; administrators add and lift bans
+-- through the admin API. A NULL expires_at bans for good. IPv6 clients are banned by their /64.
+
+CREATE TABLE IF NOT EXISTS login_bans (
+    kind        TEXT        NOT NULL CHECK (kind IN ('account', 'ip')),
+    value       TEXT        NOT NULL,
+    reason      TEXT        NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at  TIMESTAMPTZ,
+    PRIMARY KEY (kind, value)
+);
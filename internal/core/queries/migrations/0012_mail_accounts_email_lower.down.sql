@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_mail_accounts_email_lower;
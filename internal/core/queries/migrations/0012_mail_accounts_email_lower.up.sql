@@ -0,0 +1,3 @@
+-- Logins are case-folded and matched against LOWER(email), which this index serves.
+CREATE INDEX IF NOT EXISTS idx_mail_accounts_email_lower
+    ON mail_accounts (LOWER(email)) WHERE imap_enabled = TRUE;
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS tenants_notify_change ON tenants;
+
+DROP FUNCTION IF EXISTS airsend_notify_tenant_change();
+
+DROP INDEX IF EXISTS idx_mail_accounts_tenant_name;
+
+DROP TABLE IF EXISTS tenants;
@@ -0,0 +1,39 @@
+-- The customers whose domains this server hosts, referred to by mail_accounts.tenant_name.
+-- Each tenant decides whether its users may use IMAP, on which endpoints ("imap", "imaps",
+-- "unix") and under which TLS server names, and how many IMAP sessions and how large mailboxes
+-- they may have. Empty lists and zero limits do not restrict anything, and accounts of a tenant
+-- without a row are served like before tenants existed. The certificate is picked by the
+-- server name the client asks for; a server name of one tenant cannot be used by another's users.
+-- Changes are announced on the account channel so the IMAP process applies them right away.
+-- Payload: {"op": "TENANT", "tenant": ...}
+
+CREATE TABLE IF NOT EXISTS tenants (
+    name              TEXT PRIMARY KEY,
+    imap_enabled      BOOLEAN     NOT NULL DEFAULT TRUE,
+    endpoints         TEXT[]      NOT NULL DEFAULT '{}',
+    hostnames         TEXT[]      NOT NULL DEFAULT '{}',
+    tls_cert_file     TEXT        NOT NULL DEFAULT '',
+    tls_key_file      TEXT        NOT NULL DEFAULT '',
+    max_connections   INTEGER     NOT NULL DEFAULT 0 CHECK (max_connections >= 0),
+    max_mailbox_size  BIGINT      NOT NULL DEFAULT 0 CHECK (max_mailbox_size >= 0),
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_mail_accounts_tenant_name ON mail_accounts (tenant_name);
+
+CREATE OR REPLACE FUNCTION airsend_notify_tenant_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('airsend_accounts', json_build_object('op', 'TENANT', 'tenant', OLD.name)::text);
+    ELSE
+        PERFORM pg_notify('airsend_accounts', json_build_object('op', 'TENANT', 'tenant', NEW.name)::text);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tenants_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON tenants
+    FOR EACH ROW EXECUTE FUNCTION airsend_notify_tenant_change();
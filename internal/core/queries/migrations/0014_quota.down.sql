@@ -0,0 +1,3 @@
+ALTER TABLE tenants DROP COLUMN IF EXISTS max_messages;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS size;
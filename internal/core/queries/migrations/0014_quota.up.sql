@@ -0,0 +1,20 @@
+-- Quota accounting for IMAP. The size of a message is what it adds to mail_accounts.usage: the
+-- decoded length of the base64 content IMAP stores, or the length of raw content and of the text
+-- bodies of rows written without one. Deleting a message gives its size back to the usage.
+-- Tenants may also limit the number of messages of each of their accounts, a message counting
+-- once per mailbox it is in; 0 does not limit anything.
+
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS size BIGINT GENERATED ALWAYS AS (
+        CASE
+            WHEN content = '' THEN
+                octet_length(COALESCE(plain_text, '')) + octet_length(COALESCE(html_text, ''))
+            WHEN octet_length(content) % 4 = 0 AND content ~ '^[A-Za-z0-9+/]*={0,2}$' THEN
+                octet_length(content) / 4 * 3 - (octet_length(content) - octet_length(rtrim(content, '=')))
+            ELSE
+                octet_length(content)
+        END
+    ) STORED;
+
+ALTER TABLE tenants
+    ADD COLUMN IF NOT EXISTS max_messages BIGINT NOT NULL DEFAULT 0 CHECK (max_messages >= 0);
@@ -0,0 +1,2 @@
+-- \Draft of messages appended over IMAP, so that drafts saved by a client keep the flag.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_draft BOOLEAN NOT NULL DEFAULT FALSE;
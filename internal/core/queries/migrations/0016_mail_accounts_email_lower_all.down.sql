@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_mail_accounts_email_lower;
+CREATE INDEX IF NOT EXISTS idx_mail_accounts_email_lower
+    ON mail_accounts (LOWER(email)) WHERE imap_enabled = TRUE;
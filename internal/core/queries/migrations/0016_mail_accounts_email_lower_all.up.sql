@@ -0,0 +1,4 @@
+-- HTTP API logins are matched against LOWER(email) too, whether or not the account has IMAP
+-- enabled, so the index covers every account.
+DROP INDEX IF EXISTS idx_mail_accounts_email_lower;
+CREATE INDEX IF NOT EXISTS idx_mail_accounts_email_lower ON mail_accounts (LOWER(email));
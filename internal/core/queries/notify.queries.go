@@ -0,0 +1,15 @@
+package queries
+
+// NOTIFY channels written by the triggers of migrations 0005, 0008 and 0013.
+// The payload is a JSON object with op, email and id, or op and tenant for tenant changes.
+const (
+	MessageChangesChannel = "airsend_messages"
+	MailboxChangesChannel = "airsend_mailboxes"
+	AccountChangesChannel = "airsend_accounts"
+)
+
+// SetIMAPOriginQuery marks the current transaction as made by the IMAP connector,
+// so the triggers do not announce changes Gluon has already applied.
+func SetIMAPOriginQuery() string {
+	return `SELECT set_config('airsend.origin', 'imap', true);`
+}
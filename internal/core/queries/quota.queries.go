@@ -0,0 +1,42 @@
+package queries
+
+// GetQuotaQuery returns the storage an account uses against its quota.
+// Args: $1 account id.
+// Columns: usage, mailbox_size.
+func GetQuotaQuery() string {
+	return `SELECT usage, mailbox_size FROM mail_accounts WHERE id = $1;`
+}
+
+// CountAccountMessagesQuery counts the messages of an account, once per mailbox a message is in.
+// Args: $1 account id.
+// Columns: messages.
+func CountAccountMessagesQuery() string {
+	return `
+		SELECT (SELECT COUNT(*) FROM messages m WHERE m.account_id = $1)
+		     + (SELECT COUNT(*) FROM message_mailboxes mm
+		        JOIN messages m ON m.id = mm.message_id
+		        WHERE m.account_id = $1);`
+}
+
+// LockAccountQuery locks an account row until the end of the transaction, so concurrent
+// writes check the quota one after the other.
+// Args: $1 account id.
+// Columns: id.
+func LockAccountQuery() string {
+	return `SELECT id FROM mail_accounts WHERE id = $1 FOR UPDATE;`
+}
+
+// ReleaseMailboxesUsageQuery gives the size of the messages whose home folder is one of the
+// mailboxes about to be deleted back to the account usage.
+// Args: $1 account id, $2 mailbox ids (uuid[]).
+func ReleaseMailboxesUsageQuery() string {
+	return `
+		UPDATE mail_accounts a
+		SET usage = GREATEST(a.usage - s.size, 0), updated_at = NOW()
+		FROM (
+			SELECT SUM(m.size) AS size
+			FROM messages m
+			WHERE m.account_id = $1 AND m.folder = ANY($2::uuid[])
+		) s
+		WHERE a.id = $1 AND s.size > 0;`
+}
@@ -0,0 +1,50 @@
+package queries
+
+// GetAPIAccountQuery returns the account a user logs in to the HTTP API with. Emails are matched
+// without regard to case, like in GetAuthUserQuery.
+// Args: $1 lower-case email.
+// Columns: id, email, hash.
+func GetAPIAccountQuery() string {
+	return `
+		SELECT id, email, hash
+		FROM mail_accounts
+		WHERE LOWER(email) = $1
+		ORDER BY email = $1 DESC
+		LIMIT 1;`
+}
+
+// CreateAPISessionQuery starts an HTTP API session.
+// Args: $1 account id, $2 refresh token id, $3 expiry.
+// Columns: id.
+func CreateAPISessionQuery() string {
+	return `
+		INSERT INTO api_sessions (account_id, refresh_id, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id;`
+}
+
+// RotateAPISessionQuery replaces the refresh token of a live session, only if the old one is current.
+// Args: $1 session id, $2 current refresh token id, $3 new refresh token id.
+func RotateAPISessionQuery() string {
+	return `
+		UPDATE api_sessions
+		SET refresh_id = $3
+		WHERE id = $1 AND refresh_id = $2 AND revoked_at IS NULL AND expires_at > NOW();`
+}
+
+// RevokeAPISessionQuery ends an HTTP API session.
+// Args: $1 session id.
+func RevokeAPISessionQuery() string {
+	return `UPDATE api_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL;`
+}
+
+// IsAPISessionActiveQuery reports whether an HTTP API session is neither revoked nor expired.
+// Args: $1 session id.
+// Columns: active.
+func IsAPISessionActiveQuery() string {
+	return `
+		SELECT EXISTS (
+			SELECT 1 FROM api_sessions
+			WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		);`
+}
@@ -0,0 +1,69 @@
+package queries
+
+// The queries below drive the incremental sync. A sync reads the account cursor together
+// with a watermark: every transaction older than the watermark has finished, so once the
+// changes are pushed the watermark becomes the new cursor. Rows changed by transactions
+// at or after the cursor are synced again, which is harmless.
+
+// GetSyncCursorQuery returns the sync cursor of an account.
+// Args: $1 email.
+// Columns: id, sync_modseq (NULL before the first sync), watermark.
+func GetSyncCursorQuery() string {
+	return `
+		SELECT id, sync_modseq, txid_snapshot_xmin(txid_current_snapshot())
+		FROM mail_accounts
+		WHERE email = $1;`
+}
+
+// SetSyncCursorQuery stores the sync cursor and drops the tombstones it has passed.
+// Args: $1 account id, $2 cursor.
+func SetSyncCursorQuery() string {
+	return `
+		WITH cursor AS (
+			UPDATE mail_accounts SET sync_modseq = $2 WHERE id = $1
+		)
+		DELETE FROM sync_tombstones WHERE account_id = $1 AND modseq < $2;`
+}
+
+// ResetSyncCursorQuery forgets the sync cursor, so the next sync pushes everything.
+// Args: $1 email.
+func ResetSyncCursorQuery() string {
+	return `UPDATE mail_accounts SET sync_modseq = NULL WHERE email = $1;`
+}
+
+// GetCreatedMessagesQuery returns the messages created since the cursor, with the same
+// columns as GetMailboxByIDQuery.
+// Args: $1 email, $2 cursor.
+func GetCreatedMessagesQuery() string {
+	return `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN mail_accounts a ON a.id = m.account_id
+		WHERE a.email = $1 AND m.createseq >= $2
+		ORDER BY m.received_at, m.id;`
+}
+
+// GetChangedMessagesQuery returns the messages created before the cursor and changed since,
+// with the same columns as GetMailboxByIDQuery.
+// Args: $1 email, $2 cursor.
+func GetChangedMessagesQuery() string {
+	return `
+		SELECT ` + messageColumns + `
+		FROM messages m
+		JOIN mail_accounts a ON a.id = m.account_id
+		WHERE a.email = $1 AND m.modseq >= $2 AND m.createseq < $2
+		ORDER BY m.received_at, m.id;`
+}
+
+// GetTombstonesQuery returns the messages and mailboxes deleted since the cursor,
+// messages first.
+// Args: $1 email, $2 cursor.
+// Columns: object_type ('message' or 'mailbox'), object_id.
+func GetTombstonesQuery() string {
+	return `
+		SELECT t.object_type, t.object_id
+		FROM sync_tombstones t
+		JOIN mail_accounts a ON a.id = t.account_id
+		WHERE a.email = $1 AND t.modseq >= $2
+		ORDER BY t.object_type = 'mailbox', t.modseq;`
+}
@@ -0,0 +1,20 @@
+package queries
+
+// ListTenantsQuery returns every tenant.
+// Columns: name, imap_enabled, endpoints, hostnames, tls_cert_file, tls_key_file, max_connections, max_mailbox_size, max_messages.
+func ListTenantsQuery() string {
+	return `
+		SELECT name, imap_enabled, endpoints, hostnames, tls_cert_file, tls_key_file, max_connections, max_mailbox_size, max_messages
+		FROM tenants
+		ORDER BY name;`
+}
+
+// GetTenantEmailsQuery returns the emails of the IMAP enabled accounts of a tenant.
+// Args: $1 tenant name.
+// Columns: email.
+func GetTenantEmailsQuery() string {
+	return `
+		SELECT email
+		FROM mail_accounts
+		WHERE tenant_name = $1 AND imap_enabled = TRUE;`
+}
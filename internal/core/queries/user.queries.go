@@ -0,0 +1,59 @@
+package queries
+
+// GetAuthUserQuery returns the account row used by Authorize. Emails and domains are matched
+// without regard to case; an account stored in lower case wins over one that only differs in case.
+// Args: $1 lower-case email, $2 lower-case domain.
+// Columns: id, email, hash, tenant_name, mailbox_size, usage, key, open_pgp, system_email.
+func GetAuthUserQuery() string {
+	return `
+		SELECT id, email, hash, tenant_name, mailbox_size, usage, key, open_pgp, system_email
+		FROM mail_accounts
+		WHERE LOWER(email) = $1 AND LOWER(domain) = $2 AND imap_enabled = TRUE
+		ORDER BY email = $1 DESC
+		LIMIT 1;`
+}
+
+// GetAllUserWithImapEnabled returns every account that may log in over IMAP.
+// Columns: gluon_id, email.
+func GetAllUserWithImapEnabled() string {
+	return `
+		SELECT gluon_id, email
+		FROM mail_accounts
+		WHERE imap_enabled = TRUE
+		ORDER BY email;`
+}
+
+// GetImapUserQuery returns the Gluon ID of an account that may log in over IMAP.
+// Args: $1 email.
+// Columns: gluon_id.
+func GetImapUserQuery() string {
+	return `
+		SELECT gluon_id
+		FROM mail_accounts
+		WHERE email = $1 AND imap_enabled = TRUE;`
+}
+
+// GetRecentImapUsersQuery returns the accounts that logged in over IMAP recently, most recent first.
+// Args: $1 window in seconds, $2 limit.
+// Columns: gluon_id, email.
+func GetRecentImapUsersQuery() string {
+	return `
+		SELECT gluon_id, email
+		FROM mail_accounts
+		WHERE imap_enabled = TRUE
+		  AND last_imap_login > NOW() - make_interval(secs => $1)
+		ORDER BY last_imap_login DESC
+		LIMIT $2;`
+}
+
+// TouchImapLoginQuery records an IMAP login of an account.
+// Args: $1 email.
+func TouchImapLoginQuery() string {
+	return `UPDATE mail_accounts SET last_imap_login = NOW() WHERE email = $1;`
+}
+
+// UpdatePasswordHashQuery replaces the password hash of an account, unless it changed meanwhile.
+// Args: $1 account id, $2 current hash, $3 new hash.
+func UpdatePasswordHashQuery() string {
+	return `UPDATE mail_accounts SET hash = $3 WHERE id = $1 AND hash = $2;`
+}
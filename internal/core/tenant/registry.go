@@ -0,0 +1,275 @@
+// Package tenant applies the per-customer settings of the tenants table. A Registry holds the
+// tenants in memory, picks the TLS certificate of each tenant's server names, and admits the
+// IMAP sessions of each tenant's users on the endpoints and under the limits it allows.
+package tenant
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enjoys-in/airsend-imap/internal/core/queries"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrIMAPDisabled        = errors.New("IMAP is disabled for this tenant")
+	ErrEndpointNotAllowed  = errors.New("endpoint is not allowed for this tenant")
+	ErrHostnameNotAllowed  = errors.New("server name belongs to another tenant")
+	ErrTooManyConnections  = errors.New("tenant has too many IMAP sessions")
+	ErrUnknownTenant       = errors.New("no such tenant")
+	errIncompleteTLSConfig = errors.New("tls_cert_file and tls_key_file must be set together")
+)
+
+// Tenant is a row of the tenants table. Empty lists and zero limits do not restrict anything.
+type Tenant struct {
+	Name           string   `json:"name"`
+	IMAPEnabled    bool     `json:"imap_enabled"`
+	Endpoints      []string `json:"endpoints"` // IMAP endpoints its users may log in on
+	Hostnames      []string `json:"hostnames"` // TLS server names served with its certificate
+	CertFile       string   `json:"tls_cert_file,omitempty"`
+	KeyFile        string   `json:"tls_key_file,omitempty"`
+	MaxConnections int      `json:"max_connections"`  // IMAP sessions of all its users at once
+	MaxMailboxSize int      `json:"max_mailbox_size"` // Largest mailbox size of its accounts, in bytes
+	MaxMessages    int      `json:"max_messages"`     // Messages of each of its accounts, once per mailbox
+}
+
+// AllowsEndpoint reports whether the tenant's users may log in on the named endpoint.
+func (t Tenant) AllowsEndpoint(endpoint string) bool {
+	return len(t.Endpoints) == 0 || slices.Contains(t.Endpoints, endpoint)
+}
+
+// MailboxSize returns the mailbox size of an account of the tenant: the account's own size,
+// capped by the tenant's. An account size of 0 is unlimited.
+func (t Tenant) MailboxSize(accountSize int) int {
+	if t.MaxMailboxSize <= 0 || (accountSize > 0 && accountSize <= t.MaxMailboxSize) {
+		return accountSize
+	}
+	return t.MaxMailboxSize
+}
+
+// Status is a tenant and the IMAP sessions its users have open.
+type Status struct {
+	Tenant
+	Connections int `json:"connections"`
+}
+
+// Registry holds the tenants table and counts the IMAP sessions of each tenant.
+// The zero tenant "" and tenants without a row are not restricted.
+type Registry struct {
+	db *sql.DB
+
+	mu      sync.RWMutex
+	tenants map[string]Tenant
+	hosts   map[string]string           // Lower-case server name -> tenant
+	certs   map[string]*tls.Certificate // Tenant -> certificate
+	conns   map[string]int              // Tenant -> IMAP sessions admitted and not released
+}
+
+// NewRegistry returns an empty registry reading the tenants table of db. Nothing is restricted
+// until Load has run.
+func NewRegistry(db *sql.DB) *Registry {
+	return &Registry{
+		db:      db,
+		tenants: make(map[string]Tenant),
+		hosts:   make(map[string]string),
+		certs:   make(map[string]*tls.Certificate),
+		conns:   make(map[string]int),
+	}
+}
+
+// Load reads the tenants table and the tenants' certificates. A certificate that fails to
+// load is logged, and the tenant's previous certificate, if any, is kept.
+func (r *Registry) Load(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx, queries.ListTenantsQuery())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tenants := make(map[string]Tenant)
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.Name,
+			&t.IMAPEnabled,
+			pq.Array(&t.Endpoints),
+			pq.Array(&t.Hostnames),
+			&t.CertFile,
+			&t.KeyFile,
+			&t.MaxConnections,
+			&t.MaxMailboxSize,
+			&t.MaxMessages); err != nil {
+			return err
+		}
+		tenants[t.Name] = t
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	r.mu.RLock()
+	previous := r.certs
+	r.mu.RUnlock()
+
+	hosts := make(map[string]string)
+	certs := make(map[string]*tls.Certificate)
+	for _, name := range slices.Sorted(maps.Keys(tenants)) {
+		t := tenants[name]
+		for _, host := range t.Hostnames {
+			host = strings.ToLower(host)
+			if owner, taken := hosts[host]; taken {
+				log.Printf("⚠️ Server name %s of tenant %s is already used by tenant %s", host, name, owner)
+				continue
+			}
+			hosts[host] = name
+		}
+
+		cert, err := loadCertificate(t)
+		switch {
+		case err != nil:
+			log.Printf("❌ Failed to load the TLS certificate of tenant %s: %v", name, err)
+			if cert := previous[name]; cert != nil {
+				certs[name] = cert
+			}
+		case cert != nil:
+			certs[name] = cert
+		}
+	}
+
+	r.mu.Lock()
+	r.tenants, r.hosts, r.certs = tenants, hosts, certs
+	r.mu.Unlock()
+
+	return nil
+}
+
+// loadCertificate loads the certificate of a tenant, or returns nil when it has none.
+func loadCertificate(t Tenant) (*tls.Certificate, error) {
+	if t.CertFile == "" && t.KeyFile == "" {
+		return nil, nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errIncompleteTLSConfig
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Run reloads the tenants every interval until ctx is cancelled, so certificate renewals and
+// changes missed by the change listener are picked up.
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.Load(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("⚠️ Failed to reload the tenants: %v", err)
+		}
+	}
+}
+
+// Lookup returns the tenant of a name, if it has a row.
+func (r *Registry) Lookup(name string) (Tenant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.tenants[name]
+	return t, ok
+}
+
+// List returns every tenant with its open IMAP sessions, by name.
+func (r *Registry) List() []Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		statuses = append(statuses, Status{Tenant: t, Connections: r.conns[t.Name]})
+	}
+	slices.SortFunc(statuses, func(a, b Status) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return statuses
+}
+
+// Get returns a tenant with its open IMAP sessions.
+func (r *Registry) Get(name string) (Status, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.tenants[name]
+	if !ok {
+		return Status{}, ErrUnknownTenant
+	}
+	return Status{Tenant: t, Connections: r.conns[name]}, nil
+}
+
+// GetCertificate returns the certificate of the tenant owning the server name the client asked
+// for. It returns no certificate for other server names, so the default one is used.
+// It is meant for tls.Config.GetCertificate.
+func (r *Registry) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.certs[r.hosts[strings.ToLower(hello.ServerName)]], nil
+}
+
+// Admit lets an IMAP session of a user of the named tenant start, logged in on endpoint under
+// the TLS server name serverName, which is empty without TLS or SNI. The returned function ends
+// the session's count and must be called once it is closed.
+func (r *Registry) Admit(name, endpoint, serverName string) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A server name of one tenant cannot be used by the users of another.
+	if serverName != "" {
+		if owner, claimed := r.hosts[strings.ToLower(serverName)]; claimed && owner != name {
+			return nil, fmt.Errorf("%w: %s", ErrHostnameNotAllowed, serverName)
+		}
+	}
+
+	t, ok := r.tenants[name]
+	if ok {
+		switch {
+		case !t.IMAPEnabled:
+			return nil, ErrIMAPDisabled
+		case !t.AllowsEndpoint(endpoint):
+			return nil, fmt.Errorf("%w: %s", ErrEndpointNotAllowed, endpoint)
+		case t.MaxConnections > 0 && r.conns[name] >= t.MaxConnections:
+			return nil, ErrTooManyConnections
+		}
+	}
+
+	r.conns[name]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if r.conns[name]--; r.conns[name] <= 0 {
+				delete(r.conns, name)
+			}
+		})
+	}, nil
+}
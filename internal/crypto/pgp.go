@@ -1,30 +1,63 @@
 package pgp
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+
 	"github.com/ProtonMail/gopenpgp/v3/crypto"
 )
 
-func DecryptMessage(publicKey, privateKey, password, encryptedMessage string) []byte {
+// ErrDecrypterClosed is returned by a Decrypter used after Close.
+var ErrDecrypterClosed = errors.New("decrypter is closed")
+
+// Decrypter decrypts OpenPGP messages with a private key that is only unlocked once.
+// It is safe for concurrent use.
+type Decrypter struct {
+	mu     sync.Mutex
+	handle crypto.PGPDecryption // nil once closed
+}
 
-	passphrase := []byte(password) // Passphrase of the privKey
-	_, err := crypto.NewKeyFromArmored(publicKey)
+// NewDecrypter unlocks the given armored private key with password.
+func NewDecrypter(privateKey, password string) (*Decrypter, error) {
+	privateKeyObj, err := crypto.NewPrivateKeyFromArmored(privateKey, []byte(password))
 	if err != nil {
-		fmt.Printf("Public key error: %v\n", err)
+		return nil, fmt.Errorf("private key error: %w", err)
+	}
 
+	decHandle, err := crypto.PGP().Decryption().DecryptionKey(privateKeyObj).New()
+	if err != nil {
+		privateKeyObj.ClearPrivateParams()
+		return nil, fmt.Errorf("decryption handle error: %w", err)
 	}
 
-	privateKeyObj, privateKeyErr := crypto.NewPrivateKeyFromArmored(privateKey, passphrase)
-	if privateKeyErr != nil {
-		fmt.Printf("Private key error: %v\n", privateKeyErr)
+	return &Decrypter{handle: decHandle}, nil
+}
+
+// Decrypt decrypts an OpenPGP message, armored or binary.
+func (d *Decrypter) Decrypt(encryptedMessage []byte) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.handle == nil {
+		return nil, ErrDecrypterClosed
+	}
+
+	decrypted, err := d.handle.Decrypt(encryptedMessage, crypto.Auto)
+	if err != nil {
+		return nil, fmt.Errorf("decryption error: %w", err)
 	}
-	pgp := crypto.PGP()
 
-	decHandle, err := pgp.Decryption().DecryptionKey(privateKeyObj).New()
-	decrypted, err := decHandle.Decrypt([]byte(encryptedMessage), crypto.Armor)
-	myMessage := decrypted.Bytes()
+	return decrypted.Bytes(), nil
+}
 
-	decHandle.ClearPrivateParams()
+// Close wipes the unlocked key from memory.
+func (d *Decrypter) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	return myMessage
+	if d.handle != nil {
+		d.handle.ClearPrivateParams()
+		d.handle = nil
+	}
 }
@@ -4,16 +4,37 @@ import (
 	"context"
 
 	"github.com/enjoys-in/airsend-imap/internal/core/api/repository"
+	"github.com/enjoys-in/airsend-imap/internal/utils/jwt"
 )
 
 type AuthService interface {
 	GetUser(ctx context.Context, email string) (*repository.User, error)
+	Login(ctx context.Context, email, password, ip string) (*TokenPair, error)
+	Refresh(ctx context.Context, refreshToken string) (*TokenPair, error)
+	Logout(ctx context.Context, claims *jwt.Claims) error
+	Authenticate(ctx context.Context, accessToken string) (*jwt.Claims, error)
+}
+
+// TokenPair is what a login or a refresh hands to the client.
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // Seconds until the access token expires
+}
+
+// AppPasswordService manages the app passwords of the logged in account.
+type AppPasswordService interface {
+	Create(ctx context.Context, accountID, label, scope string) (*repository.AppPassword, string, error)
+	List(ctx context.Context, accountID string) ([]repository.AppPassword, error)
+	Revoke(ctx context.Context, accountID, id string) error
 }
 
 type IMAPService interface {
 }
 
 type Services struct {
-	Auth AuthService
-	IMAP IMAPService
+	Auth         AuthService
+	IMAP         IMAPService
+	AppPasswords AppPasswordService
 }
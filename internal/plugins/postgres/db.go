@@ -4,12 +4,14 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type DB struct {
 	Conn *sql.DB
+	dsn  string
 }
 
 // NewDB creates and verifies a PostgreSQL connection.
@@ -29,10 +31,20 @@ func CreateDBConnection(host, port, user, password, dbname string, sslmode strin
 		return nil, err
 	}
 	log.Println("✅ DB connected")
-	return &DB{Conn: db}, nil
+	return &DB{Conn: db, dsn: dsn}, nil
 }
 
 func (d *DB) Close() error {
 	log.Printf("Database Connection has been Closed")
 	return d.Conn.Close()
 }
+
+// NewListener opens a dedicated connection for LISTEN/NOTIFY. It reconnects on its own;
+// after a reconnect a nil notification is delivered, since notifications may have been missed.
+func (d *DB) NewListener() *pq.Listener {
+	return pq.NewListener(d.dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("⚠️ DB listener: %v", err)
+		}
+	})
+}
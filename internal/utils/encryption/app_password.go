@@ -0,0 +1,50 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// appPasswordAlphabet only has lower case letters, so app passwords are easy to type on a phone.
+const appPasswordAlphabet = "abcdefghijklmnopqrstuvwxyz"
+
+// appPasswordLength gives app passwords about 94 bits of entropy.
+const appPasswordLength = 20
+
+// NewAppPassword returns a random app password, grouped by four letters for readability.
+// The spaces are optional when it is typed in.
+func NewAppPassword() (string, error) {
+	// Bytes at or above the largest multiple of 26 are skipped, so every letter is as likely.
+	limit := byte(256 / len(appPasswordAlphabet) * len(appPasswordAlphabet))
+
+	var sb strings.Builder
+	buf := make([]byte, appPasswordLength)
+	for n := 0; n < appPasswordLength; {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			if c >= limit || n == appPasswordLength {
+				continue
+			}
+			if n > 0 && n%4 == 0 {
+				sb.WriteByte(' ')
+			}
+			sb.WriteByte(appPasswordAlphabet[int(c)%len(appPasswordAlphabet)])
+			n++
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// HashAppPassword returns the stored form of an app password. A plain SHA-256 is enough for
+// long random secrets, and lets a login find its app password without trying each one.
+func HashAppPassword(password string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(password, " ", ""))
+	sum := sha256.Sum256([]byte(normalized))
+
+	return hex.EncodeToString(sum[:])
+}
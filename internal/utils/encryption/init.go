@@ -5,14 +5,9 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha512"
-	"crypto/subtle"
 	"encoding/base64"
-	"encoding/hex"
-	"strings"
 
 	"fmt"
-	"golang.org/x/crypto/pbkdf2"
 	"io"
 )
 
@@ -92,20 +87,3 @@ func DecryptAES(cipherTextB64, ivB64 string, key []byte) (string, error) {
 
 	return string(unpadded), nil
 }
-
-// ValidateSMTPPassword checks if a provided password matches a stored password using
-// a salted hash using PBKDF2. It takes two parameters: the stored password
-// and the provided password. It returns true if the provided password matches the
-// stored password, and false otherwise. The stored password is expected to be in
-// the format "salt:hash", where the hash is a hexadecimal string.
-
-func ValidatePassword(storedPassword, providedPassword string) bool {
-	parts := strings.Split(storedPassword, ":")
-	if len(parts) != 2 {
-		return false
-	}
-	salt, storedHash := parts[0], parts[1]
-	derived := pbkdf2.Key([]byte(providedPassword), []byte(salt), 100000, 64, sha512.New)
-	storedBytes, _ := hex.DecodeString(storedHash)
-	return subtle.ConstantTimeCompare(derived, storedBytes) == 1
-}
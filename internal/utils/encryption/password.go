@@ -0,0 +1,258 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hash schemes, named as Dovecot names them in the "{SCHEME}hash" prefix.
+const (
+	SchemeArgon2ID = "ARGON2ID"
+	SchemeBcrypt   = "BLF-CRYPT"
+	SchemePBKDF2   = "PBKDF2" // The original "salt:hexhash" PBKDF2-SHA512 format, stored without a prefix
+)
+
+// ErrUnknownScheme is returned when asked to hash with a scheme that is not registered.
+var ErrUnknownScheme = errors.New("unknown password scheme")
+
+// PasswordScheme hashes and verifies passwords in one format.
+// The hashes it handles do not include the "{SCHEME}" prefix.
+type PasswordScheme interface {
+	Hash(password string) (string, error)
+	Verify(hash, password string) bool
+	// NeedsRehash reports whether a hash was made with weaker parameters than Hash uses now.
+	NeedsRehash(hash string) bool
+}
+
+var (
+	schemesMu       sync.RWMutex
+	schemes         = map[string]PasswordScheme{}
+	preferredScheme = SchemeArgon2ID
+)
+
+func init() {
+	RegisterPasswordScheme(SchemeArgon2ID, argon2idScheme{time: 2, memory: 19 * 1024, threads: 1, keyLen: 32})
+	RegisterPasswordScheme(SchemeBcrypt, bcryptScheme{cost: 12})
+	RegisterPasswordScheme(SchemePBKDF2, pbkdf2Scheme{iterations: 100000})
+}
+
+// RegisterPasswordScheme makes a scheme available under name, replacing any scheme of that name.
+func RegisterPasswordScheme(name string, scheme PasswordScheme) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+
+	schemes[strings.ToUpper(name)] = scheme
+}
+
+// SetPreferredPasswordScheme sets the scheme new hashes are made with. Passwords stored with
+// another scheme are rehashed with it on their next successful check.
+func SetPreferredPasswordScheme(name string) error {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+
+	name = strings.ToUpper(name)
+	if _, ok := schemes[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownScheme, name)
+	}
+	preferredScheme = name
+
+	return nil
+}
+
+// HashPassword hashes a password with the preferred scheme, prefixed with its name
+// unless it is the unprefixed PBKDF2 format.
+func HashPassword(password string) (string, error) {
+	schemesMu.RLock()
+	name := preferredScheme
+	scheme := schemes[name]
+	schemesMu.RUnlock()
+
+	hash, err := scheme.Hash(password)
+	if err != nil {
+		return "", err
+	}
+	if name == SchemePBKDF2 {
+		return hash, nil
+	}
+
+	return "{" + name + "}" + hash, nil
+}
+
+// VerifyPassword checks a password against a stored hash of any registered scheme.
+// needsRehash is only set for a matching password whose hash should be replaced with
+// HashPassword, because it uses another scheme than the preferred one or weaker parameters.
+func VerifyPassword(stored, password string) (ok, needsRehash bool) {
+	name, hash := splitScheme(stored)
+
+	schemesMu.RLock()
+	scheme, known := schemes[name]
+	preferred := preferredScheme
+	schemesMu.RUnlock()
+
+	if !known || !scheme.Verify(hash, password) {
+		return false, false
+	}
+
+	return true, name != preferred || scheme.NeedsRehash(hash)
+}
+
+// ValidatePassword checks if a provided password matches a stored password hash
+// of any registered scheme. It returns true if the provided password matches
+// the stored password, and false otherwise, including for malformed hashes and
+// unknown schemes.
+func ValidatePassword(storedPassword, providedPassword string) bool {
+	ok, _ := VerifyPassword(storedPassword, providedPassword)
+	return ok
+}
+
+// splitScheme returns the scheme of a stored hash and the hash without its prefix.
+// Hashes without a "{SCHEME}" prefix are recognised by their format: PHC argon2id strings
+// and modular crypt bcrypt hashes, anything else is taken as PBKDF2.
+func splitScheme(stored string) (string, string) {
+	if rest, ok := strings.CutPrefix(stored, "{"); ok {
+		if name, hash, ok := strings.Cut(rest, "}"); ok {
+			return strings.ToUpper(name), hash
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return SchemeArgon2ID, stored
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"), strings.HasPrefix(stored, "$2y$"):
+		return SchemeBcrypt, stored
+	default:
+		return SchemePBKDF2, stored
+	}
+}
+
+// pbkdf2Scheme is the "salt:hexhash" format, a PBKDF2-SHA512 key of 64 bytes.
+type pbkdf2Scheme struct {
+	iterations int
+}
+
+func (s pbkdf2Scheme) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	saltHex := hex.EncodeToString(salt)
+	derived := pbkdf2.Key([]byte(password), []byte(saltHex), s.iterations, 64, sha512.New)
+
+	return saltHex + ":" + hex.EncodeToString(derived), nil
+}
+
+func (s pbkdf2Scheme) Verify(hash, password string) bool {
+	salt, storedHex, ok := strings.Cut(hash, ":")
+	if !ok || salt == "" {
+		return false
+	}
+	stored, err := hex.DecodeString(storedHex)
+	if err != nil || len(stored) != 64 {
+		return false
+	}
+
+	derived := pbkdf2.Key([]byte(password), []byte(salt), s.iterations, 64, sha512.New)
+	return subtle.ConstantTimeCompare(derived, stored) == 1
+}
+
+func (s pbkdf2Scheme) NeedsRehash(string) bool { return false }
+
+// argon2idScheme is the PHC string format: $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>,
+// with salt and key in unpadded standard base64, as written by Dovecot and libargon2.
+type argon2idScheme struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+func (s argon2idScheme) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, s.time, s.memory, s.threads, s.keyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, s.memory, s.time, s.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (s argon2idScheme) Verify(hash, password string) bool {
+	params, salt, key, ok := parseArgon2id(hash)
+	if !ok {
+		return false
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+func (s argon2idScheme) NeedsRehash(hash string) bool {
+	params, _, key, ok := parseArgon2id(hash)
+	return !ok || params.time < s.time || params.memory < s.memory || uint32(len(key)) < s.keyLen
+}
+
+// maxArgon2Memory bounds the memory a stored hash can make a check use, in KiB.
+const maxArgon2Memory = 1 << 20
+
+// parseArgon2id splits a PHC argon2id string into its parameters, salt and key.
+func parseArgon2id(hash string) (argon2idScheme, []byte, []byte, bool) {
+	var params argon2idScheme
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params, nil, nil, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, false
+	}
+	if params.time == 0 || params.threads == 0 || params.memory == 0 || params.memory > maxArgon2Memory {
+		return params, nil, nil, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, false
+	}
+
+	return params, salt, key, true
+}
+
+// bcryptScheme is the modular crypt bcrypt format ($2a$, $2b$ or $2y$).
+type bcryptScheme struct {
+	cost int
+}
+
+func (s bcryptScheme) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+	return string(hash), err
+}
+
+func (s bcryptScheme) Verify(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (s bcryptScheme) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < s.cost
+}
@@ -0,0 +1,103 @@
+package encryption
+
+import (
+	"strings"
+	"testing"
+)
+
+// Known answers, each the hash of "password" or of the noted password.
+const (
+	// From the test vectors of the argon2 reference implementation: salt "somesalt".
+	argon2idHash = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	// From the OpenBSD bcrypt tests, of "U*U".
+	bcryptHash = "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"
+	// As written by the baseline ValidatePassword's format: PBKDF2-SHA512 of "correct horse",
+	// 100000 iterations, keyed with the hex salt as text.
+	pbkdf2Hash = "9f3c1a7e52b04d68a1e7c3f0b2d49e85:71b68873d388a36a13193f40975f7accd137146f89cf6a55721e4925593429edd2418619055bed3df09b247bfb919f22041cda209912f780068ad266b932bbc2"
+	// Of "pässwörd", with a short salt.
+	pbkdf2UTF8Hash = "a1b2c3:ffb22d00529b299f3774e705c9a601efbb17b5c275fb73e4a54982171e472130734bb02ca19bfee35433fed79a39d53f3caad807247f1e27dfd4166581c13817"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	tests := []struct {
+		name, stored, password string
+		ok, needsRehash        bool
+	}{
+		{"Dovecot argon2id", "{ARGON2ID}" + argon2idHash, "password", true, false},
+		{"Dovecot argon2id, lower-case scheme", "{argon2id}" + argon2idHash, "password", true, false},
+		{"PHC argon2id", argon2idHash, "password", true, false},
+		{"argon2id, wrong password", argon2idHash, "Password", false, false},
+		{"Dovecot bcrypt", "{BLF-CRYPT}" + bcryptHash, "U*U", true, true},
+		{"Dovecot bcrypt $2y$", "{BLF-CRYPT}$2y$" + strings.TrimPrefix(bcryptHash, "$2a$"), "U*U", true, true},
+		{"modular crypt bcrypt", bcryptHash, "U*U", true, true},
+		{"bcrypt, wrong password", bcryptHash, "U*V", false, false},
+		{"legacy PBKDF2", pbkdf2Hash, "correct horse", true, true},
+		{"legacy PBKDF2, UTF-8", pbkdf2UTF8Hash, "pässwörd", true, true},
+		{"legacy PBKDF2, salt in upper case", strings.ToUpper(pbkdf2Hash), "correct horse", false, false},
+		{"legacy PBKDF2, upper-case key", pbkdf2Hash[:33] + strings.ToUpper(pbkdf2Hash[33:]), "correct horse", true, true},
+		{"legacy PBKDF2, wrong password", pbkdf2Hash, "correct horse ", false, false},
+
+		{"unknown scheme", "{SHA512-CRYPT}$6$salt$hash", "password", false, false},
+		{"empty", "", "", false, false},
+		{"PBKDF2 without separator", strings.Replace(pbkdf2Hash, ":", "", 1), "correct horse", false, false},
+		{"PBKDF2 without salt", pbkdf2Hash[32:], "correct horse", false, false},
+		{"PBKDF2 with non-hex key", pbkdf2Hash[:33] + strings.Repeat("zz", 64), "correct horse", false, false},
+		{"PBKDF2 with odd-length key", pbkdf2Hash[:len(pbkdf2Hash)-1], "correct horse", false, false},
+		{"PBKDF2 with short key", pbkdf2Hash[:33+64], "correct horse", false, false},
+		{"PBKDF2 with empty key", pbkdf2Hash[:33], "", false, false},
+		{"argon2id with bad base64", strings.Replace(argon2idHash, "c29tZXNhbHQ", "c29tZXNhbHQ=!", 1), "password", false, false},
+		{"argon2id with another version", strings.Replace(argon2idHash, "v=19", "v=16", 1), "password", false, false},
+		{"argon2id with too much memory", strings.Replace(argon2idHash, "m=65536", "m=4194304", 1), "password", false, false},
+		{"argon2id without passes", strings.Replace(argon2idHash, "t=2", "t=0", 1), "password", false, false},
+		{"argon2i", strings.Replace(argon2idHash, "argon2id", "argon2i", 1), "password", false, false},
+		{"truncated bcrypt", bcryptHash[:30], "U*U", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash := VerifyPassword(tt.stored, tt.password)
+			if ok != tt.ok || needsRehash != tt.needsRehash {
+				t.Errorf("VerifyPassword = %v, %v, want %v, %v", ok, needsRehash, tt.ok, tt.needsRehash)
+			}
+			if ValidatePassword(tt.stored, tt.password) != tt.ok {
+				t.Errorf("ValidatePassword = %v, want %v", !tt.ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	t.Cleanup(func() { _ = SetPreferredPasswordScheme(SchemeArgon2ID) })
+
+	tests := []struct {
+		scheme, prefix string
+	}{
+		{SchemeArgon2ID, "{ARGON2ID}$argon2id$v=19$m=19456,t=2,p=1$"},
+		{SchemeBcrypt, "{BLF-CRYPT}$2a$12$"},
+		{SchemePBKDF2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			if err := SetPreferredPasswordScheme(tt.scheme); err != nil {
+				t.Fatal(err)
+			}
+			hash, err := HashPassword("pässwörd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hash, tt.prefix) || strings.HasPrefix(hash, "{") != (tt.prefix != "") {
+				t.Errorf("hash %q, want prefix %q", hash, tt.prefix)
+			}
+
+			if ok, needsRehash := VerifyPassword(hash, "pässwörd"); !ok || needsRehash {
+				t.Errorf("VerifyPassword of a fresh hash = %v, %v, want true, false", ok, needsRehash)
+			}
+			if ok, _ := VerifyPassword(hash, "password"); ok {
+				t.Error("a fresh hash matches another password")
+			}
+		})
+	}
+
+	if err := SetPreferredPasswordScheme("MD5"); err == nil {
+		t.Error("an unknown scheme was accepted as the preferred one")
+	}
+}
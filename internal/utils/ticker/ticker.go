@@ -29,10 +29,14 @@ func (ticker *Ticker) Resume() {
 }
 
 // Poll polls the ticker. It blocks until the tick has been executed.
+// It returns immediately if the ticker is stopped.
 func (ticker *Ticker) Poll() {
 	doneCh := make(chan struct{})
-	ticker.pollCh <- doneCh
-	<-doneCh
+	select {
+	case ticker.pollCh <- doneCh:
+		<-doneCh
+	case <-ticker.stopCh:
+	}
 }
 
 // Stop stops the ticker.